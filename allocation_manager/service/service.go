@@ -182,6 +182,7 @@ type invocation struct {
 	LastCheckin 	 time.Time // Time the invocation last had its queue position/allocation refreshed.
 	QueueID     	 QueueID   // Position in the queue. 0 means the invocation has not been queued yet.
 	TopologyRequest  *apb.TopologyRequest
+	Topology         *Topology // Topology allocated to the invocation. nil while queued.
 }
 
 func (i *invocation) ToProto() *apb.Invocation {
@@ -253,38 +254,6 @@ func updateMetrics(method string, err *error, startTime time.Time) {
 	metricRequestDuration.WithLabelValues(method, code.String()).Observe(d.Seconds())
 }
 
-// TODO: move to topology.go
-type Match struct {
-	TopologyRequest *apb.TopologyRequest  	// The request we recevied for matching a topology
-	Topology *Topology    			  		// The known topology that matched the request
-}
-
-// Matchmaker returns [n][_]*unit containing plausible matches
-// n: index corresponding to the invocation topologies
-// _: if all=false, len is 0 (nomatch) or 1 (match). if all=true, len is uint
-func Matchmaker(units map[string]*Unit, inventory *apb.HostInventory, topologies map[string]*Topology, inv *invocation, all bool) ([]Match, error) {
-	request := inv.TopologyRequest
-	matches := []Match{}
-
-	if request.GetName() != "" {
-		// operating off the name of a known topology. check to see if we have a match for this name in our known topologies
-		for topology_name, topology := range topologies {
-			// is this topology even available to be allocated?
-			if all == false && !topology.CanBeAllocated() {
-				// nope, let's skip it
-				continue
-			}
-
-			if topology_name == request.GetName() {
-				matches = append(matches, Match{TopologyRequest: request, Topology: topology})
-			}
-		}
-	}
-
-	// maybe we need a matchmaker struct
-	return matches, nil
-}
-
 // Allocate validates invocation request is satisfiable, then queues it.
 // See the proto docstrings for more details.
 func (s *Service) Allocate(ctx context.Context, req *apb.AllocateRequest) (retRes *apb.AllocateResponse, retErr error) {
@@ -331,24 +300,18 @@ func (s *Service) Allocate(ctx context.Context, req *apb.AllocateRequest) (retRe
 		}
 	}
 	// Update LastCheckin
-	host_infos := []*apb.HostInfo{}
+	var allocated *Topology
 	for _, u := range s.units {
 		if inv := u.GetInvocation(invocationID); inv != nil {
 			inv.LastCheckin = timeNow()
-			switch info := u.UnitInfo.Info.(type) {
-				case *apb.UnitInfo_HostInfo:
-					host_infos = append(host_infos, info.HostInfo)
-				// TODO: add cases for AcfInfo
-			}
-			
-			break // TODO: for bundles, remove this break
+			allocated = inv.Topology
 		}
 	}
 	// Invocation was already allocated (i.e. by janitor())
-	if len(host_infos) > 0 {
+	if allocated != nil {
 		alloc_topo := &apb.Topology{
-			Name: invRequest.GetName(),
-			Hosts: host_infos,
+			Name: allocated.Name,
+			Hosts: allocated.HostInfos(),
 		}
 
 		alloc_response := apb.AllocateResponse{
@@ -441,6 +404,7 @@ func (s *Service) Refresh(ctx context.Context, req *apb.RefreshRequest) (retRes
 				Owner:      	 reqInvoc.GetOwner(),
 				Purpose:    	 reqInvoc.GetPurpose(),
 				TopologyRequest: topoReq,
+				Topology:        allocated_topo,
 				// LastCheckin: timeNow(), redundant
 			}
 			if ok := unit.Allocate(inv); !ok {
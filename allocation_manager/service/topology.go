@@ -0,0 +1,225 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	apb "github.com/enfabrica/enkit/allocation_manager/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Match is a known topology matching the topology request of an invocation.
+type Match struct {
+	TopologyRequest *apb.TopologyRequest // The request we received for matching a topology
+	Topology        *Topology            // The known topology that matched the request
+}
+
+// fit measures how much of a topology a request leaves unused. Requests are
+// allocated the topology with the smallest fit, so that big hosts are left to
+// the requests needing them.
+type fit struct {
+	hosts int // Hosts of the topology no host request is matched to
+	gpus  int // GPUs of the topology beyond those requested
+	cpus  int // CPUs of the topology beyond those requested
+}
+
+// less compares unused hosts first, then GPUs, the scarcest, then CPUs.
+func (f fit) less(other fit) bool {
+	if f.hosts != other.hosts {
+		return f.hosts < other.hosts
+	}
+	if f.gpus != other.gpus {
+		return f.gpus < other.gpus
+	}
+	return f.cpus < other.cpus
+}
+
+// glob returns whether the value matches the pattern, if set.
+func glob(pattern *string, value string) (bool, error) {
+	if pattern == nil {
+		return true, nil
+	}
+	ok, err := path.Match(*pattern, value)
+	if err != nil {
+		return false, fmt.Errorf("invalid glob %q: %w", *pattern, err)
+	}
+	return ok, nil
+}
+
+// wantCPUs returns the number of CPUs matching cpu_model the request needs.
+func wantCPUs(req *apb.HostRequest) int {
+	if req.CpuModel != nil && req.NumCpus == nil {
+		return 1
+	}
+	return int(req.GetNumCpus())
+}
+
+// wantGPUs returns the number of GPUs matching gpu_model and min_vram_mb the
+// request needs.
+func wantGPUs(req *apb.HostRequest) int {
+	if (req.GpuModel != nil || req.MinVramMb != nil) && req.NumGpus == nil {
+		return 1
+	}
+	return int(req.GetNumGpus())
+}
+
+// hostMatches returns whether the host satisfies the request.
+func hostMatches(req *apb.HostRequest, host *apb.HostInfo) (bool, error) {
+	if host == nil {
+		return false, nil
+	}
+	if ok, err := glob(req.Hostname, host.GetHostname()); !ok || err != nil {
+		return false, err
+	}
+
+	cpus := 0
+	for _, cpu := range host.GetCpuInfos() {
+		ok, err := glob(req.CpuModel, cpu.GetModelName())
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			cpus++
+		}
+	}
+	if cpus < wantCPUs(req) {
+		return false, nil
+	}
+
+	gpus := 0
+	for _, gpu := range host.GetGpuInfos() {
+		gpuModel, err := glob(req.GpuModel, gpu.GetGpuModel())
+		if err != nil {
+			return false, err
+		}
+		cardModel, err := glob(req.GpuModel, gpu.GetCardModel())
+		if err != nil {
+			return false, err
+		}
+		if (gpuModel || cardModel) && gpu.GetVramMb() >= req.GetMinVramMb() {
+			gpus++
+		}
+	}
+	return gpus >= wantGPUs(req), nil
+}
+
+// assign tries to match the host request i to a host not matched to the
+// requests before, moving those to other hosts if needed, as in the augmenting
+// paths of a bipartite matching.
+//
+// candidates[i] lists the hosts request i can be matched to, and assigned[j]
+// the request host j is matched to, or -1.
+func assign(i int, candidates [][]int, assigned []int, visited []bool) bool {
+	for _, j := range candidates[i] {
+		if visited[j] {
+			continue
+		}
+		visited[j] = true
+		if assigned[j] < 0 || assign(assigned[j], candidates, assigned, visited) {
+			assigned[j] = i
+			return true
+		}
+	}
+	return false
+}
+
+// topologyFit returns how much of the topology would be left unused by the
+// host requests, or false if the topology does not have a distinct host
+// satisfying each of them.
+func topologyFit(requests []*apb.HostRequest, topology *Topology) (fit, bool, error) {
+	if len(requests) > len(topology.Units) {
+		return fit{}, false, nil
+	}
+
+	candidates := make([][]int, len(requests))
+	for i, req := range requests {
+		for j, unit := range topology.Units {
+			ok, err := hostMatches(req, unit.UnitInfo.GetHostInfo())
+			if err != nil {
+				return fit{}, false, err
+			}
+			if ok {
+				candidates[i] = append(candidates[i], j)
+			}
+		}
+	}
+	assigned := make([]int, len(topology.Units))
+	for j := range assigned {
+		assigned[j] = -1
+	}
+	for i := range requests {
+		if !assign(i, candidates, assigned, make([]bool, len(topology.Units))) {
+			return fit{}, false, nil
+		}
+	}
+
+	// Whichever hosts the requests are matched to, the resources left unused
+	// are those of the topology beyond the requested ones.
+	f := fit{hosts: len(topology.Units) - len(requests)}
+	for _, unit := range topology.Units {
+		f.gpus += len(unit.UnitInfo.GetHostInfo().GetGpuInfos())
+		f.cpus += len(unit.UnitInfo.GetHostInfo().GetCpuInfos())
+	}
+	for _, req := range requests {
+		f.gpus -= wantGPUs(req)
+		f.cpus -= wantCPUs(req)
+	}
+	return f, true, nil
+}
+
+// Matchmaker returns the known topologies matching the request of the
+// invocation, either by name, or with a distinct host satisfying each of the
+// host requests, best fit first.
+//
+// If all=false, only topologies that can be allocated now are considered,
+// and only the best fit is returned. If all=true, all matching topologies are
+// returned, to tell whether the request can ever be satisfied.
+func Matchmaker(units map[string]*Unit, inventory *apb.HostInventory, topologies map[string]*Topology, inv *invocation, all bool) ([]Match, error) {
+	request := inv.TopologyRequest
+	matches := []Match{}
+
+	if request.GetName() != "" {
+		// operating off the name of a known topology. check to see if we have a match for this name in our known topologies
+		for topology_name, topology := range topologies {
+			// is this topology even available to be allocated?
+			if all == false && !topology.CanBeAllocated() {
+				// nope, let's skip it
+				continue
+			}
+
+			if topology_name == request.GetName() {
+				matches = append(matches, Match{TopologyRequest: request, Topology: topology})
+			}
+		}
+		return matches, nil
+	}
+
+	fits := map[*Topology]fit{}
+	for _, topology := range topologies {
+		if !all && !topology.CanBeAllocated() {
+			continue
+		}
+		f, ok, err := topologyFit(request.GetHosts(), topology)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		if ok {
+			fits[topology] = f
+			matches = append(matches, Match{TopologyRequest: request, Topology: topology})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i].Topology, matches[j].Topology
+		if fits[a] != fits[b] {
+			return fits[a].less(fits[b])
+		}
+		return a.Name < b.Name
+	})
+	if !all && len(matches) > 1 {
+		matches = matches[:1]
+	}
+	return matches, nil
+}
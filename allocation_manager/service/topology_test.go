@@ -0,0 +1,298 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	apb "github.com/enfabrica/enkit/allocation_manager/proto"
+)
+
+// host returns a HostInfo with the given number of CPUs and GPUs.
+func host(hostname string, cpus int, cpuModel string, gpus int, gpuModel string, cardModel string, vramMb uint32) *apb.HostInfo {
+	info := &apb.HostInfo{Hostname: hostname}
+	for i := 0; i < cpus; i++ {
+		info.CpuInfos = append(info.CpuInfos, &apb.CpuInfo{CpuIdx: uint32(i), ModelName: cpuModel})
+	}
+	for i := 0; i < gpus; i++ {
+		info.GpuInfos = append(info.GpuInfos, &apb.GpuInfo{BusId: fmt.Sprintf("%02x:00.0", i), GpuModel: gpuModel, CardModel: cardModel, VramMb: vramMb})
+	}
+	return info
+}
+
+// getSampleInventory returns an inventory of CPU-only hosts, and of small and
+// big GPU hosts.
+func getSampleInventory() *apb.HostInventory {
+	hosts := []*apb.HostInfo{
+		host("nc-cpu-1.rdu", 24, "AMD EPYC 7413 24-Core Processor", 0, "", "", 0),
+		host("nc-cpu-2.rdu", 64, "AMD EPYC 7713 64-Core Processor", 0, "", "", 0),
+		host("nc-gpu-1.rdu", 24, "AMD EPYC 7413 24-Core Processor", 2, "NVIDIA Corporation GP104GL", "Tesla P4", 7680),
+		host("nc-gpu-2.rdu", 64, "AMD EPYC 7713 64-Core Processor", 8, "NVIDIA Corporation GA100", "A100 80GB", 81920),
+	}
+	inventory := &apb.HostInventory{Hosts: map[string]*apb.HostInfo{}}
+	for _, h := range hosts {
+		inventory.GetHosts()[h.GetHostname()] = h
+	}
+	return inventory
+}
+
+// getSampleTopologies returns a topology per host of the inventory, and
+// topologies pairing a CPU and a GPU host.
+func getSampleTopologies(units map[string]*Unit) map[string]*Topology {
+	config := &apb.Config{
+		TopologyConfigs: []*apb.TopologyConfig{
+			{Name: "cpu-1", Hosts: []string{"nc-cpu-1.rdu"}},
+			{Name: "cpu-2", Hosts: []string{"nc-cpu-2.rdu"}},
+			{Name: "gpu-1", Hosts: []string{"nc-gpu-1.rdu"}},
+			{Name: "gpu-2", Hosts: []string{"nc-gpu-2.rdu"}},
+			{Name: "pair-small", Hosts: []string{"nc-cpu-1.rdu", "nc-gpu-1.rdu"}},
+			{Name: "pair-big", Hosts: []string{"nc-cpu-2.rdu", "nc-gpu-2.rdu"}},
+		},
+	}
+	topos, err := TopologiesFromConfigAndUnits(config, units)
+	if err != nil {
+		panic(err)
+	}
+	topologies := map[string]*Topology{}
+	for _, topo := range topos {
+		topologies[topo.Name] = topo
+	}
+	return topologies
+}
+
+func TestMatchmakerHosts(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		hosts     []*apb.HostRequest
+		allocated []string // Names of the topologies allocated before matching
+		all       bool
+		want      []string // Names of the matching topologies, best fit first
+		wantErr   string
+	}{
+		{
+			desc:  "any host gets the smallest host",
+			hosts: []*apb.HostRequest{{}},
+			want:  []string{"cpu-1"},
+		},
+		{
+			desc:  "all matching topologies, best fit first",
+			hosts: []*apb.HostRequest{{}},
+			all:   true,
+			want:  []string{"cpu-1", "cpu-2", "gpu-1", "gpu-2", "pair-small", "pair-big"},
+		},
+		{
+			desc:  "number of CPUs",
+			hosts: []*apb.HostRequest{{NumCpus: proto.Uint32(32)}},
+			want:  []string{"cpu-2"},
+		},
+		{
+			desc:  "CPU model",
+			hosts: []*apb.HostRequest{{CpuModel: proto.String("*EPYC 7713*")}},
+			want:  []string{"cpu-2"},
+		},
+		{
+			desc:  "number of CPUs of a model",
+			hosts: []*apb.HostRequest{{NumCpus: proto.Uint32(48), CpuModel: proto.String("*EPYC 7413*")}},
+			want:  []string{},
+		},
+		{
+			desc:  "a GPU does not waste a big GPU host",
+			hosts: []*apb.HostRequest{{NumGpus: proto.Uint32(1)}},
+			want:  []string{"gpu-1"},
+		},
+		{
+			desc:  "number of GPUs",
+			hosts: []*apb.HostRequest{{NumGpus: proto.Uint32(4)}},
+			want:  []string{"gpu-2"},
+		},
+		{
+			desc:  "GPU model",
+			hosts: []*apb.HostRequest{{GpuModel: proto.String("*GA100")}},
+			want:  []string{"gpu-2"},
+		},
+		{
+			desc:  "GPU card model",
+			hosts: []*apb.HostRequest{{GpuModel: proto.String("Tesla*")}},
+			want:  []string{"gpu-1"},
+		},
+		{
+			desc:  "video memory",
+			hosts: []*apb.HostRequest{{MinVramMb: proto.Uint32(16384)}},
+			want:  []string{"gpu-2"},
+		},
+		{
+			desc:  "hostname glob",
+			hosts: []*apb.HostRequest{{Hostname: proto.String("nc-gpu-*.rdu")}},
+			want:  []string{"gpu-1"},
+		},
+		{
+			desc:  "hostname",
+			hosts: []*apb.HostRequest{{Hostname: proto.String("nc-cpu-2.rdu")}},
+			want:  []string{"cpu-2"},
+		},
+		{
+			desc: "multiple hosts",
+			hosts: []*apb.HostRequest{
+				{NumGpus: proto.Uint32(1)},
+				{NumCpus: proto.Uint32(16)},
+			},
+			want: []string{"pair-small"},
+		},
+		{
+			desc: "multiple hosts, each matched to a distinct host",
+			hosts: []*apb.HostRequest{
+				{},
+				{NumGpus: proto.Uint32(1)},
+			},
+			all:  true,
+			want: []string{"pair-small", "pair-big"},
+		},
+		{
+			desc: "multiple hosts needing big hosts",
+			hosts: []*apb.HostRequest{
+				{NumCpus: proto.Uint32(32)},
+				{NumGpus: proto.Uint32(8)},
+			},
+			want: []string{"pair-big"},
+		},
+		{
+			desc: "more hosts than any topology",
+			hosts: []*apb.HostRequest{
+				{}, {}, {},
+			},
+			all:  true,
+			want: []string{},
+		},
+		{
+			desc:      "allocated topologies are skipped",
+			hosts:     []*apb.HostRequest{{NumGpus: proto.Uint32(1)}},
+			allocated: []string{"gpu-1"},
+			want:      []string{"gpu-2"},
+		},
+		{
+			desc:      "allocated topologies can match eventually",
+			hosts:     []*apb.HostRequest{{NumGpus: proto.Uint32(1)}},
+			allocated: []string{"gpu-1", "gpu-2"},
+			all:       true,
+			want:      []string{"gpu-1", "gpu-2", "pair-small", "pair-big"},
+		},
+		{
+			desc:      "hosts shared with an allocated topology are skipped",
+			hosts:     []*apb.HostRequest{{NumGpus: proto.Uint32(1)}},
+			allocated: []string{"pair-small"},
+			want:      []string{"gpu-2"},
+		},
+		{
+			desc:    "invalid glob",
+			hosts:   []*apb.HostRequest{{Hostname: proto.String("nc-gpu-[")}},
+			wantErr: "invalid glob",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			inventory := getSampleInventory()
+			units, err := UnitsFromInventory(inventory)
+			assert.NoError(t, err)
+			topologies := getSampleTopologies(units)
+			for _, name := range tc.allocated {
+				assert.True(t, topologies[name].Allocate(getInvocation(name, name, 1000)), "Allocate(%s)", name)
+			}
+
+			inv := &invocation{TopologyRequest: &apb.TopologyRequest{Hosts: tc.hosts}}
+			matches, err := Matchmaker(units, inventory, topologies, inv, tc.all)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			got := []string{}
+			for _, match := range matches {
+				got = append(got, match.Topology.Name)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestMatchmakerName(t *testing.T) {
+	inventory := getSampleInventory()
+	units, err := UnitsFromInventory(inventory)
+	assert.NoError(t, err)
+	topologies := getSampleTopologies(units)
+
+	// Host requests are ignored when requesting a topology by name.
+	inv := &invocation{TopologyRequest: &apb.TopologyRequest{
+		Name:  proto.String("gpu-2"),
+		Hosts: []*apb.HostRequest{{Hostname: proto.String("nc-cpu-1.rdu")}},
+	}}
+	matches, err := Matchmaker(units, inventory, topologies, inv, false)
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+	assert.Equal(t, "gpu-2", matches[0].Topology.Name)
+
+	assert.True(t, topologies["gpu-2"].Allocate(getInvA()))
+	matches, err = Matchmaker(units, inventory, topologies, inv, false)
+	assert.NoError(t, err)
+	assert.Len(t, matches, 0)
+}
+
+func TestServiceAllocateHosts(t *testing.T) {
+	defer restoreTimeNow()
+	timeNow = func() time.Time { return time.Unix(10, 0) }
+	inventory := getSampleInventory()
+	units, err := UnitsFromInventory(inventory)
+	assert.NoError(t, err)
+	s := Service{
+		currentState:              stateRunning,
+		units:                     units,
+		inventory:                 inventory,
+		topologies:                getSampleTopologies(units),
+		queueRefreshDuration:      100 * time.Second,
+		allocationRefreshDuration: 200 * time.Second,
+	}
+	ctx := context.Background()
+
+	request := &apb.TopologyRequest{Hosts: []*apb.HostRequest{
+		{NumGpus: proto.Uint32(1)},
+		{},
+	}}
+	allocateResponse, err := s.Allocate(ctx, &apb.AllocateRequest{Invocation: &apb.Invocation{Request: request}})
+	assert.NoError(t, err)
+	topology := allocateResponse.GetAllocated().GetTopology()
+	assert.Equal(t, "pair-small", topology.GetName())
+	hostnames := []string{}
+	for _, h := range topology.GetHosts() {
+		hostnames = append(hostnames, h.GetHostname())
+	}
+	sort.Strings(hostnames)
+	assert.Equal(t, []string{"nc-cpu-1.rdu", "nc-gpu-1.rdu"}, hostnames)
+
+	// Polling again returns the same topology.
+	inv := &apb.Invocation{Id: allocateResponse.GetAllocated().GetId(), Request: request}
+	allocateResponse, err = s.Allocate(ctx, &apb.AllocateRequest{Invocation: inv})
+	assert.NoError(t, err)
+	assert.Equal(t, "pair-small", allocateResponse.GetAllocated().GetTopology().GetName())
+	assert.Len(t, allocateResponse.GetAllocated().GetTopology().GetHosts(), 2)
+
+	// The next request goes to the big pair.
+	allocateResponse, err = s.Allocate(ctx, &apb.AllocateRequest{Invocation: &apb.Invocation{Request: request}})
+	assert.NoError(t, err)
+	assert.Equal(t, "pair-big", allocateResponse.GetAllocated().GetTopology().GetName())
+
+	// Requests that no topology can ever satisfy fail.
+	_, err = s.Allocate(ctx, &apb.AllocateRequest{Invocation: &apb.Invocation{Request: &apb.TopologyRequest{
+		Hosts: []*apb.HostRequest{{NumGpus: proto.Uint32(16)}},
+	}}})
+	assert.ErrorContains(t, err, "impossible to match against inventory")
+	_, err = s.Allocate(ctx, &apb.AllocateRequest{Invocation: &apb.Invocation{Request: &apb.TopologyRequest{
+		Hosts: []*apb.HostRequest{{GpuModel: proto.String("[")}},
+	}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
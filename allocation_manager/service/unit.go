@@ -187,6 +187,7 @@ type Topology struct {
 }
 
 func (topo *Topology) Allocate(inv *invocation) bool {
+	inv.Topology = topo
 	for _, unit := range topo.Units {
 		if !unit.Allocate(inv) {
 			logger.Go.Errorf("Unit Allocate not supposed to fail!")
@@ -196,6 +197,19 @@ func (topo *Topology) Allocate(inv *invocation) bool {
 	return true
 }
 
+// HostInfos returns the HostInfo of each host in the topology.
+func (topo *Topology) HostInfos() []*apb.HostInfo {
+	host_infos := []*apb.HostInfo{}
+	for _, unit := range topo.Units {
+		switch info := unit.UnitInfo.Info.(type) {
+			case *apb.UnitInfo_HostInfo:
+				host_infos = append(host_infos, info.HostInfo)
+			// TODO: add cases for AcfInfo
+		}
+	}
+	return host_infos
+}
+
 func (topo *Topology) CanBeAllocated() bool {
 	for _, unit := range topo.Units {
 		if unit.IsAllocated() {
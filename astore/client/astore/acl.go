@@ -0,0 +1,111 @@
+package astore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client"
+)
+
+// AclPermissions lists the permissions that can be granted with an acl.
+var AclPermissions = []string{"read", "write", "tag", "delete", "publish"}
+
+// AclPrincipals returns the principals granted the permission perm by the acl.
+//
+// The returned slice can be modified to change the acl.
+func AclPrincipals(acl *astore.Acl, perm string) (*[]string, error) {
+	switch perm {
+	case "read":
+		return &acl.Read, nil
+	case "write":
+		return &acl.Write, nil
+	case "tag":
+		return &acl.Tag, nil
+	case "delete":
+		return &acl.Delete, nil
+	case "publish":
+		return &acl.Publish, nil
+	}
+	return nil, fmt.Errorf("unknown permission %q - must be one of %s", perm, strings.Join(AclPermissions, ", "))
+}
+
+// ListAcls returns the acls of p and of the paths below it.
+//
+// With inherited, it returns instead the acls applying to p: the acl of p, and the ones of its parents.
+func (c *Client) ListAcls(p string, inherited bool) ([]*astore.Acl, error) {
+	req := &astore.ListAclsRequest{Path: p, Inherited: inherited}
+
+	resp, err := c.client.ListAcls(context.TODO(), req)
+	if err != nil {
+		return nil, client.NiceError(err, "could not list acls - %s", err)
+	}
+	return resp.Acl, nil
+}
+
+// SetAcl replaces the acl of acl.Path. An acl granting no permission is removed.
+func (c *Client) SetAcl(acl *astore.Acl) error {
+	if _, err := c.client.SetAcl(context.TODO(), &astore.SetAclRequest{Acl: acl}); err != nil {
+		return client.NiceError(err, "could not set the acl of %s - %s", acl.Path, err)
+	}
+	return nil
+}
+
+// GetAcl returns the acl of exactly the path p, or an empty acl if p has none.
+func (c *Client) GetAcl(p string) (*astore.Acl, error) {
+	cleaned := strings.Trim(path.Clean("/"+p), "/")
+	acls, err := c.ListAcls(cleaned, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, acl := range acls {
+		if acl.Path == cleaned {
+			return acl, nil
+		}
+	}
+	return &astore.Acl{Path: cleaned}, nil
+}
+
+// Grant adds the principals to the ones granted the permissions perms on p.
+//
+// Returns the updated acl.
+func (c *Client) Grant(p string, perms, principals []string) (*astore.Acl, error) {
+	return c.updateAcl(p, perms, func(granted []string) []string {
+		for _, principal := range principals {
+			if !slices.Contains(granted, principal) {
+				granted = append(granted, principal)
+			}
+		}
+		return granted
+	})
+}
+
+// Revoke removes the principals from the ones granted the permissions perms on p.
+//
+// Returns the updated acl.
+func (c *Client) Revoke(p string, perms, principals []string) (*astore.Acl, error) {
+	return c.updateAcl(p, perms, func(granted []string) []string {
+		return slices.DeleteFunc(granted, func(principal string) bool {
+			return slices.Contains(principals, principal)
+		})
+	})
+}
+
+// updateAcl reads the acl of p, invokes update on the principals of each permission in perms, and stores the result.
+func (c *Client) updateAcl(p string, perms []string, update func([]string) []string) (*astore.Acl, error) {
+	acl, err := c.GetAcl(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, perm := range perms {
+		principals, err := AclPrincipals(acl, perm)
+		if err != nil {
+			return nil, err
+		}
+		*principals = update(*principals)
+	}
+	return acl, c.SetAcl(acl)
+}
@@ -0,0 +1,46 @@
+package astore
+
+import (
+	"testing"
+
+	aserver "github.com/enfabrica/enkit/astore/server/astore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrantRevoke(t *testing.T) {
+	client, _ := clientForTest(t, aserver.WithAdmins("tester@enkit.test"))
+
+	acl, err := client.Grant("/tools/", []string{"read", "write"}, []string{"group:eng", "ci@enkit.test"})
+	require.NoError(t, err)
+	assert.Equal(t, "tools", acl.Path)
+	_, err = client.Grant("tools", []string{"write"}, []string{"ci@enkit.test", "dev@enkit.test"})
+	require.NoError(t, err)
+	_, err = client.Grant("tools/hello", []string{"tag"}, []string{"*"})
+	require.NoError(t, err)
+
+	acl, err = client.GetAcl("tools")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"group:eng", "ci@enkit.test"}, acl.Read)
+	assert.Equal(t, []string{"group:eng", "ci@enkit.test", "dev@enkit.test"}, acl.Write)
+	assert.Equal(t, "tester@enkit.test", acl.Creator)
+
+	acls, err := client.ListAcls("tools/hello/world", true)
+	require.NoError(t, err)
+	require.Len(t, acls, 2)
+	assert.Equal(t, "tools", acls[0].Path)
+	assert.Equal(t, "tools/hello", acls[1].Path)
+
+	acl, err = client.Revoke("tools", []string{"write"}, []string{"group:eng", "ci@enkit.test"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dev@enkit.test"}, acl.Write)
+	_, err = client.Revoke("tools", []string{"read", "write"}, []string{"group:eng", "ci@enkit.test", "dev@enkit.test"})
+	require.NoError(t, err)
+	acls, err = client.ListAcls("", false)
+	require.NoError(t, err)
+	require.Len(t, acls, 1)
+	assert.Equal(t, "tools/hello", acls[0].Path)
+
+	_, err = client.Grant("tools", []string{"admin"}, []string{"*"})
+	assert.ErrorContains(t, err, "unknown permission")
+}
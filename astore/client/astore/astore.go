@@ -1,7 +1,9 @@
 package astore
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,12 +14,14 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/enfabrica/enkit/astore/provenance"
 	apb "github.com/enfabrica/enkit/astore/rpc/astore"
 	"github.com/enfabrica/enkit/lib/client"
 	"github.com/enfabrica/enkit/lib/client/ccontext"
 	"github.com/enfabrica/enkit/lib/grpcwebclient"
 	"github.com/enfabrica/enkit/lib/kflags"
 	"github.com/enfabrica/enkit/lib/progress"
+	"github.com/enfabrica/enkit/lib/token"
 
 	"github.com/go-git/go-git/v5"
 	"google.golang.org/grpc"
@@ -53,6 +57,10 @@ func NewNative(server string, mods ...grpc.DialOption) (*Client, error) {
 
 type DownloadOptions struct {
 	*ccontext.Context
+
+	// If not empty, only artifacts signed by one of these keys are downloaded.
+	// Unsigned artifacts, or artifacts signed by other keys, are refused.
+	TrustedSigners []*token.VerifyingKey
 }
 
 type FileToDownload struct {
@@ -68,6 +76,14 @@ type FileToDownload struct {
 	Architecture []string // ok
 	// No tags means latest tag.
 	Tag *[]string
+	// If set, only an artifact with this SHA-256 digest is downloaded.
+	SHA256 []byte
+	// If set, a semantic version constraint like ">=1.4,<2": the artifact
+	// with the highest version satisfying it is downloaded.
+	Version string
+	// If set, the artifact is a tar or zip archive, and only the files
+	// with these names are extracted from it, rather than downloaded.
+	Extract []string
 }
 
 type PathType string
@@ -159,13 +175,84 @@ func (c *Client) GetRetrieveResponse(name string, archs []string, defaultId Path
 	return response, req, id, nil
 }
 
+// GetRetrieveResponseByDigest retrieves the most recent artifact with the specified SHA-256 digest.
+//
+// If name is not empty, the artifact must also be stored at that path, for one of the archs specified.
+func (c *Client) GetRetrieveResponseByDigest(name string, archs []string, digest []byte) (*apb.RetrieveResponse, error) {
+	req := &apb.RetrieveRequest{Path: name, Sha256: digest}
+	if name == "" || len(archs) == 0 {
+		archs = []string{""}
+	}
+
+	var err error
+	for _, arch := range archs {
+		req.Architecture = arch
+
+		var response *apb.RetrieveResponse
+		response, err = c.client.Retrieve(context.TODO(), req)
+		if err == nil {
+			return response, nil
+		}
+		if status.Code(err) != codes.NotFound {
+			return nil, client.NiceError(err, "Could not contact the metadata server. Is your connectivity working? Is the server up?\nFor debugging: %s", err)
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "Could not find an artifact with sha256 %x - %s", digest, err)
+}
+
+// GetRetrieveResponseByVersion retrieves the artifact in path name with the highest version satisfying the constraint.
+//
+// No tags means any tag. The first architecture in archs with a matching artifact is used.
+func (c *Client) GetRetrieveResponseByVersion(name string, archs []string, constraint string, tags *[]string) (*apb.RetrieveResponse, error) {
+	req := &apb.RetrieveRequest{Path: name, Version: constraint}
+	if tags != nil {
+		req.Tag = &apb.TagSet{Tag: *tags}
+	}
+	if len(archs) == 0 {
+		archs = []string{"all"}
+	}
+
+	var err error
+	for _, arch := range archs {
+		req.Architecture = arch
+
+		var response *apb.RetrieveResponse
+		response, err = c.client.Retrieve(context.TODO(), req)
+		if err == nil {
+			return response, nil
+		}
+		if status.Code(err) != codes.NotFound {
+			return nil, client.NiceError(err, "Could not contact the metadata server. Is your connectivity working? Is the server up?\nFor debugging: %s", err)
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "Could not find %s with a version matching %s, archs: %s - %s", name, constraint, archs, err)
+}
+
 func (c *Client) Download(files []FileToDownload, o DownloadOptions) ([]*apb.Artifact, error) {
 	arts := []*apb.Artifact{}
 	for _, file := range files {
-		response, _, id, err := c.GetRetrieveResponse(file.Remote, file.Architecture, file.RemoteType, file.Tag)
+		var response *apb.RetrieveResponse
+		var err error
+		var id PathType = IdPath
+		if len(file.SHA256) > 0 {
+			response, err = c.GetRetrieveResponseByDigest(file.Remote, file.Architecture, file.SHA256)
+		} else if file.Version != "" {
+			response, err = c.GetRetrieveResponseByVersion(file.Remote, file.Architecture, file.Version, file.Tag)
+		} else {
+			response, _, id, err = c.GetRetrieveResponse(file.Remote, file.Architecture, file.RemoteType, file.Tag)
+		}
 		if err != nil {
 			return nil, err
 		}
+		if len(file.SHA256) > 0 && !bytes.Equal(response.Artifact.Sha256, file.SHA256) {
+			return nil, fmt.Errorf("%w - server returned artifact %s with sha256 %x, expected %x", ErrIntegrity, response.Artifact.Uid, response.Artifact.Sha256, file.SHA256)
+		}
+		// The Verifier below guarantees that the content matches the signed sha256.
+		if len(o.TrustedSigners) > 0 {
+			if err := provenance.VerifyArtifact(response.Artifact, o.TrustedSigners); err != nil {
+				return nil, err
+			}
+		}
 
 		arts = append(arts, response.Artifact)
 
@@ -188,7 +275,14 @@ func (c *Client) Download(files []FileToDownload, o DownloadOptions) ([]*apb.Art
 			}
 		}
 
-		if id == IdPath && outputFile == "" {
+		if len(file.Extract) > 0 {
+			if err := c.extract(file, response, o, outputDir, outputFile); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if id == IdPath && outputFile == "" && file.Remote != "" {
 			outputFile = filepath.Base(file.Remote)
 		}
 		if outputFile == "" {
@@ -219,28 +313,53 @@ func (c *Client) Download(files []FileToDownload, o DownloadOptions) ([]*apb.Art
 		}
 
 		p.Step("%s: downloading", shortpath)
-		if err := Download(context.TODO(), progress.WriterCreator(p, f), response.Url); err != nil {
+		verifier := NewVerifier(response.Artifact)
+		if err := Download(context.TODO(), progress.WriterCreator(p, verifier.Writer(f)), response.Url); err != nil {
 			os.Remove(f.Name())
 			return nil, err
 		}
-
-		if err := os.Link(f.Name(), output); err != nil {
-			if !os.IsExist(err) || !file.Overwrite {
-				return nil, fmt.Errorf("trying to store file as %s, failed with: %w", output, err)
-			}
-			if err := os.Rename(f.Name(), output); err != nil {
-				return nil, err
-			}
+		if err := verifier.Verify(); err != nil {
+			os.Remove(f.Name())
+			return nil, fmt.Errorf("%s: %w", output, err)
 		}
 
-		os.Remove(f.Name())
+		if err := install(f.Name(), output, file.Overwrite); err != nil {
+			return nil, err
+		}
 		p.Done()
 	}
 	return arts, nil
 }
 
+// install moves the downloaded file tmp to output, replacing output only with overwrite.
+func install(tmp, output string, overwrite bool) error {
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, output); err != nil {
+		if !os.IsExist(err) || !overwrite {
+			return fmt.Errorf("trying to store file as %s, failed with: %w", output, err)
+		}
+		return os.Rename(tmp, output)
+	}
+	return nil
+}
+
 type UploadOptions struct {
 	*ccontext.Context
+
+	// Files larger than ChunkSize are uploaded in parts of about ChunkSize bytes,
+	// in parallel, and can be resumed if interrupted.
+	// 0 means DefaultChunkSize, a negative value disables uploads in parts.
+	ChunkSize int64
+	// How many parts to upload at the same time, 0 means DefaultParallelism.
+	Parallelism int
+	// Directory where to keep track of the uploads in parts, to resume them.
+	// Empty means DefaultStateDir().
+	StateDir string
+
+	// If set, artifacts are signed with this key.
+	Signer *token.SigningKey
+	// If set, recorded with the artifacts, and covered by the signature.
+	Provenance *apb.Provenance
 }
 
 type FileToUpload struct {
@@ -257,6 +376,11 @@ type FileToUpload struct {
 }
 
 func (c *Client) Upload(files []FileToUpload, o UploadOptions) ([]*apb.Artifact, error) {
+	prov, err := provenance.Marshal(o.Provenance)
+	if err != nil {
+		return nil, err
+	}
+
 	artifacts := []*apb.Artifact{}
 	for _, file := range files {
 		o.Logger.Infof("uploading '%s' as '%s'", file.Local, file.Remote)
@@ -272,23 +396,23 @@ func (c *Client) Upload(files []FileToUpload, o UploadOptions) ([]*apb.Artifact,
 		}
 		defer fd.Close()
 
-		p.Step("%s: allocating id", shortpath)
-		response, err := c.client.Store(context.TODO(), &apb.StoreRequest{})
+		info, err := fd.Stat()
 		if err != nil {
-			return artifacts, client.NiceError(err, "could not initiate store request %s", err)
+			return artifacts, fmt.Errorf("couldn't stat %s - %w", shortpath, err)
 		}
 
-		if response.Sid == "" || response.Url == "" {
-			return artifacts, fmt.Errorf("invalid server response")
+		var signature *apb.Signature
+		if o.Signer != nil {
+			p.Step("%s: signing", shortpath)
+			hash := sha256.New()
+			if _, err := io.Copy(hash, io.NewSectionReader(fd, 0, info.Size())); err != nil {
+				return artifacts, fmt.Errorf("couldn't read %s - %w", shortpath, err)
+			}
+			signature = provenance.Sign(o.Signer, hash.Sum(nil), prov)
 		}
 
-		info, err := fd.Stat()
+		sid, statePath, err := c.uploadBlob(fd, info, o, p, shortpath)
 		if err != nil {
-			return artifacts, fmt.Errorf("couldn't stat %s - %w", shortpath, err)
-		}
-
-		p.Step("%s: uploading", shortpath)
-		if err := Upload(context.TODO(), p.Reader(fd, info.Size()), info.Size(), response.Url); err != nil {
 			return artifacts, err
 		}
 		// FIXME partial failure. UNDO upload.
@@ -300,22 +424,67 @@ func (c *Client) Upload(files []FileToUpload, o UploadOptions) ([]*apb.Artifact,
 		for _, arch := range archs {
 			p.Step("%s: committing %s", shortpath, arch)
 			resp, err := c.client.Commit(context.TODO(), &apb.CommitRequest{
-				Sid:          response.Sid,
+				Sid:          sid,
 				Architecture: arch,
 				Path:         strings.TrimPrefix(file.Remote, "/"),
 				Note:         file.Note,
 				Tag:          file.Tag,
+				Provenance:   prov,
+				Signature:    signature,
 			})
 			if err != nil {
 				return artifacts, client.NiceError(err, "commit failed - %s", err)
 			}
 			artifacts = append(artifacts, resp.Artifact)
 		}
+		if statePath != "" {
+			os.Remove(statePath)
+		}
 		p.Done()
 	}
 	return artifacts, nil
 }
 
+// uploadBlob uploads the content of a file, in parts if large enough.
+//
+// Returns the sid of the blob, ready to be committed, and the path of the file
+// tracking the upload, if any, to be removed once the blob is committed.
+func (c *Client) uploadBlob(fd *os.File, info os.FileInfo, o UploadOptions, p progress.Handler, shortpath string) (string, string, error) {
+	chunkSize := o.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	var sid, statePath string
+	var err error
+	if chunkSize > 0 && info.Size() > chunkSize {
+		sid, statePath, err = c.uploadInParts(fd, info, chunkSize, o, p, shortpath)
+	}
+	if chunkSize <= 0 || info.Size() <= chunkSize || status.Code(err) == codes.Unimplemented {
+		sid, err = c.uploadAtOnce(fd, info, p, shortpath)
+	}
+	return sid, statePath, err
+}
+
+// uploadAtOnce uploads a file with a single request, returning the sid of the blob.
+func (c *Client) uploadAtOnce(fd *os.File, info os.FileInfo, p progress.Handler, shortpath string) (string, error) {
+	p.Step("%s: allocating id", shortpath)
+	response, err := c.client.Store(context.TODO(), &apb.StoreRequest{})
+	if err != nil {
+		return "", client.NiceError(err, "could not initiate store request %s", err)
+	}
+
+	if response.Sid == "" || response.Url == "" {
+		return "", fmt.Errorf("invalid server response")
+	}
+
+	p.Step("%s: uploading", shortpath)
+	if err := Upload(context.TODO(), p.Reader(fd, info.Size()), info.Size(), response.Url); err != nil {
+		return "", err
+	}
+	return response.Sid, nil
+}
+
 func Download(ctx context.Context, f func(int64) io.WriteCloser, url string) error {
 	client := &http.Client{}
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
@@ -340,6 +509,17 @@ func Download(ctx context.Context, f func(int64) io.WriteCloser, url string) err
 	return nil
 }
 
+// UploadError is returned by Upload when the server rejects the upload.
+type UploadError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("Upload to url:\n\t%s\nFailed: status %s", e.URL, e.Status)
+}
+
 func Upload(ctx context.Context, r io.ReadCloser, size int64, url string) error {
 	client := &http.Client{}
 	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, r)
@@ -355,7 +535,8 @@ func Upload(ctx context.Context, r io.ReadCloser, size int64, url string) error
 		return err
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("Upload to url:\n\t%s\nFailed: status %s", url, resp.Status)
+		resp.Body.Close()
+		return &UploadError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
 	// Flush and discard any reply. This is strictly not needed.
@@ -518,12 +699,15 @@ func FindRemote(name string, options SuggestOptions) (string, string, error) {
 type ListOptions struct {
 	*ccontext.Context
 	Tag []string
+	// If set, only artifacts with a version satisfying this constraint are listed, highest first.
+	Version string
 }
 
 func (c *Client) List(path string, o ListOptions) ([]*apb.Artifact, []*apb.Element, error) {
 	resp, err := c.client.List(context.TODO(), &apb.ListRequest{
-		Path: path,
-		Tag:  &apb.TagSet{Tag: o.Tag},
+		Path:    path,
+		Tag:     &apb.TagSet{Tag: o.Tag},
+		Version: o.Version,
 	})
 
 	if err != nil {
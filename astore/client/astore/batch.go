@@ -0,0 +1,34 @@
+package astore
+
+import (
+	"context"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client"
+)
+
+// BatchTag atomically changes the tags of all the artifacts selected, or returns them unchanged with dryRun.
+func (c *Client) BatchTag(sel *astore.Selection, dryRun bool, mods ...TagModifier) ([]*astore.Artifact, error) {
+	tags := &astore.TagRequest{}
+	for _, m := range mods {
+		m(tags)
+	}
+	req := &astore.BatchTagRequest{Selection: sel, Set: tags.Set, Add: tags.Add, Del: tags.Del, DryRun: dryRun}
+
+	resp, err := c.client.BatchTag(context.TODO(), req)
+	if err != nil {
+		return nil, client.NiceError(err, "could not tag artifacts - %s", err)
+	}
+	return resp.Artifact, nil
+}
+
+// BatchNote atomically sets the note of all the artifacts selected, or returns them unchanged with dryRun.
+func (c *Client) BatchNote(sel *astore.Selection, note string, dryRun bool) ([]*astore.Artifact, error) {
+	req := &astore.BatchNoteRequest{Selection: sel, Note: note, DryRun: dryRun}
+
+	resp, err := c.client.BatchNote(context.TODO(), req)
+	if err != nil {
+		return nil, client.NiceError(err, "could not annotate artifacts - %s", err)
+	}
+	return resp.Artifact, nil
+}
@@ -2,9 +2,20 @@ package astore
 
 import (
 	"context"
+
 	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client"
 )
 
-func (c *Client) Delete(ctx context.Context, request *astore.DeleteRequest) {
-	//TODO
+// BatchDelete atomically deletes all the artifacts selected, or returns them without deleting them with dryRun.
+//
+// Returns the artifacts, and the sids of the blobs deleted as no longer referenced.
+func (c *Client) BatchDelete(sel *astore.Selection, dryRun bool) ([]*astore.Artifact, []string, error) {
+	req := &astore.BatchDeleteRequest{Selection: sel, DryRun: dryRun}
+
+	resp, err := c.client.BatchDelete(context.TODO(), req)
+	if err != nil {
+		return nil, nil, client.NiceError(err, "could not delete artifacts - %s", err)
+	}
+	return resp.Artifact, resp.Sid, nil
 }
@@ -0,0 +1,297 @@
+package astore
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client"
+	"github.com/enfabrica/enkit/lib/karchive"
+)
+
+// extracted is a file being extracted from an archive.
+type extracted struct {
+	output string
+	tmp    *os.File
+	entry  *karchive.Entry
+}
+
+// extract downloads the files in file.Extract from the archive artifact in
+// response, and stores them in outputDir, as outputFile if set, or with the
+// last element of their name otherwise.
+//
+// Files of uncompressed tar and zip archives are fetched by range, using the
+// manifest recorded by the server. Compressed tar archives are decompressed
+// as they are downloaded, stopping as soon as all files are found.
+//
+// When the artifact must be verified, against its signature or a digest,
+// the whole artifact is downloaded instead.
+//
+// If the archive has several files with the same name, the first one is
+// extracted, whichever way the archive is read.
+func (c *Client) extract(file FileToDownload, response *apb.RetrieveResponse, o DownloadOptions, outputDir, outputFile string) error {
+	if outputFile != "" && len(file.Extract) > 1 {
+		return fmt.Errorf("extracting %d files from %s - the destination %s must be a directory", len(file.Extract), response.Path, file.Local)
+	}
+
+	files := map[string]*extracted{}
+	for _, name := range file.Extract {
+		name = karchive.CleanName(name)
+		output := outputFile
+		if output == "" {
+			output = path.Base(name)
+		}
+		output = filepath.Join(outputDir, output)
+		if !file.Overwrite {
+			if _, err := os.Stat(output); err == nil {
+				return fmt.Errorf("%s: %w", output, os.ErrExist)
+			}
+		}
+
+		tmp, err := os.CreateTemp(outputDir, "."+filepath.Base(output)+".*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		files[name] = &extracted{output: output, tmp: tmp}
+	}
+
+	art := response.Artifact
+	retrieved, err := c.client.Retrieve(context.TODO(), &apb.RetrieveRequest{Uid: art.Uid, Architecture: art.Architecture, Tag: &apb.TagSet{}, Manifest: true})
+	if err != nil {
+		return client.NiceError(err, "could not retrieve the manifest of %s - %s", response.Path, err)
+	}
+
+	format := karchive.FormatOf(response.Path)
+	if retrieved.Manifest != nil {
+		format = karchive.Format(retrieved.Manifest.Format)
+	}
+	verify := len(o.TrustedSigners) > 0 || len(file.SHA256) > 0
+
+	p := o.Progress()
+	p.Step("%s: extracting %s", response.Path, strings.Join(file.Extract, ", "))
+	switch {
+	case retrieved.Manifest != nil && format.Seekable() && !verify:
+		err = extractRanges(files, retrieved.Manifest, response.Url)
+	case format.IsTar():
+		err = extractStream(files, format, art, response.Url, verify)
+	case format == karchive.FormatZip:
+		err = extractZip(files, art, response.Url)
+	default:
+		err = fmt.Errorf("%s is not a tar or zip archive, files cannot be extracted from it", response.Path)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := f.tmp.Chmod(f.entry.Mode.Perm()); err != nil {
+			return err
+		}
+		if err := install(f.tmp.Name(), f.output, file.Overwrite); err != nil {
+			return err
+		}
+	}
+	p.Done()
+	return nil
+}
+
+// missing returns an error listing the files that were not found in the archive, if any.
+func missing(files map[string]*extracted) error {
+	var names []string
+	for name, f := range files {
+		if f.entry == nil {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return fmt.Errorf("not found in archive: %s", strings.Join(names, ", "))
+}
+
+// write stores the content of the entry in the temporary file of f, checking its size and CRC32.
+func (f *extracted) write(entry karchive.Entry, content io.Reader) error {
+	f.entry = &entry
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(f.tmp, crc), content)
+	if err != nil {
+		return fmt.Errorf("could not extract %s - %w", entry.Name, err)
+	}
+	if n != entry.Size {
+		return fmt.Errorf("%w - %s has %d bytes, expected %d", ErrIntegrity, entry.Name, n, entry.Size)
+	}
+	if entry.CRC32 != 0 && crc.Sum32() != entry.CRC32 {
+		return fmt.Errorf("%w - %s has crc32 %08x, expected %08x", ErrIntegrity, entry.Name, crc.Sum32(), entry.CRC32)
+	}
+	return nil
+}
+
+// extractRanges fetches each file by range, at the offset recorded in the manifest.
+func extractRanges(files map[string]*extracted, manifest *apb.Manifest, url string) error {
+	for _, me := range manifest.Entry {
+		f := files[me.Name]
+		if f == nil || f.entry != nil {
+			continue
+		}
+		entry := karchive.Entry{
+			Name:       me.Name,
+			Mode:       os.FileMode(me.Mode),
+			Size:       me.Size,
+			Offset:     me.Offset,
+			StoredSize: me.StoredSize,
+			Method:     uint16(me.Method),
+			CRC32:      me.Crc32,
+		}
+
+		stored, err := DownloadRange(context.TODO(), url, entry.Offset, entry.StoredSize)
+		if err != nil {
+			return fmt.Errorf("could not download %s - %w", entry.Name, err)
+		}
+		content, err := karchive.OpenEntry(entry, stored)
+		if err == nil {
+			err = f.write(entry, content)
+			content.Close()
+		}
+		stored.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return missing(files)
+}
+
+// extractStream downloads the tar archive, extracting files as they are found.
+//
+// With verify, the whole archive is downloaded, and checked against the
+// digests of the artifact. Otherwise, the download stops as soon as all
+// files are found.
+func extractStream(files map[string]*extracted, format karchive.Format, art *apb.Artifact, url string, verify bool) error {
+	body, err := DownloadRange(context.TODO(), url, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	verifier := NewVerifier(art)
+	r := io.TeeReader(body, verifier.Writer(nopCloser{io.Discard}))
+	left := len(files)
+	err = karchive.WalkTar(format, r, func(entry karchive.Entry, content io.Reader) error {
+		f := files[entry.Name]
+		if f == nil || f.entry != nil {
+			return nil
+		}
+		if err := f.write(entry, content); err != nil {
+			return err
+		}
+		if left--; left <= 0 {
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := missing(files); err != nil {
+		return err
+	}
+	if !verify {
+		return nil
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	return verifier.Verify()
+}
+
+// extractZip downloads and verifies the whole zip archive, and extracts the files from it.
+func extractZip(files map[string]*extracted, art *apb.Artifact, url string) error {
+	archive, err := os.CreateTemp("", "astore-extract-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	verifier := NewVerifier(art)
+	if err := Download(context.TODO(), func(int64) io.WriteCloser { return verifier.Writer(nopCloser{archive}) }, url); err != nil {
+		return err
+	}
+	if err := verifier.Verify(); err != nil {
+		return err
+	}
+
+	entries, err := karchive.ListZip(archive, verifier.size)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		f := files[entry.Name]
+		if f == nil || f.entry != nil {
+			continue
+		}
+		content, err := karchive.OpenEntry(entry, io.NewSectionReader(archive, entry.Offset, entry.StoredSize))
+		if err != nil {
+			return err
+		}
+		err = f.write(entry, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return missing(files)
+}
+
+// DownloadRange returns a reader for length bytes at offset of the content at url.
+//
+// A negative length returns all the content after offset. Servers not
+// supporting range requests are tolerated, by skipping the data before offset.
+func DownloadRange(ctx context.Context, url string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if length < 0 {
+			return resp.Body, nil
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, length), resp.Body}, nil
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("request returned status code %d - %s", resp.StatusCode, resp.Status)
+}
@@ -0,0 +1,197 @@
+package astore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client/ccontext"
+	"github.com/enfabrica/enkit/lib/logger"
+	"github.com/enfabrica/enkit/lib/progress"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var extractFiles = []struct {
+	Name, Body string
+}{
+	{"./bin/tool", "#!/bin/sh\necho tool\n"},
+	{"share/README", "Nothing to see here."},
+	{"share/data", string(bytes.Repeat([]byte("compressible "), 1000))},
+}
+
+func TestExtract(t *testing.T) {
+	client, proxy := clientForTest(t)
+	cctx := &ccontext.Context{Logger: logger.Nil, Progress: progress.NewDiscard}
+
+	tarred := bytes.Buffer{}
+	tw := tar.NewWriter(&tarred)
+	for _, file := range extractFiles {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: file.Name, Mode: 0750, Size: int64(len(file.Body))}))
+		_, err := tw.Write([]byte(file.Body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	gzipped := bytes.Buffer{}
+	gw := gzip.NewWriter(&gzipped)
+	_, err := gw.Write(tarred.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	zipped := bytes.Buffer{}
+	zw := zip.NewWriter(&zipped)
+	for _, file := range extractFiles {
+		w, err := zw.Create(file.Name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(file.Body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	uploads := map[string][]byte{"bundle.tar": tarred.Bytes(), "bundle.tar.gz": gzipped.Bytes(), "bundle.zip": zipped.Bytes()}
+	digests := map[string][]byte{}
+	for remote, content := range uploads {
+		local := filepath.Join(t.TempDir(), remote)
+		require.NoError(t, os.WriteFile(local, content, 0644))
+		arts, err := client.Upload([]FileToUpload{{Local: local, Remote: "tools/" + remote}}, UploadOptions{Context: cctx})
+		require.NoError(t, err)
+		digests[remote] = arts[0].Sha256
+	}
+
+	// Manifests are built by the server in the background.
+	for remote := range uploads {
+		require.Eventually(t, func() bool {
+			retrieved, err := client.client.Retrieve(context.Background(), &apb.RetrieveRequest{Path: "tools/" + remote, Manifest: true})
+			return err == nil && retrieved.Manifest != nil
+		}, 10*time.Second, 10*time.Millisecond, remote)
+	}
+
+	extract := func(remote, local string, names ...string) error {
+		_, err := client.Download([]FileToDownload{{Remote: "tools/" + remote, Local: local, Extract: names}}, DownloadOptions{Context: cctx})
+		return err
+	}
+	read := func(p string) string {
+		data, err := os.ReadFile(p)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	for remote := range uploads {
+		dir := t.TempDir() + "/"
+		ranges := proxy.ranges.Load()
+		require.NoError(t, extract(remote, dir, "bin/tool", "share/data"), remote)
+		assert.Equal(t, extractFiles[0].Body, read(filepath.Join(dir, "tool")), remote)
+		assert.Equal(t, extractFiles[2].Body, read(filepath.Join(dir, "data")), remote)
+		if remote != "bundle.tar.gz" {
+			assert.Equal(t, ranges+2, proxy.ranges.Load(), "%s must be extracted by range", remote)
+		}
+
+		named := filepath.Join(t.TempDir(), "readme.txt")
+		require.NoError(t, extract(remote, named, "./share/README"), remote)
+		assert.Equal(t, extractFiles[1].Body, read(named), remote)
+
+		assert.ErrorIs(t, extract(remote, named, "share/README"), os.ErrExist)
+		assert.ErrorContains(t, extract(remote, t.TempDir()+"/", "bin/tool", "missing"), "not found in archive: missing")
+		assert.ErrorContains(t, extract(remote, named, "bin/tool", "share/data"), "must be a directory")
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, extract("bundle.tar", dir+"/", "bin/tool"))
+	stat, err := os.Stat(filepath.Join(dir, "tool"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), stat.Mode().Perm())
+
+	// With a digest to verify, the whole archive is downloaded and checked.
+	for remote, digest := range digests {
+		dir := t.TempDir()
+		ranges := proxy.ranges.Load()
+		_, err := client.Download([]FileToDownload{{Remote: "tools/" + remote, Local: dir, SHA256: digest, Extract: []string{"share/README"}}}, DownloadOptions{Context: cctx})
+		require.NoError(t, err, remote)
+		assert.Equal(t, extractFiles[1].Body, read(filepath.Join(dir, "README")), remote)
+		assert.Equal(t, ranges, proxy.ranges.Load(), remote)
+	}
+
+	// Corrupted downloads are detected.
+	proxy.corrupt.Store(true)
+	assert.Error(t, extract("bundle.zip", t.TempDir()+"/", "bin/tool"))
+	assert.Error(t, extract("bundle.tar.gz", t.TempDir()+"/", "bin/tool"))
+	proxy.corrupt.Store(false)
+
+	// Files cannot be extracted from artifacts that are not archives.
+	local := filepath.Join(t.TempDir(), "plain")
+	require.NoError(t, os.WriteFile(local, []byte("plain"), 0644))
+	_, err = client.Upload([]FileToUpload{{Local: local, Remote: "tools/plain"}}, UploadOptions{Context: cctx})
+	require.NoError(t, err)
+	assert.ErrorContains(t, extract("plain", t.TempDir()+"/", "bin/tool"), "not a tar or zip archive")
+}
+
+func TestExtractDuplicates(t *testing.T) {
+	client, proxy := clientForTest(t)
+	cctx := &ccontext.Context{Logger: logger.Nil, Progress: progress.NewDiscard}
+
+	tarred := bytes.Buffer{}
+	tw := tar.NewWriter(&tarred)
+	zipped := bytes.Buffer{}
+	zw := zip.NewWriter(&zipped)
+	for _, body := range []string{"first", "second"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "bin/tool", Mode: 0750, Size: int64(len(body))}))
+		_, err := tw.Write([]byte(body))
+		require.NoError(t, err)
+		w, err := zw.Create("bin/tool")
+		require.NoError(t, err)
+		_, err = w.Write([]byte(body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+	gzipped := bytes.Buffer{}
+	gw := gzip.NewWriter(&gzipped)
+	_, err := gw.Write(tarred.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	uploads := map[string][]byte{"dups.tar": tarred.Bytes(), "dups.tar.gz": gzipped.Bytes(), "dups.zip": zipped.Bytes()}
+	digests := map[string][]byte{}
+	for remote, content := range uploads {
+		local := filepath.Join(t.TempDir(), remote)
+		require.NoError(t, os.WriteFile(local, content, 0644))
+		arts, err := client.Upload([]FileToUpload{{Local: local, Remote: "tools/" + remote}}, UploadOptions{Context: cctx})
+		require.NoError(t, err)
+		digests[remote] = arts[0].Sha256
+	}
+
+	// The first file is extracted, whether the archive is read by range, as a
+	// stream, or downloaded whole to be verified.
+	for remote := range uploads {
+		if remote != "dups.tar.gz" {
+			require.Eventually(t, func() bool {
+				retrieved, err := client.client.Retrieve(context.Background(), &apb.RetrieveRequest{Path: "tools/" + remote, Manifest: true})
+				return err == nil && retrieved.Manifest != nil
+			}, 10*time.Second, 10*time.Millisecond, remote)
+		}
+		for _, verify := range []bool{false, true} {
+			dir := t.TempDir()
+			ranges := proxy.ranges.Load()
+			download := FileToDownload{Remote: "tools/" + remote, Local: dir + "/", Extract: []string{"bin/tool"}}
+			if verify {
+				download.SHA256 = digests[remote]
+			}
+			_, err := client.Download([]FileToDownload{download}, DownloadOptions{Context: cctx})
+			require.NoError(t, err, remote)
+			data, err := os.ReadFile(filepath.Join(dir, "tool"))
+			require.NoError(t, err)
+			assert.Equal(t, "first", string(data), "%s verify %t", remote, verify)
+			if remote != "dups.tar.gz" && !verify {
+				assert.Equal(t, ranges+1, proxy.ranges.Load(), "%s must be extracted by range", remote)
+			}
+		}
+	}
+}
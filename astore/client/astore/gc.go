@@ -0,0 +1,21 @@
+package astore
+
+import (
+	"context"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client"
+)
+
+// GC asks the server to apply its retention policies to the artifacts under path.
+//
+// With dryRun, the server only reports the artifacts that would be deleted.
+func (c *Client) GC(path string, dryRun bool) (*astore.GCResponse, error) {
+	req := &astore.GCRequest{Path: path, DryRun: dryRun}
+
+	resp, err := c.client.GC(context.TODO(), req)
+	if err != nil {
+		return nil, client.NiceError(err, "garbage collection failed - %s", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,21 @@
+package astore
+
+import (
+	"context"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client"
+)
+
+// History returns the audit log of the artifact uid, or of the artifacts stored in path p or below it, most recent first.
+//
+// At most limit entries are returned, or a server default if 0.
+func (c *Client) History(uid, p string, limit int) ([]*astore.AuditEntry, error) {
+	req := &astore.HistoryRequest{Uid: uid, Path: p, Limit: int32(limit)}
+
+	resp, err := c.client.History(context.TODO(), req)
+	if err != nil {
+		return nil, client.NiceError(err, "could not retrieve the history - %s", err)
+	}
+	return resp.Entry, nil
+}
@@ -0,0 +1,191 @@
+package astore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client"
+	"github.com/enfabrica/enkit/lib/client/ccontext"
+	"github.com/enfabrica/enkit/lib/progress"
+)
+
+type MirrorOptions struct {
+	*ccontext.Context
+
+	// Only artifacts of this architecture are mirrored. Empty means any architecture.
+	Architecture string
+	// Only artifacts with all these tags are mirrored. Empty means any tag.
+	Tag []string
+	// Only report what would be copied or updated, without changing the destination.
+	DryRun bool
+	// Directory where to store the artifacts while they are copied. Empty means the default temporary directory.
+	TempDir string
+	// Options to upload the artifacts to the destination. The Context is ignored.
+	Upload UploadOptions
+}
+
+// MirrorStats describes the changes performed by Mirror.
+type MirrorStats struct {
+	// Artifacts copied to the destination.
+	Copied []*apb.Artifact
+	// Artifacts already in the destination, with tags or note updated.
+	Updated []*apb.Artifact
+	// Number of artifacts already in the destination, and up to date.
+	Unchanged int
+}
+
+// Mirror copies the artifacts stored at or below root from this astore to dest, preserving their metadata.
+//
+// Mirror is incremental: artifacts already in dest, identified by uid, are not copied
+// again, only their tags and note are updated to match the source. Artifacts are never
+// deleted from dest. Requires administrative privileges on dest.
+func (c *Client) Mirror(dest *Client, root string, o MirrorOptions) (*MirrorStats, error) {
+	o.Upload.Context = o.Context
+	stats := &MirrorStats{}
+	return stats, c.mirrorPath(dest, strings.Trim(root, "/"), o, stats)
+}
+
+func (c *Client) mirrorPath(dest *Client, dir string, o MirrorOptions, stats *MirrorStats) error {
+	resp, err := c.client.List(context.TODO(), &apb.ListRequest{Path: dir, Architecture: o.Architecture, Tag: &apb.TagSet{Tag: o.Tag}})
+	if err != nil {
+		return client.NiceError(err, "could not list %q in the source - %s", dir, err)
+	}
+
+	if len(resp.Artifact) > 0 {
+		if err := c.mirrorArtifacts(dest, dir, resp.Artifact, o, stats); err != nil {
+			return err
+		}
+	}
+	for _, element := range resp.Element {
+		if err := c.mirrorPath(dest, path.Join(dir, element.Name), o, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mirrorArtifacts mirrors the artifacts listed in the path dir.
+func (c *Client) mirrorArtifacts(dest *Client, dir string, arts []*apb.Artifact, o MirrorOptions, stats *MirrorStats) error {
+	existing, err := dest.client.List(context.TODO(), &apb.ListRequest{Path: dir, Tag: &apb.TagSet{}})
+	if err != nil {
+		return client.NiceError(err, "could not list %q in the destination - %s", dir, err)
+	}
+	mirrored := map[string]*apb.Artifact{}
+	for _, art := range existing.Artifact {
+		mirrored[art.Uid] = art
+	}
+
+	// Oldest first, so tags moved from one artifact to another end up where they are in the source.
+	sort.SliceStable(arts, func(i, j int) bool {
+		return arts[i].Created < arts[j].Created
+	})
+	for _, art := range arts {
+		found := mirrored[art.Uid]
+		if found == nil {
+			if err := c.mirrorCopy(dest, dir, art, o); err != nil {
+				return err
+			}
+			stats.Copied = append(stats.Copied, art)
+			continue
+		}
+
+		sameTags := slices.Equal(sortedCopy(found.Tag), sortedCopy(art.Tag))
+		if sameTags && found.Note == art.Note {
+			stats.Unchanged++
+			continue
+		}
+		o.Logger.Infof("updating %s (uid %s) - tags %v, note %q", dir, art.Uid, art.Tag, art.Note)
+		if !o.DryRun {
+			if !sameTags {
+				if _, err := dest.Tag(art.Uid, TagSet(art.Tag)); err != nil {
+					return err
+				}
+			}
+			if found.Note != art.Note {
+				if _, err := dest.Note(art.Uid, art.Note); err != nil {
+					return err
+				}
+			}
+		}
+		stats.Updated = append(stats.Updated, art)
+	}
+	return nil
+}
+
+// mirrorCopy copies the content and metadata of a single artifact.
+func (c *Client) mirrorCopy(dest *Client, dir string, art *apb.Artifact, o MirrorOptions) error {
+	o.Logger.Infof("copying %s (uid %s, arch %s)", dir, art.Uid, art.Architecture)
+	if o.DryRun {
+		return nil
+	}
+
+	shortpath := path.Join(dir, art.Uid)
+	p := o.Progress()
+	defer p.Done()
+
+	retrieved, err := c.client.Retrieve(context.TODO(), &apb.RetrieveRequest{Uid: art.Uid, Architecture: art.Architecture, Tag: &apb.TagSet{}})
+	if err != nil {
+		return client.NiceError(err, "could not retrieve %s from the source - %s", art.Uid, err)
+	}
+
+	f, err := os.CreateTemp(o.TempDir, "astore-mirror-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	p.Step("%s: downloading", shortpath)
+	verifier := NewVerifier(art)
+	if err := Download(context.TODO(), progress.WriterCreator(p, verifier.Writer(nopCloser{f})), retrieved.Url); err != nil {
+		return err
+	}
+	if err := verifier.Verify(); err != nil {
+		return fmt.Errorf("%s: %w", shortpath, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sid, statePath, err := dest.uploadBlob(f, info, o.Upload, p, shortpath)
+	if err != nil {
+		return err
+	}
+
+	p.Step("%s: importing", shortpath)
+	_, err = dest.client.Import(context.TODO(), &apb.ImportRequest{Sid: sid, Path: dir, Artifact: art})
+	if err != nil {
+		return client.NiceError(err, "could not import %s in the destination - %s", art.Uid, err)
+	}
+	if statePath != "" {
+		os.Remove(statePath)
+	}
+	return nil
+}
+
+// nopCloser turns an io.Writer into an io.WriteCloser that does not close it,
+// so the file being downloaded can be uploaded next.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func sortedCopy(values []string) []string {
+	result := slices.Clone(values)
+	sort.Strings(result)
+	return result
+}
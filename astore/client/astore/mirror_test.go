@@ -0,0 +1,116 @@
+package astore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+	aserver "github.com/enfabrica/enkit/astore/server/astore"
+	"github.com/enfabrica/enkit/lib/client/ccontext"
+	"github.com/enfabrica/enkit/lib/logger"
+	"github.com/enfabrica/enkit/lib/progress"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror(t *testing.T) {
+	src, _ := clientForTest(t)
+	dst, _ := clientForTest(t, aserver.WithAdmins("tester@enkit.test"))
+	cctx := &ccontext.Context{Logger: logger.Nil, Progress: progress.NewDiscard}
+
+	upload := func(content, remote, arch string) *apb.Artifact {
+		local := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(local, []byte(content), 0644))
+		arts, err := src.Upload([]FileToUpload{{Local: local, Remote: remote, Architecture: []string{arch}, Note: "first"}}, UploadOptions{Context: cctx})
+		require.NoError(t, err)
+		require.Len(t, arts, 1)
+		return arts[0]
+	}
+	listed := func(c *Client, p string) map[string]*apb.Artifact {
+		resp, err := c.client.List(context.Background(), &apb.ListRequest{Path: p, Tag: &apb.TagSet{}})
+		require.NoError(t, err)
+		result := map[string]*apb.Artifact{}
+		for _, art := range resp.Artifact {
+			result[art.Uid] = art
+		}
+		return result
+	}
+
+	upload("tool v1", "tools/tool", "amd64")
+	v2 := upload("tool v2", "tools/tool", "amd64")
+	upload("lib arm", "tools/lib/lib", "arm64")
+	upload("other", "other/file", "amd64")
+
+	options := MirrorOptions{Context: cctx, Tag: []string{}}
+	stats, err := src.Mirror(dst, "tools", options)
+	require.NoError(t, err)
+	assert.Len(t, stats.Copied, 3)
+	assert.Empty(t, stats.Updated)
+
+	// Uids, tags, creator and creation time are preserved.
+	want := listed(src, "tools/tool")
+	got := listed(dst, "tools/tool")
+	require.Len(t, got, 2)
+	for uid, art := range want {
+		require.Contains(t, got, uid)
+		assert.Equal(t, art.Tag, got[uid].Tag)
+		assert.Equal(t, art.Creator, got[uid].Creator)
+		assert.Equal(t, art.Created, got[uid].Created)
+		assert.Equal(t, art.Sha256, got[uid].Sha256)
+		assert.Equal(t, "first", got[uid].Note)
+	}
+	assert.Len(t, listed(dst, "tools/lib/lib"), 1)
+	assert.Empty(t, listed(dst, "other/file"))
+
+	output := t.TempDir()
+	_, err = dst.Download([]FileToDownload{{Remote: "tools/tool", Local: output, Architecture: []string{"amd64"}}}, DownloadOptions{Context: cctx})
+	require.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(output, "tool"))
+	require.NoError(t, err)
+	assert.Equal(t, "tool v2", string(data))
+
+	// Mirroring again only picks up the changes.
+	stats, err = src.Mirror(dst, "tools", options)
+	require.NoError(t, err)
+	assert.Empty(t, stats.Copied)
+	assert.Empty(t, stats.Updated)
+	assert.Equal(t, 3, stats.Unchanged)
+
+	_, err = src.Tag(v2.Uid, TagSet([]string{"stable"}))
+	require.NoError(t, err)
+	_, err = src.Note(v2.Uid, "second")
+	require.NoError(t, err)
+	v3 := upload("tool v3", "tools/tool", "amd64")
+
+	// A dry run reports the changes, without applying them.
+	stats, err = src.Mirror(dst, "tools", MirrorOptions{Context: cctx, Tag: []string{}, DryRun: true})
+	require.NoError(t, err)
+	assert.Len(t, stats.Copied, 1)
+	assert.Len(t, stats.Updated, 1)
+	assert.Len(t, listed(dst, "tools/tool"), 2)
+
+	stats, err = src.Mirror(dst, "tools", options)
+	require.NoError(t, err)
+	require.Len(t, stats.Copied, 1)
+	assert.Equal(t, v3.Uid, stats.Copied[0].Uid)
+	require.Len(t, stats.Updated, 1)
+	assert.Equal(t, v2.Uid, stats.Updated[0].Uid)
+	got = listed(dst, "tools/tool")
+	assert.Equal(t, []string{"stable"}, got[v2.Uid].Tag)
+	assert.Equal(t, "second", got[v2.Uid].Note)
+	assert.Equal(t, []string{"latest"}, got[v3.Uid].Tag)
+
+	// Filtering by architecture.
+	filtered, _ := clientForTest(t, aserver.WithAdmins("tester@enkit.test"))
+	stats, err = src.Mirror(filtered, "", MirrorOptions{Context: cctx, Tag: []string{}, Architecture: "arm64"})
+	require.NoError(t, err)
+	require.Len(t, stats.Copied, 1)
+	assert.Equal(t, "arm64", stats.Copied[0].Architecture)
+
+	// Importing requires administrative privileges.
+	unprivileged, _ := clientForTest(t)
+	_, err = src.Mirror(unprivileged, "tools", options)
+	assert.ErrorContains(t, err, "not an administrator")
+}
@@ -0,0 +1,270 @@
+package astore
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client"
+	"github.com/enfabrica/enkit/lib/logger"
+	"github.com/enfabrica/enkit/lib/progress"
+	"github.com/enfabrica/enkit/lib/retry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultChunkSize is the size above which files are uploaded in parts, and the size of each part.
+	DefaultChunkSize = 64 << 20
+	// DefaultParallelism is the number of parts uploaded at the same time.
+	DefaultParallelism = 4
+	// DefaultPartAttempts is how many times the upload of a part is attempted before giving up.
+	DefaultPartAttempts = 5
+)
+
+// DefaultStateDir returns the directory used to keep track of uploads in parts, so they can be resumed.
+func DefaultStateDir() (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cache, "enkit", "astore", "uploads"), nil
+}
+
+// uploadState is the information persisted on disk to resume an upload in parts.
+type uploadState struct {
+	Sid       string
+	ChunkSize int64
+
+	// Used to verify that the file did not change since the upload started.
+	Size    int64
+	ModTime time.Time
+}
+
+// uploadStateFile returns the path of the file tracking the upload of local, or "" if uploads cannot be resumed.
+func uploadStateFile(dir, local string, info os.FileInfo) string {
+	if dir == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(local)
+	if err != nil {
+		return ""
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", abs, info.Size(), info.ModTime().UnixNano())))
+	return filepath.Join(dir, hex.EncodeToString(key[:16])+".json")
+}
+
+func readUploadState(path string, info os.FileInfo) *uploadState {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	state := &uploadState{}
+	if err := json.Unmarshal(data, state); err != nil || state.Size != info.Size() || !state.ModTime.Equal(info.ModTime()) {
+		return nil
+	}
+	return state
+}
+
+func writeUploadState(path string, state *uploadState) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// uploadError classifies the errors returned by Upload, so only transient errors are retried.
+func uploadError(err error) error {
+	var failed *UploadError
+	if errors.As(err, &failed) && failed.StatusCode >= 400 && failed.StatusCode < 500 &&
+		failed.StatusCode != http.StatusRequestTimeout && failed.StatusCode != http.StatusTooManyRequests {
+		return retry.Fatal(err)
+	}
+	return err
+}
+
+// startUpload starts or resumes the upload in parts of the file described by info.
+//
+// Returns the state of the upload, and the parts that still need to be uploaded.
+func (c *Client) startUpload(statePath string, info os.FileInfo, chunkSize int64, log logger.Logger) (*uploadState, []*apb.UploadPart, error) {
+	if state := readUploadState(statePath, info); state != nil {
+		resp, err := c.client.StartUpload(context.TODO(), &apb.StartUploadRequest{Sid: state.Sid, Size: state.Size, ChunkSize: state.ChunkSize})
+		if err == nil {
+			log.Infof("resuming upload %s", state.Sid)
+			return state, resp.Part, nil
+		}
+		// All the parts were uploaded and assembled, only the commit is missing.
+		if status.Code(err) == codes.AlreadyExists {
+			return state, nil, nil
+		}
+		log.Infof("could not resume upload %s, starting over - %s", state.Sid, err)
+	}
+
+	resp, err := c.client.StartUpload(context.TODO(), &apb.StartUploadRequest{Size: info.Size(), ChunkSize: chunkSize})
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Sid == "" || resp.ChunkSize <= 0 {
+		return nil, nil, fmt.Errorf("invalid server response")
+	}
+
+	state := &uploadState{Sid: resp.Sid, ChunkSize: resp.ChunkSize, Size: info.Size(), ModTime: info.ModTime()}
+	if err := writeUploadState(statePath, state); err != nil {
+		log.Warnf("could not save upload state, the upload will not be resumable - %s", err)
+	}
+	return state, resp.Part, nil
+}
+
+// partReader reports the bytes read from a part to a progress.Counter.
+type partReader struct {
+	io.Reader
+	counter progress.Counter
+
+	mu     sync.Mutex
+	read   int64 // Bytes reported to counter.
+	undone bool
+}
+
+func (r *partReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.undone {
+		r.read += int64(n)
+		r.counter.Add(int64(n))
+	}
+	return n, err
+}
+
+// undo takes back the bytes reported, when the upload of the part failed.
+//
+// Bytes read afterwards, by an upload still winding down, are not reported.
+func (r *partReader) undo() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.undone = true
+	r.counter.Add(-r.read)
+}
+
+// uploadParts uploads the parts of fd not yet marked as done, parallelism at a time.
+func uploadParts(fd *os.File, state *uploadState, parts []*apb.UploadPart, parallelism int, p progress.Handler, log logger.Logger) error {
+	var pending []*apb.UploadPart
+	var total int64
+	for _, part := range parts {
+		if part.Done {
+			continue
+		}
+		pending = append(pending, part)
+		total += min(state.ChunkSize, state.Size-int64(part.Index)*state.ChunkSize)
+	}
+
+	counter := p.Counter(total)
+	work := make(chan *apb.UploadPart)
+	errs := make(chan error, len(pending))
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range work {
+				offset := int64(part.Index) * state.ChunkSize
+				size := min(state.ChunkSize, state.Size-offset)
+
+				attempts := retry.New(retry.WithAttempts(DefaultPartAttempts), retry.WithLogger(log),
+					retry.WithDescription(fmt.Sprintf("uploading part %d of %s", part.Index, state.Sid)))
+				errs <- attempts.Run(func() error {
+					r := &partReader{Reader: io.NewSectionReader(fd, offset, size), counter: counter}
+					if err := Upload(context.TODO(), io.NopCloser(r), size, part.Url); err != nil {
+						r.undo()
+						return uploadError(err)
+					}
+					return nil
+				})
+			}
+		}()
+	}
+	for _, part := range pending {
+		work <- part
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadInParts uploads a large file in parts, resuming a previous upload if possible.
+//
+// Returns the sid of the blob, ready to be committed, and the path of the file
+// tracking the upload, to be removed once the blob is committed.
+func (c *Client) uploadInParts(fd *os.File, info os.FileInfo, chunkSize int64, o UploadOptions, p progress.Handler, shortpath string) (string, string, error) {
+	stateDir := o.StateDir
+	if stateDir == "" {
+		dir, err := DefaultStateDir()
+		if err != nil {
+			o.Logger.Warnf("no directory to store the upload state, the upload will not be resumable - %s", err)
+		}
+		stateDir = dir
+	}
+	statePath := uploadStateFile(stateDir, fd.Name(), info)
+
+	p.Step("%s: starting upload", shortpath)
+	state, parts, err := c.startUpload(statePath, info, chunkSize, o.Logger)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(parts) > 0 {
+		parallelism := o.Parallelism
+		if parallelism <= 0 {
+			parallelism = DefaultParallelism
+		}
+
+		p.Step("%s: uploading", shortpath)
+		if err := uploadParts(fd, state, parts, parallelism, p, o.Logger); err != nil {
+			return "", "", fmt.Errorf("upload failed, run the same command again to resume - %w", err)
+		}
+
+		p.Step("%s: verifying", shortpath)
+		hash := md5.New()
+		if _, err := io.Copy(hash, io.NewSectionReader(fd, 0, state.Size)); err != nil {
+			return "", "", fmt.Errorf("couldn't read %s - %w", shortpath, err)
+		}
+		_, err := c.client.CompleteUpload(context.TODO(), &apb.CompleteUploadRequest{
+			Sid:       state.Sid,
+			Size:      state.Size,
+			ChunkSize: state.ChunkSize,
+			Md5:       hash.Sum(nil),
+		})
+		if err != nil {
+			return "", "", client.NiceError(err, "could not complete upload - %s", err)
+		}
+	}
+	return state.Sid, statePath, nil
+}
@@ -0,0 +1,238 @@
+package astore
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+	aserver "github.com/enfabrica/enkit/astore/server/astore"
+	"github.com/enfabrica/enkit/lib/client/ccontext"
+	"github.com/enfabrica/enkit/lib/logger"
+	"github.com/enfabrica/enkit/lib/oauth"
+	"github.com/enfabrica/enkit/lib/progress"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// blobProxy forwards requests to the blob handler of the server, counting the uploads
+// and the downloads by range.
+//
+// If allow is not negative, only that many uploads succeed, the others fail.
+// If corrupt is set, the first byte of each download is altered.
+type blobProxy struct {
+	handler http.Handler
+	puts    atomic.Int32
+	ranges  atomic.Int32
+	allow   atomic.Int32
+	corrupt atomic.Bool
+}
+
+func (bp *blobProxy) allowed() bool {
+	for {
+		allow := bp.allow.Load()
+		if allow <= 0 {
+			return allow < 0
+		}
+		if bp.allow.CompareAndSwap(allow, allow-1) {
+			return true
+		}
+	}
+}
+
+func (bp *blobProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		if !bp.allowed() {
+			http.Error(w, "injected failure", http.StatusForbidden)
+			return
+		}
+		bp.puts.Add(1)
+	}
+	if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+		bp.ranges.Add(1)
+	}
+	if r.Method == http.MethodGet && bp.corrupt.Load() {
+		recorder := httptest.NewRecorder()
+		bp.handler.ServeHTTP(recorder, r)
+		data := recorder.Body.Bytes()
+		if len(data) > 0 {
+			data[0] ^= 0xff
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(data)
+		return
+	}
+	bp.handler.ServeHTTP(w, r)
+}
+
+// credsStream authenticates the streams as the same user as clientForTest.
+type credsStream struct {
+	grpc.ServerStream
+}
+
+func (cs *credsStream) Context() context.Context {
+	return oauth.SetCredentials(cs.ServerStream.Context(), &oauth.CredentialsCookie{
+		Identity: oauth.Identity{Username: "tester", Organization: "enkit.test"},
+	})
+}
+
+// clientForTest returns a Client connected to an astore server with no cloud dependencies.
+//
+// mods are applied to the server, after the options of the test.
+func clientForTest(t *testing.T, mods ...aserver.Modifier) (*Client, *blobProxy) {
+	t.Helper()
+
+	proxy := &blobProxy{}
+	proxy.allow.Store(-1)
+	hs := httptest.NewServer(http.StripPrefix("/b/", proxy))
+	t.Cleanup(hs.Close)
+
+	dir := t.TempDir()
+	mods = append([]aserver.Modifier{
+		aserver.WithBlobDir(filepath.Join(dir, "blobs")),
+		aserver.WithBlobURL(hs.URL + "/b/"),
+		aserver.WithMetadataDB(filepath.Join(dir, "metadata.db")),
+	}, mods...)
+	server, err := aserver.New(rand.New(rand.NewSource(0)), mods...)
+	require.NoError(t, err)
+	proxy.handler = server.BlobHandler()
+
+	creds := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(oauth.SetCredentials(ctx, &oauth.CredentialsCookie{
+			Identity: oauth.Identity{Username: "tester", Organization: "enkit.test"},
+		}), req)
+	}
+	streamCreds := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &credsStream{ServerStream: ss})
+	}
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(creds), grpc.StreamInterceptor(streamCreds))
+	apb.RegisterAstoreServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return New(conn), proxy
+}
+
+func TestUploadInParts(t *testing.T) {
+	client, proxy := clientForTest(t)
+
+	local := filepath.Join(t.TempDir(), "large.bin")
+	content := strings.Repeat("astore multipart upload ", 1000)
+	require.NoError(t, os.WriteFile(local, []byte(content), 0644))
+
+	options := UploadOptions{
+		Context:     &ccontext.Context{Logger: logger.Nil, Progress: progress.NewDiscard},
+		ChunkSize:   1000,
+		Parallelism: 1,
+		StateDir:    t.TempDir(),
+	}
+	parts := int32((len(content) + 999) / 1000)
+	files := []FileToUpload{{Local: local, Remote: "images/large", Architecture: []string{"amd64"}}}
+
+	// The upload is interrupted after a few parts, and the state is saved.
+	proxy.allow.Store(5)
+	_, err := client.Upload(files, options)
+	require.Error(t, err)
+	assert.Equal(t, int32(5), proxy.puts.Load())
+	state, err := os.ReadDir(options.StateDir)
+	require.NoError(t, err)
+	assert.Len(t, state, 1)
+
+	// Running the upload again only uploads the missing parts.
+	proxy.allow.Store(-1)
+	options.Parallelism = 4
+	arts, err := client.Upload(files, options)
+	require.NoError(t, err)
+	require.Len(t, arts, 1)
+	assert.Equal(t, parts, proxy.puts.Load())
+	assert.Equal(t, int64(len(content)), arts[0].Size)
+	state, err = os.ReadDir(options.StateDir)
+	require.NoError(t, err)
+	assert.Empty(t, state)
+
+	downloaded := filepath.Join(t.TempDir(), "downloaded.bin")
+	_, err = client.Download([]FileToDownload{{Remote: arts[0].Uid, Local: downloaded}}, DownloadOptions{Context: options.Context})
+	require.NoError(t, err)
+	data, err := os.ReadFile(downloaded)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data))
+
+	// Small files are uploaded with a single request.
+	small := filepath.Join(t.TempDir(), "small.bin")
+	require.NoError(t, os.WriteFile(small, []byte("small"), 0644))
+	_, err = client.Upload([]FileToUpload{{Local: small, Remote: "images/small"}}, options)
+	require.NoError(t, err)
+	assert.Equal(t, parts+1, proxy.puts.Load())
+}
+
+// progressCounter is a progress.Handler recording the progress reported to its Counter.
+type progressCounter struct {
+	progress.Discard
+
+	mu           sync.Mutex
+	total        int64
+	current, max int64
+}
+
+func (pc *progressCounter) Counter(total int64) progress.Counter {
+	pc.total = total
+	return pc
+}
+
+func (pc *progressCounter) Add(n int64) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.current += n
+	pc.max = max(pc.max, pc.current)
+}
+
+func TestUploadPartsProgress(t *testing.T) {
+	var failed atomic.Bool
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		// The first upload fails after sending the whole part, and is retried.
+		if failed.CompareAndSwap(false, true) {
+			http.Error(w, "injected failure", http.StatusInternalServerError)
+		}
+	}))
+	defer hs.Close()
+
+	local := filepath.Join(t.TempDir(), "large.bin")
+	require.NoError(t, os.WriteFile(local, []byte(strings.Repeat("x", 25)), 0644))
+	fd, err := os.Open(local)
+	require.NoError(t, err)
+	defer fd.Close()
+
+	state := &uploadState{Sid: "sid", ChunkSize: 10, Size: 25}
+	parts := []*apb.UploadPart{
+		{Index: 0, Url: hs.URL},
+		{Index: 1, Url: hs.URL, Done: true},
+		{Index: 2, Url: hs.URL},
+	}
+	p := &progressCounter{}
+	require.NoError(t, uploadParts(fd, state, parts, 2, p, logger.Nil))
+	assert.True(t, failed.Load())
+	// The bytes of the failed upload are not counted twice.
+	assert.Equal(t, int64(15), p.total)
+	assert.Equal(t, int64(15), p.current)
+	assert.Equal(t, int64(15), p.max)
+}
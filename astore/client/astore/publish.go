@@ -22,6 +22,10 @@ type ToPublish struct {
 	// If empty, the client will be able to select the architecture.
 	Architecture  string
 	NonExistentOK bool
+
+	// If set, the URL returns the artifact with the highest version satisfying
+	// this constraint, like "~1.4", following new versions as they are uploaded.
+	Version string
 }
 
 func (c *Client) Publish(el ToPublish) (string, *astore.ListResponse, error) {
@@ -29,6 +33,7 @@ func (c *Client) Publish(el ToPublish) (string, *astore.ListResponse, error) {
 		Path:         el.Path,
 		Uid:          el.Uid,
 		Architecture: el.Architecture,
+		Version:      el.Version,
 	}
 	if el.Tag != nil {
 		req.Tag = &astore.TagSet{Tag: *el.Tag}
@@ -0,0 +1,67 @@
+package astore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+)
+
+// ErrIntegrity is returned when downloaded content does not match the artifact it belongs to.
+var ErrIntegrity = errors.New("integrity check failed")
+
+// Verifier checks that downloaded content matches the size and digests recorded for an artifact.
+//
+// The SHA-256 is verified if the artifact has one, the MD5 otherwise, as
+// artifacts committed by older servers have no SHA-256.
+type Verifier struct {
+	art *apb.Artifact
+
+	sha256 hash.Hash
+	md5    hash.Hash
+	size   int64
+}
+
+func NewVerifier(art *apb.Artifact) *Verifier {
+	return &Verifier{art: art, sha256: sha256.New(), md5: md5.New()}
+}
+
+type verifierWriter struct {
+	io.Writer
+	io.Closer
+}
+
+// Writer returns a WriteCloser writing to w, and computing the digests of the data written.
+func (v *Verifier) Writer(w io.WriteCloser) io.WriteCloser {
+	return &verifierWriter{Writer: io.MultiWriter(w, v.sha256, v.md5, v), Closer: w}
+}
+
+// Write counts the bytes written, it never fails.
+func (v *Verifier) Write(data []byte) (int, error) {
+	v.size += int64(len(data))
+	return len(data), nil
+}
+
+// Verify returns an error wrapping ErrIntegrity if the data written does not match the artifact.
+func (v *Verifier) Verify() error {
+	if v.art.Size > 0 && v.size != v.art.Size {
+		return fmt.Errorf("%w - got %d bytes, expected %d", ErrIntegrity, v.size, v.art.Size)
+	}
+	if len(v.art.Sha256) > 0 {
+		if got := v.sha256.Sum(nil); !bytes.Equal(got, v.art.Sha256) {
+			return fmt.Errorf("%w - sha256 is %x, expected %x", ErrIntegrity, got, v.art.Sha256)
+		}
+		return nil
+	}
+	if len(v.art.MD5) > 0 {
+		if got := v.md5.Sum(nil); !bytes.Equal(got, v.art.MD5) {
+			return fmt.Errorf("%w - md5 is %x, expected %x", ErrIntegrity, got, v.art.MD5)
+		}
+	}
+	return nil
+}
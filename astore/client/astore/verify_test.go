@@ -0,0 +1,132 @@
+package astore
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/enfabrica/enkit/astore/provenance"
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client/ccontext"
+	"github.com/enfabrica/enkit/lib/logger"
+	"github.com/enfabrica/enkit/lib/progress"
+	"github.com/enfabrica/enkit/lib/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopWriteCloser struct{}
+
+func (nopWriteCloser) Write(data []byte) (int, error) { return len(data), nil }
+func (nopWriteCloser) Close() error                   { return nil }
+
+func TestVerifier(t *testing.T) {
+	content := []byte("verified content")
+	sha := sha256.Sum256(content)
+	sum := md5.Sum(content)
+
+	testCases := []struct {
+		desc    string
+		art     *apb.Artifact
+		written []byte
+		valid   bool
+	}{
+		{desc: "sha256 match", art: &apb.Artifact{Sha256: sha[:], MD5: sum[:], Size: int64(len(content))}, written: content, valid: true},
+		{desc: "sha256 mismatch", art: &apb.Artifact{Sha256: sha[:], MD5: sum[:]}, written: []byte("verified CONTENT"), valid: false},
+		{desc: "size mismatch", art: &apb.Artifact{Sha256: sha[:], Size: int64(len(content))}, written: content[1:], valid: false},
+		{desc: "md5 only match", art: &apb.Artifact{MD5: sum[:]}, written: content, valid: true},
+		{desc: "md5 only mismatch", art: &apb.Artifact{MD5: sum[:]}, written: content[:3], valid: false},
+		{desc: "no digests", art: &apb.Artifact{}, written: content, valid: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			verifier := NewVerifier(tc.art)
+			w := verifier.Writer(nopWriteCloser{})
+			_, err := w.Write(tc.written)
+			require.NoError(t, err)
+
+			err = verifier.Verify()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrIntegrity)
+			}
+		})
+	}
+}
+
+func TestDownloadVerifies(t *testing.T) {
+	client, proxy := clientForTest(t)
+	cctx := &ccontext.Context{Logger: logger.Nil, Progress: progress.NewDiscard}
+
+	local := filepath.Join(t.TempDir(), "tool")
+	require.NoError(t, os.WriteFile(local, []byte("tool v1"), 0644))
+	_, err := client.Upload([]FileToUpload{{Local: local, Remote: "tools/tool"}}, UploadOptions{Context: cctx})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(local, []byte("tool v2"), 0644))
+	_, err = client.Upload([]FileToUpload{{Local: local, Remote: "tools/tool"}}, UploadOptions{Context: cctx})
+	require.NoError(t, err)
+
+	// Pinning by digest selects the older version.
+	digest := sha256.Sum256([]byte("tool v1"))
+	output := t.TempDir()
+	arts, err := client.Download([]FileToDownload{{Remote: "tools/tool", Local: output, SHA256: digest[:]}}, DownloadOptions{Context: cctx})
+	require.NoError(t, err)
+	require.Len(t, arts, 1)
+	assert.Equal(t, digest[:], arts[0].Sha256)
+	data, err := os.ReadFile(filepath.Join(output, "tool"))
+	require.NoError(t, err)
+	assert.Equal(t, "tool v1", string(data))
+
+	// Corrupted downloads are rejected, and no file is left behind.
+	proxy.corrupt.Store(true)
+	output = t.TempDir()
+	_, err = client.Download([]FileToDownload{{Remote: "tools/tool", Local: output}}, DownloadOptions{Context: cctx})
+	assert.ErrorIs(t, err, ErrIntegrity)
+	entries, err := os.ReadDir(output)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestDownloadVerifiesSigner(t *testing.T) {
+	client, _ := clientForTest(t)
+	cctx := &ccontext.Context{Logger: logger.Nil, Progress: progress.NewDiscard}
+	rng := rand.New(rand.NewSource(1))
+	trusted, signing, err := token.GenerateSigningKey(rng)
+	require.NoError(t, err)
+	untrusted, _, err := token.GenerateSigningKey(rng)
+	require.NoError(t, err)
+
+	local := filepath.Join(t.TempDir(), "tool")
+	require.NoError(t, os.WriteFile(local, []byte("signed tool"), 0644))
+	arts, err := client.Upload([]FileToUpload{{Local: local, Remote: "tools/signed"}}, UploadOptions{
+		Context:    cctx,
+		Signer:     signing,
+		Provenance: &apb.Provenance{Builder: "ci", GitSha: "0123abcd", InvocationId: "5f2c"},
+	})
+	require.NoError(t, err)
+	require.Len(t, arts, 1)
+	require.NotNil(t, arts[0].Signature)
+	_, err = client.Upload([]FileToUpload{{Local: local, Remote: "tools/unsigned"}}, UploadOptions{Context: cctx})
+	require.NoError(t, err)
+
+	options := DownloadOptions{Context: cctx, TrustedSigners: []*token.VerifyingKey{untrusted, trusted}}
+	arts, err = client.Download([]FileToDownload{{Remote: "tools/signed", Local: t.TempDir()}}, options)
+	require.NoError(t, err)
+	prov, err := provenance.Unmarshal(arts[0].Provenance)
+	require.NoError(t, err)
+	assert.Equal(t, "0123abcd", prov.GitSha)
+
+	output := t.TempDir()
+	_, err = client.Download([]FileToDownload{{Remote: "tools/unsigned", Local: output}}, options)
+	assert.ErrorIs(t, err, provenance.ErrUnsigned)
+	options.TrustedSigners = []*token.VerifyingKey{untrusted}
+	_, err = client.Download([]FileToDownload{{Remote: "tools/signed", Local: output}}, options)
+	assert.ErrorIs(t, err, provenance.ErrUntrustedSigner)
+	entries, err := os.ReadDir(output)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
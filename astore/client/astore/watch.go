@@ -0,0 +1,207 @@
+package astore
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"time"
+
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client"
+	"github.com/enfabrica/enkit/lib/logger"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultWatchRetry is how long to wait before watching again after an error.
+	DefaultWatchRetry = 5 * time.Second
+	// DefaultPollInterval is how often to List the artifacts when the server cannot stream events.
+	DefaultPollInterval = 30 * time.Second
+)
+
+// WatchHandler is invoked for each change to the artifacts watched.
+//
+// If it returns an error, Watch stops and returns the error.
+type WatchHandler func(*apb.WatchEvent) error
+
+type WatchOptions struct {
+	Logger logger.Logger
+
+	// Invoked every time the watch is established, including after a reconnection,
+	// or when polling starts. Events that happened while disconnected are lost,
+	// this is the time to resync the state with List, if necessary.
+	Connected func()
+
+	// How long to wait before watching again after an error, 0 means DefaultWatchRetry.
+	Retry time.Duration
+	// Used when the server or the protocol cannot stream events, for
+	// example with grpc-web. 0 means DefaultPollInterval.
+	//
+	// Polling only detects changes to the artifacts stored in the path
+	// requested, not in the paths below it.
+	PollInterval time.Duration
+}
+
+// Watch invokes the handler for each change to the artifacts matching req, until ctx is canceled.
+//
+// See the Watch RPC for the semantics of the request. Returns nil once ctx is canceled.
+func (c *Client) Watch(ctx context.Context, req *apb.ListRequest, o WatchOptions, handler WatchHandler) error {
+	if o.Logger == nil {
+		o.Logger = logger.Nil
+	}
+	if o.Retry <= 0 {
+		o.Retry = DefaultWatchRetry
+	}
+
+	for {
+		err := c.watchStream(ctx, req, o, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if status.Code(err) == codes.Unimplemented {
+			o.Logger.Infof("server cannot stream events, polling for changes instead - %s", err)
+			return c.watchPoll(ctx, req, o, handler)
+		}
+		var herr *handlerError
+		if errors.As(err, &herr) {
+			return herr.err
+		}
+		if code := status.Code(err); code == codes.Unauthenticated || code == codes.PermissionDenied || code == codes.InvalidArgument {
+			return client.NiceError(err, "watch failed - %s", err)
+		}
+
+		o.Logger.Warnf("watch interrupted, retrying in %s - events may be lost - %s", o.Retry, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(o.Retry):
+		}
+	}
+}
+
+// handlerError wraps the errors returned by a WatchHandler, which stop the watch.
+type handlerError struct {
+	err error
+}
+
+func (he *handlerError) Error() string {
+	return he.err.Error()
+}
+
+func (c *Client) watchStream(ctx context.Context, req *apb.ListRequest, o WatchOptions, handler WatchHandler) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.client.Watch(ctx, req)
+	if err != nil {
+		return err
+	}
+	// The server sends the headers once the watch is established.
+	if _, err := stream.Header(); err != nil {
+		return err
+	}
+	if o.Connected != nil {
+		o.Connected()
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return status.Errorf(codes.Unavailable, "server closed the stream")
+		}
+		if err != nil {
+			return err
+		}
+		if err := handler(event); err != nil {
+			return &handlerError{err: err}
+		}
+	}
+}
+
+// watchPoll emulates Watch by periodically listing the artifacts, and comparing them with the previous list.
+func (c *Client) watchPoll(ctx context.Context, req *apb.ListRequest, o WatchOptions, handler WatchHandler) error {
+	interval := o.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	tags := []string{"latest"}
+	if req.Tag != nil {
+		tags = req.Tag.Tag
+	}
+	// Artifacts are listed with any tag, so an artifact losing a tag is not confused with a deleted one.
+	list := &apb.ListRequest{Path: req.Path, Uid: req.Uid, Architecture: req.Architecture, Tag: &apb.TagSet{}}
+
+	var known map[string]*apb.Artifact
+	for {
+		resp, err := c.client.List(ctx, list)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			o.Logger.Warnf("listing %s failed, retrying in %s - %s", req.Path, interval, err)
+		} else {
+			current := map[string]*apb.Artifact{}
+			for _, art := range resp.Artifact {
+				current[art.Uid+"/"+art.Architecture] = art
+			}
+			if known == nil && o.Connected != nil {
+				o.Connected()
+			}
+			if known != nil {
+				for _, event := range diffArtifacts(req.Path, known, current) {
+					if !hasTags(event.Artifact, tags) {
+						continue
+					}
+					if err := handler(event); err != nil {
+						return err
+					}
+				}
+			}
+			known = current
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// diffArtifacts returns the events turning the before list of artifacts into the after list.
+func diffArtifacts(path string, before, after map[string]*apb.Artifact) []*apb.WatchEvent {
+	var events []*apb.WatchEvent
+	for key, art := range after {
+		old, found := before[key]
+		switch {
+		case !found:
+			events = append(events, &apb.WatchEvent{Type: apb.WatchEvent_COMMITTED, Path: path, Artifact: art})
+		case !slices.Equal(old.Tag, art.Tag):
+			events = append(events, &apb.WatchEvent{Type: apb.WatchEvent_TAGGED, Path: path, Artifact: art})
+		case old.Note != art.Note:
+			events = append(events, &apb.WatchEvent{Type: apb.WatchEvent_NOTED, Path: path, Artifact: art})
+		}
+	}
+	for key, art := range before {
+		if _, found := after[key]; !found {
+			events = append(events, &apb.WatchEvent{Type: apb.WatchEvent_DELETED, Path: path, Artifact: art})
+		}
+	}
+	slices.SortStableFunc(events, func(a, b *apb.WatchEvent) int {
+		return cmp.Compare(a.Artifact.Created, b.Artifact.Created)
+	})
+	return events
+}
+
+// hasTags returns true if the artifact has all the tags specified.
+func hasTags(art *apb.Artifact, tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(art.Tag, tag) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package astore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/client/ccontext"
+	"github.com/enfabrica/enkit/lib/logger"
+	"github.com/enfabrica/enkit/lib/progress"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	client, _ := clientForTest(t)
+	cctx := &ccontext.Context{Logger: logger.Nil, Progress: progress.NewDiscard}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	connected := make(chan struct{})
+	events := make(chan *apb.WatchEvent, 10)
+	done := make(chan error)
+	go func() {
+		done <- client.Watch(ctx, &apb.ListRequest{Path: "tools"}, WatchOptions{Connected: func() { close(connected) }}, func(event *apb.WatchEvent) error {
+			events <- event
+			return nil
+		})
+	}()
+	<-connected
+
+	local := filepath.Join(t.TempDir(), "tool")
+	require.NoError(t, os.WriteFile(local, []byte("tool"), 0644))
+	arts, err := client.Upload([]FileToUpload{{Local: local, Remote: "tools/tool"}}, UploadOptions{Context: cctx})
+	require.NoError(t, err)
+	_, err = client.Upload([]FileToUpload{{Local: local, Remote: "other/tool"}}, UploadOptions{Context: cctx})
+	require.NoError(t, err)
+	_, err = client.Note(arts[0].Uid, "watched")
+	require.NoError(t, err)
+
+	event := <-events
+	assert.Equal(t, apb.WatchEvent_COMMITTED, event.Type)
+	assert.Equal(t, "tools/tool", event.Path)
+	assert.Equal(t, arts[0].Uid, event.Artifact.Uid)
+	event = <-events
+	assert.Equal(t, apb.WatchEvent_NOTED, event.Type)
+	assert.Equal(t, "watched", event.Artifact.Note)
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Empty(t, events)
+}
+
+func TestWatchPoll(t *testing.T) {
+	client, _ := clientForTest(t)
+	cctx := &ccontext.Context{Logger: logger.Nil, Progress: progress.NewDiscard}
+
+	local := filepath.Join(t.TempDir(), "tool")
+	require.NoError(t, os.WriteFile(local, []byte("tool v1"), 0644))
+	first, err := client.Upload([]FileToUpload{{Local: local, Remote: "tools/tool"}}, UploadOptions{Context: cctx})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connected := make(chan struct{})
+	events := make(chan *apb.WatchEvent, 10)
+	go client.watchPoll(ctx, &apb.ListRequest{Path: "tools/tool"}, WatchOptions{PollInterval: 10 * time.Millisecond, Connected: func() { close(connected) }}, func(event *apb.WatchEvent) error {
+		events <- event
+		return nil
+	})
+	<-connected
+
+	// A new version moves the latest tag: the old version no longer matches,
+	// and is not reported as deleted.
+	require.NoError(t, os.WriteFile(local, []byte("tool v2"), 0644))
+	second, err := client.Upload([]FileToUpload{{Local: local, Remote: "tools/tool"}}, UploadOptions{Context: cctx})
+	require.NoError(t, err)
+	event := <-events
+	assert.Equal(t, apb.WatchEvent_COMMITTED, event.Type)
+	assert.Equal(t, second[0].Uid, event.Artifact.Uid)
+
+	_, err = client.client.Delete(ctx, &apb.DeleteRequest{Id: second[0].Uid})
+	require.NoError(t, err)
+	event = <-events
+	assert.Equal(t, apb.WatchEvent_DELETED, event.Type)
+	assert.Equal(t, second[0].Uid, event.Artifact.Uid)
+
+	_, err = client.Tag(first[0].Uid, TagAdd([]string{"latest"}))
+	require.NoError(t, err)
+	event = <-events
+	assert.Equal(t, apb.WatchEvent_TAGGED, event.Type)
+	assert.Equal(t, first[0].Uid, event.Artifact.Uid)
+}
@@ -0,0 +1,198 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/enfabrica/enkit/astore/client/astore"
+	arpc "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/kflags"
+	"github.com/spf13/cobra"
+)
+
+// printAcls shows the acls in a human readable format.
+func printAcls(acls []*arpc.Acl) {
+	for _, acl := range acls {
+		path := acl.Path
+		if path == "" {
+			path = "/"
+		}
+		fmt.Printf("%s (set by %s on %s)\n", path, acl.Creator, time.Unix(0, acl.Created).Format(time.RFC3339))
+		for _, perm := range astore.AclPermissions {
+			principals, _ := astore.AclPrincipals(acl, perm)
+			if len(*principals) > 0 {
+				fmt.Printf("  %-8s %s\n", perm+":", strings.Join(*principals, ", "))
+			}
+		}
+	}
+}
+
+type AclList struct {
+	*cobra.Command
+	root *Root
+
+	Inherited bool
+}
+
+func NewAclList(root *Root) *AclList {
+	command := &AclList{
+		Command: &cobra.Command{
+			Use:     "list [PATH]",
+			Short:   "Shows the acls of PATH and of the paths below it, or all acls",
+			Aliases: []string{"ls", "show"},
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().BoolVarP(&command.Inherited, "inherited", "i", false, "Show the acls applying to PATH instead, set on PATH or on its parents")
+	return command
+}
+
+func (uc *AclList) Run(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return kflags.NewUsageErrorf("use as 'astore acl list [PATH]' - with a single, optional, PATH argument (got %d arguments)", len(args))
+	}
+	path := ""
+	if len(args) == 1 {
+		path = args[0]
+	}
+
+	client, err := uc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+	acls, err := client.ListAcls(path, uc.Inherited)
+	if err != nil {
+		return err
+	}
+	printAcls(acls)
+	return nil
+}
+
+type AclCommand struct {
+	*cobra.Command
+	root *Root
+
+	name string
+	op   func(client *astore.Client, path string, perms, principals []string) (*arpc.Acl, error)
+}
+
+func NewAclCommand(root *Root, name, short string, op func(*astore.Client, string, []string, []string) (*arpc.Acl, error)) *AclCommand {
+	command := &AclCommand{
+		Command: &cobra.Command{
+			Use:   fmt.Sprintf("%s PATH PERMISSION[,PERMISSION]... PRINCIPAL...", name),
+			Short: short,
+			Long: fmt.Sprintf(`%s
+
+PERMISSION is one of %s, or all.
+
+PRINCIPAL is a user, as user@organization, a group, as group:name, or *
+for any authenticated user.`, short, strings.Join(astore.AclPermissions, ", ")),
+		},
+		root: root,
+		name: name,
+		op:   op,
+	}
+	command.Command.RunE = command.Run
+	return command
+}
+
+func (uc *AclCommand) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 3 {
+		return kflags.NewUsageErrorf("use as 'astore acl %s PATH PERMISSION[,PERMISSION]... PRINCIPAL...' - a path, followed by the permissions, and one or more principals", uc.name)
+	}
+
+	var perms []string
+	for _, perm := range strings.Split(args[1], ",") {
+		perm = strings.ToLower(strings.TrimSpace(perm))
+		if perm == "all" {
+			perms = append(perms, astore.AclPermissions...)
+			continue
+		}
+		perms = append(perms, perm)
+	}
+
+	client, err := uc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+	acl, err := uc.op(client, args[0], perms, args[2:])
+	if err != nil {
+		return err
+	}
+	printAcls([]*arpc.Acl{acl})
+	return nil
+}
+
+type AclClear struct {
+	*cobra.Command
+	root *Root
+}
+
+func NewAclClear(root *Root) *AclClear {
+	command := &AclClear{
+		Command: &cobra.Command{
+			Use:     "clear PATH...",
+			Short:   "Removes the acls of the specified paths, which inherit the acls of their parents",
+			Aliases: []string{"rm", "del"},
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	return command
+}
+
+func (uc *AclClear) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return kflags.NewUsageErrorf("use as 'astore acl clear PATH...' - one or more paths")
+	}
+
+	client, err := uc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+	for _, path := range args {
+		if err := client.SetAcl(&arpc.Acl{Path: path}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Acl struct {
+	*cobra.Command
+}
+
+func NewAcl(root *Root) *Acl {
+	command := &Acl{
+		Command: &cobra.Command{
+			Use:   "acl",
+			Short: "Manages who can read, write, tag, delete or publish the artifacts of a path",
+			Long: `Manages the access control lists of paths, restricting who can read,
+write, tag, delete or publish the artifacts stored in them.
+
+An acl applies to a path and to all the paths below it. For each
+permission, the closest acl granting the permission to anyone decides
+who has it. If no acl grants a permission, any authenticated user has
+it. Admins of the server have all permissions, and are the only ones
+allowed to change acls.`,
+			Example: `  $ astore acl grant tools write,tag,delete group:release ci@example.com
+    Only members of the release group and ci@example.com can change
+    the artifacts under tools/.
+
+  $ astore acl grant tools/internal read group:eng
+    Only members of the eng group can download the artifacts under
+    tools/internal/.
+
+  $ astore acl list -i tools/internal/hello
+    Shows the acls applying to tools/internal/hello.`,
+		},
+	}
+
+	command.Command.AddCommand(NewAclList(root).Command)
+	command.Command.AddCommand(NewAclCommand(root, "grant", "Grants the permissions on PATH to the principals", (*astore.Client).Grant).Command)
+	command.Command.AddCommand(NewAclCommand(root, "revoke", "Revokes the permissions on PATH from the principals", (*astore.Client).Revoke).Command)
+	command.Command.AddCommand(NewAclClear(root).Command)
+	return command
+}
@@ -0,0 +1,47 @@
+package commands
+
+import (
+	"strings"
+
+	arpc "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/spf13/pflag"
+)
+
+// SelectFlags select the artifacts a batch command applies to, by uid or by path, architecture and tags.
+type SelectFlags struct {
+	Uid    []string
+	Path   string
+	Arch   string
+	Tag    []string
+	DryRun bool
+}
+
+func (sf *SelectFlags) Register(flagset *pflag.FlagSet) {
+	flagset.StringArrayVarP(&sf.Uid, "uid", "u", nil, "Select the artifact with this uid. Can be repeated")
+	flagset.StringVarP(&sf.Path, "path", "p", "", "Select the artifacts stored in this path")
+	flagset.StringVarP(&sf.Arch, "arch", "a", "", "With --path, only select the artifacts of this architecture")
+	flagset.StringArrayVarP(&sf.Tag, "tag", "t", []string{"latest"}, "With --path, only select the artifacts having this tag. "+
+		"Can be repeated, the artifacts must have all the tags. Use an empty tag to select artifacts with any tag")
+	flagset.BoolVarP(&sf.DryRun, "dry-run", "n", false, "Only show the artifacts selected, without changing them")
+}
+
+// Selected returns true if any artifact was selected with the flags.
+func (sf *SelectFlags) Selected() bool {
+	return len(sf.Uid) > 0 || sf.Path != ""
+}
+
+// Selection returns the selection to send to the server.
+func (sf *SelectFlags) Selection() *arpc.Selection {
+	sel := &arpc.Selection{Uid: sf.Uid}
+	if sf.Path == "" {
+		return sel
+	}
+
+	sel.List = &arpc.ListRequest{Path: sf.Path, Architecture: sf.Arch, Tag: &arpc.TagSet{}}
+	for _, tag := range sf.Tag {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			sel.List.Tag.Tag = append(sel.List.Tag.Tag, tag)
+		}
+	}
+	return sel
+}
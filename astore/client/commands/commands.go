@@ -1,6 +1,9 @@
 package commands
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"runtime"
@@ -8,6 +11,7 @@ import (
 
 	"github.com/enfabrica/enkit/astore/client/astore"
 	castore "github.com/enfabrica/enkit/astore/client/astore"
+	"github.com/enfabrica/enkit/astore/provenance"
 	arpc "github.com/enfabrica/enkit/astore/rpc/astore"
 	"github.com/enfabrica/enkit/lib/client"
 	"github.com/enfabrica/enkit/lib/config"
@@ -15,6 +19,7 @@ import (
 	"github.com/enfabrica/enkit/lib/config/marshal"
 	"github.com/enfabrica/enkit/lib/kflags"
 	"github.com/enfabrica/enkit/lib/kflags/kcobra"
+	"github.com/enfabrica/enkit/lib/token"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -47,7 +52,13 @@ func New(base *client.BaseFlags) *Root {
 	root.AddCommand(NewGuess(root).Command)
 	root.AddCommand(NewTag(root).Command)
 	root.AddCommand(NewNote(root).Command)
+	root.AddCommand(NewDelete(root).Command)
 	root.AddCommand(NewPublic(root).Command)
+	root.AddCommand(NewGC(root).Command)
+	root.AddCommand(NewWatch(root).Command)
+	root.AddCommand(NewMirror(root).Command)
+	root.AddCommand(NewAcl(root).Command)
+	root.AddCommand(NewHistory(root).Command)
 	return root
 }
 
@@ -164,6 +175,11 @@ type Download struct {
 	Overwrite bool
 	Arch      string
 	Tag       []string
+	Digest    string
+	Version   string
+	Extract   []string
+
+	VerifySigner []string
 }
 
 func SystemArch() string {
@@ -173,7 +189,7 @@ func SystemArch() string {
 func NewDownload(root *Root) *Download {
 	command := &Download{
 		Command: &cobra.Command{
-			Use:     "download <path|uid>...",
+			Use:     "download [--digest sha256|--version constraint] [--extract file]... <path|uid>...",
 			Short:   "Downloads an artifact",
 			Aliases: []string{"down", "get", "pull", "fetch"},
 		},
@@ -187,16 +203,51 @@ func NewDownload(root *Root) *Download {
 	command.Flags().BoolVarP(&command.Overwrite, "overwrite", "w", false, "Overwrite files that already exist")
 	command.Flags().StringArrayVarP(&command.Tag, "tag", "t", []string{"latest"}, "Download artifacts matching the tag specified. More than one tag can be specified")
 	command.Flags().StringVarP(&command.Arch, "arch", "a", SystemArch(), "Architecture to download the file for")
+	command.Flags().StringVar(&command.Digest, "digest", "", "Download the artifact with this hex encoded sha256 digest. "+
+		"Tags are ignored. If a path is also specified, the artifact must be stored at that path")
+	command.Flags().StringVar(&command.Version, "version", "", "Download the artifact with the highest version satisfying this constraint, like '>=1.4,<2' or '~1.4'. "+
+		"Versions are tags like v1.4.2. Unless --tag is specified, artifacts with any tag are considered")
+	command.Flags().StringArrayVar(&command.VerifySigner, "verify-signer", nil, "Refuse artifacts not signed by this ed25519 public key. "+
+		"Either a file, in authorized_keys format, or a hex encoded key. Can be repeated to trust multiple keys")
+	command.Flags().StringArrayVarP(&command.Extract, "extract", "x", nil, "The artifact is a tar or zip archive, only extract the file with this name from it. "+
+		"Only the parts of the archive needed are downloaded. Can be repeated to extract multiple files")
 
 	return command
 }
 func (dc *Download) Run(cmd *cobra.Command, args []string) error {
+	var digest []byte
+	if dc.Digest != "" {
+		var err error
+		digest, err = hex.DecodeString(strings.TrimSpace(dc.Digest))
+		if err != nil || len(digest) != sha256.Size {
+			return kflags.NewUsageErrorf("invalid --digest %q - must be a hex encoded sha256, as printed by sha256sum", dc.Digest)
+		}
+		if len(args) == 0 {
+			args = []string{""}
+		}
+	}
 	if len(args) < 1 {
 		return kflags.NewUsageErrorf("use as 'astore download <path|uid>...' - one or more paths to download")
 	}
 	if dc.ForceUid && dc.ForcePath {
 		return kflags.NewUsageErrorf("cannot specify --force-uid together with --force-path - an argument can be either one, but not both")
 	}
+	if dc.Version != "" && (dc.Digest != "" || dc.ForceUid) {
+		return kflags.NewUsageErrorf("cannot specify --version together with --digest or --force-uid - a version selects among the artifacts of a path")
+	}
+	tags := &dc.Tag
+	if dc.Version != "" && !cmd.Flags().Changed("tag") {
+		tags = nil
+	}
+
+	var trusted []*token.VerifyingKey
+	for _, signer := range dc.VerifySigner {
+		key, err := provenance.ReadVerifyingKey(signer)
+		if err != nil {
+			return kflags.NewUsageErrorf("invalid --verify-signer - %s", err)
+		}
+		trusted = append(trusted, key)
+	}
 
 	mode := astore.IdAuto
 	if dc.ForceUid {
@@ -231,7 +282,10 @@ func (dc *Download) Run(cmd *cobra.Command, args []string) error {
 			Local:        output,
 			Overwrite:    dc.Overwrite,
 			Architecture: archs,
-			Tag:          &dc.Tag,
+			Tag:          tags,
+			SHA256:       digest,
+			Version:      dc.Version,
+			Extract:      dc.Extract,
 		}
 		ftd = append(ftd, file)
 	}
@@ -244,9 +298,10 @@ func (dc *Download) Run(cmd *cobra.Command, args []string) error {
 	}
 
 	arts, err := client.Download(ftd, astore.DownloadOptions{
-		Context: dc.root.BaseFlags.Context(),
+		Context:        dc.root.BaseFlags.Context(),
+		TrustedSigners: trusted,
 	})
-	if err != nil && os.IsExist(err) {
+	if err != nil && errors.Is(err, os.ErrExist) {
 		return fmt.Errorf("file already exists? To overwrite, pass the -w or --overwrite flag - %s", err)
 	}
 
@@ -261,8 +316,9 @@ type List struct {
 	*cobra.Command
 	root *Root
 
-	Tag []string
-	All bool
+	Tag     []string
+	All     bool
+	Version string
 }
 
 func NewList(root *Root) *List {
@@ -277,6 +333,8 @@ func NewList(root *Root) *List {
 	command.Command.RunE = command.Run
 	command.Flags().StringArrayVarP(&command.Tag, "tag", "t", []string{"latest"}, "Restrict the output to artifacts having this tag")
 	command.Flags().BoolVarP(&command.All, "all", "l", false, "Show all binaries")
+	command.Flags().StringVar(&command.Version, "version", "", "Only show artifacts with a version satisfying this constraint, like '>=1.4,<2' or '~1.4', highest first. "+
+		"Unless --tag is specified, artifacts with any tag are shown")
 
 	return command
 }
@@ -296,12 +354,14 @@ func (l *List) Run(cmd *cobra.Command, args []string) error {
 	}
 
 	tags := l.Tag
-	if l.All {
+	all := l.All || (l.Version != "" && !cmd.Flags().Changed("tag"))
+	if all {
 		tags = []string{}
 	}
 	options := astore.ListOptions{
 		Context: l.root.BaseFlags.Context(),
 		Tag:     tags,
+		Version: l.Version,
 	}
 
 	arts, els, err := client.List(query, options)
@@ -313,7 +373,7 @@ func (l *List) Run(cmd *cobra.Command, args []string) error {
 	for _, art := range arts {
 		formatter.Artifact(art)
 	}
-	if !l.All && len(arts) >= 1 {
+	if !all && len(arts) >= 1 {
 		l.root.Log.Warnf("(only showing artifacts with %d tags: %v - use --all or -l to show all)\n", len(l.Tag), l.Tag)
 	}
 
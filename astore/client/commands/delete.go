@@ -1,38 +1,59 @@
 package commands
 
 import (
+	"github.com/enfabrica/enkit/lib/kflags"
 	"github.com/spf13/cobra"
 )
 
-type DeleteCommand struct {
+type Delete struct {
 	*cobra.Command
 	root *Root
 
-	name string
-}
-
-func (uc *Delete) Run(cmd *cobra.Command, args []string) error {
-	//TODO
-	return nil
-}
-
-type Delete struct {
-	*cobra.Command
-	root        *Root
-	isDryRun    bool
-	skipConfirm bool
+	Select SelectFlags
 }
 
 func NewDelete(root *Root) *Delete {
 	command := &Delete{
 		Command: &cobra.Command{
-			Use:   "delete",
-			Short: "Deletes an artifact from astore",
+			Use:   "delete [UID]...",
+			Short: "Deletes artifacts from astore",
+			Long: `Deletes the artifacts with the UIDs specified, and the ones selected
+with --uid or --path, at once: either all of them are deleted, or none is.
+
+The blobs of the artifacts are deleted as well, once no other artifact
+references them. Use --dry-run first to check which artifacts are selected.`,
+			Example: `  $ astore delete -p experiments/builds -t "" -n
+    Shows all the artifacts in experiments/builds, with any tag, that would be deleted.
+
+  $ astore delete wusyhsim6h5nhukvu5sejtp7eg6eqdgp
+    Deletes the artifact with uid wusy...gp.`,
 		},
 		root: root,
 	}
-	command.Flags().BoolVarP(&command.isDryRun, "dry-run", "dr", false, "will attempt to delete the resource without doing so")
-	command.Flags().BoolVarP(&command.skipConfirm, "skip-confirm", "sc", false, "will not promp the terminal upon deletion of an sid")
 	command.Command.RunE = command.Run
+	command.Select.Register(command.Flags())
 	return command
 }
+
+func (dc *Delete) Run(cmd *cobra.Command, args []string) error {
+	dc.Select.Uid = append(dc.Select.Uid, args...)
+	if !dc.Select.Selected() {
+		return kflags.NewUsageErrorf("use as 'astore delete [UID]...' - with one or more UIDs, or artifacts selected with --uid or --path")
+	}
+
+	client, err := dc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+
+	arts, sids, err := client.BatchDelete(dc.Select.Selection(), dc.Select.DryRun)
+	if err != nil {
+		return err
+	}
+
+	dc.root.OutputArtifacts(arts)
+	if !dc.Select.DryRun {
+		dc.root.Log.Infof("deleted %d artifacts, %d blobs", len(arts), len(sids))
+	}
+	return nil
+}
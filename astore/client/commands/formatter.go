@@ -9,6 +9,7 @@ import (
 
 	"github.com/dustin/go-humanize"
 	castore "github.com/enfabrica/enkit/astore/client/astore"
+	"github.com/enfabrica/enkit/astore/provenance"
 	"github.com/enfabrica/enkit/astore/rpc/astore"
 	"github.com/enfabrica/enkit/lib/config/marshal"
 	"github.com/fatih/color"
@@ -79,6 +80,16 @@ func (ff *TableFormatter) Artifact(af *astore.Artifact) {
 		ff.nPrint("NOTES:")
 		ff.wPrint(" %s\n", af.Note)
 	}
+	if af.Signature != nil {
+		fmt.Print(prefix + "|            ")
+		ff.nPrint("SIGNED:")
+		ff.wPrint(" by %x\n", af.Signature.Key)
+	}
+	if prov, err := provenance.Unmarshal(af.Provenance); err == nil && prov != nil {
+		fmt.Print(prefix + "|            ")
+		ff.nPrint("BUILT:")
+		ff.wPrint(" by %q from %q, invocation %q\n", prov.Builder, prov.GitSha, prov.InvocationId)
+	}
 }
 
 func (ff *TableFormatter) Element(el *astore.Element) {
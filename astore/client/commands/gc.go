@@ -0,0 +1,72 @@
+package commands
+
+import (
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/kflags"
+	"github.com/spf13/cobra"
+)
+
+type GC struct {
+	*cobra.Command
+	root *Root
+
+	DryRun bool
+}
+
+func NewGC(root *Root) *GC {
+	command := &GC{
+		Command: &cobra.Command{
+			Use:   "gc [PATH]",
+			Short: "Deletes the artifacts no longer retained by the policies of the server",
+			Long: `Applies the retention policies configured on the server, deleting the
+artifacts they no longer retain, and the corresponding blobs.
+
+This is normally done periodically by the server itself. Requires
+admin privileges on the server.`,
+			Example: `  $ astore gc --dry-run
+    Shows which artifacts would be deleted, without deleting them.
+
+  $ astore gc experiments/builds
+    Deletes the artifacts under experiments/builds no longer retained.`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().BoolVarP(&command.DryRun, "dry-run", "n", false, "Only show the artifacts that would be deleted")
+	return command
+}
+
+func (gc *GC) Run(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return kflags.NewUsageErrorf("use as 'astore gc [PATH]' - with a single, optional, PATH argument (got %d arguments)", len(args))
+	}
+	path := ""
+	if len(args) == 1 {
+		path = args[0]
+	}
+
+	client, err := gc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.GC(path, gc.DryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "deleted"
+	if gc.DryRun {
+		verb = "would delete"
+	}
+	arts := []*astore.Artifact{}
+	for _, collected := range resp.Collected {
+		gc.root.Log.Infof("%s %s (uid %s) - %s", verb, collected.Path, collected.Artifact.Uid, collected.Reason)
+		arts = append(arts, collected.Artifact)
+	}
+	gc.root.OutputArtifacts(arts)
+	if !gc.DryRun {
+		gc.root.Log.Infof("deleted %d artifacts, %d blobs", len(resp.Collected), len(resp.Sid))
+	}
+	return nil
+}
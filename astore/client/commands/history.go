@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/enfabrica/enkit/astore/client/astore"
+	arpc "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/kflags"
+	"github.com/spf13/cobra"
+)
+
+type History struct {
+	*cobra.Command
+	root *Root
+
+	ForceUid  bool
+	ForcePath bool
+	Limit     int
+}
+
+func NewHistory(root *Root) *History {
+	command := &History{
+		Command: &cobra.Command{
+			Use:   "history [PATH|UID]",
+			Short: "Shows who changed artifacts, and when",
+			Long: `Shows the audit log of the server: the artifacts committed, tagged,
+noted, deleted, published or unpublished, by whom and when, most recent
+first.
+
+With an UID, only the changes to that artifact are shown. With a PATH,
+the changes to all the artifacts stored in PATH or below it. Only the
+changes to artifacts you can read are shown.`,
+			Example: `  $ astore history tools/deployer
+    Shows the changes to tools/deployer, and to all artifacts below it.
+
+  $ astore history -n 10
+    Shows the last 10 changes to any artifact.`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().BoolVarP(&command.ForceUid, "force-uid", "u", false, "The argument specified identifies an uid")
+	command.Flags().BoolVarP(&command.ForcePath, "force-path", "p", false, "The argument specified identifies a path")
+	command.Flags().IntVarP(&command.Limit, "limit", "n", 0, "Maximum number of changes to show, the server decides if 0")
+	return command
+}
+
+func (hc *History) Run(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return kflags.NewUsageErrorf("use as 'astore history [PATH|UID]' - with a single, optional, PATH or UID argument (got %d arguments)", len(args))
+	}
+	if hc.ForceUid && hc.ForcePath {
+		return kflags.NewUsageErrorf("cannot specify --force-uid together with --force-path - an argument can be either one, but not both")
+	}
+	if hc.Limit < 0 {
+		return kflags.NewUsageErrorf("invalid --limit %d - must be positive", hc.Limit)
+	}
+
+	var uid, path string
+	if len(args) == 1 {
+		id := astore.IdAuto
+		if hc.ForceUid {
+			id = astore.IdUid
+		}
+		if hc.ForcePath {
+			id = astore.IdPath
+		}
+		if astore.GetPathType(args[0], id) == astore.IdUid {
+			uid = args[0]
+		} else {
+			path = args[0]
+		}
+	}
+
+	client, err := hc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+	entries, err := client.History(uid, path, hc.Limit)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fmt.Println(formatAuditEntry(entry))
+	}
+	return nil
+}
+
+// formatAuditEntry returns a one line, human readable, description of the entry.
+func formatAuditEntry(entry *arpc.AuditEntry) string {
+	line := fmt.Sprintf("%s %s %s", time.Unix(0, entry.Time).Format(time.RFC3339), entry.User, entry.Operation)
+	switch entry.Operation {
+	case arpc.AuditEntry_PUBLISH, arpc.AuditEntry_UNPUBLISH:
+		line += fmt.Sprintf(" %s - path %q, uid %q", entry.Published, entry.Path, entry.Uid)
+	case arpc.AuditEntry_SET_ACL:
+		line += fmt.Sprintf(" %q", entry.Path)
+	default:
+		line += fmt.Sprintf(" %s - uid %s, arch %s", entry.Path, entry.Uid, entry.Architecture)
+		switch entry.Operation {
+		case arpc.AuditEntry_TAG:
+			line += fmt.Sprintf(", tags [%s] -> [%s]", strings.Join(entry.TagsBefore, " "), strings.Join(entry.TagsAfter, " "))
+		case arpc.AuditEntry_NOTE:
+			line += fmt.Sprintf(", note %q", entry.Note)
+		case arpc.AuditEntry_DELETE, arpc.AuditEntry_COLLECT:
+			line += fmt.Sprintf(", tags [%s]", strings.Join(entry.TagsBefore, " "))
+		default:
+			line += fmt.Sprintf(", tags [%s]", strings.Join(entry.TagsAfter, " "))
+		}
+	}
+	return line
+}
@@ -0,0 +1,122 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/enfabrica/enkit/astore/client/astore"
+	"github.com/enfabrica/enkit/lib/client"
+	"github.com/enfabrica/enkit/lib/kflags"
+	"github.com/enfabrica/enkit/lib/kflags/kcobra"
+	"github.com/spf13/cobra"
+)
+
+type Mirror struct {
+	*cobra.Command
+	root *Root
+	dest *client.ServerFlags
+
+	Arch     string
+	Tag      []string
+	DryRun   bool
+	Interval time.Duration
+}
+
+func NewMirror(root *Root) *Mirror {
+	command := &Mirror{
+		Command: &cobra.Command{
+			Use:   "mirror [PATH]",
+			Short: "Copies artifacts to another astore, preserving their metadata",
+			Long: `Copies the artifacts stored at or below PATH, or all artifacts if no
+PATH is specified, to the astore server specified with --to-server.
+
+Uids, tags, notes, creator, creation time, signatures and provenance
+of the artifacts are preserved. Artifacts already copied are not
+copied again, only their tags and note are updated, so the command
+can be run periodically to keep the destination up to date.
+Artifacts deleted from the source are not deleted from the destination.
+
+Requires admin privileges on the destination server.`,
+			Example: `  $ astore mirror --to-server astore.eu.example.com:6433 tools/
+    Copies all the artifacts under tools/, with any tag.
+
+  $ astore mirror --to-server astore.eu.example.com:6433 -t stable -a amd64-linux --every 10m
+    Copies the stable artifacts for amd64-linux every 10 minutes, until interrupted.`,
+		},
+		root: root,
+		dest: client.DefaultServerFlags("to", "Destination astore server", ""),
+	}
+	command.Command.RunE = command.Run
+	command.dest.Register(&kcobra.FlagSet{FlagSet: command.Flags()}, "")
+	command.Flags().StringVarP(&command.Arch, "arch", "a", "", "Only copy artifacts of this architecture")
+	command.Flags().StringArrayVarP(&command.Tag, "tag", "t", nil, "Only copy artifacts having this tag. "+
+		"Can be repeated, the artifacts must have all the tags. By default, artifacts with any tag are copied")
+	command.Flags().BoolVarP(&command.DryRun, "dry-run", "n", false, "Only show the artifacts that would be copied or updated")
+	command.Flags().DurationVar(&command.Interval, "every", 0, "Keep mirroring at this interval, until interrupted. 0 means mirror only once")
+	return command
+}
+
+func (mc *Mirror) Run(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return kflags.NewUsageErrorf("use as 'astore mirror [PATH]' - with a single, optional, PATH argument (got %d arguments)", len(args))
+	}
+	root := ""
+	if len(args) == 1 {
+		root = args[0]
+	}
+
+	source, err := mc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+	_, cookie, err := mc.root.IdentityCookie()
+	if err != nil {
+		return err
+	}
+	destconn, err := mc.dest.Connect(client.WithCookie(cookie))
+	if err != nil {
+		return err
+	}
+	dest := astore.New(destconn)
+
+	options := astore.MirrorOptions{
+		Context:      mc.root.BaseFlags.Context(),
+		Architecture: mc.Arch,
+		Tag:          mc.Tag,
+		DryRun:       mc.DryRun,
+	}
+	if mc.Interval <= 0 {
+		return mc.mirror(source, dest, root, options)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	for {
+		if err := mc.mirror(source, dest, root, options); err != nil {
+			mc.root.Log.Warnf("mirroring failed, retrying in %s - %s", mc.Interval, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(mc.Interval):
+		}
+	}
+}
+
+func (mc *Mirror) mirror(source, dest *astore.Client, root string, options astore.MirrorOptions) error {
+	stats, err := source.Mirror(dest, root, options)
+	if stats != nil {
+		verb := "copied"
+		if mc.DryRun {
+			verb = "would copy"
+		}
+		mc.root.Log.Infof("%s %d artifacts, updated %d, %d already up to date", verb, len(stats.Copied), len(stats.Updated), stats.Unchanged)
+		if changed := append(stats.Copied, stats.Updated...); len(changed) > 0 {
+			mc.root.OutputArtifacts(changed)
+		}
+	}
+	return err
+}
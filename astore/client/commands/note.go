@@ -1,6 +1,7 @@
 package commands
 
 import (
+	arpc "github.com/enfabrica/enkit/astore/rpc/astore"
 	"github.com/enfabrica/enkit/lib/kflags"
 	"github.com/spf13/cobra"
 	"strings"
@@ -9,41 +10,59 @@ import (
 type NoteCommand struct {
 	*cobra.Command
 	root *Root
+
+	Select SelectFlags
 }
 
 func NewNote(root *Root) *NoteCommand {
 	command := &NoteCommand{
 		Command: &cobra.Command{
-			Use:     "annotate",
+			Use:     "annotate [UID] message",
 			Short:   "Adds a human readable note to an artifact",
 			Aliases: []string{"note", "darn", "warn"},
+			Long: `Sets the note of the artifact UID or, with --uid or --path, of all the
+artifacts selected at once: either all of them are changed, or none is.`,
 			Example: `  $ astore annotate wusyhsim6h5nhukvu5sejtp7eg6eqdgp ""
     Removes the note associated with artifact uid wusy...gp
 
 $ astore annotate wusyhsim6h5nhukvu5sejtp7eg6eqdgp "Do not use this binary, it is broken"
     Adds the specified note to the binary
+
+$ astore annotate -p tools/deployer -t release-1.4 "Broken, use release-1.5"
+    Adds the note to the artifacts of every architecture tagged release-1.4
 `,
 		},
 		root: root,
 	}
 	command.Command.RunE = command.Run
+	command.Select.Register(command.Flags())
 	return command
 }
 
 func (uc *NoteCommand) Run(cmd *cobra.Command, args []string) error {
-	if len(args) < 2 {
-		return kflags.NewUsageErrorf("use as 'astore annotate UID message' - the UID of exactly one artifact, followed by the message to associate")
+	if !uc.Select.Selected() {
+		if len(args) < 2 {
+			return kflags.NewUsageErrorf("use as 'astore annotate UID message' - the UID of exactly one artifact, followed by the message to associate")
+		}
+		uc.Select.Uid, args = args[:1], args[1:]
+	}
+	if len(args) < 1 {
+		return kflags.NewUsageErrorf("use as 'astore annotate --path PATH message' - the artifacts selected with flags, followed by the message to associate")
 	}
 
-	uid := args[0]
-	note := strings.Join(args[1:], " ")
+	note := strings.Join(args, " ")
 
 	client, err := uc.root.StoreClient()
 	if err != nil {
 		return err
 	}
 
-	arts, err := client.Note(uid, note)
+	var arts []*arpc.Artifact
+	if len(uc.Select.Uid) == 1 && uc.Select.Path == "" && !uc.Select.DryRun {
+		arts, err = client.Note(uc.Select.Uid[0], note)
+	} else {
+		arts, err = client.BatchNote(uc.Select.Selection(), note, uc.Select.DryRun)
+	}
 	if err != nil {
 		return err
 	}
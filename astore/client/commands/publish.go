@@ -18,6 +18,7 @@ type PublicAdd struct {
 	Arch          string
 	Tag           []string
 	All           bool
+	Version       string
 }
 
 func NewPublicAdd(root *Root) *PublicAdd {
@@ -36,6 +37,8 @@ func NewPublicAdd(root *Root) *PublicAdd {
 
 	command.Flags().StringArrayVarP(&command.Tag, "tag", "t", []string{"latest"}, "Restrict the output to artifacts having this tag")
 	command.Flags().BoolVarP(&command.All, "all", "l", false, "Show all binaries")
+	command.Flags().StringVar(&command.Version, "version", "", "Return at this URL the artifact with the highest version satisfying this constraint, like '~1.4'. "+
+		"The URL follows new versions as they are uploaded. Unless --tag is specified, artifacts with any tag are considered")
 
 	return command
 }
@@ -51,9 +54,11 @@ func (uc *PublicAdd) Run(cmd *cobra.Command, args []string) error {
 		destination = args[1]
 	}
 
-	tags := uc.Tag
+	tags := &uc.Tag
 	if uc.All {
-		tags = []string{}
+		tags = &[]string{}
+	} else if uc.Version != "" && !cmd.Flags().Changed("tag") {
+		tags = nil
 	}
 
 	toPublish := astore.ToPublish{
@@ -61,7 +66,8 @@ func (uc *PublicAdd) Run(cmd *cobra.Command, args []string) error {
 		Path:          artifact,
 		Architecture:  uc.Arch,
 		NonExistentOK: uc.NonExistentOK,
-		Tag:           &tags,
+		Tag:           tags,
+		Version:       uc.Version,
 	}
 
 	client, err := uc.root.StoreClient()
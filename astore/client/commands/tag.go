@@ -3,6 +3,7 @@ package commands
 import (
 	"fmt"
 	"github.com/enfabrica/enkit/astore/client/astore"
+	arpc "github.com/enfabrica/enkit/astore/rpc/astore"
 	"github.com/enfabrica/enkit/lib/kflags"
 	"github.com/spf13/cobra"
 	"strings"
@@ -12,38 +13,55 @@ type TagCommand struct {
 	*cobra.Command
 	root *Root
 
-	name string
-	op   func([]string) astore.TagModifier
+	name   string
+	op     func([]string) astore.TagModifier
+	Select SelectFlags
 }
 
 func NewTagCommand(root *Root, name string, op func([]string) astore.TagModifier) *TagCommand {
 	command := &TagCommand{
 		Command: &cobra.Command{
-			Use:   fmt.Sprintf("%s UID tag [tag]...", name),
+			Use:   fmt.Sprintf("%s [UID] tag [tag]...", name),
 			Short: fmt.Sprintf("%ss the specified tags", strings.Title(name)),
+			Long: `Changes the tags of the artifact UID or, with --uid or --path, of all
+the artifacts selected at once: either all of them are changed, or none is.`,
+			Example: fmt.Sprintf(`  $ astore tag %s wusyhsim6h5nhukvu5sejtp7eg6eqdgp stable
+    Changes the tags of the artifact with uid wusy...gp.
+
+  $ astore tag %s -p tools/deployer -t release-1.4 -n stable
+    Shows the artifacts of every architecture tagged release-1.4 the command would change.`, name, name),
 		},
 		root: root,
 		name: name,
 		op:   op,
 	}
 	command.Command.RunE = command.Run
+	command.Select.Register(command.Flags())
 	return command
 }
 
 func (uc *TagCommand) Run(cmd *cobra.Command, args []string) error {
-	if len(args) < 2 {
-		return kflags.NewUsageErrorf("use as 'astore tag %s UID tag [tag]...' - the UID of exactly one artifact, followed by one or more tags", uc.name)
+	if !uc.Select.Selected() {
+		if len(args) < 2 {
+			return kflags.NewUsageErrorf("use as 'astore tag %s UID tag [tag]...' - the UID of exactly one artifact, followed by one or more tags", uc.name)
+		}
+		uc.Select.Uid, args = args[:1], args[1:]
+	}
+	if len(args) < 1 {
+		return kflags.NewUsageErrorf("use as 'astore tag %s --path PATH tag [tag]...' - the artifacts selected with flags, followed by one or more tags", uc.name)
 	}
-
-	uid := args[0]
-	tags := args[1:]
 
 	client, err := uc.root.StoreClient()
 	if err != nil {
 		return err
 	}
 
-	arts, err := client.Tag(uid, uc.op(tags))
+	var arts []*arpc.Artifact
+	if len(uc.Select.Uid) == 1 && uc.Select.Path == "" && !uc.Select.DryRun {
+		arts, err = client.Tag(uc.Select.Uid[0], uc.op(args))
+	} else {
+		arts, err = client.BatchTag(uc.Select.Selection(), uc.Select.DryRun, uc.op(args))
+	}
 	if err != nil {
 		return err
 	}
@@ -2,6 +2,8 @@ package commands
 
 import (
 	"github.com/enfabrica/enkit/astore/client/astore"
+	"github.com/enfabrica/enkit/astore/provenance"
+	arpc "github.com/enfabrica/enkit/astore/rpc/astore"
 	"github.com/enfabrica/enkit/lib/kflags"
 	"github.com/spf13/cobra"
 )
@@ -14,6 +16,14 @@ type Upload struct {
 	Arch    string
 	Note    string
 	Tag     []string
+
+	ChunkMB  int
+	Parallel int
+
+	SignKey      string
+	Builder      string
+	GitSha       string
+	InvocationId string
 }
 
 func NewUpload(root *Root) *Upload {
@@ -93,6 +103,12 @@ c) If no architecture is guessed or specified, it is assumed that the
   $ astore upload -n "This is only a test, do not use in production" /etc/hosts@configs/
 	Similar to previous commands, but annotate the binary with a note
 	that will be displayed at every list and download.
+  $ astore upload --chunk-mb 16 --parallel 8 ./large-image.tar
+	Upload a large file in parts of 16MB, 8 at a time. If the upload is
+	interrupted, running the same command again resumes it.
+  $ astore upload --sign-key ~/.ssh/id_ed25519 --git-sha $(git rev-parse HEAD) ./tool
+	Sign the artifact with an ed25519 key, recording the commit it was built
+	from. Use 'astore download --verify-signer' to only accept signed artifacts.
   $ astore upload -t kernel:2.6.0 -t debug-binary /etc/hosts@configs/
 	Similar to previous commands, but assign tags to the binary, available
 	for querying.
@@ -107,6 +123,12 @@ c) If no architecture is guessed or specified, it is assumed that the
 	command.Flags().StringVarP(&command.Arch, "arch", "a", "", "Architecture of the file, avoid automated detection")
 	command.Flags().StringVarP(&command.Note, "note", "n", "", "Note to add to the upload")
 	command.Flags().StringArrayVarP(&command.Tag, "tag", "t", nil, "Tags to assign to the binary being uploaded")
+	command.Flags().IntVar(&command.ChunkMB, "chunk-mb", astore.DefaultChunkSize>>20, "Files larger than this many MB are uploaded in parts of this size, and can be resumed if interrupted. 0 to disable")
+	command.Flags().IntVar(&command.Parallel, "parallel", astore.DefaultParallelism, "Number of parts to upload at the same time")
+	command.Flags().StringVar(&command.SignKey, "sign-key", "", "Sign the artifacts with this ed25519 private key file, in OpenSSH format or hex encoded")
+	command.Flags().StringVar(&command.Builder, "builder", "", "Provenance: who or what built the artifacts, a user or a CI job")
+	command.Flags().StringVar(&command.GitSha, "git-sha", "", "Provenance: git commit the artifacts were built from")
+	command.Flags().StringVar(&command.InvocationId, "invocation-id", "", "Provenance: bazel invocation id of the build of the artifacts")
 
 	return command
 }
@@ -122,7 +144,21 @@ func (uc *Upload) Run(cmd *cobra.Command, args []string) error {
 	}
 
 	options := astore.UploadOptions{
-		Context: uc.root.BaseFlags.Context(),
+		Context:     uc.root.BaseFlags.Context(),
+		ChunkSize:   int64(uc.ChunkMB) << 20,
+		Parallelism: uc.Parallel,
+	}
+	if uc.ChunkMB <= 0 {
+		options.ChunkSize = -1
+	}
+	if uc.SignKey != "" {
+		options.Signer, err = provenance.ReadSigningKey(uc.SignKey)
+		if err != nil {
+			return kflags.NewUsageErrorf("invalid --sign-key - %s", err)
+		}
+	}
+	if uc.Builder != "" || uc.GitSha != "" || uc.InvocationId != "" {
+		options.Provenance = &arpc.Provenance{Builder: uc.Builder, GitSha: uc.GitSha, InvocationId: uc.InvocationId}
 	}
 
 	files := []astore.FileToUpload{}
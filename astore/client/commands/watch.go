@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/enfabrica/enkit/astore/client/astore"
+	arpc "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/kflags"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+type Watch struct {
+	*cobra.Command
+	root *Root
+
+	Arch         string
+	Tag          []string
+	Exec         string
+	StopOnError  bool
+	PollInterval time.Duration
+}
+
+func NewWatch(root *Root) *Watch {
+	command := &Watch{
+		Command: &cobra.Command{
+			Use:   "watch [PATH]",
+			Short: "Reports changes to artifacts as they happen, optionally running a hook",
+			Long: `Reports artifacts committed, tagged, noted or deleted under PATH, or
+anywhere if no PATH is specified, until interrupted.
+
+With --exec, the hook is run with 'sh -c' for each change, with the
+change described in the environment:
+
+  ASTORE_EVENT    - one of COMMITTED, TAGGED, NOTED or DELETED.
+  ASTORE_PATH     - path of the artifact.
+  ASTORE_UID      - uid of the artifact.
+  ASTORE_SID      - sid of the artifact.
+  ASTORE_ARCH     - architecture of the artifact.
+  ASTORE_TAGS     - space separated tags of the artifact.
+  ASTORE_SHA256   - hex encoded sha256 of the artifact.
+  ASTORE_CREATOR  - who committed the artifact.
+  ASTORE_NOTE     - note of the artifact.
+
+and the whole event, in JSON format, on its standard input.
+
+If the connection to the server is interrupted, changes that happened
+while disconnected are not reported. With servers that cannot stream
+changes, like when using grpc-web, the artifacts are listed every
+--poll-interval instead, and only changes in PATH itself are reported.`,
+			Example: `  $ astore watch -t stable tools/deployer --exec 'astore download -w -o /opt/deployer -u $ASTORE_UID'
+    Downloads every new version of tools/deployer tagged stable.
+
+  $ astore watch -a amd64-linux -t "" builds/
+    Shows all changes to artifacts under builds/, with any tag, for amd64-linux.`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().StringVarP(&command.Arch, "arch", "a", "", "Only report changes to artifacts of this architecture")
+	command.Flags().StringArrayVarP(&command.Tag, "tag", "t", []string{"latest"}, "Only report changes to artifacts having this tag. "+
+		"Can be repeated, the artifacts must have all the tags. Use an empty tag to report changes to artifacts with any tag")
+	command.Flags().StringVarP(&command.Exec, "exec", "x", "", "Hook to run for each change, with 'sh -c'")
+	command.Flags().BoolVar(&command.StopOnError, "stop-on-error", false, "Stop watching if the hook fails, rather than logging the error")
+	command.Flags().DurationVar(&command.PollInterval, "poll-interval", astore.DefaultPollInterval, "How often to list artifacts, with servers that cannot stream changes")
+	return command
+}
+
+func (wc *Watch) Run(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return kflags.NewUsageErrorf("use as 'astore watch [PATH]' - with a single, optional, PATH argument (got %d arguments)", len(args))
+	}
+	req := &arpc.ListRequest{Architecture: wc.Arch, Tag: &arpc.TagSet{}}
+	if len(args) == 1 {
+		req.Path = args[0]
+	}
+	for _, tag := range wc.Tag {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			req.Tag.Tag = append(req.Tag.Tag, tag)
+		}
+	}
+
+	client, err := wc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	options := astore.WatchOptions{
+		Logger:       wc.root.Log,
+		PollInterval: wc.PollInterval,
+		Connected: func() {
+			wc.root.Log.Infof("watching %q for changes", req.Path)
+		},
+	}
+	return client.Watch(ctx, req, options, wc.handle)
+}
+
+func (wc *Watch) handle(event *arpc.WatchEvent) error {
+	art := event.Artifact
+	wc.root.Log.Infof("%s %s - uid %s, arch %s, tags %v", event.Type, event.Path, art.Uid, art.Architecture, art.Tag)
+	if wc.Exec == "" {
+		return nil
+	}
+
+	data, err := protojson.Marshal(event)
+	if err != nil {
+		return err
+	}
+	hook := exec.Command("sh", "-c", wc.Exec)
+	hook.Stdin = bytes.NewReader(data)
+	hook.Stdout = os.Stdout
+	hook.Stderr = os.Stderr
+	hook.Env = append(os.Environ(),
+		"ASTORE_EVENT="+event.Type.String(),
+		"ASTORE_PATH="+event.Path,
+		"ASTORE_UID="+art.Uid,
+		"ASTORE_SID="+art.Sid,
+		"ASTORE_ARCH="+art.Architecture,
+		"ASTORE_TAGS="+strings.Join(art.Tag, " "),
+		"ASTORE_SHA256="+hex.EncodeToString(art.Sha256),
+		"ASTORE_CREATOR="+art.Creator,
+		"ASTORE_NOTE="+art.Note,
+	)
+	if err := hook.Run(); err != nil {
+		if wc.StopOnError {
+			return fmt.Errorf("hook failed for %s of %s - %w", event.Type, art.Uid, err)
+		}
+		wc.root.Log.Warnf("hook failed for %s of %s - %s", event.Type, art.Uid, err)
+	}
+	return nil
+}
@@ -127,8 +127,6 @@ func TestSimple(t *testing.T) {
 	for _, r := range res {
 		_, fuid := uids[r.Uid]
 		assert.False(t, fuid, "uid already seen?? %s", r.Uid)
-		_, fsid := sids[r.Sid]
-		assert.False(t, fsid, "sid already seen?? %s", r.Sid)
 
 		sids[r.Sid] = struct{}{}
 		uids[r.Uid] = struct{}{}
@@ -138,6 +136,8 @@ func TestSimple(t *testing.T) {
 		assert.Equal(t, 16, len(r.MD5))
 		assert.Equal(t, "all", r.Architecture)
 	}
+	// Same content, the server deduplicates the uploads.
+	assert.Equal(t, 1, len(sids), "%v", sids)
 
 	// No tag specified, returns all the elements.
 	allarts, els, err := ac.List(name, astore.ListOptions{
@@ -181,7 +181,7 @@ func TestSimple(t *testing.T) {
 	assert.Equal(t, 1, len(arts), "%#v", arts)
 	latest := arts[0]
 
-	assert.NotEqual(t, simple.Sid, latest.Sid)
+	assert.Equal(t, simple.Sid, latest.Sid)
 	assert.NotEqual(t, simple.Uid, latest.Uid)
 
 	// Download one of the files.
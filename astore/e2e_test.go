@@ -56,5 +56,5 @@ func TestServer(t *testing.T) {
 	})
 	assert.Nil(t, err)
 
-	fmt.Println("finalizing +%v", resp.Artifact)
+	fmt.Printf("finalizing %+v\n", resp.Artifact)
 }
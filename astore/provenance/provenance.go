@@ -0,0 +1,184 @@
+// Package provenance signs astore artifacts, and verifies their signatures.
+//
+// A signature covers the SHA-256 of the content of an artifact together with
+// its Provenance, a description of who built it and from which commit.
+// Signatures use ed25519 keys, as generated by token.GenerateSigningKey,
+// kcerts.GenerateED25519, or 'ssh-keygen -t ed25519'.
+package provenance
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/kcerts"
+	"github.com/enfabrica/enkit/lib/token"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrUnsigned         = errors.New("artifact is not signed")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrUntrustedSigner  = errors.New("artifact signed by an untrusted key")
+)
+
+// payloadPrefix prevents an astore signature from being valid for other uses of the same key.
+const payloadPrefix = "enkit astore artifact v1\x00"
+
+// Payload returns the message signed for an artifact with the specified SHA-256 and serialized Provenance.
+func Payload(digest, provenance []byte) []byte {
+	hashed := sha256.Sum256(provenance)
+
+	payload := make([]byte, 0, len(payloadPrefix)+len(digest)+len(hashed))
+	payload = append(payload, payloadPrefix...)
+	payload = append(payload, digest...)
+	return append(payload, hashed[:]...)
+}
+
+// Marshal serializes a Provenance for a CommitRequest. A nil provenance returns nil.
+func Marshal(p *apb.Provenance) ([]byte, error) {
+	if p == nil {
+		return nil, nil
+	}
+	return proto.Marshal(p)
+}
+
+// Unmarshal parses the provenance of an artifact. Returns nil if the artifact has no provenance.
+func Unmarshal(data []byte) (*apb.Provenance, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	p := &apb.Provenance{}
+	if err := proto.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("invalid provenance - %w", err)
+	}
+	return p, nil
+}
+
+// Sign signs the artifact with the SHA-256 and serialized provenance specified.
+func Sign(key *token.SigningKey, digest, provenance []byte) *apb.Signature {
+	return &apb.Signature{
+		Key:       key.VerifyingKey()[:],
+		Signature: key.Sign(Payload(digest, provenance)),
+	}
+}
+
+// Verify checks that signature is a valid signature of an artifact with the SHA-256 and provenance specified.
+//
+// Only the validity of the signature is checked, not who signed it.
+func Verify(signature *apb.Signature, digest, provenance []byte) error {
+	if signature == nil {
+		return ErrUnsigned
+	}
+	if len(digest) != sha256.Size {
+		return fmt.Errorf("%w - no sha256 to verify", ErrInvalidSignature)
+	}
+	key, err := token.VerifyingKeyFromSlice(signature.Key)
+	if err != nil {
+		return fmt.Errorf("%w - %s", ErrInvalidSignature, err)
+	}
+	if !key.Verify(Payload(digest, provenance), signature.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifyArtifact checks that the artifact has a valid signature from one of the trusted keys.
+func VerifyArtifact(art *apb.Artifact, trusted []*token.VerifyingKey) error {
+	if err := Verify(art.Signature, art.Sha256, art.Provenance); err != nil {
+		return fmt.Errorf("artifact %s - %w", art.Uid, err)
+	}
+	for _, key := range trusted {
+		if bytes.Equal(key[:], art.Signature.Key) {
+			return nil
+		}
+	}
+	return fmt.Errorf("artifact %s - %w %x", art.Uid, ErrUntrustedSigner, art.Signature.Key)
+}
+
+// SigningKeyFromPrivateKey returns the SigningKey corresponding to an ed25519 kcerts.PrivateKey.
+func SigningKeyFromPrivateKey(key kcerts.PrivateKey) (*token.SigningKey, error) {
+	switch raw := key.Raw().(type) {
+	case *ed25519.PrivateKey:
+		return token.SigningKeyFromSlice(*raw)
+	case ed25519.PrivateKey:
+		return token.SigningKeyFromSlice(raw)
+	}
+	return nil, fmt.Errorf("unsupported key type %T - only ed25519 keys can sign artifacts", key.Raw())
+}
+
+// ParseSigningKey parses a private key, either in OpenSSH format, or hex encoded.
+func ParseSigningKey(data []byte) (*token.SigningKey, error) {
+	if raw, err := ssh.ParseRawPrivateKey(data); err == nil {
+		switch key := raw.(type) {
+		case *ed25519.PrivateKey:
+			return SigningKeyFromPrivateKey(kcerts.FromEC25519(*key))
+		case ed25519.PrivateKey:
+			return SigningKeyFromPrivateKey(kcerts.FromEC25519(key))
+		}
+		return nil, fmt.Errorf("unsupported key type %T - only ed25519 keys can sign artifacts", raw)
+	}
+
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key is neither in OpenSSH format nor hex encoded")
+	}
+	return token.SigningKeyFromSlice(decoded)
+}
+
+// ParseVerifyingKey parses a public key, either in authorized_keys format (ssh-ed25519 AAAA...), or hex encoded.
+func ParseVerifyingKey(data []byte) (*token.VerifyingKey, error) {
+	if parsed, _, _, _, err := ssh.ParseAuthorizedKey(data); err == nil {
+		crypto, ok := parsed.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %s", parsed.Type())
+		}
+		key, ok := crypto.CryptoPublicKey().(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %s - only ed25519 keys can sign artifacts", parsed.Type())
+		}
+		return token.VerifyingKeyFromSlice(key)
+	}
+
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key is neither in authorized_keys format nor hex encoded")
+	}
+	return token.VerifyingKeyFromSlice(decoded)
+}
+
+// ReadSigningKey reads a private key from a file, see ParseSigningKey.
+func ReadSigningKey(path string) (*token.SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseSigningKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// ReadVerifyingKey returns the public key in value, or in the file named value if it exists.
+func ReadVerifyingKey(value string) (*token.VerifyingKey, error) {
+	data, err := os.ReadFile(value)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		data = []byte(value)
+	}
+	key, err := ParseVerifyingKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", value, err)
+	}
+	return key, nil
+}
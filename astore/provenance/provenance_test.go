@@ -0,0 +1,88 @@
+package provenance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apb "github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/kcerts"
+	"github.com/enfabrica/enkit/lib/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSignVerify(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	verifying, signing, err := token.GenerateSigningKey(rng)
+	require.NoError(t, err)
+	untrusted, _, err := token.GenerateSigningKey(rng)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256([]byte("content"))
+	prov, err := Marshal(&apb.Provenance{Builder: "ci@enkit.test", GitSha: "0123abcd", InvocationId: "5f2c"})
+	require.NoError(t, err)
+
+	art := &apb.Artifact{Uid: "uid", Sha256: digest[:], Provenance: prov, Signature: Sign(signing, digest[:], prov)}
+	assert.NoError(t, Verify(art.Signature, art.Sha256, art.Provenance))
+	assert.NoError(t, VerifyArtifact(art, []*token.VerifyingKey{untrusted, verifying}))
+	assert.ErrorIs(t, VerifyArtifact(art, []*token.VerifyingKey{untrusted}), ErrUntrustedSigner)
+	assert.ErrorIs(t, VerifyArtifact(art, nil), ErrUntrustedSigner)
+
+	parsed, err := Unmarshal(art.Provenance)
+	require.NoError(t, err)
+	assert.Equal(t, "0123abcd", parsed.GitSha)
+
+	// Changing either the content or the provenance invalidates the signature.
+	other := sha256.Sum256([]byte("other content"))
+	assert.ErrorIs(t, Verify(art.Signature, other[:], art.Provenance), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify(art.Signature, art.Sha256, nil), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify(art.Signature, nil, art.Provenance), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify(&apb.Signature{Key: []byte("short"), Signature: art.Signature.Signature}, art.Sha256, art.Provenance), ErrInvalidSignature)
+
+	unsigned := &apb.Artifact{Uid: "uid", Sha256: digest[:]}
+	assert.ErrorIs(t, VerifyArtifact(unsigned, []*token.VerifyingKey{verifying}), ErrUnsigned)
+}
+
+func TestParseKeys(t *testing.T) {
+	sshPub, private, err := kcerts.GenerateED25519()
+	require.NoError(t, err)
+	pem, err := private.SSHPemEncode()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	privatePath := filepath.Join(dir, "id_ed25519")
+	publicPath := filepath.Join(dir, "id_ed25519.pub")
+	require.NoError(t, os.WriteFile(privatePath, pem, 0600))
+	require.NoError(t, os.WriteFile(publicPath, ssh.MarshalAuthorizedKey(sshPub), 0644))
+
+	signing, err := ReadSigningKey(privatePath)
+	require.NoError(t, err)
+	verifying, err := ReadVerifyingKey(publicPath)
+	require.NoError(t, err)
+	assert.Equal(t, verifying, signing.VerifyingKey())
+
+	// Keys can also be hex encoded, and public keys passed directly.
+	fromHex, err := ParseSigningKey([]byte(hex.EncodeToString(signing[:]) + "\n"))
+	require.NoError(t, err)
+	assert.Equal(t, signing, fromHex)
+	direct, err := ReadVerifyingKey(hex.EncodeToString(verifying[:]))
+	require.NoError(t, err)
+	assert.Equal(t, verifying, direct)
+
+	_, err = ReadVerifyingKey("not a key")
+	assert.Error(t, err)
+	_, err = ParseSigningKey([]byte("0123"))
+	assert.Error(t, err)
+
+	rsaPub, rsaPrivate, err := kcerts.GenerateRSA()
+	require.NoError(t, err)
+	_, err = SigningKeyFromPrivateKey(rsaPrivate)
+	assert.Error(t, err)
+	_, err = ParseVerifyingKey(ssh.MarshalAuthorizedKey(rsaPub))
+	assert.Error(t, err)
+}
@@ -0,0 +1,217 @@
+package astore
+
+import (
+	"context"
+	"strings"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/oauth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Permission is an operation on the artifacts of a path that can be restricted by an Acl.
+type Permission string
+
+const (
+	PermissionRead    Permission = "read"
+	PermissionWrite   Permission = "write"
+	PermissionTag     Permission = "tag"
+	PermissionDelete  Permission = "delete"
+	PermissionPublish Permission = "publish"
+)
+
+// Principals matching any authenticated user, and prefixing the name of groups.
+const (
+	PrincipalAnyone = "*"
+	PrincipalGroup  = "group:"
+)
+
+// cleanPrincipals returns a copy of the list with each principal appearing once, and no empty principal.
+func cleanPrincipals(principals []string) []string {
+	result := []string{}
+	for _, principal := range cleanUnique(principals) {
+		if principal != "" {
+			result = append(result, principal)
+		}
+	}
+	return result
+}
+
+// accessChecker decides which operations a caller can perform.
+//
+// A nil accessChecker allows everything: it is used for requests that are
+// authorized by other means, like download tokens. A nil identity is an
+// unauthenticated caller, only allowed on paths not restricted by any acl.
+type accessChecker struct {
+	identity *oauth.Identity
+	admin    bool
+	acls     []*Acl
+}
+
+// isAdmin returns true if the user is one of the admins configured with WithAdmins.
+func (s *Server) isAdmin(identity *oauth.Identity) bool {
+	name := identity.GlobalName()
+	for _, admin := range s.options.admins {
+		if admin == name {
+			return true
+		}
+	}
+	return false
+}
+
+// accessFor returns an accessChecker for the caller of an RPC.
+func (s *Server) accessFor(ctx context.Context) (*accessChecker, error) {
+	var identity *oauth.Identity
+	if creds := oauth.GetCredentials(ctx); creds != nil {
+		identity = &creds.Identity
+	}
+	return s.accessAs(identity)
+}
+
+// accessAs returns an accessChecker for the user identity.
+func (s *Server) accessAs(identity *oauth.Identity) (*accessChecker, error) {
+	access := &accessChecker{identity: identity, admin: identity != nil && s.isAdmin(identity)}
+	if access.admin {
+		return access, nil
+	}
+
+	acls, err := s.meta.ListAcls(s.ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	access.acls = acls
+	return access, nil
+}
+
+// identityFromName returns the identity of a user from its global name, as returned by Identity.GlobalName.
+func identityFromName(name string, groups []string) *oauth.Identity {
+	identity := &oauth.Identity{Username: name, Groups: groups}
+	if at := strings.LastIndex(name, "@"); at >= 0 {
+		identity.Username, identity.Organization = name[:at], name[at+1:]
+	}
+	return identity
+}
+
+// unrestricted returns true if the caller can perform any operation on any path.
+func (ac *accessChecker) unrestricted() bool {
+	return ac == nil || ac.admin || len(ac.acls) == 0
+}
+
+// matches returns true if the principal designates the caller.
+func (ac *accessChecker) matches(principal string) bool {
+	if ac.identity == nil {
+		return false
+	}
+	if principal == PrincipalAnyone || principal == ac.identity.GlobalName() {
+		return true
+	}
+	if group, ok := strings.CutPrefix(principal, PrincipalGroup); ok {
+		for _, g := range ac.identity.Groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowed returns true if the caller has the permission on the path parent, cleaned with cleanPath.
+func (ac *accessChecker) allowed(perm Permission, parent string) bool {
+	if ac.unrestricted() {
+		return true
+	}
+
+	// acls are sorted by path: the last one applying is the closest to parent.
+	for i := len(ac.acls) - 1; i >= 0; i-- {
+		acl := ac.acls[i]
+		principals := acl.Principals(perm)
+		if len(principals) == 0 || !acl.Applies(parent) {
+			continue
+		}
+		for _, principal := range principals {
+			if ac.matches(principal) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// check returns a PermissionDenied error unless the caller has the permission on the path parent.
+func (ac *accessChecker) check(perm Permission, parent string) error {
+	if ac.allowed(perm, parent) {
+		return nil
+	}
+	if ac.identity == nil {
+		return status.Errorf(codes.Unauthenticated, "no credentials supplied, required for %s permission on %q", perm, userPath(parent))
+	}
+	return status.Errorf(codes.PermissionDenied, "%s does not have %s permission on %q", ac.identity.GlobalName(), perm, userPath(parent))
+}
+
+// checkUid returns an error unless the caller has the permission on the path of the artifact uid.
+//
+// Unknown uids are allowed, so the operation can fail with the appropriate error.
+func (s *Server) checkUid(access *accessChecker, perm Permission, uid string) error {
+	if access.unrestricted() {
+		return nil
+	}
+	art, err := s.meta.Retrieve(s.ctx, &ArtifactQuery{Uid: uid})
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return access.check(perm, art.Parent)
+}
+
+func (s *Server) SetAcl(ctx context.Context, req *astore.SetAclRequest) (*astore.SetAclResponse, error) {
+	if err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if req.Acl == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "must supply an acl")
+	}
+
+	acl := FromAclProto(req.Acl, oauth.GetCredentials(ctx).Identity.GlobalName())
+	if err := s.meta.SetAcl(s.ctx, acl); err != nil {
+		return nil, err
+	}
+	s.watchers.acls.Add(1)
+	s.audit(acl.Creator, astore.AuditEntry_SET_ACL, &Audit{Parent: acl.Parent})
+	return &astore.SetAclResponse{}, nil
+}
+
+func (s *Server) ListAcls(ctx context.Context, req *astore.ListAclsRequest) (*astore.ListAclsResponse, error) {
+	if err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	var acls []*Acl
+	var err error
+	if req.Inherited {
+		all, err := s.meta.ListAcls(s.ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		dir := cleanPath(req.Path)
+		for _, acl := range all {
+			if acl.Applies(dir) {
+				acls = append(acls, acl)
+			}
+		}
+	} else {
+		acls, err = s.meta.ListAcls(s.ctx, req.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &astore.ListAclsResponse{}
+	for _, acl := range acls {
+		resp.Acl = append(resp.Acl, acl.ToProto())
+	}
+	return resp, nil
+}
@@ -0,0 +1,166 @@
+package astore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/oauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAccessChecker(t *testing.T) {
+	acls := []*Acl{
+		{Parent: "root", Write: []string{"group:eng"}, Delete: []string{"admin@enkit.test"}},
+		{Parent: "root/tools", Read: []string{"group:eng", "ci@enkit.test"}, Write: []string{"ci@enkit.test"}},
+		{Parent: "root/tools/public", Read: []string{"*"}},
+	}
+	eng := &oauth.Identity{Username: "dev", Organization: "enkit.test", Groups: []string{"eng"}}
+	ci := &oauth.Identity{Username: "ci", Organization: "enkit.test"}
+	other := &oauth.Identity{Username: "other", Organization: "enkit.test"}
+
+	testCases := []struct {
+		desc     string
+		identity *oauth.Identity
+		perm     Permission
+		parent   string
+		allowed  bool
+	}{
+		{desc: "no acl for permission", identity: other, perm: PermissionTag, parent: "root/tools/hello", allowed: true},
+		{desc: "no acl for path", identity: other, perm: PermissionRead, parent: "root/docs", allowed: true},
+		{desc: "group grant", identity: eng, perm: PermissionRead, parent: "root/tools/hello", allowed: true},
+		{desc: "user grant", identity: ci, perm: PermissionRead, parent: "root/tools", allowed: true},
+		{desc: "not granted", identity: other, perm: PermissionRead, parent: "root/tools/hello", allowed: false},
+		{desc: "similar prefix", identity: other, perm: PermissionRead, parent: "root/toolset", allowed: true},
+		{desc: "anyone", identity: other, perm: PermissionRead, parent: "root/tools/public/hello", allowed: true},
+		{desc: "unauthenticated anyone", identity: nil, perm: PermissionRead, parent: "root/tools/public/hello", allowed: false},
+		{desc: "unauthenticated unrestricted", identity: nil, perm: PermissionRead, parent: "root/docs", allowed: true},
+		{desc: "closest acl wins", identity: eng, perm: PermissionWrite, parent: "root/tools/hello", allowed: false},
+		{desc: "inherited from root", identity: eng, perm: PermissionWrite, parent: "root/docs", allowed: true},
+		{desc: "closest acl for permission", identity: other, perm: PermissionDelete, parent: "root/tools/public", allowed: false},
+	}
+	for _, tc := range testCases {
+		access := &accessChecker{identity: tc.identity, acls: acls}
+		assert.Equal(t, tc.allowed, access.allowed(tc.perm, tc.parent), tc.desc)
+	}
+
+	assert.True(t, (&accessChecker{identity: other, admin: true, acls: acls}).allowed(PermissionRead, "root/tools"))
+	assert.True(t, (*accessChecker)(nil).allowed(PermissionRead, "root/tools"))
+	err := (&accessChecker{identity: other, acls: acls}).check(PermissionRead, "root/tools/hello")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.ErrorContains(t, err, `other@enkit.test does not have read permission on "tools/hello"`)
+}
+
+func TestAcls(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	server.options.admins = []string{"tester@enkit.test"}
+	as := func(user string, groups ...string) context.Context {
+		return oauth.SetCredentials(context.Background(), &oauth.CredentialsCookie{
+			Identity: oauth.Identity{Username: user, Organization: "enkit.test", Groups: groups},
+		})
+	}
+	dev, other := as("dev", "eng"), as("other")
+
+	copied := uploadForTest(t, server, ctx, "hello", &astore.CommitRequest{Path: "docs/hello"})
+	hello := uploadForTest(t, server, ctx, "hello", &astore.CommitRequest{Path: "tools/hello"})
+	uploadForTest(t, server, ctx, "docs", &astore.CommitRequest{Path: "docs/readme"})
+
+	_, err := server.SetAcl(dev, &astore.SetAclRequest{Acl: &astore.Acl{Path: "tools", Read: []string{"group:eng"}}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.SetAcl(ctx, &astore.SetAclRequest{Acl: &astore.Acl{
+		Path:  "/tools/",
+		Read:  []string{"group:eng", "group:eng", ""},
+		Write: []string{"dev@enkit.test"},
+		Tag:   []string{"group:eng"},
+	}})
+	require.NoError(t, err)
+	_, err = server.SetAcl(ctx, &astore.SetAclRequest{Acl: &astore.Acl{Path: "tools/hello/public", Read: []string{"*"}}})
+	require.NoError(t, err)
+
+	listed, err := server.ListAcls(ctx, &astore.ListAclsRequest{})
+	require.NoError(t, err)
+	require.Len(t, listed.Acl, 2)
+	assert.Equal(t, "tools", listed.Acl[0].Path)
+	assert.Equal(t, []string{"group:eng"}, listed.Acl[0].Read)
+	assert.Equal(t, "tester@enkit.test", listed.Acl[0].Creator)
+	listed, err = server.ListAcls(ctx, &astore.ListAclsRequest{Path: "tools/hello", Inherited: true})
+	require.NoError(t, err)
+	require.Len(t, listed.Acl, 1)
+	assert.Equal(t, "tools", listed.Acl[0].Path)
+
+	// Reading.
+	_, err = server.Retrieve(dev, &astore.RetrieveRequest{Path: "tools/hello"})
+	assert.NoError(t, err)
+	_, err = server.Retrieve(other, &astore.RetrieveRequest{Path: "tools/hello"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.Retrieve(other, &astore.RetrieveRequest{Uid: hello.Uid, Tag: &astore.TagSet{}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.Retrieve(other, &astore.RetrieveRequest{Path: "docs/readme"})
+	assert.NoError(t, err)
+	// Retrieving by digest skips the artifacts with the same content that cannot be read.
+	retrieved, err := server.Retrieve(other, &astore.RetrieveRequest{Sha256: hello.Sha256})
+	require.NoError(t, err)
+	assert.Equal(t, copied.Uid, retrieved.Artifact.Uid)
+	retrieved, err = server.Retrieve(dev, &astore.RetrieveRequest{Sha256: hello.Sha256})
+	require.NoError(t, err)
+	assert.Equal(t, hello.Uid, retrieved.Artifact.Uid)
+	_, err = server.List(other, &astore.ListRequest{Path: "tools/hello"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	resp, err := server.List(dev, &astore.ListRequest{Path: "tools/hello"})
+	require.NoError(t, err)
+	assert.Len(t, resp.Artifact, 1)
+
+	// Writing, tagging, noting.
+	_, err = server.Commit(other, &astore.CommitRequest{Sid: hello.Sid, Path: "tools/hello"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.Commit(dev, &astore.CommitRequest{Sid: hello.Sid, Path: "tools/hello", Architecture: "arm64"})
+	assert.NoError(t, err)
+	_, err = server.Tag(other, &astore.TagRequest{Uid: hello.Uid, Add: &astore.TagSet{Tag: []string{"stable"}}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.Tag(dev, &astore.TagRequest{Uid: hello.Uid, Add: &astore.TagSet{Tag: []string{"stable"}}})
+	assert.NoError(t, err)
+	_, err = server.Note(as("ci", "eng"), &astore.NoteRequest{Uid: hello.Uid, Note: "denied"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Deleting is restricted by the acl of the root.
+	_, err = server.SetAcl(ctx, &astore.SetAclRequest{Acl: &astore.Acl{Delete: []string{"group:eng"}}})
+	require.NoError(t, err)
+	_, err = server.Delete(other, &astore.DeleteRequest{Id: hello.Uid})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.Delete(dev, &astore.DeleteRequest{Id: hello.Uid})
+	assert.NoError(t, err)
+
+	// Published artifacts can be downloaded as long as the creator can publish them.
+	server.options.publishBaseURL = "https://astore.enkit.test/d/"
+	_, err = server.SetAcl(ctx, &astore.SetAclRequest{Acl: &astore.Acl{Path: "docs", Publish: []string{"group:eng"}}})
+	require.NoError(t, err)
+	_, err = server.Publish(other, &astore.PublishRequest{Path: "readme", Select: &astore.ListRequest{Path: "docs/readme"}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.Publish(dev, &astore.PublishRequest{Path: "readme", Select: &astore.ListRequest{Path: "docs/readme"}})
+	require.NoError(t, err)
+
+	download := func() error {
+		var result error
+		server.DownloadPublished("/d/", func(_ string, _ *astore.RetrieveResponse, err error, _ http.ResponseWriter, _ *http.Request) {
+			result = err
+		}, httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/d/readme", nil))
+		return result
+	}
+	assert.NoError(t, download())
+	_, err = server.SetAcl(ctx, &astore.SetAclRequest{Acl: &astore.Acl{Path: "docs", Publish: []string{"tester@enkit.test"}}})
+	require.NoError(t, err)
+	assert.Equal(t, codes.PermissionDenied, status.Code(download()))
+	_, err = server.Unpublish(dev, &astore.UnpublishRequest{Path: "readme"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Removing an acl by granting nothing.
+	_, err = server.SetAcl(ctx, &astore.SetAclRequest{Acl: &astore.Acl{Path: "tools"}})
+	require.NoError(t, err)
+	_, err = server.List(other, &astore.ListRequest{Path: "tools/hello"})
+	assert.NoError(t, err)
+}
@@ -1,45 +1,38 @@
 package astore
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"path"
-	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/datastore"
-	"cloud.google.com/go/storage"
 	"encoding/base32"
+	"github.com/Masterminds/semver/v3"
+	"github.com/enfabrica/enkit/astore/provenance"
 	"github.com/enfabrica/enkit/astore/rpc/astore"
 	"github.com/enfabrica/enkit/lib/oauth"
-	"github.com/enfabrica/enkit/lib/retry"
-	"google.golang.org/api/iterator"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-// datastoreClient defines the subset of methods we need to call, providing a
-// surface to mock in unit tests.
-type datastoreClient interface {
-	Delete(context.Context, *datastore.Key) error
-	Get(context.Context, *datastore.Key, interface{}) error
-	GetAll(context.Context, *datastore.Query, interface{}) ([]*datastore.Key, error)
-	Mutate(context.Context, ...*datastore.Mutation) ([]*datastore.Key, error)
-	NewTransaction(context.Context, ...datastore.TransactionOption) (*datastore.Transaction, error)
-	Run(context.Context, *datastore.Query) *datastore.Iterator
-}
-
 type Server struct {
 	ctx context.Context
 
 	rng *rand.Rand
 
-	gcs *storage.Client
-	bkt *storage.BucketHandle
-
-	ds datastoreClient
+	blobs     BlobStore
+	meta      MetadataStore
+	watchers  watchers
+	manifests manifestQueue
 
 	options Options
 }
@@ -72,13 +65,40 @@ func GenerateUid(rng *rand.Rand) (string, error) {
 	return idEncoder.EncodeToString(uid), nil
 }
 
+var sidRegex = regexp.MustCompile("^[a-z0-9]{2}/[a-z0-9]{2}/[a-z0-9]+$")
+
+// IsSid returns true if the string supplied looks like a valid sid, as generated by GenerateSid.
+func IsSid(sid string) bool {
+	return sidRegex.MatchString(sid)
+}
+
+var uidRegex = regexp.MustCompile("^[a-z0-9]{32}$")
+
+// IsUid returns true if the string supplied looks like a valid uid, as generated by GenerateUid.
+func IsUid(uid string) bool {
+	return uidRegex.MatchString(uid)
+}
+
+// checkAdmin returns an error unless the caller is one of the admins configured with WithAdmins.
+func (s *Server) checkAdmin(ctx context.Context) error {
+	creds := oauth.GetCredentials(ctx)
+	if creds == nil {
+		return status.Errorf(codes.Unauthenticated, "no credentials supplied")
+	}
+
+	if s.isAdmin(&creds.Identity) {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "%s is not an administrator of this server", creds.Identity.GlobalName())
+}
+
 func (s *Server) Store(ctx context.Context, req *astore.StoreRequest) (*astore.StoreResponse, error) {
 	sid, err := GenerateSid(s.rng)
 	if err != nil {
 		return nil, fmt.Errorf("problems with secure prng - %w", err)
 	}
 
-	url, err := storage.SignedURL(s.options.bucket, objectPath(sid), s.options.ForSigning("PUT"))
+	url, err := s.blobs.PutURL(ctx, sid)
 	if err != nil {
 		return nil, fmt.Errorf("could not sign the url - %w", err)
 	}
@@ -91,249 +111,146 @@ func parentPath(p string) string {
 	return trimSlash(p)
 }
 
-func queryForPath(kind, path, arch string) (*datastore.Query, error) {
-	path, akey, err := keyFromPath(path, arch)
+func (s *Server) List(ctx context.Context, req *astore.ListRequest) (*astore.ListResponse, error) {
+	access, err := s.accessFor(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return datastore.NewQuery(kind).Filter("Parent = ", path).Order("-Created").Ancestor(akey), nil
+	return s.list(req, access, PermissionRead)
 }
 
-func (s *Server) List(ctx context.Context, req *astore.ListRequest) (*astore.ListResponse, error) {
-	// Two queries are necessary:
-	//   1) To retrieve artifacts.
-	//   2) To retrieve sub-paths.
-	childFiles := []*PathElement{}
-	queryPath, err := queryForPath(KindPathElement, req.Path, "")
-	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
-	}
-	kf, err := s.ds.GetAll(s.ctx, queryPath, &childFiles)
+// list returns the artifacts matching req that the caller has the permission perm on.
+func (s *Server) list(req *astore.ListRequest, access *accessChecker, perm Permission) (*astore.ListResponse, error) {
+	childFiles, childArtifacts, err := s.listArtifacts(req, access, perm)
 	if err != nil {
 		return nil, err
 	}
 
-	reqarch := strings.TrimSpace(req.Architecture)
-	queryArtifact, err := queryForPath(KindArtifact, req.Path, reqarch)
-	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
-	}
-	if req.Uid != "" {
-		queryArtifact = queryArtifact.Filter("Uid = ", req.Uid)
+	dirs := []*astore.Element{}
+	for _, file := range childFiles {
+		dirs = append(dirs, file.ToProto())
 	}
 
-	tags := []string{"latest"}
-	if req.Tag != nil {
-		tags = req.Tag.Tag
+	response := astore.ListResponse{
+		Element:  dirs,
+		Artifact: artifactsToProto(childArtifacts),
 	}
-	for _, tag := range tags {
-		queryArtifact = queryArtifact.Filter("Tag = ", tag)
+	return &response, nil
+}
+
+// listArtifacts returns the path elements below req.Path, and the artifacts matching req that
+// the caller has the permission perm on.
+func (s *Server) listArtifacts(req *astore.ListRequest, access *accessChecker, perm Permission) ([]*PathElement, []*Artifact, error) {
+	if err := access.check(perm, cleanPath(req.Path)); err != nil {
+		return nil, nil, err
 	}
 
-	childArtifacts := []*Artifact{}
-	ka, err := s.ds.GetAll(s.ctx, queryArtifact, &childArtifacts)
-	if err != nil {
-		return nil, err
+	var constraint *semver.Constraints
+	if req.Version != "" {
+		var err error
+		if constraint, err = parseConstraint(req.Version); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	dirs := []*astore.Element{}
-	for ix, file := range childFiles {
-		k := kf[ix]
-		dirs = append(dirs, &astore.Element{Name: k.Name, Created: file.Created.UnixNano(), Creator: file.Creator})
+	tags := []string{"latest"}
+	switch {
+	case req.Tag != nil:
+		tags = req.Tag.Tag
+	case constraint != nil:
+		tags = nil
 	}
 
-	arts := []*astore.Artifact{}
-	for ix, art := range childArtifacts {
-		arts = append(arts, art.ToProto(keyToArchitecture(ka[ix])))
+	childFiles, childArtifacts, err := s.meta.List(s.ctx, &ArtifactQuery{
+		Path:         req.Path,
+		Uid:          req.Uid,
+		Architecture: strings.TrimSpace(req.Architecture),
+		Tag:          tags,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if constraint != nil {
+		childArtifacts = s.matchVersion(childArtifacts, constraint)
 	}
 
-	response := astore.ListResponse{
-		Element:  dirs,
-		Artifact: arts,
+	var arts []*Artifact
+	for _, art := range childArtifacts {
+		if !access.allowed(perm, art.Parent) {
+			continue
+		}
+		arts = append(arts, art)
 	}
-	return &response, nil
+	return childFiles, arts, nil
 }
 
 func objectPath(sid string) string {
 	return path.Join("upload", sid)
 }
 
-func Rollback(t **datastore.Transaction) {
-	if *t == nil {
-		return
-	}
-
-	(*t).Rollback()
-	(*t) = nil
-}
-
-func Commit(t **datastore.Transaction) error {
-	_, err := (*t).Commit()
-	(*t) = nil
-	return err
-}
-
 func (s *Server) Tag(ctx context.Context, req *astore.TagRequest) (*astore.TagResponse, error) {
 	if req.Uid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid request - no sid and no path")
 	}
+	access, err := s.accessFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkUid(access, PermissionTag, req.Uid); err != nil {
+		return nil, err
+	}
 
-	arts := []*astore.Artifact{}
-	err := retry.New(retry.WithDescription("tag transaction"), retry.WithLogger(s.options.logger)).Run(func() error {
-		t, err := s.ds.NewTransaction(s.ctx)
-		if err != nil {
-			return err
-		}
-		defer Rollback(&t)
+	updated, err := s.tagArtifacts(callerName(ctx), []string{req.Uid}, req.Set, req.Add, req.Del)
+	return &astore.TagResponse{Artifact: artifactsToProto(updated)}, err
+}
 
-		query := datastore.NewQuery(KindArtifact).Filter("Uid = ", req.Uid).Transaction(t)
-		var artifacts []*Artifact
-		keys, err := s.ds.GetAll(s.ctx, query, &artifacts)
-		if err != nil {
-			return status.Errorf(codes.Internal, "error running query - %s", err)
-		}
-		if len(artifacts) == 0 {
-			return retry.Fatal(status.Errorf(codes.NotFound, "no match for uid - %s", req.Uid))
+// tagArtifacts changes the tags of the artifacts with the uids specified, atomically, on behalf of user.
+//
+// Tags are set first, if set is not nil, then added, then deleted.
+func (s *Server) tagArtifacts(user string, uids []string, set, add, del *astore.TagSet) ([]*Artifact, error) {
+	type key struct{ uid, arch string }
+	before := map[key][]string{}
+	updated, err := s.meta.Update(s.ctx, uids, func(art *Artifact) error {
+		before[key{art.Uid, art.Architecture}] = art.Tag
+		if set != nil {
+			art.Tag = set.Tag
 		}
-
-		// Found list of artifacts to update. This should be a single artifact, as UIDs should
-		// be globally unique. Using a loop for defense in depth.
-		muts := []*datastore.Mutation{}
-		for ix, art := range artifacts {
-			key := keys[ix]
-
-			if req.Set != nil {
-				art.Tag = req.Set.Tag
-			}
-			if req.Add != nil {
-				art.Tag = append(art.Tag, req.Add.Tag...)
-			}
-			var del []string
-			if req.Del != nil {
-				del = req.Del.Tag
-			}
-
-			art.Tag = cleanUniqueDelete(art.Tag, del)
-			m, err := s.deleteTagsMutation(t, key, art.Tag)
-			if err != nil {
-				return err
-			}
-			muts = append(muts, m...)
-			muts = append(muts, datastore.NewUpdate(key, art))
-			arts = append(arts, art.ToProto(keyToArchitecture(key)))
+		if add != nil {
+			art.Tag = append(art.Tag, add.Tag...)
 		}
-
-		_, err = t.Mutate(muts...)
-		if err != nil {
-			return err
+		var deleted []string
+		if del != nil {
+			deleted = del.Tag
 		}
 
-		err = Commit(&t)
-		if err != nil {
-			return err
-		}
+		art.Tag = cleanUniqueDelete(art.Tag, deleted)
 		return nil
 	})
-
-	return &astore.TagResponse{Artifact: arts}, err
-}
-
-func keyToArchitecture(key *datastore.Key) string {
-	cursor := key
-	for cursor != nil {
-		if cursor.Kind == KindPathElement {
-			return ""
-		}
-		if cursor.Kind == KindArchitecture {
-			return cursor.Name
-		}
-
-		cursor = cursor.Parent
-	}
-	return ""
-}
-
-func keyToPath(key *datastore.Key) string {
-	cursor := key
-	path := ""
-	for cursor != nil {
-		if cursor.Kind == KindPathElement && cursor.Name != "root" && cursor.Name != "" {
-			path = cursor.Name + "/" + path
-		}
-
-		cursor = cursor.Parent
+	if err != nil {
+		return nil, err
 	}
-
-	if path[len(path)-1] == '/' {
-		return path[:len(path)-1]
+	s.watchers.notify(astore.WatchEvent_TAGGED, updated...)
+	for _, art := range updated {
+		entry := auditArtifact(art)
+		entry.TagsBefore = before[key{art.Uid, art.Architecture}]
+		s.audit(user, astore.AuditEntry_TAG, entry)
 	}
-	return path
-}
-
-func keyForArtifact(key *datastore.Key) *datastore.Key {
-	return datastore.IncompleteKey(KindArtifact, key)
+	return updated, nil
 }
 
-// keyFromPath cleans and parses the supplied path to compute a key.
-// Returns the final path - after cleaning - and the computed key.
-func keyFromPath(orig, architecture string) (string, *datastore.Key, error) {
-	dir := path.Clean(filepath.ToSlash(strings.TrimSpace(orig)))
-	if dir == "." {
-		dir = ""
+// artifactsToProto converts the artifacts to their protocol buffer form, returning an empty list if there are none.
+func artifactsToProto(arts []*Artifact) []*astore.Artifact {
+	converted := []*astore.Artifact{}
+	for _, art := range arts {
+		converted = append(converted, art.ToProto())
 	}
-	dir = path.Join("root", dir)
-
-	var key *datastore.Key
-	elements := strings.Split(dir, "/")
-	if elements[0] == "" {
-		elements = elements[1:]
-	}
-	for _, element := range elements[:len(elements)] {
-		key = datastore.NameKey(KindPathElement, element, key)
-	}
-	if architecture != "" {
-		key = datastore.NameKey(KindArchitecture, architecture, key)
-	}
-	return dir, key, nil
+	return converted
 }
 
 func trimSlash(str string) string {
 	return strings.TrimSuffix(str, "/")
 }
 
-// mutationsForKeyPath computes the mutations necessary to create the path of objects supplied.
-// path and key should come from keyFromPath to guarantee consistency and format.
-func mutationsForKeyPath(dir string, key *datastore.Key, creator string) []*datastore.Mutation {
-	muts := []*datastore.Mutation{}
-
-	cursor := key
-	parent := trimSlash(dir)
-
-	for cursor != nil {
-		switch cursor.Kind {
-		case KindArchitecture:
-			muts = append(muts, datastore.NewInsert(cursor, &Architecture{
-				Parent:  parent,
-				Created: time.Now(),
-				Creator: creator,
-			}))
-
-		case KindPathElement:
-			parent, _ = path.Split(parent)
-			parent = trimSlash(parent)
-
-			muts = append(muts, datastore.NewInsert(cursor, &PathElement{
-				Parent:  parent,
-				Created: time.Now(),
-				Creator: creator,
-			}))
-		}
-
-		cursor = cursor.Parent
-	}
-	return muts
-}
-
 func cleanUniqueDeleteMap(tags []string, seen map[string]struct{}) []string {
 	res := []string{}
 	for _, t := range tags {
@@ -374,6 +291,20 @@ func hasTag(tags []string, tag string) bool {
 	return false
 }
 
+// sameTags returns true if the two lists contain the same tags, in any order.
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	index := indexStrings(a)
+	for _, t := range b {
+		if _, found := index[t]; !found {
+			return false
+		}
+	}
+	return true
+}
+
 func removeTag(tags []string, tag string) []string {
 	if !hasTag(tags, tag) {
 		return tags
@@ -389,81 +320,6 @@ func removeTag(tags []string, tag string) []string {
 	return result
 }
 
-func alreadyExistsError(err error) bool {
-	if status.Code(err) == codes.AlreadyExists {
-		return true
-	}
-
-	merr, ok := err.(datastore.MultiError)
-	if !ok {
-		return false
-	}
-	for _, err := range merr {
-		if status.Code(err) != codes.AlreadyExists {
-			return false
-		}
-	}
-	return true
-}
-
-// deleteTagsMutation computes the mutations necessary to make sure the supplied list of tags is not applied to any other artifact in the same path/architecture.
-//
-// key is the key of the artifact owning the tags supplied, or the key of the parent where the artifact is supposed to be stored.
-// tags is the list of tags to be added to the specified artifact. Those tags need to be removed from any other artifact.
-func (s *Server) deleteTagsMutation(t *datastore.Transaction, key *datastore.Key, tags []string) ([]*datastore.Mutation, error) {
-	pkey := key
-	if key.Kind == KindArtifact {
-		pkey = key.Parent
-	}
-
-	type KeyArtifact struct {
-		Key *datastore.Key
-		Art *Artifact
-	}
-	muts := []*datastore.Mutation{}
-	entries := map[int64]KeyArtifact{}
-
-	// A tag can only live on one version of an artifact.
-	//
-	// The goal of the loop is to identify all other artifacts that have one of the tags specified
-	// assigned.
-	//
-	// Note that one artifact can have multiple tags. Given that this code is run in a transaction,
-	// every read of the same artifact will show all the tags already available.
-	//
-	// To modify the list correct, the code has to:
-	// - remove all the tags at once, so if the same object is written multiple times, it is always
-	//   written with the correct set of tags.
-	// - use the entries map above to prevent multiple writes.
-	for _, tag := range tags {
-		query := datastore.NewQuery(KindArtifact).Ancestor(pkey).Filter("Tag = ", tag).Transaction(t)
-
-		// If a tag can only live on one version, this loop is not necessary.
-		// But better safe than sorry, especially with eventual consistency and so on.
-		for it := s.ds.Run(s.ctx, query); ; {
-			var artifact Artifact
-			curk, err := it.Next(&artifact)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				return nil, err
-			}
-			if curk.Equal(key) {
-				continue
-			}
-			entries[curk.ID] = KeyArtifact{Key: curk, Art: &artifact}
-		}
-	}
-
-	for _, ka := range entries {
-		ka.Art.Tag = cleanUniqueDelete(ka.Art.Tag, tags)
-		muts = append(muts, datastore.NewUpdate(ka.Key, ka.Art))
-	}
-
-	return muts, nil
-}
-
 func (s *Server) Commit(ctx context.Context, req *astore.CommitRequest) (*astore.CommitResponse, error) {
 	creds := oauth.GetCredentials(ctx)
 	if req.Sid == "" {
@@ -472,82 +328,235 @@ func (s *Server) Commit(ctx context.Context, req *astore.CommitRequest) (*astore
 	if req.Path == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "Must supply a path")
 	}
+	access, err := s.accessFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := access.check(PermissionWrite, cleanPath(req.Path)); err != nil {
+		return nil, err
+	}
 
 	architecture := "all"
 	if req.Architecture != "" {
 		architecture = req.Architecture
 	}
 
-	opath := objectPath(req.Sid)
-	attrs, err := s.bkt.Object(opath).Attrs(s.ctx)
-	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "SID %s is invalid - %s", opath, err)
-	}
-
 	uid, err := GenerateUid(s.rng)
 	if err != nil {
 		return nil, err
 	}
 
 	creator := creds.Identity.GlobalName()
-
-	_, err = s.bkt.Object(opath).Update(s.ctx, storage.ObjectAttrsToUpdate{
-		Metadata: map[string]string{
-			"path":    req.Path,
-			"uid":     uid,
-			"creator": creator,
-		},
-	})
+	blob, err := s.resolveBlob(req.Sid)
 	if err != nil {
 		return nil, err
 	}
-
-	path, pkey, err := keyFromPath(req.Path, architecture)
-	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
-	}
-	muts := mutationsForKeyPath(path, pkey, creator)
-	_, err = s.ds.Mutate(s.ctx, muts...)
-	if err != nil && !alreadyExistsError(err) {
+	if err := checkSignature(req.Sid, blob, req.Provenance, req.Signature); err != nil {
 		return nil, err
 	}
 
-	tags := cleanUnique(append(req.Tag, "latest"))
 	artifact := &Artifact{
-		Uid:     uid,
-		Sid:     req.Sid,
-		MD5:     attrs.MD5,
-		Size:    attrs.Size,
-		Tag:     tags,
-		Parent:  path,
-		Creator: creator,
-		Created: time.Now(),
-		Note:    req.Note,
-	}
-
-	err = retry.New(retry.WithDescription("insert transaction"), retry.WithLogger(s.options.logger)).Run(func() error {
-		t, err := s.ds.NewTransaction(s.ctx)
-		if err != nil {
-			return err
-		}
-		defer Rollback(&t)
+		Uid:          uid,
+		Tag:          cleanUnique(append(req.Tag, "latest")),
+		Creator:      creator,
+		Created:      time.Now(),
+		Note:         req.Note,
+		Provenance:   req.Provenance,
+		Architecture: architecture,
+	}
+	if req.Signature != nil {
+		artifact.SignerKey = req.Signature.Key
+		artifact.Signature = req.Signature.Signature
+	}
+	if err := s.record(req.Sid, req.Path, blob, artifact); err != nil {
+		return nil, err
+	}
+	s.audit(creator, astore.AuditEntry_COMMIT, auditArtifact(artifact))
+	return &astore.CommitResponse{Artifact: artifact.ToProto()}, nil
+}
+
+// checkSignature verifies the provenance and signature supplied for the artifact stored in blob, if any.
+func checkSignature(sid string, blob *committedBlob, prov []byte, signature *astore.Signature) error {
+	if _, err := provenance.Unmarshal(prov); err != nil {
+		return status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+	if signature == nil {
+		return nil
+	}
+	if err := provenance.Verify(signature, blob.sha256, prov); err != nil {
+		return status.Errorf(codes.InvalidArgument, "signature of %s does not match its content or provenance - %s", sid, err)
+	}
+	return nil
+}
 
-		muts, err := s.deleteTagsMutation(t, pkey, tags)
+// record stores an artifact in path p, pointing to the blob resolved for the upload sid.
+//
+// The content related fields of the artifact are filled in from the blob.
+func (s *Server) record(sid, p string, blob *committedBlob, artifact *Artifact) error {
+	if !blob.duplicate {
+		err := s.blobs.Annotate(s.ctx, blob.sid, map[string]string{
+			"path":    p,
+			"uid":     artifact.Uid,
+			"creator": artifact.Creator,
+			"sha256":  hex.EncodeToString(blob.sha256),
+		})
 		if err != nil {
 			return err
 		}
+	}
 
-		muts = append(muts, datastore.NewInsert(keyForArtifact(pkey), artifact))
+	artifact.Sid = blob.sid
+	artifact.MD5 = blob.md5
+	artifact.SHA256 = blob.sha256
+	artifact.Size = blob.size
 
-		_, err = t.Mutate(muts...)
+	err := s.meta.Commit(s.ctx, p, artifact)
+	if status.Code(err) == codes.Aborted && blob.duplicate && blob.uploaded {
+		// The blob we were about to share was deleted in the meantime, use the uploaded one.
+		artifact.Sid = sid
+		blob.duplicate = false
+		err = s.meta.Commit(s.ctx, p, artifact)
+	}
+	if err != nil {
+		return err
+	}
+
+	if blob.duplicate && blob.uploaded {
+		s.reclaimDuplicate(sid, blob.sid)
+	}
+	s.recordManifest(p, artifact)
+	s.watchers.notify(astore.WatchEvent_COMMITTED, artifact)
+	return nil
+}
+
+// committedBlob is the blob an artifact being committed will reference.
+type committedBlob struct {
+	sid    string
+	md5    []byte
+	sha256 []byte
+	size   int64
+
+	// True if the blob was uploaded as part of this commit, false if it was
+	// already known from a previous commit.
+	uploaded bool
+	// True if the content was already stored in another blob.
+	duplicate bool
+}
+
+// resolveBlob finds the blob to use for an artifact uploaded as sid.
+//
+// If the same content is already stored in another blob, the artifact is
+// pointed to that blob instead. This allows many identical uploads to share
+// a single copy of the content.
+func (s *Server) resolveBlob(sid string) (*committedBlob, error) {
+	known, err := s.meta.GetBlob(s.ctx, sid)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+	// The sid was committed before, and turned out to be a duplicate.
+	// This happens when the same upload is committed for multiple architectures.
+	if known != nil && known.DuplicateOf != "" {
+		original, err := s.meta.GetBlob(s.ctx, known.DuplicateOf)
 		if err != nil {
-			return err
+			return nil, status.Errorf(codes.InvalidArgument, "SID %s is invalid - duplicate of %s - %s", sid, known.DuplicateOf, err)
+		}
+		return &committedBlob{sid: known.DuplicateOf, md5: original.MD5, sha256: original.SHA256, size: original.Size, duplicate: true}, nil
+	}
+
+	attrs, err := s.blobs.Stat(s.ctx, sid)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "SID %s is invalid - %s", sid, err)
+	}
+	blob := &committedBlob{sid: sid, md5: attrs.MD5, size: attrs.Size, uploaded: known == nil}
+	switch {
+	case known != nil && len(known.SHA256) > 0:
+		blob.sha256 = known.SHA256
+	case known != nil && len(annotatedSHA256(attrs)) > 0:
+		blob.sha256 = annotatedSHA256(attrs)
+	default:
+		blob.sha256, err = s.blobSHA256(sid, attrs)
+		if errors.Is(err, ErrBlobCorrupted) {
+			return nil, status.Errorf(codes.DataLoss, "SID %s does not match the md5 supplied at upload - %s", sid, err)
 		}
-		err = Commit(&t)
 		if err != nil {
-			return err
+			return nil, status.Errorf(codes.Internal, "could not compute the digest of %s - %s", sid, err)
 		}
+	}
+	if !blob.uploaded || len(attrs.MD5) == 0 {
+		return blob, nil
+	}
+
+	existing, err := s.meta.FindBlob(s.ctx, attrs.MD5, attrs.Size)
+	if err != nil {
+		if status.Code(err) != codes.NotFound {
+			s.options.logger.Warnf("could not look up duplicates of %s - %s", sid, err)
+		}
+		return blob, nil
+	}
+	if existing == sid {
+		return blob, nil
+	}
+	// MD5 collisions can be crafted: only share blobs with the same SHA256, when known.
+	if original, err := s.meta.GetBlob(s.ctx, existing); err == nil && len(original.SHA256) > 0 && !bytes.Equal(original.SHA256, blob.sha256) {
+		s.options.logger.Warnf("blob %s has the same md5 and size of %s, but different sha256", sid, existing)
+		return blob, nil
+	}
+	blob.sid = existing
+	blob.duplicate = true
+	return blob, nil
+}
+
+// annotatedSHA256 returns the SHA256 stored by record in the metadata of the
+// blob, or nil.
+//
+// Only to be trusted for blobs committed before: the metadata of blobs never
+// committed may have been set by whoever uploaded them.
+func annotatedSHA256(attrs *BlobAttrs) []byte {
+	recorded, err := hex.DecodeString(attrs.Metadata["sha256"])
+	if err != nil || len(recorded) != sha256.Size {
 		return nil
-	})
-	return &astore.CommitResponse{Artifact: artifact.ToProto(architecture)}, err
+	}
+	return recorded
+}
+
+// blobSHA256 returns the SHA256 of the blob sid.
+//
+// Uses the digest computed by the BlobStore when available, or reads the
+// whole blob otherwise.
+//
+// When the blob is read, an MD5 the BlobStore did not compute is checked as
+// well, and ErrBlobCorrupted returned if it does not match: the MD5 is used to
+// find duplicates, it must not point the artifact at content it does not have.
+func (s *Server) blobSHA256(sid string, attrs *BlobAttrs) ([]byte, error) {
+	if len(attrs.SHA256) > 0 {
+		return attrs.SHA256, nil
+	}
+	r, err := s.blobs.Open(s.ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	hash, digest := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(hash, digest), r); err != nil {
+		return nil, err
+	}
+	if attrs.MD5Unverified && !bytes.Equal(hash.Sum(nil), attrs.MD5) {
+		return nil, ErrBlobCorrupted
+	}
+	return digest.Sum(nil), nil
+}
+
+// reclaimDuplicate deletes the blob sid, a duplicate of the blob of.
+//
+// Errors are only logged: the commit succeeded, and the worst outcome is a blob
+// no artifact references, removed when its sid is explicitly deleted.
+func (s *Server) reclaimDuplicate(sid, of string) {
+	if err := s.meta.MarkDuplicate(s.ctx, sid, of); err != nil {
+		s.options.logger.Warnf("could not record %s as duplicate of %s - %s", sid, of, err)
+		return
+	}
+	if err := s.blobs.Delete(s.ctx, sid); err != nil {
+		s.options.logger.Warnf("could not delete %s, duplicate of %s - %s", sid, of, err)
+	}
 }
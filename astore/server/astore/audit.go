@@ -0,0 +1,101 @@
+package astore
+
+import (
+	"context"
+	"time"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/oauth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultHistoryLimit is the number of audit entries returned by History if the request sets no limit.
+const DefaultHistoryLimit = 100
+
+// JanitorUser is the user recorded in the audit log for the artifacts deleted by RunJanitor.
+const JanitorUser = "janitor"
+
+// callerName returns the name of the user performing an RPC, as recorded in the audit log.
+func callerName(ctx context.Context) string {
+	if creds := oauth.GetCredentials(ctx); creds != nil {
+		return creds.Identity.GlobalName()
+	}
+	return ""
+}
+
+// auditArtifact returns an audit entry for a change to the artifact, with the tags it has after the change.
+func auditArtifact(art *Artifact) *Audit {
+	return &Audit{
+		Uid:          art.Uid,
+		Parent:       art.Parent,
+		Architecture: art.Architecture,
+		TagsAfter:    art.Tag,
+	}
+}
+
+// audit appends the entry to the audit log, on behalf of user.
+//
+// The change has already happened by the time it is audited, so errors are only logged.
+func (s *Server) audit(user string, op astore.AuditEntry_Operation, entry *Audit) {
+	entry.Time = time.Now()
+	entry.User = user
+	entry.Operation = op.String()
+	if err := s.meta.Audit(s.ctx, entry); err != nil {
+		s.options.logger.Warnf("could not record %s of %s %s by %s in the audit log - %s", entry.Operation, entry.Uid, userPath(entry.Parent), user, err)
+	}
+}
+
+// History returns the audit log of an artifact, or of the artifacts below a path.
+//
+// Only the entries of paths the caller can read are returned, and changes to acls only to admins.
+func (s *Server) History(ctx context.Context, req *astore.HistoryRequest) (*astore.HistoryResponse, error) {
+	if req.Limit < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid limit %d", req.Limit)
+	}
+	access, err := s.accessFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query := &AuditQuery{Uid: req.Uid}
+	if req.Path != "" {
+		query.Path = cleanPath(req.Path)
+		if err := access.check(PermissionRead, query.Path); err != nil {
+			return nil, err
+		}
+	}
+	if req.Uid != "" {
+		if err := s.checkUid(access, PermissionRead, req.Uid); err != nil {
+			return nil, err
+		}
+	}
+
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = DefaultHistoryLimit
+	}
+	// With acls, entries the caller cannot see are filtered below, so the store cannot apply the limit.
+	if access.unrestricted() {
+		query.Limit = limit
+	}
+	entries, err := s.meta.History(s.ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &astore.HistoryResponse{}
+	for _, entry := range entries {
+		if len(resp.Entry) >= limit {
+			break
+		}
+		if entry.Operation == astore.AuditEntry_SET_ACL.String() && !access.admin {
+			continue
+		}
+		if entry.Parent != "" && !access.allowed(PermissionRead, entry.Parent) {
+			continue
+		}
+		resp.Entry = append(resp.Entry, entry.ToProto())
+	}
+	return resp, nil
+}
@@ -0,0 +1,141 @@
+package astore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/oauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAudit(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	server.options.admins = []string{"tester@enkit.test"}
+	server.options.publishBaseURL = "https://astore.enkit.test/d/"
+	dev := oauth.SetCredentials(context.Background(), &oauth.CredentialsCookie{
+		Identity: oauth.Identity{Username: "dev", Organization: "enkit.test"},
+	})
+
+	hello := uploadForTest(t, server, ctx, "hello", &astore.CommitRequest{Path: "tools/hello", Tag: []string{"v1"}})
+	docs := uploadForTest(t, server, ctx, "docs", &astore.CommitRequest{Path: "docs/readme"})
+	_, err := server.Tag(dev, &astore.TagRequest{Uid: hello.Uid, Add: &astore.TagSet{Tag: []string{"stable"}}, Del: &astore.TagSet{Tag: []string{"v1"}}})
+	require.NoError(t, err)
+	_, err = server.Note(dev, &astore.NoteRequest{Uid: hello.Uid, Note: "greets"})
+	require.NoError(t, err)
+	_, err = server.Publish(ctx, &astore.PublishRequest{Path: "hello", Select: &astore.ListRequest{Path: "tools/hello"}})
+	require.NoError(t, err)
+	// Audited with the cleaned path, as published.
+	_, err = server.Unpublish(dev, &astore.UnpublishRequest{Path: " ./hello/ "})
+	require.NoError(t, err)
+	_, err = server.Delete(dev, &astore.DeleteRequest{Id: hello.Uid})
+	require.NoError(t, err)
+
+	history, err := server.History(ctx, &astore.HistoryRequest{Uid: hello.Uid})
+	require.NoError(t, err)
+	var ops []astore.AuditEntry_Operation
+	for _, entry := range history.Entry {
+		ops = append(ops, entry.Operation)
+		assert.Equal(t, "tools/hello", entry.Path)
+	}
+	assert.Equal(t, []astore.AuditEntry_Operation{astore.AuditEntry_DELETE, astore.AuditEntry_NOTE, astore.AuditEntry_TAG, astore.AuditEntry_COMMIT}, ops)
+
+	deleted, noted, tagged, committed := history.Entry[0], history.Entry[1], history.Entry[2], history.Entry[3]
+	assert.Equal(t, "tester@enkit.test", committed.User)
+	assert.Empty(t, committed.TagsBefore)
+	assert.ElementsMatch(t, []string{"v1", "latest"}, committed.TagsAfter)
+	assert.Equal(t, "dev@enkit.test", tagged.User)
+	assert.ElementsMatch(t, []string{"v1", "latest"}, tagged.TagsBefore)
+	assert.ElementsMatch(t, []string{"latest", "stable"}, tagged.TagsAfter)
+	assert.Equal(t, "greets", noted.Note)
+	assert.ElementsMatch(t, []string{"latest", "stable"}, deleted.TagsBefore)
+	assert.Empty(t, deleted.TagsAfter)
+	assert.True(t, deleted.Time >= committed.Time)
+
+	// A path returns the changes to all the artifacts below it, including publishing.
+	history, err = server.History(ctx, &astore.HistoryRequest{Path: "tools"})
+	require.NoError(t, err)
+	require.Len(t, history.Entry, 6)
+	assert.Equal(t, astore.AuditEntry_UNPUBLISH, history.Entry[1].Operation)
+	assert.Equal(t, "hello", history.Entry[1].Published)
+	assert.Equal(t, "dev@enkit.test", history.Entry[1].User)
+	assert.Equal(t, astore.AuditEntry_PUBLISH, history.Entry[2].Operation)
+
+	history, err = server.History(ctx, &astore.HistoryRequest{Path: "docs/readme"})
+	require.NoError(t, err)
+	require.Len(t, history.Entry, 1)
+	assert.Equal(t, docs.Uid, history.Entry[0].Uid)
+	history, err = server.History(ctx, &astore.HistoryRequest{Path: "tool"})
+	require.NoError(t, err)
+	assert.Empty(t, history.Entry)
+
+	history, err = server.History(ctx, &astore.HistoryRequest{Limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, history.Entry, 2)
+
+	// Entries are only visible to users allowed to read the path, and acl changes only to admins.
+	_, err = server.SetAcl(ctx, &astore.SetAclRequest{Acl: &astore.Acl{Path: "docs", Read: []string{"group:docs"}}})
+	require.NoError(t, err)
+	_, err = server.History(dev, &astore.HistoryRequest{Path: "docs"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.History(dev, &astore.HistoryRequest{Uid: docs.Uid})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	history, err = server.History(dev, &astore.HistoryRequest{})
+	require.NoError(t, err)
+	assert.Len(t, history.Entry, 6)
+	history, err = server.History(ctx, &astore.HistoryRequest{})
+	require.NoError(t, err)
+	require.Len(t, history.Entry, 8)
+	assert.Equal(t, astore.AuditEntry_SET_ACL, history.Entry[0].Operation)
+	assert.Equal(t, "docs", history.Entry[0].Path)
+
+	// Artifacts deleted by the retention policies are recorded as collected.
+	server.options.retention = []*astore.RetentionPolicy{{Prefix: "docs", KeepLast: 1}}
+	uploadForTest(t, server, ctx, "docs v2", &astore.CommitRequest{Path: "docs/readme"})
+	_, err = server.collectGarbage(JanitorUser, "", false)
+	require.NoError(t, err)
+	history, err = server.History(ctx, &astore.HistoryRequest{Uid: docs.Uid, Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, history.Entry, 1)
+	assert.Equal(t, astore.AuditEntry_COLLECT, history.Entry[0].Operation)
+	assert.Equal(t, JanitorUser, history.Entry[0].User)
+}
+
+// failingUpdateMetadata runs the updater on the artifacts, but fails to store them.
+type failingUpdateMetadata struct {
+	MetadataStore
+}
+
+func (m failingUpdateMetadata) Update(ctx context.Context, uids []string, updater ArtifactUpdater) ([]*Artifact, error) {
+	var arts []*Artifact
+	for _, uid := range uids {
+		art, err := m.Retrieve(ctx, &ArtifactQuery{Uid: uid})
+		if err != nil {
+			return nil, err
+		}
+		if err := updater(art); err != nil {
+			return nil, err
+		}
+		arts = append(arts, art)
+	}
+	return arts, status.Errorf(codes.Aborted, "transaction failed")
+}
+
+func TestAuditFailedUpdate(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	hello := uploadForTest(t, server, ctx, "hello", &astore.CommitRequest{Path: "tools/hello"})
+	server.meta = failingUpdateMetadata{server.meta}
+
+	_, err := server.Tag(ctx, &astore.TagRequest{Uid: hello.Uid, Add: &astore.TagSet{Tag: []string{"stable"}}})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, err = server.Note(ctx, &astore.NoteRequest{Uid: hello.Uid, Note: "greets"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	history, err := server.History(ctx, &astore.HistoryRequest{Uid: hello.Uid})
+	require.NoError(t, err)
+	require.Len(t, history.Entry, 1)
+	assert.Equal(t, astore.AuditEntry_COMMIT, history.Entry[0].Operation)
+}
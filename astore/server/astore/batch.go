@@ -0,0 +1,155 @@
+package astore
+
+import (
+	"context"
+	"strings"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MaxBatchSize is the maximum number of artifacts a batch operation can change,
+// to keep the transactions within the limits of the metadata backends.
+const MaxBatchSize = 250
+
+// selectArtifacts returns the artifacts selected for a batch operation, checking
+// that the caller has the permission perm on all of them.
+//
+// Each artifact is returned once, even if selected both by uid and by the list.
+func (s *Server) selectArtifacts(access *accessChecker, perm Permission, sel *astore.Selection) ([]*Artifact, error) {
+	if sel == nil || (len(sel.Uid) == 0 && sel.List == nil) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request - no uid and no list of artifacts selected")
+	}
+
+	seen := map[string]struct{}{}
+	var selected []*Artifact
+	add := func(art *Artifact) {
+		if _, found := seen[art.Uid]; found {
+			return
+		}
+		seen[art.Uid] = struct{}{}
+		selected = append(selected, art)
+	}
+
+	for _, uid := range sel.Uid {
+		uid = strings.TrimSpace(uid)
+		if !IsUid(uid) {
+			return nil, status.Errorf(codes.InvalidArgument, "%q is not a valid uid", uid)
+		}
+		art, err := s.meta.Retrieve(s.ctx, &ArtifactQuery{Uid: uid})
+		if err != nil {
+			return nil, err
+		}
+		if err := access.check(perm, art.Parent); err != nil {
+			return nil, err
+		}
+		add(art)
+	}
+
+	if sel.List != nil {
+		// An empty path would select the artifacts in the root, which is rarely intended.
+		if strings.Trim(strings.TrimSpace(sel.List.Path), "/") == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid request - selecting artifacts by list requires a path")
+		}
+		_, arts, err := s.listArtifacts(sel.List, access, perm)
+		if err != nil {
+			return nil, err
+		}
+		for _, art := range arts {
+			add(art)
+		}
+	}
+
+	if len(selected) > MaxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "%d artifacts selected, more than the %d allowed in a batch - narrow down the selection", len(selected), MaxBatchSize)
+	}
+	return selected, nil
+}
+
+// uidsOf returns the uids of the artifacts.
+func uidsOf(arts []*Artifact) []string {
+	var uids []string
+	for _, art := range arts {
+		uids = append(uids, art.Uid)
+	}
+	return uids
+}
+
+func (s *Server) BatchTag(ctx context.Context, req *astore.BatchTagRequest) (*astore.BatchTagResponse, error) {
+	access, err := s.accessFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := s.selectArtifacts(access, PermissionTag, req.Selection)
+	if err != nil {
+		return nil, err
+	}
+
+	// A tag can only be assigned to one artifact per path and architecture.
+	if (req.Set != nil && len(req.Set.Tag) > 0) || (req.Add != nil && len(req.Add.Tag) > 0) {
+		type key struct{ parent, arch string }
+		paths := map[key]string{}
+		for _, art := range selected {
+			k := key{art.Parent, art.Architecture}
+			if other, found := paths[k]; found {
+				return nil, status.Errorf(codes.InvalidArgument, "artifacts %s and %s are both in %s for %s - tags can only be assigned to one of them", other, art.Uid, art.Path(), art.Architecture)
+			}
+			paths[k] = art.Uid
+		}
+	}
+
+	if req.DryRun || len(selected) == 0 {
+		return &astore.BatchTagResponse{Artifact: artifactsToProto(selected)}, nil
+	}
+	updated, err := s.tagArtifacts(callerName(ctx), uidsOf(selected), req.Set, req.Add, req.Del)
+	if err != nil {
+		return nil, err
+	}
+	return &astore.BatchTagResponse{Artifact: artifactsToProto(updated)}, nil
+}
+
+func (s *Server) BatchNote(ctx context.Context, req *astore.BatchNoteRequest) (*astore.BatchNoteResponse, error) {
+	access, err := s.accessFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := s.selectArtifacts(access, PermissionWrite, req.Selection)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.DryRun || len(selected) == 0 {
+		return &astore.BatchNoteResponse{Artifact: artifactsToProto(selected)}, nil
+	}
+	updated, err := s.noteArtifacts(callerName(ctx), uidsOf(selected), req.Note)
+	if err != nil {
+		return nil, err
+	}
+	return &astore.BatchNoteResponse{Artifact: artifactsToProto(updated)}, nil
+}
+
+// BatchDelete removes the artifacts selected, followed by the blobs no longer referenced by any artifact.
+func (s *Server) BatchDelete(ctx context.Context, req *astore.BatchDeleteRequest) (*astore.BatchDeleteResponse, error) {
+	access, err := s.accessFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := s.selectArtifacts(access, PermissionDelete, req.Selection)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.DryRun || len(selected) == 0 {
+		return &astore.BatchDeleteResponse{Artifact: artifactsToProto(selected)}, nil
+	}
+	arts, orphans, err := s.meta.Delete(s.ctx, uidsOf(selected))
+	if err != nil {
+		return nil, err
+	}
+	s.watchers.notify(astore.WatchEvent_DELETED, arts...)
+	s.auditDeleted(callerName(ctx), astore.AuditEntry_DELETE, arts)
+
+	blobs, err := s.deleteBlobs(orphans)
+	return &astore.BatchDeleteResponse{Artifact: artifactsToProto(arts), Sid: blobs}, err
+}
@@ -0,0 +1,141 @@
+package astore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/oauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBatch(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	server.options.admins = []string{"tester@enkit.test"}
+
+	first := uploadForTest(t, server, ctx, "first", &astore.CommitRequest{Path: "tools/hello", Architecture: "amd64"})
+	second := uploadForTest(t, server, ctx, "second", &astore.CommitRequest{Path: "tools/hello", Architecture: "amd64"})
+	arm := uploadForTest(t, server, ctx, "arm", &astore.CommitRequest{Path: "tools/hello", Architecture: "arm64"})
+	copied := uploadForTest(t, server, ctx, "first", &astore.CommitRequest{Path: "tools/copy"})
+	require.Equal(t, first.Sid, copied.Sid)
+
+	uids := func(arts []*astore.Artifact) []string {
+		var uids []string
+		for _, art := range arts {
+			uids = append(uids, art.Uid)
+		}
+		return uids
+	}
+	retrieve := func(uid string) (*astore.Artifact, error) {
+		resp, err := server.Retrieve(ctx, &astore.RetrieveRequest{Uid: uid, Tag: &astore.TagSet{}})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Artifact, nil
+	}
+	hello := &astore.ListRequest{Path: "tools/hello", Tag: &astore.TagSet{}}
+	latest := &astore.ListRequest{Path: "tools/hello"}
+
+	// Tags can only be added to one artifact per path and architecture.
+	_, err := server.BatchTag(ctx, &astore.BatchTagRequest{Selection: &astore.Selection{List: hello}, Add: &astore.TagSet{Tag: []string{"stable"}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	dry, err := server.BatchTag(ctx, &astore.BatchTagRequest{Selection: &astore.Selection{List: latest}, Add: &astore.TagSet{Tag: []string{"release"}}, DryRun: true})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{second.Uid, arm.Uid}, uids(dry.Artifact))
+	art, err := retrieve(arm.Uid)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"latest"}, art.Tag)
+
+	tagged, err := server.BatchTag(ctx, &astore.BatchTagRequest{Selection: &astore.Selection{List: latest}, Add: &astore.TagSet{Tag: []string{"release"}}})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{second.Uid, arm.Uid}, uids(tagged.Artifact))
+	for _, uid := range []string{second.Uid, arm.Uid} {
+		art, err := retrieve(uid)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"latest", "release"}, art.Tag)
+	}
+
+	// Deleting tags from many artifacts in the same path is fine.
+	tagged, err = server.BatchTag(ctx, &astore.BatchTagRequest{Selection: &astore.Selection{List: hello, Uid: []string{copied.Uid}}, Del: &astore.TagSet{Tag: []string{"release", "latest"}}})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{first.Uid, second.Uid, arm.Uid, copied.Uid}, uids(tagged.Artifact))
+	for _, art := range tagged.Artifact {
+		assert.Empty(t, art.Tag)
+	}
+
+	noted, err := server.BatchNote(ctx, &astore.BatchNoteRequest{Selection: &astore.Selection{Uid: []string{first.Uid, copied.Uid, first.Uid}}, Note: "same content"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{first.Uid, copied.Uid}, uids(noted.Artifact))
+	art, err = retrieve(copied.Uid)
+	require.NoError(t, err)
+	assert.Equal(t, "same content", art.Note)
+
+	// Invalid selections.
+	_, err = server.BatchNote(ctx, &astore.BatchNoteRequest{Note: "nothing"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.BatchNote(ctx, &astore.BatchNoteRequest{Selection: &astore.Selection{List: &astore.ListRequest{Path: "/"}}, Note: "everything"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.BatchNote(ctx, &astore.BatchNoteRequest{Selection: &astore.Selection{Uid: []string{"not-an-uid"}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// The metadata store applies all changes, or none.
+	missing := "abcdefghijklmnopqrstuvwxyz234567"
+	_, err = server.meta.Update(server.ctx, []string{first.Uid, missing}, func(art *Artifact) error {
+		art.Note = "partial"
+		return nil
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.meta.Update(server.ctx, []string{first.Uid, second.Uid}, func(art *Artifact) error {
+		art.Note = "partial"
+		if art.Uid == second.Uid {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	assert.Error(t, err)
+	art, err = retrieve(first.Uid)
+	require.NoError(t, err)
+	assert.Equal(t, "same content", art.Note)
+
+	_, _, err = server.meta.Delete(server.ctx, []string{first.Uid, missing})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = retrieve(first.Uid)
+	assert.NoError(t, err)
+
+	// Deleting requires the permission on all the artifacts selected.
+	dev := oauth.SetCredentials(context.Background(), &oauth.CredentialsCookie{
+		Identity: oauth.Identity{Username: "dev", Organization: "enkit.test"},
+	})
+	_, err = server.SetAcl(ctx, &astore.SetAclRequest{Acl: &astore.Acl{Path: "tools/copy", Delete: []string{"group:admins"}}})
+	require.NoError(t, err)
+	_, err = server.BatchDelete(dev, &astore.BatchDeleteRequest{Selection: &astore.Selection{List: hello, Uid: []string{copied.Uid}}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	dryDeleted, err := server.BatchDelete(dev, &astore.BatchDeleteRequest{Selection: &astore.Selection{List: hello}, DryRun: true})
+	require.NoError(t, err)
+	assert.Len(t, dryDeleted.Artifact, 3)
+	assert.Empty(t, dryDeleted.Sid)
+
+	deleted, err := server.BatchDelete(dev, &astore.BatchDeleteRequest{Selection: &astore.Selection{List: hello}})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{first.Uid, second.Uid, arm.Uid}, uids(deleted.Artifact))
+	// The blob of the first artifact is still used by the copy.
+	assert.ElementsMatch(t, []string{second.Sid, arm.Sid}, deleted.Sid)
+	for _, uid := range []string{first.Uid, second.Uid, arm.Uid} {
+		_, err := retrieve(uid)
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	}
+	_, err = retrieve(copied.Uid)
+	assert.NoError(t, err)
+
+	history, err := server.History(ctx, &astore.HistoryRequest{Uid: first.Uid, Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, history.Entry, 1)
+	assert.Equal(t, astore.AuditEntry_DELETE, history.Entry[0].Operation)
+	assert.Equal(t, "dev@enkit.test", history.Entry[0].User)
+}
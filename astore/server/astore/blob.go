@@ -0,0 +1,85 @@
+package astore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// ErrBlobNotFound is returned by a BlobStore when the requested sid has no data.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// ErrBlobCorrupted is returned by a MultipartBlobStore when the assembled blob does not match the expected MD5.
+var ErrBlobCorrupted = errors.New("blob does not match the expected checksum")
+
+// BlobAttrs are the attributes of a blob that has been uploaded to a BlobStore.
+type BlobAttrs struct {
+	Size int64
+	MD5  []byte
+	// True if MD5 was supplied by the client rather than computed by the store.
+	MD5Unverified bool
+	// SHA256 of the blob, nil if the store does not compute it.
+	SHA256 []byte
+
+	// Arbitrary key value pairs attached with Annotate.
+	Metadata map[string]string
+}
+
+// BlobStore stores the bytes backing an artifact, indexed by sid.
+//
+// The astore server never proxies data through its gRPC API: clients are
+// handed URLs by Store and Retrieve, and upload or download the content
+// directly from there.
+type BlobStore interface {
+	// PutURL returns a URL that can be used to upload the blob with an HTTP PUT.
+	PutURL(ctx context.Context, sid string) (string, error)
+	// GetURL returns a URL that can be used to download the blob with an HTTP GET.
+	GetURL(ctx context.Context, sid string) (string, error)
+
+	// Stat returns the attributes of an uploaded blob, or ErrBlobNotFound.
+	Stat(ctx context.Context, sid string) (*BlobAttrs, error)
+	// Open returns a reader for the content of the blob, or ErrBlobNotFound.
+	//
+	// Used by the server to compute the digests a BlobStore does not provide.
+	Open(ctx context.Context, sid string) (io.ReadCloser, error)
+	// OpenRange returns a reader for length bytes of the blob starting at
+	// offset, or ErrBlobNotFound.
+	//
+	// Used by the server to read the index of archives, without reading the
+	// whole blob.
+	OpenRange(ctx context.Context, sid string, offset, length int64) (io.ReadCloser, error)
+	// Annotate attaches metadata to an uploaded blob.
+	//
+	// Metadata is only used to make it possible to find out what a blob is
+	// when looking at the storage directly.
+	Annotate(ctx context.Context, sid string, metadata map[string]string) error
+	// Delete removes the blob. Deleting a blob that does not exist returns ErrBlobNotFound.
+	Delete(ctx context.Context, sid string) error
+}
+
+// MultipartBlobStore is a BlobStore supporting uploads in parts.
+//
+// Parts are uploaded independently, possibly in parallel, through the URLs
+// returned by PartURL, and then assembled into the blob with Compose.
+// Until Compose is invoked, the blob does not exist.
+type MultipartBlobStore interface {
+	BlobStore
+
+	// PartURL returns a URL that can be used to upload a part of the blob with an HTTP PUT.
+	PartURL(ctx context.Context, sid string, part int) (string, error)
+	// StatPart returns the size of a part that has been uploaded, or ErrBlobNotFound.
+	StatPart(ctx context.Context, sid string, part int) (int64, error)
+	// Compose assembles parts 0 to parts - 1 into the blob, and deletes them.
+	//
+	// If md5 is not empty, it is the expected MD5 of the blob. Stores that
+	// can verify it return ErrBlobCorrupted on mismatch.
+	Compose(ctx context.Context, sid string, parts int, md5 []byte) error
+}
+
+// BlobHandler returns the http.Handler serving uploads and downloads of blobs,
+// or nil if the BlobStore in use does not rely on the astore server to serve them.
+func (s *Server) BlobHandler() http.Handler {
+	handler, _ := s.blobs.(http.Handler)
+	return handler
+}
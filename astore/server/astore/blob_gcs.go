@@ -0,0 +1,164 @@
+package astore
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"cloud.google.com/go/storage"
+)
+
+// Functions mocked in unit tests
+var storageSignedURL = storage.SignedURL
+
+// GCSBlobStore is a BlobStore keeping blobs in a Google Cloud Storage bucket.
+//
+// Clients upload and download the data directly from GCS using signed URLs.
+type GCSBlobStore struct {
+	bucket string
+	bkt    *storage.BucketHandle
+
+	options *Options
+}
+
+// NewGCSBlobStore returns a BlobStore using the bucket and signing
+// configuration specified in options.
+func NewGCSBlobStore(gcs *storage.Client, options *Options) *GCSBlobStore {
+	return &GCSBlobStore{
+		bucket:  options.bucket,
+		bkt:     gcs.Bucket(options.bucket),
+		options: options,
+	}
+}
+
+func (gs *GCSBlobStore) PutURL(ctx context.Context, sid string) (string, error) {
+	return storageSignedURL(gs.bucket, objectPath(sid), gs.options.ForSigning("PUT"))
+}
+
+func (gs *GCSBlobStore) GetURL(ctx context.Context, sid string) (string, error) {
+	return storageSignedURL(gs.bucket, objectPath(sid), gs.options.ForSigning("GET"))
+}
+
+// gcsPartPath returns the name of the object storing a part of the blob sid.
+func gcsPartPath(sid string, part int) string {
+	return fmt.Sprintf("%s.part%05d", objectPath(sid), part)
+}
+
+func (gs *GCSBlobStore) PartURL(ctx context.Context, sid string, part int) (string, error) {
+	return storageSignedURL(gs.bucket, gcsPartPath(sid, part), gs.options.ForSigning("PUT"))
+}
+
+func (gs *GCSBlobStore) StatPart(ctx context.Context, sid string, part int) (int64, error) {
+	attrs, err := gs.bkt.Object(gcsPartPath(sid, part)).Attrs(ctx)
+	if err != nil {
+		return 0, gcsError(err)
+	}
+	return attrs.Size, nil
+}
+
+// gcsMaxCompose is the maximum number of objects GCS accepts in a single compose request.
+const gcsMaxCompose = 32
+
+// gcsMD5Key is the metadata key storing the MD5 of composite objects.
+//
+// GCS does not compute the MD5 of composite objects, so the one supplied by
+// the client is stored instead. Stat reports it as unverified: the blob must be
+// read in full to check it, which the server does when it is first committed.
+const gcsMD5Key = "astore-md5"
+
+func (gs *GCSBlobStore) Compose(ctx context.Context, sid string, parts int, md5 []byte) error {
+	var names, intermediate []string
+	for part := 0; part < parts; part++ {
+		names = append(names, gcsPartPath(sid, part))
+	}
+	// names is replaced by the intermediate objects as the tree is composed.
+	partNames := slices.Clone(names)
+	defer func() {
+		for _, name := range append(partNames, intermediate...) {
+			gs.bkt.Object(name).Delete(ctx)
+		}
+	}()
+
+	compose := func(dest string, sources []string, metadata map[string]string) error {
+		var objects []*storage.ObjectHandle
+		for _, source := range sources {
+			objects = append(objects, gs.bkt.Object(source))
+		}
+		composer := gs.bkt.Object(dest).ComposerFrom(objects...)
+		composer.ContentType = "application/octet-stream"
+		composer.Metadata = metadata
+		_, err := composer.Run(ctx)
+		return gcsError(err)
+	}
+
+	// Compose the parts in a tree, gcsMaxCompose objects at a time.
+	for round := 0; len(names) > gcsMaxCompose; round++ {
+		var next []string
+		for start := 0; start < len(names); start += gcsMaxCompose {
+			end := min(start+gcsMaxCompose, len(names))
+			dest := fmt.Sprintf("%s.compose%d-%05d", objectPath(sid), round, start)
+			if err := compose(dest, names[start:end], nil); err != nil {
+				return err
+			}
+			next = append(next, dest)
+			intermediate = append(intermediate, dest)
+		}
+		names = next
+	}
+
+	var metadata map[string]string
+	if len(md5) > 0 {
+		metadata = map[string]string{gcsMD5Key: hex.EncodeToString(md5)}
+	}
+	return compose(objectPath(sid), names, metadata)
+}
+
+func gcsError(err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (gs *GCSBlobStore) Stat(ctx context.Context, sid string) (*BlobAttrs, error) {
+	attrs, err := gs.bkt.Object(objectPath(sid)).Attrs(ctx)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	if len(attrs.MD5) == 0 {
+		sum, _ := hex.DecodeString(attrs.Metadata[gcsMD5Key])
+		return &BlobAttrs{Size: attrs.Size, MD5: sum, MD5Unverified: len(sum) > 0, Metadata: attrs.Metadata}, nil
+	}
+	return &BlobAttrs{Size: attrs.Size, MD5: attrs.MD5, Metadata: attrs.Metadata}, nil
+}
+
+func (gs *GCSBlobStore) Open(ctx context.Context, sid string) (io.ReadCloser, error) {
+	r, err := gs.bkt.Object(objectPath(sid)).NewReader(ctx)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return r, nil
+}
+
+func (gs *GCSBlobStore) OpenRange(ctx context.Context, sid string, offset, length int64) (io.ReadCloser, error) {
+	r, err := gs.bkt.Object(objectPath(sid)).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return r, nil
+}
+
+func (gs *GCSBlobStore) Annotate(ctx context.Context, sid string, metadata map[string]string) error {
+	// Update patches the metadata: keys not specified, like gcsMD5Key, are preserved.
+	_, err := gs.bkt.Object(objectPath(sid)).Update(ctx, storage.ObjectAttrsToUpdate{
+		Metadata: metadata,
+	})
+	return gcsError(err)
+}
+
+func (gs *GCSBlobStore) Delete(ctx context.Context, sid string) error {
+	return gcsError(gs.bkt.Object(objectPath(sid)).Delete(ctx))
+}
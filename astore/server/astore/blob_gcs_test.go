@@ -0,0 +1,102 @@
+package astore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+// fakeGCS implements the compose and delete calls of the GCS JSON API,
+// recording the objects composed and deleted.
+type fakeGCS struct {
+	mu       sync.Mutex
+	composed map[string][]string // Sources of each composed object
+	deleted  []string
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, name, ok := strings.Cut(r.URL.Path, "/b/test-bucket/o/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(name, "/compose"):
+		name = strings.TrimSuffix(name, "/compose")
+		var req struct {
+			SourceObjects []struct {
+				Name string `json:"name"`
+			} `json:"sourceObjects"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.SourceObjects) > gcsMaxCompose {
+			http.Error(w, "too many source objects", http.StatusBadRequest)
+			return
+		}
+		for _, source := range req.SourceObjects {
+			f.composed[name] = append(f.composed[name], source.Name)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"bucket": "test-bucket", "name": name})
+	case r.Method == http.MethodDelete:
+		f.deleted = append(f.deleted, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestGCSCompose(t *testing.T) {
+	ctx := context.Background()
+	for _, parts := range []int{1, gcsMaxCompose, gcsMaxCompose + 1, 3*gcsMaxCompose*gcsMaxCompose + 5} {
+		fake := &fakeGCS{composed: map[string][]string{}}
+		hs := httptest.NewServer(fake)
+		defer hs.Close()
+		client, err := storage.NewClient(ctx, option.WithEndpoint(hs.URL), option.WithoutAuthentication())
+		require.NoError(t, err)
+		store := NewGCSBlobStore(client, &Options{bucket: "test-bucket"})
+
+		require.NoError(t, store.Compose(ctx, "sid", parts, nil), "%d parts", parts)
+
+		// Resolves the composed objects down to the parts they are made of.
+		var resolve func(name string) []string
+		resolve = func(name string) []string {
+			sources, ok := fake.composed[name]
+			if !ok {
+				return []string{name}
+			}
+			var resolved []string
+			for _, source := range sources {
+				resolved = append(resolved, resolve(source)...)
+			}
+			return resolved
+		}
+		var want []string
+		for part := 0; part < parts; part++ {
+			want = append(want, gcsPartPath("sid", part))
+		}
+		assert.Equal(t, want, resolve(objectPath("sid")), "%d parts", parts)
+
+		// Parts and intermediate objects are deleted, the blob is not.
+		for name := range fake.composed {
+			if name != objectPath("sid") {
+				want = append(want, name)
+			}
+		}
+		assert.ElementsMatch(t, want, fake.deleted, "%d parts", parts)
+	}
+}
@@ -0,0 +1,460 @@
+package astore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/enfabrica/enkit/lib/token"
+)
+
+// LocalBlobStore is a BlobStore keeping blobs in a directory of the local file system.
+//
+// Uploads and downloads are served by the LocalBlobStore itself, which
+// implements http.Handler, through URLs carrying an encrypted and
+// time limited grant. This is the equivalent of a GCS signed URL, and
+// allows to run an astore server with no dependency on cloud services.
+//
+// The handler expects the sid as the path of the request, so it needs to
+// be mounted with something like:
+//
+//	mux.Handle("/b/", http.StripPrefix("/b/", store))
+//
+// with the baseURL of the store set to the externally visible URL of "/b/".
+type LocalBlobStore struct {
+	dir     string
+	baseURL string
+
+	encoder *token.TypeEncoder
+}
+
+// blobGrant is the content of the token appended to the URLs returned by a LocalBlobStore.
+type blobGrant struct {
+	Sid    string
+	Method string
+	// 1 + the index of the part the grant is for, 0 for the whole blob.
+	Part int `json:",omitempty"`
+}
+
+// localAttrs is the format of the file storing the BlobAttrs next to each blob.
+type localAttrs struct {
+	Size     int64
+	MD5      []byte
+	SHA256   []byte            `json:",omitempty"`
+	Metadata map[string]string `json:",omitempty"`
+}
+
+// NewLocalBlobStore creates a LocalBlobStore.
+//
+// dir is the directory where to store the blobs, created if it does not exist.
+// baseURL is the URL prepended to the sid to obtain the URL of the blob.
+// validity is how long the returned URLs will be valid for.
+//
+// setters configure the key used to protect the URLs. If none is supplied, a
+// random key is generated: URLs will stop working once the process exits.
+func NewLocalBlobStore(rng *rand.Rand, dir, baseURL string, validity time.Duration, setters ...token.SymmetricSetter) (*LocalBlobStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("a directory to store the blobs must be specified")
+	}
+	if baseURL == "" {
+		return nil, fmt.Errorf("a base URL to access the blobs must be specified")
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, fmt.Errorf("could not create blob directory %s - %w", dir, err)
+	}
+
+	if len(setters) == 0 {
+		setters = append(setters, token.WithGeneratedSymmetricKey(0))
+	}
+	be, err := token.NewSymmetricEncoder(rng, setters...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalBlobStore{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/",
+		encoder: token.NewTypeEncoder(token.NewChainedEncoder(token.NewTimeEncoder(nil, validity), be, token.NewBase64UrlEncoder())),
+	}, nil
+}
+
+func (ls *LocalBlobStore) blobPath(sid string) (string, error) {
+	if !IsSid(sid) {
+		return "", fmt.Errorf("invalid sid %q", sid)
+	}
+	return filepath.Join(ls.dir, filepath.FromSlash(objectPath(sid))), nil
+}
+
+func attrsPath(blob string) string {
+	return blob + ".attrs"
+}
+
+func partPath(blob string, part int) string {
+	return fmt.Sprintf("%s.part%05d", blob, part)
+}
+
+func (ls *LocalBlobStore) signedURL(sid, method string, part int) (string, error) {
+	if !IsSid(sid) {
+		return "", fmt.Errorf("invalid sid %q", sid)
+	}
+	grant, err := ls.encoder.Encode(&blobGrant{Sid: sid, Method: method, Part: part})
+	if err != nil {
+		return "", err
+	}
+	return ls.baseURL + sid + "?t=" + url.QueryEscape(string(grant)), nil
+}
+
+func (ls *LocalBlobStore) PutURL(ctx context.Context, sid string) (string, error) {
+	return ls.signedURL(sid, http.MethodPut, 0)
+}
+
+func (ls *LocalBlobStore) GetURL(ctx context.Context, sid string) (string, error) {
+	return ls.signedURL(sid, http.MethodGet, 0)
+}
+
+func (ls *LocalBlobStore) PartURL(ctx context.Context, sid string, part int) (string, error) {
+	if part < 0 {
+		return "", fmt.Errorf("invalid part %d", part)
+	}
+	return ls.signedURL(sid, http.MethodPut, part+1)
+}
+
+func readAttrs(blob string) (*localAttrs, error) {
+	data, err := os.ReadFile(attrsPath(blob))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	attrs := &localAttrs{}
+	if err := json.Unmarshal(data, attrs); err != nil {
+		return nil, fmt.Errorf("corrupted attributes for %s - %w", blob, err)
+	}
+	return attrs, nil
+}
+
+// writeFileAtomic writes a file by first creating a temporary and then renaming it,
+// so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func writeAttrs(blob string, attrs *localAttrs) error {
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(attrsPath(blob), data)
+}
+
+func (ls *LocalBlobStore) Stat(ctx context.Context, sid string) (*BlobAttrs, error) {
+	blob, err := ls.blobPath(sid)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(blob); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+
+	attrs, err := readAttrs(blob)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobAttrs{Size: attrs.Size, MD5: attrs.MD5, SHA256: attrs.SHA256, Metadata: attrs.Metadata}, nil
+}
+
+func (ls *LocalBlobStore) Open(ctx context.Context, sid string) (io.ReadCloser, error) {
+	return ls.open(sid)
+}
+
+func (ls *LocalBlobStore) OpenRange(ctx context.Context, sid string, offset, length int64) (io.ReadCloser, error) {
+	f, err := ls.open(sid)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+func (ls *LocalBlobStore) open(sid string) (*os.File, error) {
+	blob, err := ls.blobPath(sid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(blob)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func (ls *LocalBlobStore) Annotate(ctx context.Context, sid string, metadata map[string]string) error {
+	blob, err := ls.blobPath(sid)
+	if err != nil {
+		return err
+	}
+	attrs, err := readAttrs(blob)
+	if err != nil {
+		return err
+	}
+	if attrs.Metadata == nil {
+		attrs.Metadata = map[string]string{}
+	}
+	for k, v := range metadata {
+		attrs.Metadata[k] = v
+	}
+	return writeAttrs(blob, attrs)
+}
+
+func (ls *LocalBlobStore) Delete(ctx context.Context, sid string) error {
+	blob, err := ls.blobPath(sid)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(blob); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrBlobNotFound
+		}
+		return err
+	}
+	if err := os.Remove(attrsPath(blob)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (ls *LocalBlobStore) StatPart(ctx context.Context, sid string, part int) (int64, error) {
+	blob, err := ls.blobPath(sid)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(partPath(blob, part))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, ErrBlobNotFound
+		}
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (ls *LocalBlobStore) Compose(ctx context.Context, sid string, parts int, sum []byte) error {
+	blob, err := ls.blobPath(sid)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(blob), "."+filepath.Base(blob)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	hash, digest := md5.New(), sha256.New()
+	var size int64
+	for part := 0; part < parts; part++ {
+		written, err := appendFile(io.MultiWriter(f, hash, digest), partPath(blob, part))
+		if err != nil {
+			f.Close()
+			if errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("part %d: %w", part, ErrBlobNotFound)
+			}
+			return err
+		}
+		size += written
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	computed := hash.Sum(nil)
+	if len(sum) > 0 && !bytes.Equal(sum, computed) {
+		return ErrBlobCorrupted
+	}
+	if err := writeAttrs(blob, &localAttrs{Size: size, MD5: computed, SHA256: digest.Sum(nil)}); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), blob); err != nil {
+		return err
+	}
+
+	for part := 0; part < parts; part++ {
+		os.Remove(partPath(blob, part))
+	}
+	return nil
+}
+
+// appendFile copies the content of the file at path into w.
+func appendFile(w io.Writer, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// ServeHTTP handles uploads and downloads through the URLs returned by PutURL and GetURL.
+func (ls *LocalBlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sid := strings.TrimPrefix(r.URL.Path, "/")
+	blob, err := ls.blobPath(sid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+
+	var grant blobGrant
+	if _, err := ls.encoder.Decode(r.Context(), []byte(r.URL.Query().Get("t")), &grant); err != nil || grant.Sid != sid || grant.Method != method {
+		http.Error(w, "invalid or expired signature", http.StatusForbidden)
+		return
+	}
+
+	switch method {
+	case http.MethodGet:
+		if grant.Part != 0 {
+			http.Error(w, "parts cannot be downloaded", http.StatusMethodNotAllowed)
+			return
+		}
+		ls.serveGet(blob, w, r)
+	case http.MethodPut:
+		if grant.Part != 0 {
+			ls.servePart(partPath(blob, grant.Part-1), w, r)
+			return
+		}
+		ls.servePut(blob, w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (ls *LocalBlobStore) serveGet(blob string, w http.ResponseWriter, r *http.Request) {
+	f, err := os.Open(blob)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "blob not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "could not open blob", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "could not stat blob", http.StatusInternalServerError)
+		return
+	}
+
+	// Same parameter supported by GCS signed URLs, used to preserve the original file name.
+	if disposition := r.URL.Query().Get("response-content-disposition"); disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// receive stores the body of the request in a temporary file next to dest.
+//
+// Returns the temporary file and its attributes, or an error already reported to the client.
+// The caller is responsible for renaming or removing the temporary file.
+func receive(dest string, w http.ResponseWriter, r *http.Request) (string, *localAttrs, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0770); err != nil {
+		http.Error(w, "could not create directory", http.StatusInternalServerError)
+		return "", nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if err != nil {
+		http.Error(w, "could not create file", http.StatusInternalServerError)
+		return "", nil, err
+	}
+
+	hash, digest := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash, digest), r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		http.Error(w, "upload failed", http.StatusInternalServerError)
+		return "", nil, err
+	}
+	if r.ContentLength >= 0 && size != r.ContentLength {
+		os.Remove(f.Name())
+		err := fmt.Errorf("truncated upload - got %d bytes, expected %d", size, r.ContentLength)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, err
+	}
+	return f.Name(), &localAttrs{Size: size, MD5: hash.Sum(nil), SHA256: digest.Sum(nil)}, nil
+}
+
+func (ls *LocalBlobStore) servePut(blob string, w http.ResponseWriter, r *http.Request) {
+	temp, attrs, err := receive(blob, w, r)
+	if err != nil {
+		return
+	}
+	defer os.Remove(temp)
+
+	if err := writeAttrs(blob, attrs); err != nil {
+		http.Error(w, "could not store attributes", http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(temp, blob); err != nil {
+		http.Error(w, "could not store blob", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ls *LocalBlobStore) servePart(part string, w http.ResponseWriter, r *http.Request) {
+	temp, _, err := receive(part, w, r)
+	if err != nil {
+		return
+	}
+	defer os.Remove(temp)
+
+	if err := os.Rename(temp, part); err != nil {
+		http.Error(w, "could not store part", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
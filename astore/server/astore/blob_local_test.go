@@ -0,0 +1,152 @@
+package astore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func localBlobStoreForTest(t *testing.T) (*LocalBlobStore, *httptest.Server) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	hs := httptest.NewServer(mux)
+	t.Cleanup(hs.Close)
+
+	store, err := NewLocalBlobStore(rand.New(rand.NewSource(0)), t.TempDir(), hs.URL+"/b/", time.Hour)
+	require.NoError(t, err)
+	mux.Handle("/b/", http.StripPrefix("/b/", store))
+	return store, hs
+}
+
+func doRequest(t *testing.T, method, url string, body []byte) (int, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, data
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	ctx := context.Background()
+	store, _ := localBlobStoreForTest(t)
+
+	sid, err := GenerateSid(rand.New(rand.NewSource(1)))
+	require.NoError(t, err)
+
+	_, err = store.Stat(ctx, sid)
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	put, err := store.PutURL(ctx, sid)
+	require.NoError(t, err)
+	code, _ := doRequest(t, http.MethodPut, put, content)
+	require.Equal(t, http.StatusOK, code)
+
+	attrs, err := store.Stat(ctx, sid)
+	require.NoError(t, err)
+	sum := md5.Sum(content)
+	assert.Equal(t, int64(len(content)), attrs.Size)
+	assert.Equal(t, sum[:], attrs.MD5)
+
+	require.NoError(t, store.Annotate(ctx, sid, map[string]string{"path": "test/fox.txt"}))
+	attrs, err = store.Stat(ctx, sid)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"path": "test/fox.txt"}, attrs.Metadata)
+
+	get, err := store.GetURL(ctx, sid)
+	require.NoError(t, err)
+	code, data := doRequest(t, http.MethodGet, get, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, content, data)
+
+	require.NoError(t, store.Delete(ctx, sid))
+	_, err = store.Stat(ctx, sid)
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+	assert.ErrorIs(t, store.Delete(ctx, sid), ErrBlobNotFound)
+
+	code, _ = doRequest(t, http.MethodGet, get, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestLocalBlobStoreRejects(t *testing.T) {
+	ctx := context.Background()
+	store, hs := localBlobStoreForTest(t)
+
+	rng := rand.New(rand.NewSource(1))
+	sid, err := GenerateSid(rng)
+	require.NoError(t, err)
+	other, err := GenerateSid(rng)
+	require.NoError(t, err)
+
+	get, err := store.GetURL(ctx, sid)
+	require.NoError(t, err)
+	put, err := store.PutURL(ctx, sid)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc   string
+		method string
+		url    string
+		want   int
+	}{
+		{
+			desc:   "get url used to upload",
+			method: http.MethodPut,
+			url:    get,
+			want:   http.StatusForbidden,
+		},
+		{
+			desc:   "put url used to download",
+			method: http.MethodGet,
+			url:    put,
+			want:   http.StatusForbidden,
+		},
+		{
+			desc:   "grant for a different sid",
+			method: http.MethodGet,
+			url:    strings.Replace(get, sid, other, 1),
+			want:   http.StatusForbidden,
+		},
+		{
+			desc:   "missing grant",
+			method: http.MethodGet,
+			url:    hs.URL + "/b/" + sid,
+			want:   http.StatusForbidden,
+		},
+		{
+			desc:   "tampered grant",
+			method: http.MethodGet,
+			url:    get + "x",
+			want:   http.StatusForbidden,
+		},
+		{
+			desc:   "invalid sid",
+			method: http.MethodGet,
+			url:    hs.URL + "/b/aa/bb",
+			want:   http.StatusBadRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			code, _ := doRequest(t, tc.method, tc.url, []byte("data"))
+			assert.Equal(t, tc.want, code)
+		})
+	}
+}
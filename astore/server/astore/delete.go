@@ -2,9 +2,129 @@ package astore
 
 import (
 	"context"
+	"errors"
+	"strings"
+
 	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func (s *Server) Delete(ctx context.Context, request *astore.DeleteRequest) (*astore.DeleteResponse, error) {
-	panic("implement me")
+// Delete removes an artifact by uid, or all the artifacts stored in a blob by sid.
+//
+// Blobs are removed once no artifact references them anymore.
+func (s *Server) Delete(ctx context.Context, req *astore.DeleteRequest) (*astore.DeleteResponse, error) {
+	id := strings.TrimSpace(req.Id)
+	access, err := s.accessFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids, sids []string
+	switch {
+	case IsUid(id):
+		if err := s.checkUid(access, PermissionDelete, id); err != nil {
+			return nil, err
+		}
+		uids = append(uids, id)
+
+	case IsSid(id):
+		found, err := s.meta.FindBySid(s.ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, art := range found {
+			if err := access.check(PermissionDelete, art.Parent); err != nil {
+				return nil, err
+			}
+			uids = append(uids, art.Uid)
+		}
+		sids = append(sids, id)
+
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "%q is neither a valid uid nor a valid sid", id)
+	}
+
+	arts, blobs, err := s.deleteArtifacts(uids, sids)
+	s.auditDeleted(callerName(ctx), astore.AuditEntry_DELETE, arts)
+	if err == nil && len(arts) == 0 && len(blobs) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no match for id - %s", id)
+	}
+
+	resp := &astore.DeleteResponse{}
+	for _, art := range arts {
+		resp.Ids = append(resp.Ids, art.Uid)
+	}
+	resp.Ids = append(resp.Ids, blobs...)
+	return resp, err
+}
+
+// auditDeleted records the deletion of the artifacts in the audit log.
+func (s *Server) auditDeleted(user string, op astore.AuditEntry_Operation, arts []*Artifact) {
+	for _, art := range arts {
+		entry := auditArtifact(art)
+		entry.TagsBefore, entry.TagsAfter = art.Tag, nil
+		s.audit(user, op, entry)
+	}
+}
+
+// deleteArtifacts removes the artifacts with the uids specified, followed by the blobs
+// that are no longer referenced by any artifact.
+//
+// sids are additional blobs to remove, if not referenced by any artifact.
+// Returns the deleted artifacts, and the sids of the deleted blobs.
+func (s *Server) deleteArtifacts(uids []string, sids []string) ([]*Artifact, []string, error) {
+	var arts []*Artifact
+	defer func() { s.watchers.notify(astore.WatchEvent_DELETED, arts...) }()
+
+	check := map[string]struct{}{}
+	for _, sid := range sids {
+		check[sid] = struct{}{}
+	}
+
+	for _, uid := range uids {
+		deleted, orphans, err := s.meta.Delete(s.ctx, []string{uid})
+		if err != nil {
+			// Someone else deleted the artifact in the meantime.
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+			return arts, nil, err
+		}
+		for _, sid := range orphans {
+			check[sid] = struct{}{}
+		}
+		arts = append(arts, deleted...)
+	}
+
+	var orphans []string
+	for sid := range check {
+		orphans = append(orphans, sid)
+	}
+	blobs, err := s.deleteBlobs(orphans)
+	return arts, blobs, err
+}
+
+// deleteBlobs deletes the blobs with the sids specified, unless still referenced by an artifact.
+//
+// Returns the sids of the deleted blobs.
+func (s *Server) deleteBlobs(sids []string) ([]string, error) {
+	var blobs []string
+	for _, sid := range sids {
+		// Reference counts should be enough. But deleting data that is still
+		// in use is not something that can be undone, so better safe than sorry.
+		remaining, err := s.meta.FindBySid(s.ctx, sid)
+		if err != nil {
+			return blobs, err
+		}
+		if len(remaining) > 0 {
+			continue
+		}
+
+		if err := s.blobs.Delete(s.ctx, sid); err != nil && !errors.Is(err, ErrBlobNotFound) {
+			return blobs, status.Errorf(codes.Internal, "could not delete blob %s - %s", sid, err)
+		}
+		blobs = append(blobs, sid)
+	}
+	return blobs, nil
 }
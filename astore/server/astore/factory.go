@@ -17,8 +17,11 @@ import (
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 
+	"github.com/enfabrica/enkit/astore/rpc/astore"
 	"github.com/enfabrica/enkit/lib/kflags"
 	"github.com/enfabrica/enkit/lib/logger"
+	"github.com/enfabrica/enkit/lib/protocfg"
+	"github.com/enfabrica/enkit/lib/token"
 )
 
 type Modifier func(o *Options) error
@@ -133,6 +136,122 @@ func WithPublishBaseURL(url string) Modifier {
 	}
 }
 
+// WithBlobDir stores blobs in the specified local directory rather than in a GCS bucket.
+//
+// Uploads and downloads are served by the handler returned by Server.BlobHandler,
+// which must be reachable at the URL configured with WithBlobURL.
+func WithBlobDir(dir string) Modifier {
+	return func(o *Options) error {
+		o.blobDir = dir
+		return nil
+	}
+}
+
+// WithBlobURL sets the externally visible URL of the handler returned by Server.BlobHandler.
+func WithBlobURL(url string) Modifier {
+	return func(o *Options) error {
+		o.blobURL = url
+		return nil
+	}
+}
+
+// WithBlobKey sets the symmetric key used to protect the URLs of a local blob store.
+//
+// If not set, a random key is generated at startup.
+func WithBlobKey(key []byte) Modifier {
+	return func(o *Options) error {
+		o.blobKey = key
+		return nil
+	}
+}
+
+// WithBlobStore uses the supplied BlobStore, overriding any other blob related option.
+func WithBlobStore(blobs BlobStore) Modifier {
+	return func(o *Options) error {
+		o.blobs = blobs
+		return nil
+	}
+}
+
+// WithMetadataDB keeps the metadata of the artifacts in a local database file,
+// rather than in Google Cloud Datastore.
+func WithMetadataDB(path string) Modifier {
+	return func(o *Options) error {
+		o.metadataDB = path
+		return nil
+	}
+}
+
+// WithMetadataStore uses the supplied MetadataStore, overriding any other metadata related option.
+func WithMetadataStore(meta MetadataStore) Modifier {
+	return func(o *Options) error {
+		o.meta = meta
+		return nil
+	}
+}
+
+// WithAdmins sets the users allowed to invoke administrative RPCs, like GC.
+//
+// Users are identified by their global name, like "user@domain.com".
+func WithAdmins(admins ...string) Modifier {
+	return func(o *Options) error {
+		o.admins = append(o.admins, admins...)
+		return nil
+	}
+}
+
+// WithRetentionPolicies adds retention policies, applied by GC and by the janitor.
+func WithRetentionPolicies(policies ...*astore.RetentionPolicy) Modifier {
+	return func(o *Options) error {
+		o.retention = append(o.retention, policies...)
+		return nil
+	}
+}
+
+// WithRetentionConfig loads the retention policies from a file.
+//
+// The file contains an astore.RetentionConfig message, in any of the formats
+// supported by protocfg (.textproto, .json, .jsonnet, ...).
+func WithRetentionConfig(path string) Modifier {
+	return func(o *Options) error {
+		config, err := protocfg.FromFile[astore.RetentionConfig](path).Load()
+		if err != nil {
+			return fmt.Errorf("could not load retention config %s - %w", path, err)
+		}
+		return WithRetentionPolicies(config.Policy...)(o)
+	}
+}
+
+// WithGCInterval sets how often the janitor applies the retention policies.
+func WithGCInterval(interval time.Duration) Modifier {
+	return func(o *Options) error {
+		o.gcInterval = interval
+		return nil
+	}
+}
+
+// WithUploadChunkSize sets the default size of the parts of uploads performed with StartUpload.
+func WithUploadChunkSize(size int64) Modifier {
+	return func(o *Options) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid upload chunk size %d - must be positive", size)
+		}
+		o.uploadChunkSize = size
+		return nil
+	}
+}
+
+// WithVersionPrefix sets the prefix of the tags holding the version of an artifact.
+//
+// For example, with the default prefix "v", the tag "v1.4.2" gives version 1.4.2
+// to an artifact, used to select artifacts with a version constraint.
+func WithVersionPrefix(prefix string) Modifier {
+	return func(o *Options) error {
+		o.versionPrefix = prefix
+		return nil
+	}
+}
+
 func WithLogger(log logger.Logger) Modifier {
 	return func(o *Options) error {
 		o.logger = log
@@ -147,6 +266,19 @@ type Flags struct {
 	SignatureValidity time.Duration
 	PublishBaseURL    string
 
+	BlobDir string
+	BlobURL string
+	BlobKey []byte
+
+	MetadataDB string
+
+	Admins          []string
+	RetentionConfig string
+	GCInterval      time.Duration
+
+	UploadChunkMB int
+	VersionPrefix string
+
 	ProjectIDJSON       []byte
 	SigningConfigJSON   []byte
 	CredentialsFileJSON []byte
@@ -161,10 +293,25 @@ func WithFlags(flags *Flags) Modifier {
 		if len(flags.ProjectIDJSON) > 0 {
 			WithProjectIDJSON(flags.ProjectIDJSON)(o)
 		}
-		if flags.Bucket == "" {
-			return kflags.NewUsageErrorf("A bucket must be specified with the --bucket option")
+		if flags.Bucket == "" && flags.BlobDir == "" {
+			return kflags.NewUsageErrorf("A bucket must be specified with the --bucket option, or a local directory with --blob-dir")
 		}
 		WithBucket(flags.Bucket)(o)
+		WithBlobDir(flags.BlobDir)(o)
+		WithBlobURL(flags.BlobURL)(o)
+		WithBlobKey(flags.BlobKey)(o)
+		WithMetadataDB(flags.MetadataDB)(o)
+		WithAdmins(flags.Admins...)(o)
+		WithGCInterval(flags.GCInterval)(o)
+		WithVersionPrefix(flags.VersionPrefix)(o)
+		if err := WithUploadChunkSize(int64(flags.UploadChunkMB) << 20)(o); err != nil {
+			return err
+		}
+		if flags.RetentionConfig != "" {
+			if err := WithRetentionConfig(flags.RetentionConfig)(o); err != nil {
+				return err
+			}
+		}
 
 		WithPublishBaseURL(flags.PublishBaseURL)(o)
 		if flags.SignatureValidity != 0 {
@@ -199,6 +346,9 @@ func DefaultFlags() *Flags {
 		Bucket:            options.bucket,
 		ProjectID:         options.projectID,
 		SignatureValidity: options.expires,
+		GCInterval:        options.gcInterval,
+		UploadChunkMB:     int(options.uploadChunkSize >> 20),
+		VersionPrefix:     options.versionPrefix,
 	}
 }
 
@@ -206,6 +356,16 @@ func (f *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 	set.StringVar(&f.Bucket, prefix+"bucket", f.Bucket, "Datastore bucket where to store the artifacts")
 	set.StringVar(&f.ProjectID, prefix+"project-id", f.ProjectID, "Project id for datastore access")
 	set.StringVar(&f.PublishBaseURL, prefix+"publish-base-url", "", "URL prependend to published file paths, to turn them into downloadable URLs")
+	set.StringVar(&f.BlobDir, prefix+"blob-dir", f.BlobDir, "If set, artifacts are stored in this local directory and served by the astore server itself, rather than stored in the GCS bucket")
+	set.StringVar(&f.BlobURL, prefix+"blob-url", f.BlobURL, "URL at which the astore server serves the blobs stored in --"+prefix+"blob-dir")
+	set.ByteFileVar(&f.BlobKey, prefix+"blob-key", "",
+		"Path to a file containing the key used to sign the URLs of the blobs stored in --"+prefix+"blob-dir. If not specified, a random key is generated at each start")
+	set.StringVar(&f.MetadataDB, prefix+"metadata-db", f.MetadataDB, "If set, the metadata of the artifacts is stored in this local database file rather than in datastore")
+	set.StringArrayVar(&f.Admins, prefix+"admin", f.Admins, "Users allowed to invoke administrative RPCs, like user@domain.com. Can be repeated")
+	set.StringVar(&f.RetentionConfig, prefix+"retention-config", f.RetentionConfig, "Path to a file with the retention policies to apply - textproto, json, or jsonnet")
+	set.DurationVar(&f.GCInterval, prefix+"gc-interval", f.GCInterval, "How often to delete the artifacts no longer retained by the --"+prefix+"retention-config policies. 0 to disable")
+	set.IntVar(&f.UploadChunkMB, prefix+"upload-chunk-mb", f.UploadChunkMB, "Default size in MB of each part of large artifacts uploaded in parts")
+	set.StringVar(&f.VersionPrefix, prefix+"version-prefix", f.VersionPrefix, "Prefix of the tags holding the semantic version of an artifact, like v in v1.4.2. Used to select artifacts by version constraint")
 	set.DurationVar(&f.SignatureValidity, prefix+"url-validity", f.SignatureValidity, "How long should the signed URL be valid for")
 	set.ByteFileVar(&f.ProjectIDJSON, prefix+"project-id-file", "",
 		"Rather than specify a project id directly, you can specify a json file containing a project_id value (credentials file, jwt, ...)")
@@ -226,6 +386,21 @@ type Options struct {
 	expires time.Duration
 	signing storage.SignedURLOptions
 
+	blobDir string
+	blobURL string
+	blobKey []byte
+	blobs   BlobStore
+
+	metadataDB string
+	meta       MetadataStore
+
+	admins     []string
+	retention  []*astore.RetentionPolicy
+	gcInterval time.Duration
+
+	uploadChunkSize int64
+	versionPrefix   string
+
 	logger logger.Logger
 
 	tokenPublicKeys []jwt.VerificationKey
@@ -238,8 +413,12 @@ func DefaultOptions() Options {
 		projectID: datastore.DetectProjectID,
 		bucket:    "artifacts",
 
-		expires: time.Hour * 24,
-		logger:  &logger.NilLogger{},
+		expires:    time.Hour * 24,
+		gcInterval: time.Hour * 6,
+		logger:     &logger.NilLogger{},
+
+		uploadChunkSize: defaultUploadChunkSize,
+		versionPrefix:   DefaultVersionPrefix,
 	}
 }
 
@@ -258,34 +437,67 @@ func New(rng *rand.Rand, mods ...Modifier) (*Server, error) {
 		}
 	}
 
-	if options.bucket == "" {
-		return nil, fmt.Errorf("incorrect API usage - need to provide a bucket with WithBucket")
-	}
-
 	ctx := context.Background()
-	gcs, err := storage.NewClient(ctx, options.clientOptions...)
+	blobs, err := newBlobStore(ctx, rng, &options)
 	if err != nil {
 		return nil, err
 	}
 
-	ds, err := datastore.NewClient(ctx, options.projectID, options.clientOptions...)
+	meta, err := newMetadataStore(ctx, &options)
 	if err != nil {
 		return nil, err
 	}
 
-	bkt := gcs.Bucket(options.bucket)
-
 	server := &Server{
 		rng: rng,
 		ctx: ctx,
 
-		gcs: gcs,
-		bkt: bkt,
-
-		ds: ds,
+		blobs: blobs,
+		meta:  meta,
 
 		options: options,
 	}
 
 	return server, nil
 }
+
+// newBlobStore creates the BlobStore selected by the options.
+func newBlobStore(ctx context.Context, rng *rand.Rand, options *Options) (BlobStore, error) {
+	if options.blobs != nil {
+		return options.blobs, nil
+	}
+
+	if options.blobDir != "" {
+		var setters []token.SymmetricSetter
+		if len(options.blobKey) > 0 {
+			setters = append(setters, token.UseSymmetricKey(options.blobKey))
+		}
+		return NewLocalBlobStore(rng, options.blobDir, options.blobURL, options.expires, setters...)
+	}
+
+	if options.bucket == "" {
+		return nil, fmt.Errorf("incorrect API usage - need to provide a bucket with WithBucket, or a directory with WithBlobDir")
+	}
+	gcs, err := storage.NewClient(ctx, options.clientOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return NewGCSBlobStore(gcs, options), nil
+}
+
+// newMetadataStore creates the MetadataStore selected by the options.
+func newMetadataStore(ctx context.Context, options *Options) (MetadataStore, error) {
+	if options.meta != nil {
+		return options.meta, nil
+	}
+
+	if options.metadataDB != "" {
+		return OpenBoltMetadata(options.metadataDB)
+	}
+
+	ds, err := datastore.NewClient(ctx, options.projectID, options.clientOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return NewDatastoreMetadata(ds, options.logger), nil
+}
@@ -0,0 +1,191 @@
+package astore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+)
+
+// cleanPolicyPath normalizes a path for comparison with the prefix of a retention policy.
+func cleanPolicyPath(p string) string {
+	return strings.Trim(path.Clean("/"+strings.TrimSpace(p)), "/")
+}
+
+// hasPathPrefix returns true if p is prefix, or a path below prefix.
+//
+// Both p and prefix must have been normalized with cleanPolicyPath.
+func hasPathPrefix(p, prefix string) bool {
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// retentionPolicy returns the policy with the longest prefix matching the path of
+// an artifact, or nil if no policy applies.
+func retentionPolicy(policies []*astore.RetentionPolicy, p string) *astore.RetentionPolicy {
+	p = cleanPolicyPath(p)
+
+	var found *astore.RetentionPolicy
+	for _, policy := range policies {
+		prefix := cleanPolicyPath(policy.Prefix)
+		if !hasPathPrefix(p, prefix) {
+			continue
+		}
+		if found == nil || len(prefix) > len(cleanPolicyPath(found.Prefix)) {
+			found = policy
+		}
+	}
+	return found
+}
+
+// retentionReason returns why an artifact must be deleted according to the policy,
+// or the empty string if the artifact must be kept.
+//
+// position is the index of the artifact in the list of artifacts with the same path
+// and architecture, sorted most recent first.
+func retentionReason(policy *astore.RetentionPolicy, position int, art *Artifact, now time.Time) string {
+	if policy.KeepLast > 0 && position < int(policy.KeepLast) {
+		return ""
+	}
+	for _, tag := range policy.KeepTag {
+		if hasTag(art.Tag, tag) {
+			return ""
+		}
+	}
+
+	if policy.KeepLast > 0 {
+		return fmt.Sprintf("not one of the %d most recent artifacts", policy.KeepLast)
+	}
+	maxAge := time.Duration(policy.MaxUntaggedAgeSeconds) * time.Second
+	if maxAge > 0 && len(art.Tag) == 0 && now.Sub(art.Created) > maxAge {
+		return fmt.Sprintf("untagged and older than %s", maxAge)
+	}
+	return ""
+}
+
+// walk invokes fn for each path at or below root, with all the artifacts stored in it.
+func (s *Server) walk(root string, fn func(p string, arts []*Artifact) error) error {
+	elements, arts, err := s.meta.List(s.ctx, &ArtifactQuery{Path: root})
+	if err != nil {
+		return err
+	}
+	if len(arts) > 0 {
+		if err := fn(root, arts); err != nil {
+			return err
+		}
+	}
+
+	for _, element := range elements {
+		if err := s.walk(path.Join(root, element.Name), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collect returns the artifacts at or below root that must be deleted according to the retention policies.
+func (s *Server) collect(root string, now time.Time) ([]*astore.Collected, error) {
+	policies := s.options.retention
+	if len(policies) == 0 {
+		return nil, nil
+	}
+
+	var collected []*astore.Collected
+	err := s.walk(root, func(p string, arts []*Artifact) error {
+		policy := retentionPolicy(policies, p)
+		if policy == nil {
+			return nil
+		}
+
+		byArch := map[string][]*Artifact{}
+		for _, art := range arts {
+			byArch[art.Architecture] = append(byArch[art.Architecture], art)
+		}
+		for _, group := range byArch {
+			sort.SliceStable(group, func(i, j int) bool {
+				return group[i].Created.After(group[j].Created)
+			})
+			for position, art := range group {
+				reason := retentionReason(policy, position, art, now)
+				if reason == "" {
+					continue
+				}
+				collected = append(collected, &astore.Collected{Path: p, Artifact: art.ToProto(), Reason: reason})
+			}
+		}
+		return nil
+	})
+	return collected, err
+}
+
+// collectGarbage deletes the artifacts at or below root, and the corresponding blobs,
+// according to the retention policies of the server.
+//
+// With dryRun, it only reports the artifacts that would be deleted.
+// The deletions are recorded in the audit log on behalf of user.
+func (s *Server) collectGarbage(user, root string, dryRun bool) (*astore.GCResponse, error) {
+	collected, err := s.collect(root, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if dryRun || len(collected) == 0 {
+		return &astore.GCResponse{Collected: collected}, nil
+	}
+
+	var uids []string
+	for _, c := range collected {
+		uids = append(uids, c.Artifact.Uid)
+	}
+	arts, blobs, err := s.deleteArtifacts(uids, nil)
+	s.auditDeleted(user, astore.AuditEntry_COLLECT, arts)
+
+	deleted := map[string]struct{}{}
+	for _, art := range arts {
+		deleted[art.Uid] = struct{}{}
+	}
+	resp := &astore.GCResponse{Sid: blobs}
+	for _, c := range collected {
+		if _, found := deleted[c.Artifact.Uid]; found {
+			resp.Collected = append(resp.Collected, c)
+		}
+	}
+	return resp, err
+}
+
+// GC applies the retention policies to the artifacts under the requested path.
+func (s *Server) GC(ctx context.Context, req *astore.GCRequest) (*astore.GCResponse, error) {
+	if err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	return s.collectGarbage(callerName(ctx), req.Path, req.DryRun)
+}
+
+// RunJanitor periodically applies the retention policies to all artifacts, until the context is canceled.
+//
+// Returns immediately if no retention policy or no interval was configured.
+func (s *Server) RunJanitor(ctx context.Context) {
+	if len(s.options.retention) == 0 || s.options.gcInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.options.gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		resp, err := s.collectGarbage(JanitorUser, "", false)
+		if err != nil {
+			s.options.logger.Warnf("garbage collection failed - %s", err)
+		}
+		if resp != nil {
+			s.options.logger.Infof("garbage collection deleted %d artifacts and %d blobs", len(resp.Collected), len(resp.Sid))
+		}
+	}
+}
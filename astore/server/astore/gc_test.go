@@ -0,0 +1,123 @@
+package astore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	all := &astore.RetentionPolicy{Prefix: ""}
+	tools := &astore.RetentionPolicy{Prefix: "tools/"}
+	hello := &astore.RetentionPolicy{Prefix: "/tools/hello"}
+	policies := []*astore.RetentionPolicy{tools, all, hello}
+
+	testCases := []struct {
+		desc string
+		path string
+		want *astore.RetentionPolicy
+	}{
+		{desc: "root", path: "", want: all},
+		{desc: "unrelated path", path: "builds/x", want: all},
+		{desc: "prefix", path: "tools", want: tools},
+		{desc: "below prefix", path: "tools/world", want: tools},
+		{desc: "longest prefix wins", path: "tools/hello/amd64", want: hello},
+		{desc: "prefix is not a path prefix", path: "tools/hellothere", want: tools},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Same(t, tc.want, retentionPolicy(policies, tc.path))
+		})
+	}
+
+	assert.Nil(t, retentionPolicy([]*astore.RetentionPolicy{hello}, "tools"))
+}
+
+func TestRetentionReason(t *testing.T) {
+	now := time.Now()
+	old := &Artifact{Created: now.Add(-48 * time.Hour)}
+	oldTagged := &Artifact{Created: now.Add(-48 * time.Hour), Tag: []string{"stable"}}
+	recent := &Artifact{Created: now.Add(-time.Hour)}
+
+	testCases := []struct {
+		desc     string
+		policy   *astore.RetentionPolicy
+		position int
+		art      *Artifact
+		deleted  bool
+	}{
+		{desc: "empty policy keeps everything", policy: &astore.RetentionPolicy{}, position: 10, art: old},
+		{desc: "within keep last", policy: &astore.RetentionPolicy{KeepLast: 3}, position: 2, art: old},
+		{desc: "beyond keep last", policy: &astore.RetentionPolicy{KeepLast: 3}, position: 3, art: recent, deleted: true},
+		{desc: "beyond keep last with kept tag", policy: &astore.RetentionPolicy{KeepLast: 3, KeepTag: []string{"stable"}}, position: 3, art: oldTagged},
+		{desc: "beyond keep last with other tag", policy: &astore.RetentionPolicy{KeepLast: 3, KeepTag: []string{"latest"}}, position: 3, art: oldTagged, deleted: true},
+		{desc: "untagged and old", policy: &astore.RetentionPolicy{MaxUntaggedAgeSeconds: 86400}, art: old, deleted: true},
+		{desc: "untagged and recent", policy: &astore.RetentionPolicy{MaxUntaggedAgeSeconds: 86400}, art: recent},
+		{desc: "tagged and old", policy: &astore.RetentionPolicy{MaxUntaggedAgeSeconds: 86400}, art: oldTagged},
+		{desc: "untagged and old within keep last", policy: &astore.RetentionPolicy{KeepLast: 1, MaxUntaggedAgeSeconds: 86400}, art: old},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			reason := retentionReason(tc.policy, tc.position, tc.art, now)
+			assert.Equal(t, tc.deleted, reason != "", "reason: %q", reason)
+		})
+	}
+}
+
+func TestGC(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	server.options.retention = []*astore.RetentionPolicy{{Prefix: "tools", KeepLast: 2}}
+
+	var arts []*astore.Artifact
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		arts = append(arts, uploadForTest(t, server, ctx, content, &astore.CommitRequest{Path: "tools/hello", Architecture: "amd64"}))
+	}
+	untouched := uploadForTest(t, server, ctx, "other", &astore.CommitRequest{Path: "other/hello", Architecture: "amd64"})
+	// Same content as arts[0], so the blob is shared.
+	shared := uploadForTest(t, server, ctx, "v1", &astore.CommitRequest{Path: "tools/hello", Architecture: "arm64"})
+	require.Equal(t, arts[0].Sid, shared.Sid)
+
+	_, err := server.GC(ctx, &astore.GCRequest{DryRun: true})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	server.options.admins = []string{"tester@enkit.test"}
+
+	resp, err := server.GC(ctx, &astore.GCRequest{DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, resp.Collected, 2)
+	assert.Empty(t, resp.Sid)
+	for _, collected := range resp.Collected {
+		assert.Equal(t, "tools/hello", collected.Path)
+		assert.Contains(t, []string{arts[0].Uid, arts[1].Uid}, collected.Artifact.Uid)
+	}
+	_, err = server.Retrieve(ctx, &astore.RetrieveRequest{Uid: arts[0].Uid, Tag: &astore.TagSet{}})
+	require.NoError(t, err)
+
+	resp, err = server.GC(ctx, &astore.GCRequest{Path: "other"})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Collected)
+
+	resp, err = server.GC(ctx, &astore.GCRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Collected, 2)
+	assert.ElementsMatch(t, []string{arts[1].Sid}, resp.Sid)
+
+	for ix, art := range arts {
+		_, err = server.Retrieve(ctx, &astore.RetrieveRequest{Uid: art.Uid, Tag: &astore.TagSet{}})
+		if ix < 2 {
+			assert.Equal(t, codes.NotFound, status.Code(err))
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+	_, err = server.blobs.Stat(ctx, arts[1].Sid)
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+	_, err = server.blobs.Stat(ctx, shared.Sid)
+	assert.NoError(t, err)
+	_, err = server.Retrieve(ctx, &astore.RetrieveRequest{Uid: untouched.Uid})
+	assert.NoError(t, err)
+}
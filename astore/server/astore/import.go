@@ -0,0 +1,72 @@
+package astore
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Import records an artifact copied from another astore instance, preserving its metadata.
+//
+// Differently from Commit, the uid, creator and creation time are supplied by the
+// caller, which is why Import is restricted to admins.
+func (s *Server) Import(ctx context.Context, req *astore.ImportRequest) (*astore.ImportResponse, error) {
+	if err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	orig := req.Artifact
+	if req.Sid == "" || req.Path == "" || orig == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "must supply an sid, a path, and an artifact")
+	}
+	if !IsUid(orig.Uid) {
+		return nil, status.Errorf(codes.InvalidArgument, "%q is not a valid uid", orig.Uid)
+	}
+
+	_, err := s.meta.Retrieve(s.ctx, &ArtifactQuery{Uid: orig.Uid})
+	if err == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "artifact %s already exists", orig.Uid)
+	}
+	if status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+
+	blob, err := s.resolveBlob(req.Sid)
+	if err != nil {
+		return nil, err
+	}
+	if (len(orig.MD5) > 0 && len(blob.md5) > 0 && !bytes.Equal(orig.MD5, blob.md5)) ||
+		(len(orig.Sha256) > 0 && !bytes.Equal(orig.Sha256, blob.sha256)) || orig.Size != blob.size {
+		return nil, status.Errorf(codes.InvalidArgument, "content of %s does not match artifact %s", req.Sid, orig.Uid)
+	}
+	if err := checkSignature(req.Sid, blob, orig.Provenance, orig.Signature); err != nil {
+		return nil, err
+	}
+
+	architecture := "all"
+	if arch := strings.TrimSpace(orig.Architecture); arch != "" {
+		architecture = arch
+	}
+	artifact := &Artifact{
+		Uid:          orig.Uid,
+		Tag:          cleanUnique(orig.Tag),
+		Creator:      orig.Creator,
+		Created:      time.Unix(0, orig.Created),
+		Note:         orig.Note,
+		Provenance:   orig.Provenance,
+		Architecture: architecture,
+	}
+	if orig.Signature != nil {
+		artifact.SignerKey = orig.Signature.Key
+		artifact.Signature = orig.Signature.Signature
+	}
+	if err := s.record(req.Sid, req.Path, blob, artifact); err != nil {
+		return nil, err
+	}
+	s.audit(callerName(ctx), astore.AuditEntry_IMPORT, auditArtifact(artifact))
+	return &astore.ImportResponse{Artifact: artifact.ToProto()}, nil
+}
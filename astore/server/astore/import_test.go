@@ -0,0 +1,59 @@
+package astore
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// storeForTest uploads content without committing it, returning the sid.
+func storeForTest(t *testing.T, server *Server, ctx context.Context, content string) string {
+	t.Helper()
+
+	stored, err := server.Store(ctx, &astore.StoreRequest{})
+	require.NoError(t, err)
+	code, _ := doRequest(t, http.MethodPut, stored.Url, []byte(content))
+	require.Equal(t, http.StatusOK, code)
+	return stored.Sid
+}
+
+func TestImport(t *testing.T) {
+	source, sctx := localServerForTest(t)
+	orig := uploadForTest(t, source, sctx, "imported", &astore.CommitRequest{Path: "tools/hello", Architecture: "amd64", Tag: []string{"stable"}, Note: "v1"})
+
+	server, ctx := localServerForTest(t)
+	sid := storeForTest(t, server, ctx, "imported")
+	_, err := server.Import(ctx, &astore.ImportRequest{Sid: sid, Path: "tools/hello", Artifact: orig})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	server.options.admins = []string{"tester@enkit.test"}
+	// The content must match the artifact.
+	other := storeForTest(t, server, ctx, "different")
+	_, err = server.Import(ctx, &astore.ImportRequest{Sid: other, Path: "tools/hello", Artifact: orig})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	imported, err := server.Import(ctx, &astore.ImportRequest{Sid: sid, Path: "tools/hello", Artifact: orig})
+	require.NoError(t, err)
+	assert.Equal(t, orig.Uid, imported.Artifact.Uid)
+	assert.Equal(t, orig.Created, imported.Artifact.Created)
+	assert.Equal(t, orig.Creator, imported.Artifact.Creator)
+	assert.ElementsMatch(t, orig.Tag, imported.Artifact.Tag)
+	assert.Equal(t, "v1", imported.Artifact.Note)
+	assert.Equal(t, orig.Sha256, imported.Artifact.Sha256)
+
+	listed, err := server.List(ctx, &astore.ListRequest{Path: "tools/hello", Architecture: "amd64", Tag: &astore.TagSet{Tag: []string{"stable"}}})
+	require.NoError(t, err)
+	require.Len(t, listed.Artifact, 1)
+	assert.Equal(t, orig.Uid, listed.Artifact[0].Uid)
+
+	// Artifacts are imported only once.
+	again := storeForTest(t, server, ctx, "imported")
+	_, err = server.Import(ctx, &astore.ImportRequest{Sid: again, Path: "tools/hello", Artifact: orig})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
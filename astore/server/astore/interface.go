@@ -1,8 +1,11 @@
 package astore
 
 import (
-	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"path"
+	"strings"
 	"time"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
 )
 
 const KindArtifact = "Artifact"
@@ -12,26 +15,53 @@ type Artifact struct {
 	Sid string
 	Tag []string
 
-	MD5  []byte
-	Size int64
+	MD5    []byte
+	SHA256 []byte
+	Size   int64
 
 	Parent  string
 	Creator string
 	Created time.Time
 	Note    string `datastore:",noindex"`
+
+	// Serialized astore.Provenance, and detached signature of the artifact, if signed.
+	Provenance []byte `datastore:",noindex" json:",omitempty"`
+	SignerKey  []byte `json:",omitempty"`
+	Signature  []byte `datastore:",noindex" json:",omitempty"`
+
+	// Filled in by the MetadataStore when reading the artifact.
+	// In datastore, the architecture is part of the key.
+	Architecture string `datastore:"-"`
+}
+
+// Path returns the path of the artifact, as supplied by the user at commit time.
+func (af *Artifact) Path() string {
+	return userPath(af.Parent)
 }
 
-func (af *Artifact) ToProto(arch string) *astore.Artifact {
+// userPath turns a path cleaned with cleanPath back into the form used by users.
+func userPath(parent string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(parent, "root"), "/")
+}
+
+func (af *Artifact) ToProto() *astore.Artifact {
+	var signature *astore.Signature
+	if len(af.Signature) > 0 {
+		signature = &astore.Signature{Key: af.SignerKey, Signature: af.Signature}
+	}
 	return &astore.Artifact{
 		Uid:          af.Uid,
 		Sid:          af.Sid,
-		Architecture: arch,
+		Architecture: af.Architecture,
 		MD5:          af.MD5,
+		Sha256:       af.SHA256,
 		Size:         af.Size,
 		Tag:          af.Tag,
 		Creator:      af.Creator,
 		Created:      af.Created.UnixNano(),
 		Note:         af.Note,
+		Provenance:   af.Provenance,
+		Signature:    signature,
 	}
 }
 
@@ -51,6 +81,40 @@ type PathElement struct {
 
 	Created time.Time
 	Creator string
+
+	// Filled in by the MetadataStore when reading the element.
+	// In datastore, the name is part of the key.
+	Name string `datastore:"-"`
+}
+
+func (pe *PathElement) ToProto() *astore.Element {
+	return &astore.Element{Name: pe.Name, Created: pe.Created.UnixNano(), Creator: pe.Creator}
+}
+
+const KindBlob = "Blob"
+
+// Blob keeps track of the artifacts referencing a blob, so that artifacts
+// with identical content can share the same blob, and the blob can be
+// deleted once no artifact references it anymore.
+//
+// In datastore, the key of a Blob is its sid.
+type Blob struct {
+	MD5    []byte
+	SHA256 []byte
+	Size   int64
+
+	// Number of artifacts referencing the blob.
+	//
+	// Once it drops to 0 the blob is deleted, and the entry is kept as a
+	// tombstone: a deleted blob can no longer be referenced.
+	Refs int64
+	// If set, the blob was a duplicate of the blob with this sid, and was deleted.
+	DuplicateOf string
+
+	// Files in the blob, if it is an archive, as a marshalled astore.Manifest.
+	Manifest []byte `datastore:",noindex" json:",omitempty"`
+
+	Created time.Time
 }
 
 const KindPublished = "Pub"
@@ -60,6 +124,10 @@ type Published struct {
 	Creator string
 	Created time.Time
 
+	// Groups of the creator when the entry was published. Downloads are
+	// allowed only as long as the creator keeps the publish permission.
+	CreatorGroups []string `datastore:",noindex" json:",omitempty"`
+
 	// Fields from RetrieveRequest.
 	Uid          string
 	Path         string
@@ -72,12 +140,16 @@ type Published struct {
 	// We flatten the struct here, so we use a bool to differentiate between the two cases.
 	HasTags bool
 	Tag     []string
+
+	// Version constraint, to track the highest version in a range.
+	Version string `datastore:",noindex" json:",omitempty"`
 }
 
 func FromListRequest(req *astore.ListRequest, pub *Published) *Published {
 	pub.Uid = req.Uid
 	pub.Path = req.Path
 	pub.Architecture = req.Architecture
+	pub.Version = req.Version
 	if req.Tag != nil {
 		pub.HasTags = true
 		pub.Tag = req.Tag.Tag
@@ -90,6 +162,7 @@ func FromRetrieveRequest(req *astore.RetrieveRequest, pub *Published) *Published
 	pub.Uid = req.Uid
 	pub.Path = req.Path
 	pub.Architecture = req.Architecture
+	pub.Version = req.Version
 	if req.Tag != nil {
 		pub.HasTags = true
 		pub.Tag = req.Tag.Tag
@@ -103,6 +176,7 @@ func (pub *Published) ToRetrieveRequest() *astore.RetrieveRequest {
 	req.Uid = pub.Uid
 	req.Path = pub.Path
 	req.Architecture = pub.Architecture
+	req.Version = pub.Version
 	if pub.HasTags {
 		req.Tag = &astore.TagSet{Tag: pub.Tag}
 	}
@@ -115,9 +189,127 @@ func (pub *Published) ToListRequest() *astore.ListRequest {
 	req.Uid = pub.Uid
 	req.Path = pub.Path
 	req.Architecture = pub.Architecture
+	req.Version = pub.Version
 	if pub.HasTags {
 		req.Tag = &astore.TagSet{Tag: pub.Tag}
 	}
 
 	return req
 }
+
+const KindAcl = "Acl"
+
+// Acl is the access control list of a path, see astore.Acl.
+//
+// In datastore, the key of an Acl is its Parent.
+type Acl struct {
+	// Path the acl applies to, cleaned with cleanPath.
+	Parent string
+
+	Read    []string `datastore:",noindex"`
+	Write   []string `datastore:",noindex"`
+	Tag     []string `datastore:",noindex"`
+	Delete  []string `datastore:",noindex"`
+	Publish []string `datastore:",noindex"`
+
+	Creator string
+	Created time.Time
+}
+
+// Empty returns true if the acl grants no permission.
+func (acl *Acl) Empty() bool {
+	return len(acl.Read) == 0 && len(acl.Write) == 0 && len(acl.Tag) == 0 && len(acl.Delete) == 0 && len(acl.Publish) == 0
+}
+
+// Principals returns the principals granted the permission specified.
+func (acl *Acl) Principals(perm Permission) []string {
+	switch perm {
+	case PermissionRead:
+		return acl.Read
+	case PermissionWrite:
+		return acl.Write
+	case PermissionTag:
+		return acl.Tag
+	case PermissionDelete:
+		return acl.Delete
+	case PermissionPublish:
+		return acl.Publish
+	}
+	return nil
+}
+
+// Applies returns true if the acl applies to the path parent, cleaned with cleanPath.
+func (acl *Acl) Applies(parent string) bool {
+	return parent == acl.Parent || strings.HasPrefix(parent, acl.Parent+"/")
+}
+
+func FromAclProto(acl *astore.Acl, creator string) *Acl {
+	return &Acl{
+		Parent:  cleanPath(acl.Path),
+		Read:    cleanPrincipals(acl.Read),
+		Write:   cleanPrincipals(acl.Write),
+		Tag:     cleanPrincipals(acl.Tag),
+		Delete:  cleanPrincipals(acl.Delete),
+		Publish: cleanPrincipals(acl.Publish),
+		Creator: creator,
+		Created: time.Now(),
+	}
+}
+
+func (acl *Acl) ToProto() *astore.Acl {
+	return &astore.Acl{
+		Path:    userPath(acl.Parent),
+		Read:    acl.Read,
+		Write:   acl.Write,
+		Tag:     acl.Tag,
+		Delete:  acl.Delete,
+		Publish: acl.Publish,
+		Creator: acl.Creator,
+		Created: acl.Created.UnixNano(),
+	}
+}
+
+const KindAudit = "Audit"
+
+// Audit is an entry of the audit log, recording a change to an artifact, a published path, or an acl.
+type Audit struct {
+	Time      time.Time
+	User      string `datastore:",noindex"`
+	Operation string `datastore:",noindex"`
+
+	Uid string
+	// Path of the artifact, or of the acl, cleaned with cleanPath.
+	Parent       string `datastore:",noindex"`
+	Architecture string `datastore:",noindex"`
+	// Parent and all the paths above it, to find the entries below a path.
+	Paths []string `json:"-"`
+
+	TagsBefore []string `datastore:",noindex"`
+	TagsAfter  []string `datastore:",noindex"`
+	Note       string   `datastore:",noindex"`
+	Published  string   `datastore:",noindex"`
+}
+
+// parentPaths returns the path parent, cleaned with cleanPath, and all the paths above it.
+func parentPaths(parent string) []string {
+	var paths []string
+	for p := parent; p != "" && p != "." && p != "/"; p = path.Dir(p) {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func (au *Audit) ToProto() *astore.AuditEntry {
+	return &astore.AuditEntry{
+		Time:         au.Time.UnixNano(),
+		User:         au.User,
+		Operation:    astore.AuditEntry_Operation(astore.AuditEntry_Operation_value[au.Operation]),
+		Uid:          au.Uid,
+		Path:         userPath(au.Parent),
+		Architecture: au.Architecture,
+		TagsBefore:   au.TagsBefore,
+		TagsAfter:    au.TagsAfter,
+		Note:         au.Note,
+		Published:    au.Published,
+	}
+}
@@ -0,0 +1,205 @@
+package astore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/karchive"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxManifestSize is the size of the largest manifest recorded, to stay well
+// within the limits of a datastore entity. Larger archives have no manifest.
+const maxManifestSize = 512 * 1024
+
+// manifestTimeout bounds the time spent building the manifest of an archive.
+const manifestTimeout = 30 * time.Minute
+
+// manifestReadSize is the size of the range reads listing the files of a zip
+// archive, large enough to read most indexes in one or two reads.
+const manifestReadSize = 1024 * 1024
+
+// manifestRequest is an archive committed, waiting for its manifest.
+type manifestRequest struct {
+	path   string
+	format karchive.Format
+	sid    string
+	size   int64
+}
+
+// manifestQueue holds the archives waiting for their manifest, built one at a
+// time by a goroutine started as needed.
+type manifestQueue struct {
+	mu      sync.Mutex
+	pending []manifestRequest
+	running bool           // True while a goroutine is building the pending manifests.
+	done    sync.WaitGroup // Counts the archives queued, and not processed yet.
+}
+
+// recordManifest queues the artifact committed in p to have its files listed,
+// if p names an archive, so clients can extract some of them without
+// downloading the whole artifact.
+//
+// Manifests are built in the background, as reading a large archive takes
+// longer than clients wait for a commit: until then, the artifact has no manifest.
+func (s *Server) recordManifest(p string, artifact *Artifact) {
+	format := karchive.FormatOf(p)
+	if format == karchive.FormatUnknown {
+		return
+	}
+
+	q := &s.manifests
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.done.Add(1)
+	q.pending = append(q.pending, manifestRequest{path: p, format: format, sid: artifact.Sid, size: artifact.Size})
+	if !q.running {
+		q.running = true
+		go s.buildManifests()
+	}
+}
+
+// buildManifests records the manifests of the archives queued, until none is left.
+func (s *Server) buildManifests() {
+	q := &s.manifests
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		req := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(s.ctx, manifestTimeout)
+		s.storeManifest(ctx, req)
+		cancel()
+		q.done.Done()
+	}
+}
+
+// storeManifest builds and stores the manifest of the archive, unless the
+// blob already has one.
+//
+// Errors are only logged: the artifact is committed, just without a manifest.
+func (s *Server) storeManifest(ctx context.Context, req manifestRequest) {
+	blob, err := s.meta.GetBlob(ctx, req.sid)
+	if err != nil {
+		s.options.logger.Warnf("could not look up blob %s of %s - %s", req.sid, req.path, err)
+		return
+	}
+	if len(blob.Manifest) > 0 {
+		return
+	}
+
+	manifest, err := s.buildManifest(ctx, req.format, req.sid, req.size)
+	if err != nil {
+		s.options.logger.Infof("no manifest for %s - could not read it as a %s archive - %s", req.path, req.format, err)
+		return
+	}
+	data, err := proto.Marshal(manifest)
+	if err != nil {
+		s.options.logger.Warnf("could not marshal manifest of %s - %s", req.path, err)
+		return
+	}
+	if len(data) > maxManifestSize {
+		s.options.logger.Infof("no manifest for %s - %d files, manifest would be %d bytes, above limit", req.path, len(manifest.Entry), len(data))
+		return
+	}
+	if err := s.meta.SetManifest(ctx, req.sid, data); err != nil {
+		s.options.logger.Warnf("could not record manifest of %s - %s", req.path, err)
+	}
+}
+
+// blobReaderAt is an io.ReaderAt over a blob, performing range reads of at
+// least manifestReadSize bytes, and serving smaller reads from the last one.
+type blobReaderAt struct {
+	ctx   context.Context
+	blobs BlobStore
+	sid   string
+	size  int64
+
+	buf    []byte // Data of the last range read.
+	offset int64  // Offset of buf in the blob.
+}
+
+func (b *blobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	want := min(int64(len(p)), b.size-off)
+	if off < b.offset || off+want > b.offset+int64(len(b.buf)) {
+		length := min(max(want, manifestReadSize), b.size-off)
+		r, err := b.blobs.OpenRange(b.ctx, b.sid, off, length)
+		if err != nil {
+			return 0, err
+		}
+		defer r.Close()
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, err
+		}
+		b.buf, b.offset = buf, off
+	}
+
+	n := copy(p, b.buf[off-b.offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// buildManifest reads the blob sid as an archive of the specified format, and returns the files in it.
+func (s *Server) buildManifest(ctx context.Context, format karchive.Format, sid string, size int64) (*astore.Manifest, error) {
+	var entries []karchive.Entry
+	if format.IsTar() {
+		r, err := s.blobs.Open(ctx, sid)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		entries, err = karchive.ListTar(format, r)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Zip files have their index at the end: only the index is read.
+		var err error
+		entries, err = karchive.ListZip(&blobReaderAt{ctx: ctx, blobs: s.blobs, sid: sid, size: size}, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifest := &astore.Manifest{Format: astore.Manifest_Format(format)}
+	for _, entry := range entries {
+		manifest.Entry = append(manifest.Entry, &astore.ManifestEntry{
+			Name:       entry.Name,
+			Mode:       uint32(entry.Mode.Perm()),
+			Size:       entry.Size,
+			Offset:     entry.Offset,
+			StoredSize: entry.StoredSize,
+			Method:     uint32(entry.Method),
+			Crc32:      entry.CRC32,
+		})
+	}
+	return manifest, nil
+}
+
+// retrieveManifest returns the manifest recorded for the blob sid, or nil if there is none.
+func (s *Server) retrieveManifest(sid string) (*astore.Manifest, error) {
+	blob, err := s.meta.GetBlob(s.ctx, sid)
+	if err != nil || len(blob.Manifest) == 0 {
+		return nil, err
+	}
+	manifest := &astore.Manifest{}
+	if err := proto.Unmarshal(blob.Manifest, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
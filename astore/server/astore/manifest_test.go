@@ -0,0 +1,120 @@
+package astore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/karchive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	server, ctx := localServerForTest(t)
+
+	tarred := bytes.Buffer{}
+	tw := tar.NewWriter(&tarred)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./bin/tool", Mode: 0755, Size: 5}))
+	_, err := tw.Write([]byte("tool\n"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	zipped := bytes.Buffer{}
+	zw := zip.NewWriter(&zipped)
+	w, err := zw.Create("docs/README")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("read me, read me, read me"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	uploadForTest(t, server, ctx, tarred.String(), &astore.CommitRequest{Path: "tools/bundle.tar"})
+	uploadForTest(t, server, ctx, zipped.String(), &astore.CommitRequest{Path: "tools/docs.zip"})
+	uploadForTest(t, server, ctx, "not really a tar", &astore.CommitRequest{Path: "tools/broken.tar.gz"})
+	uploadForTest(t, server, ctx, tarred.String(), &astore.CommitRequest{Path: "tools/bundle"})
+	// Manifests are built in the background.
+	server.manifests.done.Wait()
+
+	resp, err := server.Retrieve(ctx, &astore.RetrieveRequest{Path: "tools/bundle.tar", Manifest: true})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Manifest)
+	assert.Equal(t, astore.Manifest_TAR, resp.Manifest.Format)
+	require.Len(t, resp.Manifest.Entry, 1)
+	entry := resp.Manifest.Entry[0]
+	assert.Equal(t, "bin/tool", entry.Name)
+	assert.Equal(t, uint32(0755), entry.Mode)
+	assert.Equal(t, int64(512), entry.Offset)
+	assert.Equal(t, "tool\n", tarred.String()[entry.Offset:entry.Offset+entry.StoredSize])
+
+	resp, err = server.Retrieve(ctx, &astore.RetrieveRequest{Path: "tools/docs.zip", Manifest: true})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Manifest)
+	assert.Equal(t, astore.Manifest_ZIP, resp.Manifest.Format)
+	require.Len(t, resp.Manifest.Entry, 1)
+	assert.Equal(t, "docs/README", resp.Manifest.Entry[0].Name)
+	assert.Equal(t, uint32(zip.Deflate), resp.Manifest.Entry[0].Method)
+
+	// Without asking, or for artifacts that are not archives, there is no manifest.
+	resp, err = server.Retrieve(ctx, &astore.RetrieveRequest{Path: "tools/docs.zip"})
+	require.NoError(t, err)
+	assert.Nil(t, resp.Manifest)
+	resp, err = server.Retrieve(ctx, &astore.RetrieveRequest{Path: "tools/broken.tar.gz", Manifest: true})
+	require.NoError(t, err)
+	assert.Nil(t, resp.Manifest)
+
+	// The same content committed under a name that is not an archive shares the manifest.
+	resp, err = server.Retrieve(ctx, &astore.RetrieveRequest{Path: "tools/bundle", Manifest: true})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Manifest)
+}
+
+// rangeBlobStore is a LocalBlobStore counting the bytes read by OpenRange,
+// and refusing to open blobs whole.
+type rangeBlobStore struct {
+	*LocalBlobStore
+	read int64
+}
+
+func (r *rangeBlobStore) Open(ctx context.Context, sid string) (io.ReadCloser, error) {
+	return nil, errors.New("blob opened whole")
+}
+
+func (r *rangeBlobStore) OpenRange(ctx context.Context, sid string, offset, length int64) (io.ReadCloser, error) {
+	r.read += length
+	return r.LocalBlobStore.OpenRange(ctx, sid, offset, length)
+}
+
+func TestManifestZipIndex(t *testing.T) {
+	server, ctx := localServerForTest(t)
+
+	zipped := bytes.Buffer{}
+	zw := zip.NewWriter(&zipped)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "data/large", Method: zip.Store})
+	require.NoError(t, err)
+	_, err = io.CopyN(w, rand.New(rand.NewSource(0)), 4*manifestReadSize)
+	require.NoError(t, err)
+	w, err = zw.Create("docs/README")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("read me"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	art := uploadForTest(t, server, ctx, zipped.String(), &astore.CommitRequest{Path: "data.zip"})
+	server.manifests.done.Wait()
+
+	// Only the index at the end of the archive is read.
+	blobs := &rangeBlobStore{LocalBlobStore: server.blobs.(*LocalBlobStore)}
+	server.blobs = blobs
+	manifest, err := server.buildManifest(ctx, karchive.FormatZip, art.Sid, art.Size)
+	require.NoError(t, err)
+	require.Len(t, manifest.Entry, 2)
+	assert.Equal(t, "data/large", manifest.Entry[0].Name)
+	assert.Equal(t, int64(4*manifestReadSize), manifest.Entry[0].Size)
+	assert.Equal(t, "docs/README", manifest.Entry[1].Name)
+	assert.Less(t, blobs.read, art.Size/2)
+}
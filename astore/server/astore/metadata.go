@@ -0,0 +1,158 @@
+package astore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ArtifactQuery selects artifacts stored in a MetadataStore.
+//
+// Each field is an "and": artifacts must match all the fields specified.
+type ArtifactQuery struct {
+	// Path the artifact is stored in. If empty, all paths are searched.
+	Path string
+	// Uid of the artifact.
+	Uid string
+	// Architecture of the artifact. If empty, any architecture matches.
+	Architecture string
+	// Tags the artifact must have, all of them. If empty, any artifact matches.
+	Tag []string
+	// SHA256 of the content of the artifact. If empty, any artifact matches.
+	SHA256 []byte
+	// Accept, if set, is invoked on the artifacts matching all the other
+	// fields: those it rejects are skipped. Used to skip artifacts the
+	// caller has no access to.
+	Accept func(*Artifact) bool
+}
+
+// AuditQuery selects entries of the audit log stored in a MetadataStore.
+type AuditQuery struct {
+	// Uid of the artifact. If empty, entries for any artifact match.
+	Uid string
+	// Path the entries must be at or below, cleaned with cleanPath. If empty, any path matches.
+	Path string
+	// Maximum number of entries to return. If 0, all entries are returned.
+	Limit int
+}
+
+// ArtifactUpdater modifies an artifact as part of a MetadataStore.Update call.
+type ArtifactUpdater func(*Artifact) error
+
+// MetadataStore keeps track of artifacts, the paths they are stored in, and published URLs.
+//
+// Errors are returned as grpc status errors, so they can be propagated directly
+// to the client: for example, codes.NotFound is returned if an artifact does not
+// exist, codes.AlreadyExists if a published path is already in use.
+type MetadataStore interface {
+	// Commit records a new artifact in the path and architecture specified.
+	//
+	// Any missing path element is created, and art.Parent is set to
+	// the cleaned path. The tags assigned to the artifact are removed
+	// from all other artifacts in the same path and architecture, as a
+	// tag can only be assigned to one version of an artifact.
+	//
+	// The reference count of the blob art.Sid is incremented, and the
+	// Blob recorded if unknown. codes.Aborted is returned if the blob
+	// has already been deleted.
+	Commit(ctx context.Context, path string, art *Artifact) error
+
+	// List returns the path elements immediately below query.Path, and the
+	// artifacts stored in query.Path matching the query, most recent first.
+	List(ctx context.Context, query *ArtifactQuery) ([]*PathElement, []*Artifact, error)
+
+	// Retrieve returns the most recent artifact matching the query.
+	//
+	// One of query.Path, query.Uid or query.SHA256 must be set.
+	Retrieve(ctx context.Context, query *ArtifactQuery) (*Artifact, error)
+
+	// Update invokes the updater on the artifacts with the specified uids,
+	// and atomically stores the result. Returns the updated artifacts.
+	//
+	// Either all the artifacts are updated, or none is: codes.NotFound is
+	// returned if any uid does not exist, and the error of the updater if
+	// it fails on any artifact. No artifact is returned with an error.
+	//
+	// If the updater changes the tags of an artifact, the new tags are
+	// removed from any other artifact in the same path and architecture.
+	Update(ctx context.Context, uids []string, updater ArtifactUpdater) ([]*Artifact, error)
+
+	// Delete removes the artifacts with the specified uids, and returns them.
+	//
+	// Either all the artifacts are deleted, or none is: codes.NotFound is
+	// returned if any uid does not exist.
+	//
+	// The reference count of their blobs is decremented. Returns the sids
+	// of the blobs no longer referenced by any artifact, which must be
+	// deleted by the caller.
+	Delete(ctx context.Context, uids []string) ([]*Artifact, []string, error)
+
+	// FindBySid returns all the artifacts referencing the specified sid.
+	FindBySid(ctx context.Context, sid string) ([]*Artifact, error)
+
+	// GetBlob returns the Blob recorded for sid.
+	GetBlob(ctx context.Context, sid string) (*Blob, error)
+	// FindBlob returns the sid of a blob with the specified digest and size,
+	// still referenced by at least one artifact.
+	FindBlob(ctx context.Context, md5 []byte, size int64) (string, error)
+	// MarkDuplicate records that the blob sid was a duplicate of the blob of,
+	// so that further commits of sid can be redirected to of.
+	MarkDuplicate(ctx context.Context, sid, of string) error
+	// SetManifest records the files in the archive stored in the blob sid.
+	SetManifest(ctx context.Context, sid string, manifest []byte) error
+
+	// Publish stores pub under the published path specified.
+	Publish(ctx context.Context, path string, pub *Published) error
+	// GetPublished returns the Published entry stored under path.
+	GetPublished(ctx context.Context, path string) (*Published, error)
+	// Unpublish removes the Published entry stored under path.
+	Unpublish(ctx context.Context, path string) error
+
+	// SetAcl stores acl, replacing the one stored for acl.Parent, if any.
+	// If the acl is empty, the stored one is removed instead.
+	SetAcl(ctx context.Context, acl *Acl) error
+	// ListAcls returns the acls of path and of the paths below it, sorted by path.
+	// An empty path returns all the acls.
+	ListAcls(ctx context.Context, path string) ([]*Acl, error)
+
+	// Audit appends an entry to the audit log. Entries are never modified or removed.
+	Audit(ctx context.Context, entry *Audit) error
+	// History returns the entries of the audit log matching the query, most recent first.
+	History(ctx context.Context, query *AuditQuery) ([]*Audit, error)
+}
+
+// cleanPath normalizes a path supplied by the user into a path suitable as
+// the Parent of an artifact or path element.
+//
+// The returned path always starts with "root".
+func cleanPath(orig string) string {
+	dir := path.Clean(filepath.ToSlash(strings.TrimSpace(orig)))
+	if dir == "." {
+		dir = ""
+	}
+	return path.Join("root", dir)
+}
+
+// cleanPublishPath normalizes a path supplied by the user to publish an artifact.
+//
+// Returns the path where the Published entity is stored, starting with "published",
+// and the cleaned path supplied by the user, to use in URLs.
+func cleanPublishPath(orig string) (string, string, error) {
+	cleaned := filepath.ToSlash(path.Clean(strings.TrimSpace(orig)))
+	if cleaned == "" || cleaned == "." {
+		return "", "", fmt.Errorf("%s results in empty cleaned after normalization", cleaned)
+	}
+
+	return path.Join("published", cleaned), cleaned, nil
+}
+
+// pathElements splits a cleaned path in its components.
+func pathElements(dir string) []string {
+	elements := strings.Split(dir, "/")
+	if elements[0] == "" {
+		elements = elements[1:]
+	}
+	return elements
+}
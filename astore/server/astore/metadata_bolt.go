@@ -0,0 +1,663 @@
+package astore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// Artifacts, indexed by uid.
+	boltArtifacts = []byte("artifacts")
+	// Path elements, indexed by parent and name.
+	boltPaths = []byte("paths")
+	// Published entries, indexed by cleaned publish path.
+	boltPublished = []byte("published")
+	// Blobs, indexed by sid.
+	boltBlobs = []byte("blobs")
+	// Acls, indexed by cleaned path.
+	boltAcls = []byte("acls")
+	// Audit log entries, indexed by time and sequence number.
+	boltAudit = []byte("audit")
+
+	// Index of the artifacts by parent, architecture and uid.
+	boltByPath = []byte("by-path")
+	// Index of the artifacts by sid and uid.
+	boltBySid = []byte("by-sid")
+	// Index of the blobs by md5, size and sid.
+	boltByDigest = []byte("by-digest")
+	// Index of the artifacts by hex encoded sha256 and uid.
+	boltBySHA256 = []byte("by-sha256")
+)
+
+// BoltMetadata is a MetadataStore keeping all the metadata in a local bbolt database.
+//
+// It allows to run an astore server with no dependency on cloud services,
+// typically together with a LocalBlobStore. All the operations are performed
+// in bbolt transactions, so the database is always consistent.
+type BoltMetadata struct {
+	db *bolt.DB
+}
+
+// OpenBoltMetadata opens or creates the bbolt database at the path specified.
+func OpenBoltMetadata(path string) (*BoltMetadata, error) {
+	db, err := bolt.Open(path, 0660, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open metadata database %s - %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltArtifacts, boltPaths, boltPublished, boltBlobs, boltAcls, boltAudit, boltByPath, boltBySid, boltByDigest, boltBySHA256} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not initialize metadata database %s - %w", path, err)
+	}
+	return &BoltMetadata{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (bm *BoltMetadata) Close() error {
+	return bm.db.Close()
+}
+
+// boltKey joins the components supplied in a key for one of the buckets.
+//
+// \x00 is used as a separator as it cannot appear in paths, architectures, sids or uids.
+func boltKey(components ...string) []byte {
+	return []byte(strings.Join(components, "\x00"))
+}
+
+// boltPrefix returns a prefix matching all the keys starting with the components supplied.
+func boltPrefix(components ...string) []byte {
+	return append(boltKey(components...), 0)
+}
+
+func boltGet(b *bolt.Bucket, key []byte, dest interface{}) (bool, error) {
+	data := b.Get(key)
+	if data == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, dest); err != nil {
+		return false, status.Errorf(codes.DataLoss, "corrupted entry %q - %s", key, err)
+	}
+	return true, nil
+}
+
+func boltPut(b *bolt.Bucket, key []byte, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// matchArtifact returns true if the artifact satisfies the query.
+func matchArtifact(art *Artifact, q *ArtifactQuery) bool {
+	if q.Uid != "" && art.Uid != q.Uid {
+		return false
+	}
+	if q.Architecture != "" && art.Architecture != q.Architecture {
+		return false
+	}
+	for _, tag := range q.Tag {
+		if !hasTag(art.Tag, tag) {
+			return false
+		}
+	}
+	if len(q.SHA256) > 0 && !bytes.Equal(art.SHA256, q.SHA256) {
+		return false
+	}
+	return q.Accept == nil || q.Accept(art)
+}
+
+// sortArtifacts sorts the artifacts most recent first, as the datastore queries do.
+func sortArtifacts(arts []*Artifact) {
+	sort.SliceStable(arts, func(i, j int) bool {
+		return arts[i].Created.After(arts[j].Created)
+	})
+}
+
+func (bm *BoltMetadata) getArtifact(tx *bolt.Tx, uid string) (*Artifact, error) {
+	art := &Artifact{}
+	found, err := boltGet(tx.Bucket(boltArtifacts), []byte(uid), art)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "no match for uid - %s", uid)
+	}
+	return art, nil
+}
+
+func (bm *BoltMetadata) putArtifact(tx *bolt.Tx, art *Artifact) error {
+	if err := boltPut(tx.Bucket(boltArtifacts), []byte(art.Uid), art); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltByPath).Put(boltKey(art.Parent, art.Architecture, art.Uid), nil); err != nil {
+		return err
+	}
+	if len(art.SHA256) > 0 {
+		if err := tx.Bucket(boltBySHA256).Put(boltKey(hex.EncodeToString(art.SHA256), art.Uid), nil); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(boltBySid).Put(boltKey(art.Sid, art.Uid), nil)
+}
+
+// scanArtifacts returns all the artifacts whose index key starts with prefix.
+func (bm *BoltMetadata) scanArtifacts(tx *bolt.Tx, index, prefix []byte) ([]*Artifact, error) {
+	var arts []*Artifact
+	c := tx.Bucket(index).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		uid := k[bytes.LastIndexByte(k, 0)+1:]
+		art, err := bm.getArtifact(tx, string(uid))
+		if err != nil {
+			return nil, status.Errorf(codes.DataLoss, "index %s points to missing artifact %s - %s", index, uid, err)
+		}
+		arts = append(arts, art)
+	}
+	return arts, nil
+}
+
+// queryArtifacts returns the artifacts matching the query, most recent first.
+func (bm *BoltMetadata) queryArtifacts(tx *bolt.Tx, q *ArtifactQuery) ([]*Artifact, error) {
+	var candidates []*Artifact
+	switch {
+	case q.Path != "" && q.Architecture != "":
+		arts, err := bm.scanArtifacts(tx, boltByPath, boltPrefix(cleanPath(q.Path), q.Architecture))
+		if err != nil {
+			return nil, err
+		}
+		candidates = arts
+
+	case q.Path != "":
+		arts, err := bm.scanArtifacts(tx, boltByPath, boltPrefix(cleanPath(q.Path)))
+		if err != nil {
+			return nil, err
+		}
+		candidates = arts
+
+	case q.Uid != "":
+		art, err := bm.getArtifact(tx, q.Uid)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return nil, err
+		}
+		if art != nil {
+			candidates = append(candidates, art)
+		}
+
+	case len(q.SHA256) > 0:
+		arts, err := bm.scanArtifacts(tx, boltBySHA256, boltPrefix(hex.EncodeToString(q.SHA256)))
+		if err != nil {
+			return nil, err
+		}
+		candidates = arts
+
+	default:
+		err := tx.Bucket(boltArtifacts).ForEach(func(k, v []byte) error {
+			art := &Artifact{}
+			if err := json.Unmarshal(v, art); err != nil {
+				return status.Errorf(codes.DataLoss, "corrupted artifact %s - %s", k, err)
+			}
+			candidates = append(candidates, art)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var result []*Artifact
+	for _, art := range candidates {
+		if matchArtifact(art, q) {
+			result = append(result, art)
+		}
+	}
+	sortArtifacts(result)
+	return result, nil
+}
+
+// createPath creates all the path elements leading to dir, ignoring those that already exist.
+func (bm *BoltMetadata) createPath(tx *bolt.Tx, dir string, creator string) error {
+	b := tx.Bucket(boltPaths)
+
+	parent := ""
+	for _, element := range pathElements(dir) {
+		key := boltKey(parent, element)
+		if b.Get(key) == nil {
+			if err := boltPut(b, key, &PathElement{Parent: parent, Created: time.Now(), Creator: creator}); err != nil {
+				return err
+			}
+		}
+		parent = path.Join(parent, element)
+	}
+	return nil
+}
+
+// deleteTags removes the tags supplied from all the artifacts in the same path
+// and architecture of art, except art itself.
+func (bm *BoltMetadata) deleteTags(tx *bolt.Tx, art *Artifact) error {
+	if len(art.Tag) == 0 {
+		return nil
+	}
+
+	others, err := bm.scanArtifacts(tx, boltByPath, boltPrefix(art.Parent, art.Architecture))
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other.Uid == art.Uid {
+			continue
+		}
+		tags := cleanUniqueDelete(other.Tag, art.Tag)
+		if len(tags) == len(other.Tag) {
+			continue
+		}
+		other.Tag = tags
+		if err := bm.putArtifact(tx, other); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func digestKey(md5 []byte, size int64, sid string) []byte {
+	return boltKey(hex.EncodeToString(md5), strconv.FormatInt(size, 10), sid)
+}
+
+func (bm *BoltMetadata) putBlob(tx *bolt.Tx, sid string, blob *Blob) error {
+	if err := boltPut(tx.Bucket(boltBlobs), []byte(sid), blob); err != nil {
+		return err
+	}
+	if blob.Refs <= 0 || blob.DuplicateOf != "" {
+		return tx.Bucket(boltByDigest).Delete(digestKey(blob.MD5, blob.Size, sid))
+	}
+	return tx.Bucket(boltByDigest).Put(digestKey(blob.MD5, blob.Size, sid), nil)
+}
+
+// getBlob returns the blob recorded for sid or, if it was never recorded, a Blob
+// counting the artifacts already referencing it.
+//
+// Returns true if the blob was recorded.
+func (bm *BoltMetadata) getBlob(tx *bolt.Tx, sid string) (*Blob, bool, error) {
+	blob := &Blob{}
+	found, err := boltGet(tx.Bucket(boltBlobs), []byte(sid), blob)
+	if err != nil || found {
+		return blob, found, err
+	}
+
+	prefix := boltPrefix(sid)
+	c := tx.Bucket(boltBySid).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		blob.Refs += 1
+	}
+	return blob, false, nil
+}
+
+func (bm *BoltMetadata) Commit(ctx context.Context, path string, art *Artifact) error {
+	art.Parent = cleanPath(path)
+
+	return bm.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltArtifacts).Get([]byte(art.Uid)) != nil {
+			return status.Errorf(codes.AlreadyExists, "artifact with uid %s already exists", art.Uid)
+		}
+		if err := bm.createPath(tx, art.Parent, art.Creator); err != nil {
+			return err
+		}
+		if err := bm.deleteTags(tx, art); err != nil {
+			return err
+		}
+
+		blob, found, err := bm.getBlob(tx, art.Sid)
+		if err != nil {
+			return err
+		}
+		if found && blob.Refs <= 0 {
+			return status.Errorf(codes.Aborted, "blob %s has already been deleted", art.Sid)
+		}
+		if !found {
+			blob.MD5, blob.SHA256, blob.Size, blob.Created = art.MD5, art.SHA256, art.Size, time.Now()
+		}
+		blob.Refs += 1
+		if err := bm.putBlob(tx, art.Sid, blob); err != nil {
+			return err
+		}
+		return bm.putArtifact(tx, art)
+	})
+}
+
+func (bm *BoltMetadata) List(ctx context.Context, q *ArtifactQuery) ([]*PathElement, []*Artifact, error) {
+	var elements []*PathElement
+	var arts []*Artifact
+
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		prefix := boltPrefix(cleanPath(q.Path))
+		c := tx.Bucket(boltPaths).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			element := &PathElement{}
+			if err := json.Unmarshal(v, element); err != nil {
+				return status.Errorf(codes.DataLoss, "corrupted path element %q - %s", k, err)
+			}
+			element.Name = string(k[len(prefix):])
+			elements = append(elements, element)
+		}
+
+		query := *q
+		if query.Path == "" {
+			// An empty path lists the artifacts in the root, not all artifacts.
+			query.Path = "/"
+		}
+		found, err := bm.queryArtifacts(tx, &query)
+		arts = found
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return elements, arts, nil
+}
+
+func (bm *BoltMetadata) Retrieve(ctx context.Context, q *ArtifactQuery) (*Artifact, error) {
+	query := *q
+	if query.Path == "" {
+		// Consistent with datastore, where the architecture is part of the key of
+		// the artifact, and can only be used together with a path.
+		query.Architecture = ""
+	}
+
+	var arts []*Artifact
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		found, err := bm.queryArtifacts(tx, &query)
+		arts = found
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(arts) < 1 {
+		return nil, status.Errorf(codes.NotFound, "artifact not found (%d found)", len(arts))
+	}
+	return arts[0], nil
+}
+
+func (bm *BoltMetadata) Update(ctx context.Context, uids []string, updater ArtifactUpdater) ([]*Artifact, error) {
+	var arts []*Artifact
+	err := bm.db.Update(func(tx *bolt.Tx) error {
+		for _, uid := range uids {
+			found, err := bm.getArtifact(tx, uid)
+			if err != nil {
+				return err
+			}
+
+			original := append([]string{}, found.Tag...)
+			if err := updater(found); err != nil {
+				return err
+			}
+			if !sameTags(original, found.Tag) {
+				if err := bm.deleteTags(tx, found); err != nil {
+					return err
+				}
+			}
+			if err := bm.putArtifact(tx, found); err != nil {
+				return err
+			}
+			arts = append(arts, found)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return arts, nil
+}
+
+func (bm *BoltMetadata) Delete(ctx context.Context, uids []string) ([]*Artifact, []string, error) {
+	var arts []*Artifact
+	var orphans []string
+	err := bm.db.Update(func(tx *bolt.Tx) error {
+		for _, uid := range uids {
+			found, err := bm.getArtifact(tx, uid)
+			if err != nil {
+				return err
+			}
+			blob, _, err := bm.getBlob(tx, found.Sid)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Bucket(boltArtifacts).Delete([]byte(uid)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltByPath).Delete(boltKey(found.Parent, found.Architecture, found.Uid)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltBySid).Delete(boltKey(found.Sid, found.Uid)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltBySHA256).Delete(boltKey(hex.EncodeToString(found.SHA256), found.Uid)); err != nil {
+				return err
+			}
+
+			if blob.Refs > 0 {
+				blob.Refs -= 1
+			}
+			// Artifacts sharing a blob see the count left by the previous ones.
+			if blob.Refs <= 0 && !slices.Contains(orphans, found.Sid) {
+				orphans = append(orphans, found.Sid)
+			}
+			arts = append(arts, found)
+			if err := bm.putBlob(tx, found.Sid, blob); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return arts, orphans, nil
+}
+
+func (bm *BoltMetadata) FindBySid(ctx context.Context, sid string) ([]*Artifact, error) {
+	var arts []*Artifact
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		found, err := bm.scanArtifacts(tx, boltBySid, boltPrefix(sid))
+		arts = found
+		return err
+	})
+	return arts, err
+}
+
+func (bm *BoltMetadata) GetBlob(ctx context.Context, sid string) (*Blob, error) {
+	blob := &Blob{}
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		found, err := boltGet(tx.Bucket(boltBlobs), []byte(sid), blob)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return status.Errorf(codes.NotFound, "blob %s not found", sid)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+func (bm *BoltMetadata) FindBlob(ctx context.Context, md5 []byte, size int64) (string, error) {
+	var sid string
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		prefix := boltPrefix(hex.EncodeToString(md5), strconv.FormatInt(size, 10))
+		k, _ := tx.Bucket(boltByDigest).Cursor().Seek(prefix)
+		if k == nil || !bytes.HasPrefix(k, prefix) {
+			return status.Errorf(codes.NotFound, "no blob with md5 %x", md5)
+		}
+		sid = string(k[len(prefix):])
+		return nil
+	})
+	return sid, err
+}
+
+func (bm *BoltMetadata) MarkDuplicate(ctx context.Context, sid, of string) error {
+	return bm.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltBlobs).Get([]byte(sid)) != nil {
+			return status.Errorf(codes.AlreadyExists, "blob %s already recorded", sid)
+		}
+		return bm.putBlob(tx, sid, &Blob{DuplicateOf: of, Created: time.Now()})
+	})
+}
+
+func (bm *BoltMetadata) SetManifest(ctx context.Context, sid string, manifest []byte) error {
+	return bm.db.Update(func(tx *bolt.Tx) error {
+		blob := &Blob{}
+		found, err := boltGet(tx.Bucket(boltBlobs), []byte(sid), blob)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return status.Errorf(codes.NotFound, "blob %s not found", sid)
+		}
+		blob.Manifest = manifest
+		return bm.putBlob(tx, sid, blob)
+	})
+}
+
+func (bm *BoltMetadata) Publish(ctx context.Context, path string, pub *Published) error {
+	dir, _, err := cleanPublishPath(path)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "path %s is invalid - results in empty path after cleanups", path)
+	}
+
+	return bm.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltPublished)
+		if b.Get([]byte(dir)) != nil {
+			return status.Errorf(codes.AlreadyExists, "path %s is already published", path)
+		}
+		return boltPut(b, []byte(dir), pub)
+	})
+}
+
+func (bm *BoltMetadata) GetPublished(ctx context.Context, path string) (*Published, error) {
+	dir, _, err := cleanPublishPath(path)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "path %s is invalid - results in empty path after cleanups", path)
+	}
+
+	pub := &Published{}
+	err = bm.db.View(func(tx *bolt.Tx) error {
+		found, err := boltGet(tx.Bucket(boltPublished), []byte(dir), pub)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return status.Errorf(codes.NotFound, "artifact not found")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+func (bm *BoltMetadata) Unpublish(ctx context.Context, path string) error {
+	dir, _, err := cleanPublishPath(path)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "path %s is invalid - results in empty path after cleanups", path)
+	}
+
+	return bm.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltPublished).Delete([]byte(dir))
+	})
+}
+
+func (bm *BoltMetadata) SetAcl(ctx context.Context, acl *Acl) error {
+	return bm.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAcls)
+		if acl.Empty() {
+			return b.Delete([]byte(acl.Parent))
+		}
+		return boltPut(b, []byte(acl.Parent), acl)
+	})
+}
+
+func (bm *BoltMetadata) ListAcls(ctx context.Context, path string) ([]*Acl, error) {
+	dir := cleanPath(path)
+
+	var acls []*Acl
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltAcls).Cursor()
+		for k, v := c.Seek([]byte(dir)); k != nil && bytes.HasPrefix(k, []byte(dir)); k, v = c.Next() {
+			if len(k) > len(dir) && k[len(dir)] != '/' {
+				continue
+			}
+			acl := &Acl{}
+			if err := json.Unmarshal(v, acl); err != nil {
+				return status.Errorf(codes.DataLoss, "corrupted acl %q - %s", k, err)
+			}
+			acls = append(acls, acl)
+		}
+		return nil
+	})
+	return acls, err
+}
+
+func (bm *BoltMetadata) Audit(ctx context.Context, entry *Audit) error {
+	return bm.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAudit)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		// Keys sort by time, the sequence number keeps entries recorded in the same nanosecond apart.
+		key := binary.BigEndian.AppendUint64(nil, uint64(entry.Time.UnixNano()))
+		key = binary.BigEndian.AppendUint64(key, seq)
+		return boltPut(b, key, entry)
+	})
+}
+
+func (bm *BoltMetadata) History(ctx context.Context, query *AuditQuery) ([]*Audit, error) {
+	var entries []*Audit
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltAudit).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			entry := &Audit{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				return status.Errorf(codes.DataLoss, "corrupted audit entry %x - %s", k, err)
+			}
+			if query.Uid != "" && entry.Uid != query.Uid {
+				continue
+			}
+			if query.Path != "" && entry.Parent != query.Path && !strings.HasPrefix(entry.Parent, query.Path+"/") {
+				continue
+			}
+			entries = append(entries, entry)
+			if query.Limit > 0 && len(entries) >= query.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,277 @@
+package astore
+
+import (
+	"context"
+	"crypto/sha256"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/enfabrica/enkit/astore/provenance"
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/logger"
+	"github.com/enfabrica/enkit/lib/oauth"
+	"github.com/enfabrica/enkit/lib/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// localServerForTest creates a server with no cloud dependencies, backed by
+// a LocalBlobStore and a BoltMetadata.
+func localServerForTest(t *testing.T) (*Server, context.Context) {
+	t.Helper()
+
+	blobs, _ := localBlobStoreForTest(t)
+	meta, err := OpenBoltMetadata(filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { meta.Close() })
+
+	options := Options{logger: logger.Nil}
+	server := &Server{
+		ctx:     context.Background(),
+		rng:     rand.New(rand.NewSource(0)),
+		blobs:   blobs,
+		meta:    meta,
+		options: options,
+	}
+
+	ctx := oauth.SetCredentials(context.Background(), &oauth.CredentialsCookie{
+		Identity: oauth.Identity{Username: "tester", Organization: "enkit.test"},
+	})
+	return server, ctx
+}
+
+// uploadForTest stores and commits an artifact with the content specified.
+func uploadForTest(t *testing.T, server *Server, ctx context.Context, content string, req *astore.CommitRequest) *astore.Artifact {
+	t.Helper()
+
+	stored, err := server.Store(ctx, &astore.StoreRequest{})
+	require.NoError(t, err)
+	code, _ := doRequest(t, http.MethodPut, stored.Url, []byte(content))
+	require.Equal(t, http.StatusOK, code)
+
+	req.Sid = stored.Sid
+	committed, err := server.Commit(ctx, req)
+	require.NoError(t, err)
+	return committed.Artifact
+}
+
+func TestBoltMetadataServer(t *testing.T) {
+	server, ctx := localServerForTest(t)
+
+	first := uploadForTest(t, server, ctx, "first", &astore.CommitRequest{Path: "tools/hello", Architecture: "amd64", Tag: []string{"stable"}})
+	assert.ElementsMatch(t, []string{"stable", "latest"}, first.Tag)
+	assert.Equal(t, "amd64", first.Architecture)
+	assert.Equal(t, "tester@enkit.test", first.Creator)
+
+	second := uploadForTest(t, server, ctx, "second", &astore.CommitRequest{Path: "tools/hello", Architecture: "amd64", Note: "v2"})
+	other := uploadForTest(t, server, ctx, "other", &astore.CommitRequest{Path: "tools/hello", Architecture: "arm64"})
+
+	// The latest tag moved to the second artifact, but only for the same architecture.
+	listed, err := server.List(ctx, &astore.ListRequest{Path: "tools/hello", Tag: &astore.TagSet{}})
+	require.NoError(t, err)
+	require.Len(t, listed.Artifact, 3)
+	byUid := map[string]*astore.Artifact{}
+	for _, art := range listed.Artifact {
+		byUid[art.Uid] = art
+	}
+	assert.ElementsMatch(t, []string{"stable"}, byUid[first.Uid].Tag)
+	assert.ElementsMatch(t, []string{"latest"}, byUid[second.Uid].Tag)
+	assert.ElementsMatch(t, []string{"latest"}, byUid[other.Uid].Tag)
+
+	listed, err = server.List(ctx, &astore.ListRequest{Path: "tools"})
+	require.NoError(t, err)
+	assert.Empty(t, listed.Artifact)
+	require.Len(t, listed.Element, 1)
+	assert.Equal(t, "hello", listed.Element[0].Name)
+
+	listed, err = server.List(ctx, &astore.ListRequest{Path: "tools/hello", Architecture: "arm64"})
+	require.NoError(t, err)
+	require.Len(t, listed.Artifact, 1)
+	assert.Equal(t, other.Uid, listed.Artifact[0].Uid)
+
+	retrieved, err := server.Retrieve(ctx, &astore.RetrieveRequest{Path: "tools/hello", Architecture: "amd64", Tag: &astore.TagSet{Tag: []string{"stable"}}})
+	require.NoError(t, err)
+	assert.Equal(t, first.Uid, retrieved.Artifact.Uid)
+	assert.Equal(t, "tools/hello", retrieved.Path)
+	code, data := doRequest(t, http.MethodGet, retrieved.Url, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "first", string(data))
+
+	retrieved, err = server.Retrieve(ctx, &astore.RetrieveRequest{Uid: second.Uid})
+	require.NoError(t, err)
+	assert.Equal(t, "v2", retrieved.Artifact.Note)
+
+	// Moving the stable tag removes it from the first artifact.
+	tagged, err := server.Tag(ctx, &astore.TagRequest{Uid: second.Uid, Add: &astore.TagSet{Tag: []string{"stable"}}})
+	require.NoError(t, err)
+	require.Len(t, tagged.Artifact, 1)
+	assert.ElementsMatch(t, []string{"latest", "stable"}, tagged.Artifact[0].Tag)
+	retrieved, err = server.Retrieve(ctx, &astore.RetrieveRequest{Uid: first.Uid, Tag: &astore.TagSet{}})
+	require.NoError(t, err)
+	assert.Empty(t, retrieved.Artifact.Tag)
+
+	noted, err := server.Note(ctx, &astore.NoteRequest{Uid: first.Uid, Note: "obsolete"})
+	require.NoError(t, err)
+	require.Len(t, noted.Artifact, 1)
+	assert.Equal(t, "obsolete", noted.Artifact[0].Note)
+
+	deleted, err := server.Delete(ctx, &astore.DeleteRequest{Id: first.Uid})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{first.Uid, first.Sid}, deleted.Ids)
+	_, err = server.Retrieve(ctx, &astore.RetrieveRequest{Uid: first.Uid, Tag: &astore.TagSet{}})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.blobs.Stat(ctx, first.Sid)
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+
+	_, err = server.Delete(ctx, &astore.DeleteRequest{Id: "invalid"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestBoltMetadataPublish(t *testing.T) {
+	ctx := context.Background()
+	meta, err := OpenBoltMetadata(filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+	defer meta.Close()
+
+	_, err = meta.GetPublished(ctx, "releases/hello")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	pub := &Published{Parent: "published/releases/hello", Path: "tools/hello", HasTags: true, Tag: []string{"stable"}}
+	require.NoError(t, meta.Publish(ctx, "releases/hello", pub))
+	assert.Equal(t, codes.AlreadyExists, status.Code(meta.Publish(ctx, "/releases//hello", pub)))
+
+	got, err := meta.GetPublished(ctx, "releases/hello/")
+	require.NoError(t, err)
+	assert.Equal(t, pub.Path, got.Path)
+	assert.Equal(t, pub.Tag, got.Tag)
+
+	require.NoError(t, meta.Unpublish(ctx, "releases/hello"))
+	_, err = meta.GetPublished(ctx, "releases/hello")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = meta.GetPublished(ctx, "")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCommitDeduplicates(t *testing.T) {
+	server, ctx := localServerForTest(t)
+
+	first := uploadForTest(t, server, ctx, "toolchain", &astore.CommitRequest{Path: "tools/first"})
+
+	// Same content, uploaded again and committed for two architectures.
+	stored, err := server.Store(ctx, &astore.StoreRequest{})
+	require.NoError(t, err)
+	code, _ := doRequest(t, http.MethodPut, stored.Url, []byte("toolchain"))
+	require.Equal(t, http.StatusOK, code)
+
+	var dups []*astore.Artifact
+	for _, arch := range []string{"amd64", "arm64"} {
+		committed, err := server.Commit(ctx, &astore.CommitRequest{Sid: stored.Sid, Path: "tools/second", Architecture: arch})
+		require.NoError(t, err)
+		assert.Equal(t, first.Sid, committed.Artifact.Sid)
+		assert.Equal(t, first.MD5, committed.Artifact.MD5)
+		dups = append(dups, committed.Artifact)
+	}
+	_, err = server.blobs.Stat(ctx, stored.Sid)
+	assert.ErrorIs(t, err, ErrBlobNotFound, "duplicate blob was not reclaimed")
+
+	different := uploadForTest(t, server, ctx, "toolchain v2", &astore.CommitRequest{Path: "tools/first"})
+	assert.NotEqual(t, first.Sid, different.Sid)
+
+	// The blob is only deleted with the last artifact referencing it.
+	for _, art := range append([]*astore.Artifact{first}, dups...) {
+		_, err = server.blobs.Stat(ctx, first.Sid)
+		require.NoError(t, err)
+
+		deleted, err := server.Delete(ctx, &astore.DeleteRequest{Id: art.Uid})
+		require.NoError(t, err)
+		assert.Contains(t, deleted.Ids, art.Uid)
+	}
+	_, err = server.blobs.Stat(ctx, first.Sid)
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+
+	// A deleted blob can no longer be referenced.
+	_, err = server.Commit(ctx, &astore.CommitRequest{Sid: first.Sid, Path: "tools/third"})
+	assert.Error(t, err)
+}
+
+func TestRetrieveBySHA256(t *testing.T) {
+	server, ctx := localServerForTest(t)
+
+	first := uploadForTest(t, server, ctx, "first", &astore.CommitRequest{Path: "tools/hello", Architecture: "amd64"})
+	second := uploadForTest(t, server, ctx, "second", &astore.CommitRequest{Path: "tools/hello", Architecture: "amd64"})
+	copied := uploadForTest(t, server, ctx, "first", &astore.CommitRequest{Path: "tools/copy", Architecture: "amd64"})
+
+	digest := sha256.Sum256([]byte("first"))
+	assert.Equal(t, digest[:], first.Sha256)
+	assert.Equal(t, digest[:], copied.Sha256)
+
+	// Without a TagSet, any tag matches: first is no longer the latest.
+	retrieved, err := server.Retrieve(ctx, &astore.RetrieveRequest{Path: "tools/hello", Architecture: "amd64", Sha256: digest[:]})
+	require.NoError(t, err)
+	assert.Equal(t, first.Uid, retrieved.Artifact.Uid)
+
+	retrieved, err = server.Retrieve(ctx, &astore.RetrieveRequest{Sha256: digest[:]})
+	require.NoError(t, err)
+	assert.Equal(t, copied.Uid, retrieved.Artifact.Uid)
+
+	_, err = server.Retrieve(ctx, &astore.RetrieveRequest{Sha256: digest[:], Tag: &astore.TagSet{Tag: []string{"stable"}}})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.Retrieve(ctx, &astore.RetrieveRequest{Path: "tools/hello", Sha256: second.MD5})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Deleted artifacts can no longer be found by digest.
+	_, err = server.Delete(ctx, &astore.DeleteRequest{Id: copied.Uid})
+	require.NoError(t, err)
+	retrieved, err = server.Retrieve(ctx, &astore.RetrieveRequest{Sha256: digest[:]})
+	require.NoError(t, err)
+	assert.Equal(t, first.Uid, retrieved.Artifact.Uid)
+
+	// Digests not computed by the BlobStore are computed from the content.
+	computed, err := server.blobSHA256(second.Sid, &BlobAttrs{})
+	require.NoError(t, err)
+	assert.Equal(t, second.Sha256, computed)
+}
+
+func TestCommitSigned(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	verifying, signing, err := token.GenerateSigningKey(rand.New(rand.NewSource(1)))
+	require.NoError(t, err)
+
+	digest := sha256.Sum256([]byte("signed"))
+	prov, err := provenance.Marshal(&astore.Provenance{Builder: "ci", GitSha: "0123abcd"})
+	require.NoError(t, err)
+	signature := provenance.Sign(signing, digest[:], prov)
+
+	signed := uploadForTest(t, server, ctx, "signed", &astore.CommitRequest{Path: "tools/signed", Provenance: prov, Signature: signature})
+	assert.Equal(t, prov, signed.Provenance)
+	assert.Equal(t, verifying[:], signed.Signature.Key)
+
+	retrieved, err := server.Retrieve(ctx, &astore.RetrieveRequest{Uid: signed.Uid, Tag: &astore.TagSet{}})
+	require.NoError(t, err)
+	assert.NoError(t, provenance.VerifyArtifact(retrieved.Artifact, []*token.VerifyingKey{verifying}))
+
+	unsigned := uploadForTest(t, server, ctx, "unsigned", &astore.CommitRequest{Path: "tools/unsigned", Provenance: prov})
+	assert.Nil(t, unsigned.Signature)
+	assert.Equal(t, prov, unsigned.Provenance)
+
+	// Signatures not matching the content or the provenance are rejected.
+	for _, req := range []*astore.CommitRequest{
+		{Path: "tools/signed", Provenance: prov, Signature: signature},
+		{Path: "tools/signed", Signature: provenance.Sign(signing, digest[:], prov)},
+		{Path: "tools/signed", Provenance: []byte("invalid")},
+	} {
+		stored, err := server.Store(ctx, &astore.StoreRequest{})
+		require.NoError(t, err)
+		code, _ := doRequest(t, http.MethodPut, stored.Url, []byte("tampered"))
+		require.Equal(t, http.StatusOK, code)
+
+		req.Sid = stored.Sid
+		_, err = server.Commit(ctx, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
@@ -0,0 +1,703 @@
+package astore
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/enfabrica/enkit/lib/logger"
+	"github.com/enfabrica/enkit/lib/retry"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// datastoreClient defines the subset of methods we need to call, providing a
+// surface to mock in unit tests.
+type datastoreClient interface {
+	Delete(context.Context, *datastore.Key) error
+	Get(context.Context, *datastore.Key, interface{}) error
+	GetAll(context.Context, *datastore.Query, interface{}) ([]*datastore.Key, error)
+	Mutate(context.Context, ...*datastore.Mutation) ([]*datastore.Key, error)
+	NewTransaction(context.Context, ...datastore.TransactionOption) (*datastore.Transaction, error)
+	Run(context.Context, *datastore.Query) *datastore.Iterator
+}
+
+// DatastoreMetadata is a MetadataStore backed by Google Cloud Datastore.
+//
+// Path elements, architectures and artifacts are stored as a hierarchy
+// of entities: the key of an artifact has as ancestors the key of its
+// architecture, and the keys of each element of its path.
+type DatastoreMetadata struct {
+	ds  datastoreClient
+	log logger.Logger
+}
+
+// NewDatastoreMetadata returns a MetadataStore using the supplied datastore client.
+func NewDatastoreMetadata(ds *datastore.Client, log logger.Logger) *DatastoreMetadata {
+	return &DatastoreMetadata{ds: ds, log: log}
+}
+
+func Rollback(t **datastore.Transaction) {
+	if *t == nil {
+		return
+	}
+
+	(*t).Rollback()
+	(*t) = nil
+}
+
+func Commit(t **datastore.Transaction) error {
+	_, err := (*t).Commit()
+	(*t) = nil
+	return err
+}
+
+func queryForPath(kind, path, arch string) (*datastore.Query, error) {
+	path, akey, err := keyFromPath(path, arch)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NewQuery(kind).Filter("Parent = ", path).Order("-Created").Ancestor(akey), nil
+}
+
+func filterArtifacts(query *datastore.Query, q *ArtifactQuery) *datastore.Query {
+	if q.Uid != "" {
+		query = query.Filter("Uid = ", q.Uid)
+	}
+	for _, tag := range q.Tag {
+		query = query.Filter("Tag = ", tag)
+	}
+	if len(q.SHA256) > 0 {
+		query = query.Filter("SHA256 = ", q.SHA256)
+	}
+	return query
+}
+
+func keyToArchitecture(key *datastore.Key) string {
+	cursor := key
+	for cursor != nil {
+		if cursor.Kind == KindPathElement {
+			return ""
+		}
+		if cursor.Kind == KindArchitecture {
+			return cursor.Name
+		}
+
+		cursor = cursor.Parent
+	}
+	return ""
+}
+
+func keyForArtifact(key *datastore.Key) *datastore.Key {
+	return datastore.IncompleteKey(KindArtifact, key)
+}
+
+// keyFromDir computes the key of a path cleaned with cleanPath or cleanPublishPath.
+func keyFromDir(dir, architecture string) *datastore.Key {
+	var key *datastore.Key
+	for _, element := range pathElements(dir) {
+		key = datastore.NameKey(KindPathElement, element, key)
+	}
+	if architecture != "" {
+		key = datastore.NameKey(KindArchitecture, architecture, key)
+	}
+	return key
+}
+
+// keyFromPath cleans and parses the supplied path to compute a key.
+// Returns the final path - after cleaning - and the computed key.
+func keyFromPath(orig, architecture string) (string, *datastore.Key, error) {
+	dir := cleanPath(orig)
+	return dir, keyFromDir(dir, architecture), nil
+}
+
+func keyForPublished(key *datastore.Key) *datastore.Key {
+	return datastore.NameKey(KindPublished, "published", key)
+}
+
+func publishKeyFromPath(orig string) (string, *datastore.Key, error) {
+	dir, _, err := cleanPublishPath(orig)
+	if err != nil {
+		return "", nil, err
+	}
+	return dir, keyFromDir(dir, ""), nil
+}
+
+// mutationsForKeyPath computes the mutations necessary to create the path of objects supplied.
+// path and key should come from keyFromPath to guarantee consistency and format.
+func mutationsForKeyPath(dir string, key *datastore.Key, creator string) []*datastore.Mutation {
+	muts := []*datastore.Mutation{}
+
+	cursor := key
+	parent := trimSlash(dir)
+
+	for cursor != nil {
+		switch cursor.Kind {
+		case KindArchitecture:
+			muts = append(muts, datastore.NewInsert(cursor, &Architecture{
+				Parent:  parent,
+				Created: time.Now(),
+				Creator: creator,
+			}))
+
+		case KindPathElement:
+			parent, _ = path.Split(parent)
+			parent = trimSlash(parent)
+
+			muts = append(muts, datastore.NewInsert(cursor, &PathElement{
+				Parent:  parent,
+				Created: time.Now(),
+				Creator: creator,
+			}))
+		}
+
+		cursor = cursor.Parent
+	}
+	return muts
+}
+
+func alreadyExistsError(err error) bool {
+	if status.Code(err) == codes.AlreadyExists {
+		return true
+	}
+
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		return false
+	}
+	for _, err := range merr {
+		if status.Code(err) != codes.AlreadyExists {
+			return false
+		}
+	}
+	return true
+}
+
+// createPath creates all the elements of the path identified by dir and key, ignoring those that already exist.
+func (dm *DatastoreMetadata) createPath(ctx context.Context, dir string, key *datastore.Key, creator string) error {
+	muts := mutationsForKeyPath(dir, key, creator)
+	_, err := dm.ds.Mutate(ctx, muts...)
+	if err != nil && !alreadyExistsError(err) {
+		return err
+	}
+	return nil
+}
+
+// deleteTagsMutation computes the mutations necessary to make sure the supplied list of tags is not applied to any other artifact in the same path/architecture.
+//
+// key is the key of the artifact owning the tags supplied, or the key of the parent where the artifact is supposed to be stored.
+// tags is the list of tags to be added to the specified artifact. Those tags need to be removed from any other artifact.
+func (dm *DatastoreMetadata) deleteTagsMutation(ctx context.Context, t *datastore.Transaction, key *datastore.Key, tags []string) ([]*datastore.Mutation, error) {
+	pkey := key
+	if key.Kind == KindArtifact {
+		pkey = key.Parent
+	}
+
+	type KeyArtifact struct {
+		Key *datastore.Key
+		Art *Artifact
+	}
+	muts := []*datastore.Mutation{}
+	entries := map[int64]KeyArtifact{}
+
+	// A tag can only live on one version of an artifact.
+	//
+	// The goal of the loop is to identify all other artifacts that have one of the tags specified
+	// assigned.
+	//
+	// Note that one artifact can have multiple tags. Given that this code is run in a transaction,
+	// every read of the same artifact will show all the tags already available.
+	//
+	// To modify the list correct, the code has to:
+	// - remove all the tags at once, so if the same object is written multiple times, it is always
+	//   written with the correct set of tags.
+	// - use the entries map above to prevent multiple writes.
+	for _, tag := range tags {
+		query := datastore.NewQuery(KindArtifact).Ancestor(pkey).Filter("Tag = ", tag).Transaction(t)
+
+		// If a tag can only live on one version, this loop is not necessary.
+		// But better safe than sorry, especially with eventual consistency and so on.
+		for it := dm.ds.Run(ctx, query); ; {
+			var artifact Artifact
+			curk, err := it.Next(&artifact)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if curk.Equal(key) {
+				continue
+			}
+			entries[curk.ID] = KeyArtifact{Key: curk, Art: &artifact}
+		}
+	}
+
+	for _, ka := range entries {
+		ka.Art.Tag = cleanUniqueDelete(ka.Art.Tag, tags)
+		muts = append(muts, datastore.NewUpdate(ka.Key, ka.Art))
+	}
+
+	return muts, nil
+}
+
+func keyForBlob(sid string) *datastore.Key {
+	return datastore.NameKey(KindBlob, sid, nil)
+}
+
+// legacyRefs returns the number of artifacts referencing sid, if sid was never recorded as a Blob.
+//
+// Artifacts committed before blobs were reference counted have no Blob entity.
+func (dm *DatastoreMetadata) legacyRefs(ctx context.Context, sid string) (int64, error) {
+	_, err := dm.GetBlob(ctx, sid)
+	if status.Code(err) != codes.NotFound {
+		return 0, err
+	}
+	arts, err := dm.FindBySid(ctx, sid)
+	return int64(len(arts)), err
+}
+
+// refBlobMutation computes the mutation necessary to add a reference to the blob sid.
+func (dm *DatastoreMetadata) refBlobMutation(t *datastore.Transaction, artifact *Artifact, legacy int64) (*datastore.Mutation, error) {
+	key := keyForBlob(artifact.Sid)
+
+	blob := Blob{}
+	err := t.Get(key, &blob)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		blob = Blob{MD5: artifact.MD5, SHA256: artifact.SHA256, Size: artifact.Size, Refs: legacy, Created: time.Now()}
+	case err != nil:
+		return nil, err
+	case blob.Refs <= 0:
+		return nil, retry.Fatal(status.Errorf(codes.Aborted, "blob %s has already been deleted", artifact.Sid))
+	}
+
+	blob.Refs += 1
+	return datastore.NewUpsert(key, &blob), nil
+}
+
+func (dm *DatastoreMetadata) Commit(ctx context.Context, path string, artifact *Artifact) error {
+	path, pkey, err := keyFromPath(path, artifact.Architecture)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
+	}
+	if err := dm.createPath(ctx, path, pkey, artifact.Creator); err != nil {
+		return err
+	}
+	artifact.Parent = path
+
+	legacy, err := dm.legacyRefs(ctx, artifact.Sid)
+	if err != nil {
+		return err
+	}
+
+	return retry.New(retry.WithDescription("insert transaction"), retry.WithLogger(dm.log)).Run(func() error {
+		t, err := dm.ds.NewTransaction(ctx)
+		if err != nil {
+			return err
+		}
+		defer Rollback(&t)
+
+		muts, err := dm.deleteTagsMutation(ctx, t, pkey, artifact.Tag)
+		if err != nil {
+			return err
+		}
+
+		bmut, err := dm.refBlobMutation(t, artifact, legacy)
+		if err != nil {
+			return err
+		}
+		muts = append(muts, bmut, datastore.NewInsert(keyForArtifact(pkey), artifact))
+
+		_, err = t.Mutate(muts...)
+		if err != nil {
+			return err
+		}
+		err = Commit(&t)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (dm *DatastoreMetadata) List(ctx context.Context, q *ArtifactQuery) ([]*PathElement, []*Artifact, error) {
+	// Two queries are necessary:
+	//   1) To retrieve artifacts.
+	//   2) To retrieve sub-paths.
+	childFiles := []*PathElement{}
+	queryPath, err := queryForPath(KindPathElement, q.Path, "")
+	if err != nil {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
+	}
+	kf, err := dm.ds.GetAll(ctx, queryPath, &childFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	for ix, file := range childFiles {
+		file.Name = kf[ix].Name
+	}
+
+	queryArtifact, err := queryForPath(KindArtifact, q.Path, q.Architecture)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
+	}
+	queryArtifact = filterArtifacts(queryArtifact, q)
+
+	childArtifacts := []*Artifact{}
+	ka, err := dm.ds.GetAll(ctx, queryArtifact, &childArtifacts)
+	if err != nil {
+		return nil, nil, err
+	}
+	accepted := childArtifacts[:0]
+	for ix, art := range childArtifacts {
+		art.Architecture = keyToArchitecture(ka[ix])
+		if q.Accept == nil || q.Accept(art) {
+			accepted = append(accepted, art)
+		}
+	}
+	return childFiles, accepted, nil
+}
+
+func (dm *DatastoreMetadata) Retrieve(ctx context.Context, q *ArtifactQuery) (*Artifact, error) {
+	var query *datastore.Query
+	var err error
+	if q.Path != "" {
+		query, err = queryForPath(KindArtifact, q.Path, q.Architecture)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
+		}
+	} else if len(q.SHA256) > 0 {
+		query = datastore.NewQuery(KindArtifact).Order("-Created")
+	} else {
+		query = datastore.NewQuery(KindArtifact)
+	}
+	query = filterArtifacts(query, q)
+	if q.Accept == nil {
+		query = query.Limit(1)
+	}
+
+	// The most recent artifacts are returned first: stop at the first accepted.
+	for it := dm.ds.Run(ctx, query); ; {
+		artifact := &Artifact{}
+		key, err := it.Next(artifact)
+		if err == iterator.Done {
+			return nil, status.Errorf(codes.NotFound, "artifact not found")
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "error running query - %s", err)
+		}
+		artifact.Architecture = keyToArchitecture(key)
+		if q.Accept == nil || q.Accept(artifact) {
+			return artifact, nil
+		}
+	}
+}
+
+// artifactsByUid returns the artifacts with the specified uid, as part of the transaction t.
+func (dm *DatastoreMetadata) artifactsByUid(ctx context.Context, t *datastore.Transaction, uid string) ([]*datastore.Key, []*Artifact, error) {
+	query := datastore.NewQuery(KindArtifact).Filter("Uid = ", uid).Transaction(t)
+	var artifacts []*Artifact
+	keys, err := dm.ds.GetAll(ctx, query, &artifacts)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "error running query - %s", err)
+	}
+	if len(artifacts) == 0 {
+		return nil, nil, retry.Fatal(status.Errorf(codes.NotFound, "no match for uid - %s", uid))
+	}
+	for ix, art := range artifacts {
+		art.Architecture = keyToArchitecture(keys[ix])
+	}
+	return keys, artifacts, nil
+}
+
+func (dm *DatastoreMetadata) Update(ctx context.Context, uids []string, updater ArtifactUpdater) ([]*Artifact, error) {
+	var arts []*Artifact
+	err := retry.New(retry.WithDescription("update transaction"), retry.WithLogger(dm.log)).Run(func() error {
+		arts = nil
+
+		t, err := dm.ds.NewTransaction(ctx)
+		if err != nil {
+			return err
+		}
+		defer Rollback(&t)
+
+		muts := []*datastore.Mutation{}
+		for _, uid := range uids {
+			keys, artifacts, err := dm.artifactsByUid(ctx, t, uid)
+			if err != nil {
+				return err
+			}
+
+			// Found list of artifacts to update. This should be a single artifact, as UIDs should
+			// be globally unique. Using a loop for defense in depth.
+			for ix, art := range artifacts {
+				key := keys[ix]
+
+				original := append([]string{}, art.Tag...)
+				if err := updater(art); err != nil {
+					return retry.Fatal(err)
+				}
+
+				if !sameTags(original, art.Tag) {
+					m, err := dm.deleteTagsMutation(ctx, t, key, art.Tag)
+					if err != nil {
+						return err
+					}
+					muts = append(muts, m...)
+				}
+				muts = append(muts, datastore.NewUpdate(key, art))
+				arts = append(arts, art)
+			}
+		}
+
+		_, err = t.Mutate(muts...)
+		if err != nil {
+			return err
+		}
+
+		return Commit(&t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return arts, nil
+}
+
+func (dm *DatastoreMetadata) Delete(ctx context.Context, uids []string) ([]*Artifact, []string, error) {
+	var arts []*Artifact
+	var orphans, legacy []string
+	err := retry.New(retry.WithDescription("delete transaction"), retry.WithLogger(dm.log)).Run(func() error {
+		arts, orphans, legacy = nil, nil, nil
+
+		t, err := dm.ds.NewTransaction(ctx)
+		if err != nil {
+			return err
+		}
+		defer Rollback(&t)
+
+		muts := []*datastore.Mutation{}
+		blobs := map[string]*Blob{}
+		for _, uid := range uids {
+			keys, artifacts, err := dm.artifactsByUid(ctx, t, uid)
+			if err != nil {
+				return err
+			}
+
+			for ix, art := range artifacts {
+				muts = append(muts, datastore.NewDelete(keys[ix]))
+				arts = append(arts, art)
+
+				blob, found := blobs[art.Sid]
+				if !found {
+					blob = &Blob{}
+					if err := t.Get(keyForBlob(art.Sid), blob); err != nil {
+						if err != datastore.ErrNoSuchEntity {
+							return err
+						}
+						blob = nil
+						legacy = append(legacy, art.Sid)
+					}
+					blobs[art.Sid] = blob
+				}
+				if blob != nil && blob.Refs > 0 {
+					blob.Refs -= 1
+				}
+			}
+		}
+		for sid, blob := range blobs {
+			if blob == nil {
+				continue
+			}
+			if blob.Refs <= 0 {
+				orphans = append(orphans, sid)
+			}
+			muts = append(muts, datastore.NewUpdate(keyForBlob(sid), blob))
+		}
+
+		if _, err := t.Mutate(muts...); err != nil {
+			return err
+		}
+		return Commit(&t)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, sid := range legacy {
+		remaining, err := dm.FindBySid(ctx, sid)
+		if err != nil {
+			return arts, orphans, err
+		}
+		if len(remaining) == 0 {
+			orphans = append(orphans, sid)
+		}
+	}
+	return arts, orphans, nil
+}
+
+func (dm *DatastoreMetadata) FindBySid(ctx context.Context, sid string) ([]*Artifact, error) {
+	var arts []*Artifact
+	keys, err := dm.ds.GetAll(ctx, datastore.NewQuery(KindArtifact).Filter("Sid = ", sid), &arts)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error running query - %s", err)
+	}
+	for ix, art := range arts {
+		art.Architecture = keyToArchitecture(keys[ix])
+	}
+	return arts, nil
+}
+
+func (dm *DatastoreMetadata) GetBlob(ctx context.Context, sid string) (*Blob, error) {
+	blob := &Blob{}
+	if err := dm.ds.Get(ctx, keyForBlob(sid), blob); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, status.Errorf(codes.NotFound, "blob %s not found", sid)
+		}
+		return nil, err
+	}
+	return blob, nil
+}
+
+func (dm *DatastoreMetadata) FindBlob(ctx context.Context, md5 []byte, size int64) (string, error) {
+	var blobs []*Blob
+	keys, err := dm.ds.GetAll(ctx, datastore.NewQuery(KindBlob).Filter("MD5 = ", md5).Filter("Size = ", size), &blobs)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "error running query - %s", err)
+	}
+	for ix, blob := range blobs {
+		if blob.Refs > 0 && blob.DuplicateOf == "" {
+			return keys[ix].Name, nil
+		}
+	}
+	return "", status.Errorf(codes.NotFound, "no blob with md5 %x", md5)
+}
+
+func (dm *DatastoreMetadata) MarkDuplicate(ctx context.Context, sid, of string) error {
+	_, err := dm.ds.Mutate(ctx, datastore.NewInsert(keyForBlob(sid), &Blob{DuplicateOf: of, Created: time.Now()}))
+	return err
+}
+
+func (dm *DatastoreMetadata) SetManifest(ctx context.Context, sid string, manifest []byte) error {
+	return retry.New(retry.WithDescription("manifest transaction"), retry.WithLogger(dm.log)).Run(func() error {
+		t, err := dm.ds.NewTransaction(ctx)
+		if err != nil {
+			return err
+		}
+		defer Rollback(&t)
+
+		blob := &Blob{}
+		if err := t.Get(keyForBlob(sid), blob); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return retry.Fatal(status.Errorf(codes.NotFound, "blob %s not found", sid))
+			}
+			return err
+		}
+		blob.Manifest = manifest
+		if _, err := t.Mutate(datastore.NewUpdate(keyForBlob(sid), blob)); err != nil {
+			return err
+		}
+		return Commit(&t)
+	})
+}
+
+func (dm *DatastoreMetadata) Publish(ctx context.Context, path string, published *Published) error {
+	dpath, pkey, err := publishKeyFromPath(path)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "path %s is invalid - results in empty path after cleanups", path)
+	}
+	if err := dm.createPath(ctx, dpath, pkey, published.Creator); err != nil {
+		return err
+	}
+
+	_, err = dm.ds.Mutate(ctx, datastore.NewInsert(keyForPublished(pkey), published))
+	return err
+}
+
+func (dm *DatastoreMetadata) GetPublished(ctx context.Context, path string) (*Published, error) {
+	_, pkey, err := publishKeyFromPath(path)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "path %s is invalid - results in empty path after cleanups", path)
+	}
+
+	published := Published{}
+	err = dm.ds.Get(ctx, keyForPublished(pkey), &published)
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			err = status.Errorf(codes.NotFound, "artifact not found")
+		}
+		return nil, err
+	}
+	return &published, nil
+}
+
+func (dm *DatastoreMetadata) Unpublish(ctx context.Context, path string) error {
+	_, pkey, err := publishKeyFromPath(path)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "path %s is invalid - results in empty path after cleanups", path)
+	}
+
+	return dm.ds.Delete(ctx, keyForPublished(pkey))
+}
+
+func keyForAcl(parent string) *datastore.Key {
+	return datastore.NameKey(KindAcl, parent, nil)
+}
+
+func (dm *DatastoreMetadata) SetAcl(ctx context.Context, acl *Acl) error {
+	if acl.Empty() {
+		return dm.ds.Delete(ctx, keyForAcl(acl.Parent))
+	}
+	_, err := dm.ds.Mutate(ctx, datastore.NewUpsert(keyForAcl(acl.Parent), acl))
+	return err
+}
+
+func (dm *DatastoreMetadata) ListAcls(ctx context.Context, path string) ([]*Acl, error) {
+	dir := cleanPath(path)
+
+	// There are only a handful of acls, filtering them here is simpler than
+	// maintaining an index by path prefix.
+	var all []*Acl
+	if _, err := dm.ds.GetAll(ctx, datastore.NewQuery(KindAcl), &all); err != nil {
+		return nil, status.Errorf(codes.Internal, "error running query - %s", err)
+	}
+	var acls []*Acl
+	for _, acl := range all {
+		if acl.Parent == dir || strings.HasPrefix(acl.Parent, dir+"/") {
+			acls = append(acls, acl)
+		}
+	}
+	sort.Slice(acls, func(i, j int) bool {
+		return acls[i].Parent < acls[j].Parent
+	})
+	return acls, nil
+}
+
+func (dm *DatastoreMetadata) Audit(ctx context.Context, entry *Audit) error {
+	entry.Paths = parentPaths(entry.Parent)
+	_, err := dm.ds.Mutate(ctx, datastore.NewInsert(datastore.IncompleteKey(KindAudit, nil), entry))
+	return err
+}
+
+func (dm *DatastoreMetadata) History(ctx context.Context, query *AuditQuery) ([]*Audit, error) {
+	q := datastore.NewQuery(KindAudit).Order("-Time")
+	if query.Uid != "" {
+		q = q.Filter("Uid =", query.Uid)
+	}
+	if query.Path != "" {
+		q = q.Filter("Paths =", query.Path)
+	}
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+
+	var entries []*Audit
+	if _, err := dm.ds.GetAll(ctx, q, &entries); err != nil {
+		return nil, status.Errorf(codes.Internal, "error running query - %s", err)
+	}
+	return entries, nil
+}
@@ -1,10 +1,8 @@
 package astore
 
 import (
-	"cloud.google.com/go/datastore"
 	"context"
 	"github.com/enfabrica/enkit/astore/rpc/astore"
-	"github.com/enfabrica/enkit/lib/retry"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -13,47 +11,33 @@ func (s *Server) Note(ctx context.Context, req *astore.NoteRequest) (*astore.Not
 	if req.Uid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid request - no sid and no path")
 	}
+	access, err := s.accessFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkUid(access, PermissionWrite, req.Uid); err != nil {
+		return nil, err
+	}
 
-	arts := []*astore.Artifact{}
-	err := retry.New(retry.WithDescription("note transaction"), retry.WithLogger(s.options.logger)).Run(func() error {
-		t, err := s.ds.NewTransaction(s.ctx)
-		if err != nil {
-			return err
-		}
-		defer Rollback(&t)
-
-		query := datastore.NewQuery(KindArtifact).Filter("Uid = ", req.Uid).Transaction(t)
-		var artifacts []*Artifact
-		keys, err := s.ds.GetAll(s.ctx, query, &artifacts)
-		if err != nil {
-			return status.Errorf(codes.Internal, "error running query - %s", err)
-		}
-		if len(artifacts) == 0 {
-			return retry.Fatal(status.Errorf(codes.NotFound, "no match for uid - %s", req.Uid))
-		}
-
-		// Found list of artifacts to update. This should be a single artifact, as UIDs should
-		// be globally unique. Using a loop for defense in depth.
-		muts := []*datastore.Mutation{}
-		for ix, art := range artifacts {
-			key := keys[ix]
-
-			art.Note = req.Note
-			muts = append(muts, datastore.NewUpdate(key, art))
-			arts = append(arts, art.ToProto(keyToArchitecture(key)))
-		}
-
-		_, err = t.Mutate(muts...)
-		if err != nil {
-			return err
-		}
+	updated, err := s.noteArtifacts(callerName(ctx), []string{req.Uid}, req.Note)
+	return &astore.NoteResponse{Artifact: artifactsToProto(updated)}, err
+}
 
-		err = Commit(&t)
-		if err != nil {
-			return err
-		}
+// noteArtifacts sets the note of the artifacts with the uids specified, atomically, on behalf of user.
+func (s *Server) noteArtifacts(user string, uids []string, note string) ([]*Artifact, error) {
+	updated, err := s.meta.Update(s.ctx, uids, func(art *Artifact) error {
+		art.Note = note
 		return nil
 	})
-
-	return &astore.NoteResponse{Artifact: arts}, err
+	if err != nil {
+		return nil, err
+	}
+	s.watchers.notify(astore.WatchEvent_NOTED, updated...)
+	for _, art := range updated {
+		entry := auditArtifact(art)
+		entry.TagsBefore = art.Tag
+		entry.Note = art.Note
+		s.audit(user, astore.AuditEntry_NOTE, entry)
+	}
+	return updated, nil
 }
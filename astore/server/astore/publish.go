@@ -1,43 +1,17 @@
 package astore
 
 import (
-	"cloud.google.com/go/datastore"
 	"context"
-	"fmt"
 	"github.com/enfabrica/enkit/astore/rpc/astore"
 	"github.com/enfabrica/enkit/lib/oauth"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"net/http"
 	"path"
-	"path/filepath"
 	"strings"
 	"time"
 )
 
-func publishKeyFromPath(orig string) (string, string, *datastore.Key, error) {
-	cleaned := filepath.ToSlash(path.Clean(strings.TrimSpace(orig)))
-	if cleaned == "" || cleaned == "." {
-		return "", "", nil, fmt.Errorf("%s results in empty cleaned after normalization", cleaned)
-	}
-
-	dir := path.Join("published", cleaned)
-
-	var key *datastore.Key
-	elements := strings.Split(dir, "/")
-	if elements[0] == "" {
-		elements = elements[1:]
-	}
-	for _, element := range elements[:len(elements)] {
-		key = datastore.NameKey(KindPathElement, element, key)
-	}
-	return dir, cleaned, key, nil
-}
-
-func keyForPublished(key *datastore.Key) *datastore.Key {
-	return datastore.NameKey(KindPublished, "published", key)
-}
-
 type DownloadHandler func(string, *astore.RetrieveResponse, error, http.ResponseWriter, *http.Request)
 
 func (s *Server) getPublished(prefix string, w http.ResponseWriter, r *http.Request) (string, *Published, error) {
@@ -47,20 +21,15 @@ func (s *Server) getPublished(prefix string, w http.ResponseWriter, r *http.Requ
 	}
 
 	keypath := strings.TrimPrefix(upath, prefix)
-	_, _, pkey, err := publishKeyFromPath(keypath)
-	if err != nil {
+	if _, _, err := cleanPublishPath(keypath); err != nil {
 		return upath, nil, status.Errorf(codes.InvalidArgument, "path %s is invalid - results in empty path after cleanups", upath)
 	}
 
-	published := Published{}
-	err = s.ds.Get(s.ctx, keyForPublished(pkey), &published)
+	published, err := s.meta.GetPublished(s.ctx, keypath)
 	if err != nil {
-		if err == datastore.ErrNoSuchEntity {
-			err = status.Errorf(codes.NotFound, "artifact not found")
-		}
 		return upath, nil, err
 	}
-	return keypath, &published, nil
+	return keypath, published, nil
 }
 
 func (s *Server) DownloadPublished(prefix string, ehandler DownloadHandler, w http.ResponseWriter, r *http.Request) {
@@ -85,14 +54,28 @@ func (s *Server) DownloadPublished(prefix string, ehandler DownloadHandler, w ht
 	if req.Architecture == "" {
 		req.Architecture = arch
 	}
-	if req.Uid == "" {
+	// A version constraint selects the artifact, and cannot be combined with an uid.
+	if req.Uid == "" && req.Version == "" {
 		req.Uid = uid
 	}
 
-	retr, err := s.Retrieve(context.TODO(), req)
+	access, err := s.publisherAccess(pub)
+	if err != nil {
+		ehandler(upath, nil, err, w, r)
+		return
+	}
+	retr, err := s.retrieve(context.TODO(), req, access, PermissionPublish)
 	ehandler(upath, retr, err, w, r)
 }
 
+// publisherAccess returns an accessChecker for the creator of a published entry.
+//
+// Published entries are accessible without authentication, as long as their
+// creator keeps the permission to publish the artifacts they select.
+func (s *Server) publisherAccess(pub *Published) (*accessChecker, error) {
+	return s.accessAs(identityFromName(pub.Creator, pub.CreatorGroups))
+}
+
 type ListHandler func(string, *astore.ListResponse, error, http.ResponseWriter, *http.Request)
 
 func (s *Server) ListPublished(prefix string, ehandler ListHandler, w http.ResponseWriter, r *http.Request) {
@@ -102,53 +85,103 @@ func (s *Server) ListPublished(prefix string, ehandler ListHandler, w http.Respo
 		return
 	}
 
-	req := pub.ToListRequest()
-	retr, err := s.List(context.TODO(), req)
+	access, err := s.publisherAccess(pub)
+	if err != nil {
+		ehandler(upath, nil, err, w, r)
+		return
+	}
+	retr, err := s.list(pub.ToListRequest(), access, PermissionPublish)
 	ehandler(upath, retr, err, w, r)
 }
 
 func (s *Server) Publish(ctx context.Context, req *astore.PublishRequest) (*astore.PublishResponse, error) {
-	creator := oauth.GetCredentials(ctx).Identity.GlobalName()
+	identity := oauth.GetCredentials(ctx).Identity
 
 	if s.options.publishBaseURL == "" {
 		return nil, status.Errorf(codes.Unavailable, "publish service has not been configured on the server")
 	}
-
-	dpath, cleaned, pkey, err := publishKeyFromPath(req.Path)
+	if req.Select == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "must supply the artifacts to publish")
+	}
+	access, err := s.accessAs(&identity)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "path %s is invalid - results in empty path after cleanups", req.Path)
+		return nil, err
 	}
-
-	muts := mutationsForKeyPath(dpath, pkey, creator)
-	_, err = s.ds.Mutate(s.ctx, muts...)
-	if err != nil && !alreadyExistsError(err) {
+	if err := s.checkSelect(access, req.Select.Path, req.Select.Uid); err != nil {
 		return nil, err
 	}
+	if req.Select.Version != "" {
+		if req.Select.Path == "" || req.Select.Uid != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid request - a version requires a path, and cannot be combined with an uid")
+		}
+		if _, err := parseConstraint(req.Select.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	dpath, cleaned, err := cleanPublishPath(req.Path)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "path %s is invalid - results in empty path after cleanups", req.Path)
+	}
 
 	published := FromListRequest(req.Select, &Published{
-		Parent:  dpath,
-		Creator: creator,
-		Created: time.Now(),
+		Parent:        dpath,
+		Creator:       identity.GlobalName(),
+		CreatorGroups: identity.Groups,
+		Created:       time.Now(),
 	})
 
-	_, err = s.ds.Mutate(s.ctx, datastore.NewInsert(keyForPublished(pkey), published))
-	if err != nil {
+	if err := s.meta.Publish(s.ctx, req.Path, published); err != nil {
 		return nil, err
 	}
+	s.audit(published.Creator, astore.AuditEntry_PUBLISH, &Audit{
+		Uid:          req.Select.Uid,
+		Parent:       cleanPath(req.Select.Path),
+		Architecture: req.Select.Architecture,
+		Published:    cleaned,
+	})
 
 	return &astore.PublishResponse{Url: s.options.publishBaseURL + cleaned}, nil
 }
 
 func (s *Server) Unpublish(ctx context.Context, req *astore.UnpublishRequest) (*astore.UnpublishResponse, error) {
-	_, _, pkey, err := publishKeyFromPath(req.Path)
+	_, cleaned, err := cleanPublishPath(req.Path)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "path %s is invalid - results in empty path after cleanups", req.Path)
 	}
-
-	err = s.ds.Delete(s.ctx, keyForPublished(pkey))
+	access, err := s.accessFor(ctx)
 	if err != nil {
 		return nil, err
 	}
+	pub, err := s.meta.GetPublished(s.ctx, cleaned)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+	if pub != nil {
+		if err := s.checkSelect(access, pub.Path, pub.Uid); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.meta.Unpublish(s.ctx, cleaned); err != nil {
+		return nil, err
+	}
+	entry := &Audit{Published: cleaned}
+	if pub != nil {
+		entry.Uid, entry.Parent, entry.Architecture = pub.Uid, cleanPath(pub.Path), pub.Architecture
+	}
+	s.audit(callerName(ctx), astore.AuditEntry_UNPUBLISH, entry)
 
 	return &astore.UnpublishResponse{}, nil
 }
+
+// checkSelect returns an error unless the caller can publish the artifacts selected by path and uid.
+func (s *Server) checkSelect(access *accessChecker, path, uid string) error {
+	if err := access.check(PermissionPublish, cleanPath(path)); err != nil {
+		return err
+	}
+	if uid != "" {
+		return s.checkUid(access, PermissionPublish, uid)
+	}
+	return nil
+}
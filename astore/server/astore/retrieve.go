@@ -2,6 +2,8 @@ package astore
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
 	"net/url"
 	"path"
@@ -9,15 +11,10 @@ import (
 
 	"github.com/enfabrica/enkit/astore/rpc/astore"
 
-	"cloud.google.com/go/datastore"
-	"cloud.google.com/go/storage"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-// Functions mocked in unit tests
-var storageSignedURL = storage.SignedURL
-
 type authType int
 
 const (
@@ -62,14 +59,27 @@ func (s *Server) DownloadArtifact(prefix string, ehandler DownloadHandler, auth
 	arch := getSingleParam(params, "a", "arch")
 	uid := getSingleParam(params, "u", "uid")
 	tags := getListParam(params, "t", "tag")
+	version := getSingleParam(params, "v", "version")
+	digest, err := hex.DecodeString(getSingleParam(params, "s", "sha256"))
+	if err != nil {
+		ehandler(upath, nil, status.Errorf(codes.InvalidArgument, "invalid sha256 - %s", err), w, r)
+		return
+	}
 
+	// Tokens authorize the download of a specific uid, and are not subject to acls.
+	var access *accessChecker
 	switch auth {
 	default:
 		s.options.logger.Errorf("auth type '%v' not supported by DownloadArtifact()", auth)
 		ehandler(upath, nil, status.Errorf(codes.Unauthenticated, "unhandled auth type: %v", auth), w, r)
+		return
 	case AuthTypeOauth:
 		// Assume user has been authenticated at a higher level by this point
-		break
+		access, err = s.accessFor(r.Context())
+		if err != nil {
+			ehandler(upath, nil, err, w, r)
+			return
+		}
 	case AuthTypeToken:
 		if token := params.Get("token"); token != "" {
 			if err := s.validateToken(token, uid); err != nil {
@@ -91,6 +101,8 @@ func (s *Server) DownloadArtifact(prefix string, ehandler DownloadHandler, auth
 	req.Path = astorePath
 	req.Uid = uid
 	req.Architecture = arch
+	req.Sha256 = digest
+	req.Version = version
 
 	if len(tags) > 0 {
 		req.Tag = &astore.TagSet{}
@@ -107,7 +119,7 @@ func (s *Server) DownloadArtifact(prefix string, ehandler DownloadHandler, auth
 		req.Tag = &astore.TagSet{}
 	}
 
-	retr, err := s.Retrieve(r.Context(), req)
+	retr, err := s.retrieve(r.Context(), req, access, PermissionRead)
 	if err != nil {
 		s.options.logger.Errorf("DownloadArtifact failed (path=%q uid=%q arch=%q tags=%+v): %v", req.Path, req.Uid, req.Architecture, req.Tag, err)
 	}
@@ -115,55 +127,74 @@ func (s *Server) DownloadArtifact(prefix string, ehandler DownloadHandler, auth
 }
 
 func (s *Server) Retrieve(ctx context.Context, req *astore.RetrieveRequest) (*astore.RetrieveResponse, error) {
-	if req.Uid == "" && req.Path == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "invalid request - no uid and no path")
+	access, err := s.accessFor(ctx)
+	if err != nil {
+		return nil, err
 	}
+	return s.retrieve(ctx, req, access, PermissionRead)
+}
 
-	reqarch := strings.TrimSpace(req.Architecture)
-
-	var query *datastore.Query
-	var err error
-	if req.Path != "" {
-		query, err = queryForPath(KindArtifact, req.Path, reqarch)
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
-		}
-	} else {
-		query = datastore.NewQuery(KindArtifact)
+// retrieve returns the artifact matching req, if the caller has the permission perm on it.
+func (s *Server) retrieve(ctx context.Context, req *astore.RetrieveRequest, access *accessChecker, perm Permission) (*astore.RetrieveResponse, error) {
+	if req.Uid == "" && req.Path == "" && len(req.Sha256) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request - no uid and no path or sha256")
 	}
-	query = query.Limit(1)
-
-	if req.Uid != "" {
-		query = query.Filter("Uid = ", req.Uid)
+	if len(req.Sha256) != 0 && len(req.Sha256) != sha256.Size {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid sha256 - must be %d bytes, got %d", sha256.Size, len(req.Sha256))
+	}
+	if req.Version != "" && (req.Path == "" || req.Uid != "" || len(req.Sha256) != 0) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request - a version requires a path, and cannot be combined with an uid or sha256")
 	}
 
-	tags := []string{"latest"}
-	if req.Tag != nil {
+	var tags []string
+	switch {
+	case req.Tag != nil:
 		tags = req.Tag.Tag
-	}
-	for _, tag := range tags {
-		query = query.Filter("Tag = ", tag)
+	case len(req.Sha256) == 0 && req.Version == "":
+		tags = []string{"latest"}
 	}
 
-	var artifacts []*Artifact
-	keys, err := s.ds.GetAll(s.ctx, query, &artifacts)
+	query := &ArtifactQuery{
+		Path:         req.Path,
+		Uid:          req.Uid,
+		Architecture: strings.TrimSpace(req.Architecture),
+		Tag:          tags,
+		SHA256:       req.Sha256,
+	}
+	// The same content can be stored in paths with different permissions:
+	// find the most recent artifact the caller has access to.
+	if req.Path == "" && req.Uid == "" {
+		query.Accept = func(art *Artifact) bool { return access.check(perm, art.Parent) == nil }
+	}
+	var artifact *Artifact
+	var err error
+	if req.Version != "" {
+		artifact, err = s.retrieveVersion(query, req.Version)
+	} else {
+		artifact, err = s.meta.Retrieve(s.ctx, query)
+	}
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "error running query - %s", err)
+		return nil, err
 	}
-	if len(keys) != 1 || len(artifacts) != 1 {
-		return nil, status.Errorf(codes.NotFound, "artifact not found (%d found)", len(artifacts))
+	if err := access.check(perm, artifact.Parent); err != nil {
+		return nil, err
 	}
 
-	artifact := artifacts[0]
-	url, err := storageSignedURL(s.options.bucket, objectPath(artifact.Sid), s.options.ForSigning("GET"))
+	url, err := s.blobs.GetURL(ctx, artifact.Sid)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not generate download URL - %s", err)
 	}
 
 	resp := &astore.RetrieveResponse{
-		Path:     keyToPath(keys[0]),
-		Artifact: artifact.ToProto(keyToArchitecture(keys[0])),
+		Path:     artifact.Path(),
+		Artifact: artifact.ToProto(),
 		Url:      url,
 	}
+	if req.Manifest {
+		resp.Manifest, err = s.retrieveManifest(artifact.Sid)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "could not retrieve manifest - %s", err)
+		}
+	}
 	return resp, nil
 }
@@ -0,0 +1,150 @@
+package astore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultUploadChunkSize is the size of the parts of an upload, unless configured otherwise.
+const defaultUploadChunkSize = 64 << 20
+
+// maxUploadParts is the maximum number of parts of an upload.
+//
+// This is the maximum number of components of a composite object in GCS.
+// Larger uploads are split in larger parts.
+const maxUploadParts = 1024
+
+// uploadParts returns the number of parts of chunkSize bytes needed to upload size bytes.
+func uploadParts(size, chunkSize int64) int {
+	if size <= 0 {
+		return 1
+	}
+	return int((size + chunkSize - 1) / chunkSize)
+}
+
+// multipartStore returns the BlobStore of the server if it supports uploads in parts.
+func (s *Server) multipartStore() (MultipartBlobStore, error) {
+	blobs, ok := s.blobs.(MultipartBlobStore)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "the storage in use does not support uploads in parts")
+	}
+	return blobs, nil
+}
+
+// checkUpload validates the parameters of an upload in parts, returning the number of parts.
+func checkUpload(sid string, size, chunkSize int64) (int, error) {
+	if !IsSid(sid) {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid sid %q", sid)
+	}
+	if size < 0 || chunkSize <= 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid size %d or chunk size %d", size, chunkSize)
+	}
+	parts := uploadParts(size, chunkSize)
+	if parts > maxUploadParts {
+		return 0, status.Errorf(codes.InvalidArgument, "chunk size %d too small - %d parts needed, at most %d allowed", chunkSize, parts, maxUploadParts)
+	}
+	return parts, nil
+}
+
+// partSize returns the expected size of a part of an upload.
+func partSize(part int, size, chunkSize int64) int64 {
+	return min(chunkSize, size-int64(part)*chunkSize)
+}
+
+// StartUpload starts or resumes an upload in parts.
+//
+// The server keeps no state about uploads: the parts already uploaded are
+// found by looking at the storage, so an upload can be resumed as long as
+// the client remembers the sid, size and chunk size.
+func (s *Server) StartUpload(ctx context.Context, req *astore.StartUploadRequest) (*astore.StartUploadResponse, error) {
+	blobs, err := s.multipartStore()
+	if err != nil {
+		return nil, err
+	}
+
+	sid := req.Sid
+	chunkSize := req.ChunkSize
+	if sid == "" {
+		sid, err = GenerateSid(s.rng)
+		if err != nil {
+			return nil, fmt.Errorf("problems with secure prng - %w", err)
+		}
+
+		if chunkSize <= 0 {
+			chunkSize = s.options.uploadChunkSize
+		}
+		if chunkSize <= 0 {
+			chunkSize = defaultUploadChunkSize
+		}
+		if parts := uploadParts(req.Size, chunkSize); parts > maxUploadParts {
+			chunkSize = (req.Size + maxUploadParts - 1) / maxUploadParts
+		}
+	} else {
+		if _, err := blobs.Stat(ctx, sid); err == nil {
+			return nil, status.Errorf(codes.AlreadyExists, "upload %s was already completed", sid)
+		}
+	}
+
+	parts, err := checkUpload(sid, req.Size, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &astore.StartUploadResponse{Sid: sid, ChunkSize: chunkSize}
+	for part := 0; part < parts; part++ {
+		url, err := blobs.PartURL(ctx, sid, part)
+		if err != nil {
+			return nil, fmt.Errorf("could not sign the url - %w", err)
+		}
+
+		done := false
+		if req.Sid != "" {
+			size, err := blobs.StatPart(ctx, sid, part)
+			if err != nil && !errors.Is(err, ErrBlobNotFound) {
+				return nil, status.Errorf(codes.Internal, "could not check part %d of %s - %s", part, sid, err)
+			}
+			done = err == nil && size == partSize(part, req.Size, chunkSize)
+		}
+		resp.Part = append(resp.Part, &astore.UploadPart{Index: int32(part), Url: url, Done: done})
+	}
+	return resp, nil
+}
+
+// CompleteUpload assembles the parts of an upload into a blob, ready to be committed.
+func (s *Server) CompleteUpload(ctx context.Context, req *astore.CompleteUploadRequest) (*astore.CompleteUploadResponse, error) {
+	blobs, err := s.multipartStore()
+	if err != nil {
+		return nil, err
+	}
+	parts, err := checkUpload(req.Sid, req.Size, req.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []int
+	for part := 0; part < parts; part++ {
+		size, err := blobs.StatPart(ctx, req.Sid, part)
+		if err != nil && !errors.Is(err, ErrBlobNotFound) {
+			return nil, status.Errorf(codes.Internal, "could not check part %d of %s - %s", part, req.Sid, err)
+		}
+		if err != nil || size != partSize(part, req.Size, req.ChunkSize) {
+			missing = append(missing, part)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "upload %s is incomplete - parts %v are missing or truncated", req.Sid, missing)
+	}
+
+	if err := blobs.Compose(ctx, req.Sid, parts, req.Md5); err != nil {
+		if errors.Is(err, ErrBlobCorrupted) {
+			return nil, status.Errorf(codes.DataLoss, "upload %s does not match the expected md5 - %s", req.Sid, err)
+		}
+		return nil, status.Errorf(codes.Internal, "could not assemble upload %s - %s", req.Sid, err)
+	}
+	return &astore.CompleteUploadResponse{}, nil
+}
@@ -0,0 +1,185 @@
+package astore
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUploadParts(t *testing.T) {
+	testCases := []struct {
+		size, chunkSize int64
+		parts           int
+	}{
+		{size: 0, chunkSize: 10, parts: 1},
+		{size: 1, chunkSize: 10, parts: 1},
+		{size: 10, chunkSize: 10, parts: 1},
+		{size: 11, chunkSize: 10, parts: 2},
+		{size: 100, chunkSize: 10, parts: 10},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.parts, uploadParts(tc.size, tc.chunkSize), "size %d chunk %d", tc.size, tc.chunkSize)
+	}
+	assert.Equal(t, int64(1), partSize(10, 101, 10))
+	assert.Equal(t, int64(10), partSize(9, 101, 10))
+}
+
+func TestMultipartUpload(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	content := strings.Repeat("0123456789", 10) + "x"
+
+	started, err := server.StartUpload(ctx, &astore.StartUploadRequest{Size: int64(len(content)), ChunkSize: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), started.ChunkSize)
+	require.Len(t, started.Part, 11)
+
+	// Upload all parts but the last two, out of order.
+	for _, part := range started.Part[:9] {
+		offset := int(part.Index) * 10
+		code, _ := doRequest(t, http.MethodPut, part.Url, []byte(content[offset:offset+10]))
+		require.Equal(t, http.StatusOK, code)
+	}
+
+	complete := &astore.CompleteUploadRequest{Sid: started.Sid, Size: int64(len(content)), ChunkSize: 10}
+	_, err = server.CompleteUpload(ctx, complete)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Resuming reports the parts already uploaded.
+	resumed, err := server.StartUpload(ctx, &astore.StartUploadRequest{Sid: started.Sid, Size: int64(len(content)), ChunkSize: 10})
+	require.NoError(t, err)
+	assert.Equal(t, started.Sid, resumed.Sid)
+	require.Len(t, resumed.Part, 11)
+	for _, part := range resumed.Part {
+		assert.Equal(t, part.Index < 9, part.Done, "part %d", part.Index)
+	}
+	for _, part := range resumed.Part[9:] {
+		offset := int(part.Index) * 10
+		code, _ := doRequest(t, http.MethodPut, part.Url, []byte(content[offset:min(offset+10, len(content))]))
+		require.Equal(t, http.StatusOK, code)
+	}
+
+	// Parts can be uploaded, but not downloaded.
+	code, _ := doRequest(t, http.MethodGet, resumed.Part[0].Url, nil)
+	assert.NotEqual(t, http.StatusOK, code)
+
+	sum := md5.Sum([]byte(content))
+	complete.Md5 = sum[:]
+	_, err = server.CompleteUpload(ctx, complete)
+	require.NoError(t, err)
+
+	_, err = server.StartUpload(ctx, &astore.StartUploadRequest{Sid: started.Sid, Size: int64(len(content)), ChunkSize: 10})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	committed, err := server.Commit(ctx, &astore.CommitRequest{Sid: started.Sid, Path: "images/large"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), committed.Artifact.Size)
+	assert.Equal(t, sum[:], committed.Artifact.MD5)
+
+	retrieved, err := server.Retrieve(ctx, &astore.RetrieveRequest{Uid: committed.Artifact.Uid})
+	require.NoError(t, err)
+	code, data := doRequest(t, http.MethodGet, retrieved.Url, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, content, string(data))
+}
+
+func TestMultipartUploadErrors(t *testing.T) {
+	server, ctx := localServerForTest(t)
+
+	// Chunk sizes too small are adjusted for new uploads, and rejected when resuming.
+	started, err := server.StartUpload(ctx, &astore.StartUploadRequest{Size: 10 * maxUploadParts, ChunkSize: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), started.ChunkSize)
+	assert.Len(t, started.Part, maxUploadParts)
+	_, err = server.StartUpload(ctx, &astore.StartUploadRequest{Sid: started.Sid, Size: 10 * maxUploadParts, ChunkSize: 1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = server.StartUpload(ctx, &astore.StartUploadRequest{Sid: "invalid", Size: 10, ChunkSize: 1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Content not matching the expected md5 is rejected.
+	started, err = server.StartUpload(ctx, &astore.StartUploadRequest{Size: 4, ChunkSize: 2})
+	require.NoError(t, err)
+	for _, part := range started.Part {
+		code, _ := doRequest(t, http.MethodPut, part.Url, []byte("ab"))
+		require.Equal(t, http.StatusOK, code)
+	}
+	sum := md5.Sum([]byte("abcd"))
+	_, err = server.CompleteUpload(ctx, &astore.CompleteUploadRequest{Sid: started.Sid, Size: 4, ChunkSize: 2, Md5: sum[:]})
+	assert.Equal(t, codes.DataLoss, status.Code(err))
+	_, err = server.blobs.Stat(ctx, started.Sid)
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+}
+
+// claimedMD5BlobStore reports the MD5 supplied by clients instead of the one
+// of the content, as GCSBlobStore does for composite objects.
+type claimedMD5BlobStore struct {
+	*LocalBlobStore
+	claimed map[string][]byte
+}
+
+func (s *claimedMD5BlobStore) Stat(ctx context.Context, sid string) (*BlobAttrs, error) {
+	attrs, err := s.LocalBlobStore.Stat(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobAttrs{Size: attrs.Size, MD5: s.claimed[sid], MD5Unverified: true, Metadata: attrs.Metadata}, nil
+}
+
+func TestCommitVerifiesClaimedMD5(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	blobs := &claimedMD5BlobStore{LocalBlobStore: server.blobs.(*LocalBlobStore), claimed: map[string][]byte{}}
+	server.blobs = blobs
+
+	store := func(content string, claimed string) string {
+		stored, err := server.Store(ctx, &astore.StoreRequest{})
+		require.NoError(t, err)
+		code, _ := doRequest(t, http.MethodPut, stored.Url, []byte(content))
+		require.Equal(t, http.StatusOK, code)
+		sum := md5.Sum([]byte(claimed))
+		blobs.claimed[stored.Sid] = sum[:]
+		return stored.Sid
+	}
+
+	first, err := server.Commit(ctx, &astore.CommitRequest{Sid: store("toolchain", "toolchain"), Path: "tools/first"})
+	require.NoError(t, err)
+
+	// Claiming the MD5 of another blob does not make the artifact point to it.
+	_, err = server.Commit(ctx, &astore.CommitRequest{Sid: store("malware!!", "toolchain"), Path: "tools/second"})
+	assert.Equal(t, codes.DataLoss, status.Code(err))
+
+	committed, err := server.Commit(ctx, &astore.CommitRequest{Sid: store("toolchain", "toolchain"), Path: "tools/second"})
+	require.NoError(t, err)
+	assert.Equal(t, first.Artifact.Sid, committed.Artifact.Sid)
+}
+
+func TestCommitIgnoresUploadedSHA256(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	blobs := &claimedMD5BlobStore{LocalBlobStore: server.blobs.(*LocalBlobStore), claimed: map[string][]byte{}}
+	server.blobs = blobs
+
+	stored, err := server.Store(ctx, &astore.StoreRequest{})
+	require.NoError(t, err)
+	code, _ := doRequest(t, http.MethodPut, stored.Url, []byte("malware"))
+	require.Equal(t, http.StatusOK, code)
+	sum := md5.Sum([]byte("malware"))
+	blobs.claimed[stored.Sid] = sum[:]
+
+	// The digest recorded in the metadata of a blob never committed is not
+	// trusted, as it may have been set by the uploader.
+	claimed := sha256.Sum256([]byte("toolchain"))
+	require.NoError(t, blobs.Annotate(ctx, stored.Sid, map[string]string{"sha256": hex.EncodeToString(claimed[:])}))
+	committed, err := server.Commit(ctx, &astore.CommitRequest{Sid: stored.Sid, Path: "tools/first"})
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("malware"))
+	assert.Equal(t, digest[:], committed.Artifact.Sha256)
+}
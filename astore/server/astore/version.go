@@ -0,0 +1,80 @@
+package astore
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultVersionPrefix is the prefix of the tags holding the version of an artifact, like "v1.4.2".
+const DefaultVersionPrefix = "v"
+
+// parseConstraint parses a version constraint supplied by the user, like ">=1.4,<2" or "~1.4".
+func parseConstraint(constraint string) (*semver.Constraints, error) {
+	parsed, err := semver.NewConstraint(strings.TrimSpace(constraint))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid version constraint %q - %s", constraint, err)
+	}
+	return parsed, nil
+}
+
+// artifactVersion returns the highest version among the tags of the artifact, or nil if it has none.
+//
+// Versions are tags starting with the version prefix configured, followed by a semantic version.
+func (s *Server) artifactVersion(art *Artifact) *semver.Version {
+	var highest *semver.Version
+	for _, tag := range art.Tag {
+		raw, found := strings.CutPrefix(tag, s.options.versionPrefix)
+		if !found {
+			continue
+		}
+		version, err := semver.NewVersion(raw)
+		if err != nil {
+			continue
+		}
+		if highest == nil || version.GreaterThan(highest) {
+			highest = version
+		}
+	}
+	return highest
+}
+
+// matchVersion returns the artifacts with a version satisfying the constraint, highest version first.
+//
+// Artifacts with the same version keep their relative order.
+func (s *Server) matchVersion(arts []*Artifact, constraint *semver.Constraints) []*Artifact {
+	var matched []*Artifact
+	versions := map[*Artifact]*semver.Version{}
+	for _, art := range arts {
+		version := s.artifactVersion(art)
+		if version == nil || !constraint.Check(version) {
+			continue
+		}
+		versions[art] = version
+		matched = append(matched, art)
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return versions[matched[i]].GreaterThan(versions[matched[j]])
+	})
+	return matched
+}
+
+// retrieveVersion returns the artifact matching the query with the highest version satisfying the constraint.
+func (s *Server) retrieveVersion(query *ArtifactQuery, constraint string) (*Artifact, error) {
+	parsed, err := parseConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+	_, arts, err := s.meta.List(s.ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	matched := s.matchVersion(arts, parsed)
+	if len(matched) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no artifact in %s with a version matching %q", query.Path, constraint)
+	}
+	return matched[0], nil
+}
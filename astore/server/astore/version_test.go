@@ -0,0 +1,98 @@
+package astore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVersion(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	server.options.versionPrefix = DefaultVersionPrefix
+
+	upload := func(tags ...string) *astore.Artifact {
+		return uploadForTest(t, server, ctx, tags[0], &astore.CommitRequest{Path: "tools/hello", Tag: tags})
+	}
+	v142 := upload("v1.4.2")
+	v1410 := upload("v1.4.10", "stable")
+	upload("v2.0.0")
+	upload("v1.3.0")
+	upload("nightly")
+
+	retrieve := func(version string, tags ...string) (*astore.Artifact, error) {
+		req := &astore.RetrieveRequest{Path: "tools/hello", Version: version}
+		if tags != nil {
+			req.Tag = &astore.TagSet{Tag: tags}
+		}
+		resp, err := server.Retrieve(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Artifact, nil
+	}
+
+	// The highest version matching is returned, not the most recent one.
+	art, err := retrieve(">=1.4,<2")
+	require.NoError(t, err)
+	assert.Equal(t, v1410.Uid, art.Uid)
+	art, err = retrieve("~1.4")
+	require.NoError(t, err)
+	assert.Equal(t, v1410.Uid, art.Uid)
+	art, err = retrieve("<1.4.10 || >=3")
+	require.NoError(t, err)
+	assert.Equal(t, v142.Uid, art.Uid)
+
+	// Tags still restrict the artifacts considered.
+	_, err = retrieve("~1.3", "stable")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = retrieve("<1")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = retrieve("not a constraint")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.Retrieve(ctx, &astore.RetrieveRequest{Uid: v142.Uid, Version: "~1.4"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	listed, err := server.List(ctx, &astore.ListRequest{Path: "tools/hello", Version: "1.x"})
+	require.NoError(t, err)
+	var versions []string
+	for _, art := range listed.Artifact {
+		versions = append(versions, art.Tag[0])
+	}
+	assert.Equal(t, []string{"v1.4.10", "v1.4.2", "v1.3.0"}, versions)
+
+	// Published URLs track the highest version in the range.
+	server.options.publishBaseURL = "https://astore.enkit.test/d/"
+	_, err = server.Publish(ctx, &astore.PublishRequest{Path: "hello-1", Select: &astore.ListRequest{Path: "tools/hello", Version: "^1"}})
+	require.NoError(t, err)
+	_, err = server.Publish(ctx, &astore.PublishRequest{Path: "hello-bad", Select: &astore.ListRequest{Path: "tools/hello", Version: "^^1"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	published := func(url string) string {
+		var uid string
+		server.DownloadPublished("/d/", func(_ string, resp *astore.RetrieveResponse, err error, _ http.ResponseWriter, _ *http.Request) {
+			require.NoError(t, err)
+			uid = resp.Artifact.Uid
+		}, httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+		return uid
+	}
+	assert.Equal(t, v1410.Uid, published("/d/hello-1"))
+	v15 := upload("v1.5.0")
+	assert.Equal(t, v15.Uid, published("/d/hello-1"))
+	// The uid parameter is ignored, the version constraint selects the artifact.
+	assert.Equal(t, v15.Uid, published("/d/hello-1?u="+v1410.Uid))
+
+	// The version prefix is configurable.
+	server.options.versionPrefix = "release-"
+	release := upload("release-0.9")
+	art, err = retrieve("<1")
+	require.NoError(t, err)
+	assert.Equal(t, release.Uid, art.Uid)
+	_, err = retrieve("^1")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
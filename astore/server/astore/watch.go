@@ -0,0 +1,171 @@
+package astore
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// watchBuffer is the number of events queued for a Watch stream before it is considered too slow.
+const watchBuffer = 256
+
+// watchAclRefresh is how often a Watch stream reads the acls again, to notice
+// the changes made through other replicas.
+const watchAclRefresh = time.Minute
+
+// watcher is the state of a single Watch stream.
+type watcher struct {
+	parent string
+	uid    string
+	arch   string
+	tags   []string
+
+	// Closed if the stream could not keep up with the events.
+	events chan *astore.WatchEvent
+}
+
+func newWatcher(req *astore.ListRequest) *watcher {
+	tags := []string{"latest"}
+	if req.Tag != nil {
+		tags = req.Tag.Tag
+	}
+	return &watcher{
+		parent: cleanPath(req.Path),
+		uid:    strings.TrimSpace(req.Uid),
+		arch:   strings.TrimSpace(req.Architecture),
+		tags:   tags,
+		events: make(chan *astore.WatchEvent, watchBuffer),
+	}
+}
+
+// matches returns true if the watcher is interested in changes to art.
+func (w *watcher) matches(art *Artifact) bool {
+	if art.Parent != w.parent && !strings.HasPrefix(art.Parent, w.parent+"/") {
+		return false
+	}
+	if w.uid != "" && art.Uid != w.uid {
+		return false
+	}
+	if w.arch != "" && art.Architecture != w.arch {
+		return false
+	}
+	have := indexStrings(art.Tag)
+	for _, tag := range w.tags {
+		if _, found := have[tag]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// watchers dispatches the changes to the artifacts to the Watch streams.
+//
+// Events are only dispatched to the streams connected to the same server:
+// with multiple replicas, clients must be routed consistently, or must
+// resync periodically with List.
+//
+// The zero value is ready to use.
+type watchers struct {
+	lock    sync.Mutex
+	watcher map[*watcher]struct{}
+
+	// Incremented every time the acls are changed through this server.
+	acls atomic.Uint64
+}
+
+func (ws *watchers) add(w *watcher) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if ws.watcher == nil {
+		ws.watcher = map[*watcher]struct{}{}
+	}
+	ws.watcher[w] = struct{}{}
+}
+
+func (ws *watchers) remove(w *watcher) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if _, found := ws.watcher[w]; found {
+		delete(ws.watcher, w)
+		close(w.events)
+	}
+}
+
+// notify dispatches an event for each artifact to the interested watchers.
+//
+// Watchers that cannot keep up are dropped, rather than blocking the caller.
+func (ws *watchers) notify(kind astore.WatchEvent_Type, arts ...*Artifact) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	for _, art := range arts {
+		var event *astore.WatchEvent
+		for w := range ws.watcher {
+			if !w.matches(art) {
+				continue
+			}
+			if event == nil {
+				event = &astore.WatchEvent{Type: kind, Path: art.Path(), Artifact: art.ToProto()}
+			}
+			select {
+			case w.events <- event:
+			default:
+				delete(ws.watcher, w)
+				close(w.events)
+			}
+		}
+	}
+}
+
+// Watch streams the changes to the artifacts matching the request, until the client disconnects.
+func (s *Server) Watch(req *astore.ListRequest, stream astore.Astore_WatchServer) error {
+	acls, checked := s.watchers.acls.Load(), time.Now()
+	access, err := s.accessFor(stream.Context())
+	if err != nil {
+		return err
+	}
+	if err := access.check(PermissionRead, cleanPath(req.Path)); err != nil {
+		return err
+	}
+
+	w := newWatcher(req)
+	s.watchers.add(w)
+	defer s.watchers.remove(w)
+
+	// Lets the client know that the watch is established, and no event will be missed.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-w.events:
+			if !ok {
+				return status.Errorf(codes.ResourceExhausted, "client too slow, events were dropped - watch again, and resync with List")
+			}
+			// Acls may have changed since the watch started. Rather than reading them
+			// for each event, they are read again when changed through this server,
+			// and every watchAclRefresh for changes made through other replicas.
+			if current := s.watchers.acls.Load(); current != acls || time.Since(checked) >= watchAclRefresh {
+				refreshed, err := s.accessFor(stream.Context())
+				if err != nil {
+					continue
+				}
+				access, acls, checked = refreshed, current, time.Now()
+			}
+			if !access.allowed(PermissionRead, cleanPath(event.Path)) {
+				continue
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package astore
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/enfabrica/enkit/astore/rpc/astore"
+	"github.com/enfabrica/enkit/lib/oauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestWatcherMatches(t *testing.T) {
+	art := &Artifact{Uid: "uid", Parent: "root/tools/hello", Architecture: "amd64", Tag: []string{"latest", "stable"}}
+
+	testCases := []struct {
+		desc    string
+		req     *astore.ListRequest
+		matches bool
+	}{
+		{desc: "everything", req: &astore.ListRequest{}, matches: true},
+		{desc: "same path", req: &astore.ListRequest{Path: "tools/hello"}, matches: true},
+		{desc: "parent path", req: &astore.ListRequest{Path: "/tools/"}, matches: true},
+		{desc: "other path", req: &astore.ListRequest{Path: "tools/hell"}, matches: false},
+		{desc: "child path", req: &astore.ListRequest{Path: "tools/hello/world"}, matches: false},
+		{desc: "uid", req: &astore.ListRequest{Uid: "uid"}, matches: true},
+		{desc: "other uid", req: &astore.ListRequest{Uid: "other"}, matches: false},
+		{desc: "arch", req: &astore.ListRequest{Path: "tools", Architecture: "amd64"}, matches: true},
+		{desc: "other arch", req: &astore.ListRequest{Path: "tools", Architecture: "arm64"}, matches: false},
+		{desc: "tags", req: &astore.ListRequest{Tag: &astore.TagSet{Tag: []string{"stable", "latest"}}}, matches: true},
+		{desc: "any tag", req: &astore.ListRequest{Tag: &astore.TagSet{}}, matches: true},
+		{desc: "missing tag", req: &astore.ListRequest{Tag: &astore.TagSet{Tag: []string{"stable", "canary"}}}, matches: false},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.matches, newWatcher(tc.req).matches(art), tc.desc)
+	}
+
+	untagged := &Artifact{Uid: "uid", Parent: "root/tools/hello", Architecture: "amd64"}
+	assert.False(t, newWatcher(&astore.ListRequest{}).matches(untagged))
+}
+
+func TestWatchers(t *testing.T) {
+	server, ctx := localServerForTest(t)
+
+	all := newWatcher(&astore.ListRequest{Tag: &astore.TagSet{}})
+	stable := newWatcher(&astore.ListRequest{Path: "tools", Tag: &astore.TagSet{Tag: []string{"stable"}}})
+	server.watchers.add(all)
+	server.watchers.add(stable)
+
+	hello := uploadForTest(t, server, ctx, "hello", &astore.CommitRequest{Path: "tools/hello"})
+	_, err := server.Tag(ctx, &astore.TagRequest{Uid: hello.Uid, Add: &astore.TagSet{Tag: []string{"stable"}}})
+	require.NoError(t, err)
+	_, err = server.Note(ctx, &astore.NoteRequest{Uid: hello.Uid, Note: "released"})
+	require.NoError(t, err)
+	_, err = server.Delete(ctx, &astore.DeleteRequest{Id: hello.Uid})
+	require.NoError(t, err)
+	uploadForTest(t, server, ctx, "other", &astore.CommitRequest{Path: "other/hello"})
+
+	expected := []astore.WatchEvent_Type{astore.WatchEvent_COMMITTED, astore.WatchEvent_TAGGED, astore.WatchEvent_NOTED, astore.WatchEvent_DELETED, astore.WatchEvent_COMMITTED}
+	for i, kind := range expected {
+		event := <-all.events
+		assert.Equal(t, kind, event.Type, "event %d", i)
+	}
+	assert.Empty(t, all.events)
+
+	expected = []astore.WatchEvent_Type{astore.WatchEvent_TAGGED, astore.WatchEvent_NOTED, astore.WatchEvent_DELETED}
+	for i, kind := range expected {
+		event := <-stable.events
+		assert.Equal(t, kind, event.Type, "event %d", i)
+		assert.Equal(t, "tools/hello", event.Path)
+		assert.Equal(t, hello.Uid, event.Artifact.Uid)
+	}
+	assert.Empty(t, stable.events)
+
+	// Watchers not keeping up are dropped, and their channel closed.
+	server.watchers.remove(all)
+	for i := 0; i <= watchBuffer; i++ {
+		server.watchers.notify(astore.WatchEvent_NOTED, &Artifact{Parent: "root/tools", Tag: []string{"stable"}})
+	}
+	assert.Len(t, stable.events, watchBuffer)
+	for range stable.events {
+	}
+	assert.Empty(t, server.watchers.watcher)
+}
+
+// watchStream is an Astore_WatchServer delivering events to a channel.
+type watchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	header chan struct{}
+	events chan *astore.WatchEvent
+}
+
+func (s *watchStream) Context() context.Context { return s.ctx }
+
+func (s *watchStream) SendHeader(metadata.MD) error {
+	close(s.header)
+	return nil
+}
+
+func (s *watchStream) Send(event *astore.WatchEvent) error {
+	s.events <- event
+	return nil
+}
+
+// countingMetadata counts the acl queries.
+type countingMetadata struct {
+	MetadataStore
+	listAcls atomic.Int32
+}
+
+func (m *countingMetadata) ListAcls(ctx context.Context, path string) ([]*Acl, error) {
+	m.listAcls.Add(1)
+	return m.MetadataStore.ListAcls(ctx, path)
+}
+
+func TestWatchAcls(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	server.options.admins = []string{"tester@enkit.test"}
+	meta := &countingMetadata{MetadataStore: server.meta}
+	server.meta = meta
+	_, err := server.SetAcl(ctx, &astore.SetAclRequest{Acl: &astore.Acl{Path: "docs", Read: []string{"group:docs"}}})
+	require.NoError(t, err)
+
+	dev, cancel := context.WithCancel(oauth.SetCredentials(context.Background(), &oauth.CredentialsCookie{
+		Identity: oauth.Identity{Username: "dev", Organization: "enkit.test"},
+	}))
+	defer cancel()
+	stream := &watchStream{ctx: dev, header: make(chan struct{}), events: make(chan *astore.WatchEvent, watchBuffer)}
+	done := make(chan error)
+	go func() { done <- server.Watch(&astore.ListRequest{Tag: &astore.TagSet{}}, stream) }()
+	<-stream.header
+
+	// Acls are not read again for each event.
+	meta.listAcls.Store(0)
+	uploadForTest(t, server, ctx, "hello", &astore.CommitRequest{Path: "tools/hello"})
+	uploadForTest(t, server, ctx, "world", &astore.CommitRequest{Path: "tools/world"})
+	assert.Equal(t, "tools/hello", (<-stream.events).Path)
+	assert.Equal(t, "tools/world", (<-stream.events).Path)
+	assert.Equal(t, int32(0), meta.listAcls.Load())
+
+	// Acls changed through the server are read again, once.
+	_, err = server.SetAcl(ctx, &astore.SetAclRequest{Acl: &astore.Acl{Path: "tools", Read: []string{"group:tools"}}})
+	require.NoError(t, err)
+	uploadForTest(t, server, ctx, "hidden", &astore.CommitRequest{Path: "tools/hidden"})
+	uploadForTest(t, server, ctx, "readme", &astore.CommitRequest{Path: "other/readme"})
+	uploadForTest(t, server, ctx, "license", &astore.CommitRequest{Path: "other/license"})
+	assert.Equal(t, "other/readme", (<-stream.events).Path)
+	assert.Equal(t, "other/license", (<-stream.events).Path)
+	assert.Equal(t, int32(1), meta.listAcls.Load())
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestWatchersFailedUpdate(t *testing.T) {
+	server, ctx := localServerForTest(t)
+	hello := uploadForTest(t, server, ctx, "hello", &astore.CommitRequest{Path: "tools/hello"})
+	server.meta = failingUpdateMetadata{server.meta}
+	all := newWatcher(&astore.ListRequest{Tag: &astore.TagSet{}})
+	server.watchers.add(all)
+
+	_, err := server.Tag(ctx, &astore.TagRequest{Uid: hello.Uid, Add: &astore.TagSet{Tag: []string{"stable"}}})
+	assert.Error(t, err)
+	_, err = server.Note(ctx, &astore.NoteRequest{Uid: hello.Uid, Note: "greets"})
+	assert.Error(t, err)
+	assert.Empty(t, all.events)
+}
@@ -118,6 +118,10 @@ func Start(ctx context.Context, targetURL, cookieDomain string, astoreFlags *ast
 	oauthFlags.TargetURL = strings.TrimSuffix(targetURL, "/") + "/e/"
 	optAuthFlags.TargetURL = strings.TrimSuffix(targetURL, "/") + "/e/"
 
+	if astoreFlags.BlobDir != "" && astoreFlags.BlobURL == "" {
+		astoreFlags.BlobURL = strings.TrimSuffix(targetURL, "/") + "/b/"
+	}
+
 	listURL := ""
 	downloadURL := ""
 	if astoreFlags.PublishBaseURL != "" {
@@ -133,6 +137,7 @@ func Start(ctx context.Context, targetURL, cookieDomain string, astoreFlags *ast
 	if err != nil {
 		return fmt.Errorf("could not initialize storage - %s Maybe you need to pass --credentials-file or --project-id-file?", err)
 	}
+	go astoreServer.RunJanitor(ctx)
 
 	authServer, err := auth.New(rng, auth.WithLogger(log), auth.WithFlags(authFlags))
 	if err != nil {
@@ -203,6 +208,12 @@ func Start(ctx context.Context, targetURL, cookieDomain string, astoreFlags *ast
 		}, astore.AuthTypeToken, w, r)
 	})
 
+	// Upload and download of artifacts, when they are stored locally rather than in a GCS bucket.
+	// Requests are authenticated by the token carried in the URL.
+	if handler := astoreServer.BlobHandler(); handler != nil {
+		mux.Handle("/b/", http.StripPrefix("/b/", handler))
+	}
+
 	// Web authentication endpoint. Other web services can redirect the user to /w here with an r= parameter to perform authentication,
 	// and redirect the user back to the r= target if authentication succeeds.
 	mux.HandleFunc("/w", func(w http.ResponseWriter, r *http.Request) {
@@ -3,9 +3,10 @@ package astore_test
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 
 	"github.com/enfabrica/enkit/astore/atesting"
@@ -23,6 +24,8 @@ type AStoreDescriptor struct {
 }
 
 // RunAStoreServer will spin up an emulated datastore along with an instance of the astore grpc server.
+//
+// Blobs are stored in a temporary directory, so no GCS bucket or service account is necessary.
 func RunAStoreServer() (*AStoreDescriptor, atesting.KillAbleProcess, error) {
 	killFunctions := atesting.KillAbleProcess{}
 	emulatorDescriptor, emulatorKill, err := atesting.RunEmulatedDatastore()
@@ -30,31 +33,41 @@ func RunAStoreServer() (*AStoreDescriptor, atesting.KillAbleProcess, error) {
 	if err != nil {
 		return nil, killFunctions, err
 	}
-	// Causes the google-could-go/storage library to use a local emulator rather than the real endpoint.
+	// Causes the google-cloud-go/datastore library to use the local emulator rather than the real endpoint.
 	err = os.Setenv(
-		"STORAGE_EMULATOR_HOST",
+		"DATASTORE_EMULATOR_HOST",
 		fmt.Sprintf("localhost:%d", emulatorDescriptor.Addr.Port))
 	if err != nil {
 		return nil, killFunctions, err
 	}
+
+	// Blobs are kept in a temporary directory, and served by a local web server.
+	blobDir, err := os.MkdirTemp("", "astore-blobs")
+	if err != nil {
+		return nil, killFunctions, err
+	}
+	killFunctions.Add(func() {
+		os.RemoveAll(blobDir)
+	})
+	blobMux := http.NewServeMux()
+	blobServer := httptest.NewServer(blobMux)
+	killFunctions.Add(blobServer.Close)
+
 	buffListener := bufconn.Listen(2048 * 2048)
 	bufDialer := func(context.Context, string) (net.Conn, error) {
 		return buffListener.Dial()
 	}
 	grpcServer := grpc.NewServer()
-	credentialString, err := ioutil.ReadFile("./testdata/credentials.json")
-	if err != nil {
-		return nil, nil, err
-	}
 
 	server, err := astore.New(rand.New(srand.Source),
-		astore.WithCredentialsJSON(credentialString),
-		astore.WithSigningJSON(credentialString),
-		astore.WithBucket("example-bucket"))
+		astore.WithProjectID("astore-test"),
+		astore.WithBlobDir(blobDir),
+		astore.WithBlobURL(blobServer.URL+"/b/"))
 
 	if err != nil {
 		return nil, killFunctions, err
 	}
+	blobMux.Handle("/b/", http.StripPrefix("/b/", server.BlobHandler()))
 	apb.RegisterAstoreServer(grpcServer, server)
 	if err := grpcServer.Serve(buffListener); err != nil {
 		return nil, killFunctions, err
@@ -23,16 +23,26 @@ astore_output_format = rule(
     build_setting = config.string(flag = True),
 )
 
-def _astore_url(package, uid, access_mod = "g", instance = "https://astore.corp.enfabrica.net"):
-    """Returns a URL for a particular package version from astore."""
+def _astore_url(package, uid, access_mod = "g", instance = "https://astore.corp.enfabrica.net", digest = None):
+    """Returns a URL for a particular package version from astore.
+
+    The version is selected by uid or, if no uid is supplied, by sha256 digest.
+    """
     if not package:
         fail("package not passed to astore_url substitution")
 
-    if not uid:
-        fail("uid not passed to astore_url substitution")
+    if not uid and not digest:
+        fail("neither uid nor digest passed to astore_url substitution")
 
     if not package.startswith("/"):
         package = "/" + package
+    if not uid:
+        return "{}/{}{}?s={}".format(
+            instance,
+            access_mod,
+            package,
+            digest,
+        )
     return "{}/{}{}?u={}".format(
         instance,
         access_mod,
@@ -44,17 +54,18 @@ def astore_url(package, uid, instance = "https://astore.corp.enfabrica.net"):
     _astore_url(package, uid, "d", instance)
 
 def _get_url_and_sha256(kwargs):
+    sha256 = kwargs.pop("sha256", None)
+    if not sha256:
+        sha256 = kwargs.pop("digest", None)
+
     url = kwargs.pop("url", None)
     if not url:
         url = _astore_url(
             kwargs.pop("path", None),
             kwargs.pop("uid", None),
+            digest = sha256,
         )
 
-    sha256 = kwargs.pop("sha256", None)
-    if not sha256:
-        sha256 = kwargs.pop("digest", None)
-
     return url, sha256
 
 def _astore_upload(ctx):
@@ -203,6 +214,9 @@ def _astore_download(ctx):
         command += " -a " + ctx.attr.arch
     if ctx.attr.uid:
         command += " --force-uid %s" % ctx.attr.uid
+    elif ctx.attr.digest:
+        # The artifact is pinned by digest, which is as hermetic as a uid.
+        command += " --digest %s %s" % (ctx.attr.digest, ctx.attr.download_src)
     else:
         command += " --tag %s %s" % (ctx.attr.astore_tag, ctx.attr.download_src)
         execution_requirements["no-cache"] = "Not hermetic, since uid was not specified."
@@ -288,7 +302,8 @@ astore_download = rule(
             default = "",
         ),
         "digest": attr.string(
-            doc = "The sha256 digest of the file that we expect to receive.",
+            doc = "The sha256 digest of the file that we expect to receive. " +
+                  "If no uid is specified, the file is selected by digest.",
             mandatory = False,
             default = "",
         ),
@@ -347,7 +362,7 @@ def astore_package(**kwargs):
 
 def _astore_file_impl(rctx):
     output = rctx.path(rctx.attr.path.split("/")[-1])
-    url = _astore_url(rctx.attr.path, rctx.attr.uid)
+    url = _astore_url(rctx.attr.path, rctx.attr.uid, digest = rctx.attr.digest)
     rctx.download(
         url = url,
         output = output,
@@ -366,8 +381,7 @@ astore_file = repository_rule(
             mandatory = True,
         ),
         "uid": attr.string(
-            doc = "Astore UID of the desired version of the object.",
-            mandatory = True,
+            doc = "Astore UID of the desired version of the object. If not specified, the object is selected by digest.",
         ),
         "digest": attr.string(
             doc = "SHA256 digest of the object.",
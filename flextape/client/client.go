@@ -11,12 +11,31 @@ import (
 	fpb "github.com/enfabrica/enkit/flextape/proto"
 )
 
-var runCommand = func(ctx context.Context, result chan error, cmd string, args ...string) {
+// runCommand runs the command until it exits, or is killed when ctx is done.
+// Signals received on the signals channel are sent to the command.
+var runCommand = func(ctx context.Context, result chan error, signals chan os.Signal, cmd string, args ...string) {
 	job := exec.CommandContext(ctx, cmd, args...)
 	job.Stdout = os.Stdout
 	job.Stderr = os.Stderr
 
-	result <- job.Run()
+	if err := job.Start(); err != nil {
+		result <- err
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				job.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	err := job.Wait()
+	close(done)
+	result <- err
 }
 
 // LicenseClient wraps a FlextapeClient for a specific license acquisition.
@@ -24,6 +43,9 @@ type LicenseClient struct {
 	client     fpb.FlextapeClient
 	invocation *fpb.Invocation
 	licenseErr chan error
+
+	preemptSignal os.Signal      // Signal sent to the command when preempted.
+	preempted     chan time.Time // Receives the preemption deadline, when preempted.
 }
 
 // New returns a LicenseClient that can be used to guard command invocations
@@ -42,9 +64,18 @@ func New(client fpb.FlextapeClient, username string, vendor string, feature stri
 			BuildTag: buildTag,
 		},
 		licenseErr: make(chan error),
+		preempted:  make(chan time.Time, 1),
 	}
 }
 
+// Preemptible allows the server to revoke the license in favor of invocations
+// with higher priority. When preempted, Guard sends sig to the command, and
+// kills it if it is still running when the license is revoked.
+func (c *LicenseClient) Preemptible(sig os.Signal) {
+	c.invocation.Preemptible = true
+	c.preemptSignal = sig
+}
+
 // Guard wraps the specified command with the license acquire/refresh/release
 // lifecycle.
 func (c *LicenseClient) Guard(ctx context.Context, cmd string, args ...string) error {
@@ -56,8 +87,9 @@ func (c *LicenseClient) Guard(ctx context.Context, cmd string, args ...string) e
 	}
 
 	jobResult := make(chan error)
+	signals := make(chan os.Signal, 1)
 	go c.refresh(ctx)
-	go runCommand(ctx, jobResult, cmd, args...)
+	go runCommand(ctx, jobResult, signals, cmd, args...)
 
 	defer c.release(3 * time.Second)
 
@@ -73,6 +105,38 @@ func (c *LicenseClient) Guard(ctx context.Context, cmd string, args ...string) e
 			err = ctx.Err()
 		}
 		return fmt.Errorf("lost license and killed job: %w", err)
+	case deadline := <-c.preempted:
+		// License preempted: the command has until the deadline to stop, before
+		// the license is revoked.
+		fmt.Fprintf(os.Stderr, "flextape request %s: license preempted; stopping tool by %v\n", c.invocation.GetId(), deadline)
+		if c.preemptSignal != nil {
+			signals <- c.preemptSignal
+		}
+		select {
+		case err := <-jobResult:
+			cancel()
+			lost := c.stopRefresh()
+			if err != nil {
+				return fmt.Errorf("license preempted, job stopped: %w", err)
+			}
+			if lost != nil {
+				return fmt.Errorf("license preempted, lost license: %w", lost)
+			}
+			return nil
+		case err := <-c.licenseErr:
+			cancel()
+			<-jobResult
+			c.stopRefresh()
+			if err == nil {
+				err = ctx.Err()
+			}
+			return fmt.Errorf("license preempted, lost license and killed job: %w", err)
+		case <-time.After(time.Until(deadline)):
+		}
+		cancel()
+		<-jobResult
+		c.stopRefresh()
+		return fmt.Errorf("license preempted, killed job")
 	case err := <-jobResult:
 		// Command has finished, either with success or error
 		if err != nil {
@@ -80,19 +144,32 @@ func (c *LicenseClient) Guard(ctx context.Context, cmd string, args ...string) e
 		}
 		// Stop refreshing
 		cancel()
-		<-c.licenseErr
+		c.stopRefresh()
 		return nil
 	}
 }
 
+// stopRefresh waits for refresh to return, after its context is cancelled.
+// Returns the error refresh failed with, if any.
+func (c *LicenseClient) stopRefresh() error {
+	var lost error
+	for err := range c.licenseErr {
+		if lost == nil {
+			lost = err
+		}
+	}
+	return lost
+}
+
 // acquire returns nil if the license is successfully acquired, or an error if
 // acquisition failed.
 func (c *LicenseClient) acquire(ctx context.Context) error {
 	var queuePos uint32
+	var estimate int64 // Estimated allocation time, in Unix nanoseconds. 0 if unknown.
 	var reqID atomic.Value
 	doneChan := make(chan struct{})
 	defer close(doneChan)
-	go logQueuePosition(&reqID, &queuePos, 30*time.Second, doneChan)
+	go logQueuePosition(&reqID, &queuePos, &estimate, 30*time.Second, doneChan)
 
 	req := &fpb.AllocateRequest{
 		Invocation: c.invocation,
@@ -113,6 +190,11 @@ func (c *LicenseClient) acquire(ctx context.Context) error {
 			req.GetInvocation().Id = r.Queued.GetInvocationId()
 			reqID.Store(req.GetInvocation().GetId())
 			atomic.StoreUint32(&queuePos, r.Queued.GetQueuePosition())
+			if r.Queued.GetEstimatedAllocationTime() != nil {
+				atomic.StoreInt64(&estimate, r.Queued.GetEstimatedAllocationTime().AsTime().UnixNano())
+			} else {
+				atomic.StoreInt64(&estimate, 0)
+			}
 			sleepTime := min(time.Until(r.Queued.GetNextPollTime().AsTime())*3/5, 5*time.Second)
 			time.Sleep(sleepTime)
 			continue
@@ -122,25 +204,40 @@ func (c *LicenseClient) acquire(ctx context.Context) error {
 	}
 }
 
-// logQueuePosition prints the queue position queuePos to stderr every
-// `interval` until `done` is closed.
-func logQueuePosition(id *atomic.Value, queuePos *uint32, interval time.Duration, done chan struct{}) {
+// queueStatus describes the queue position, and the estimated allocation
+// time in Unix nanoseconds if not 0.
+func queueStatus(queuePos uint32, estimate int64, now time.Time) string {
+	status := fmt.Sprintf("queued at position: %v", queuePos)
+	if estimate == 0 {
+		return status
+	}
+	at := time.Unix(0, estimate)
+	wait := max(0, at.Sub(now)).Round(time.Minute)
+	return fmt.Sprintf("%s; license expected in %v (at %s)", status, wait, at.Local().Format("15:04"))
+}
+
+// logQueuePosition prints the queue position queuePos, and the estimated
+// allocation time, to stderr every `interval` until `done` is closed.
+func logQueuePosition(id *atomic.Value, queuePos *uint32, estimate *int64, interval time.Duration, done chan struct{}) {
 	tick := time.NewTicker(interval)
 	defer tick.Stop()
 
 	for {
 		select {
 		case <-tick.C:
-			fmt.Fprintf(os.Stderr, "flextape request %s: queued at position: %v\n", id.Load().(string), atomic.LoadUint32(queuePos))
+			fmt.Fprintf(os.Stderr, "flextape request %s: %s\n", id.Load().(string), queueStatus(atomic.LoadUint32(queuePos), atomic.LoadInt64(estimate), time.Now()))
 		case <-done:
 			return
 		}
 	}
 }
 
-// refresh refreshes the license in a loop until the context is finished.
+// refresh refreshes the license in a loop until the context is finished, or
+// until a refresh fails. The failure is sent to licenseErr, unless the context
+// is finished first.
 func (c *LicenseClient) refresh(ctx context.Context) {
 	defer close(c.licenseErr)
+	notified := false
 	for {
 		req := &fpb.RefreshRequest{
 			Invocation: c.invocation,
@@ -148,7 +245,19 @@ func (c *LicenseClient) refresh(ctx context.Context) {
 
 		res, err := c.client.Refresh(ctx, req)
 		if err != nil {
-			c.licenseErr <- fmt.Errorf("Refresh() failure: %w", err)
+			// Failures caused by the context being finished are not reported.
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case c.licenseErr <- fmt.Errorf("Refresh() failure: %w", err):
+			case <-ctx.Done():
+			}
+			return
+		}
+		if deadline := res.GetPreemptionDeadline(); deadline != nil && !notified {
+			notified = true
+			c.preempted <- deadline.AsTime()
 		}
 
 		sleepTime := time.Until(res.GetLicenseRefreshDeadline().AsTime())
@@ -3,11 +3,15 @@ package client
 import (
 	"context"
 	"fmt"
+	"os"
+	"syscall"
 	"testing"
+	"time"
 
 	fpb "github.com/enfabrica/enkit/flextape/proto"
 	"github.com/enfabrica/enkit/lib/errdiff"
 
+	"github.com/prashantv/gostub"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -19,6 +23,7 @@ type fakeClient struct {
 	refreshCallCount  int
 	refreshResponses  []*fpb.RefreshResponse
 	refreshCancel     func()
+	releaseCallCount  int
 }
 
 func (c *fakeClient) Allocate(context.Context, *fpb.AllocateRequest, ...grpc.CallOption) (*fpb.AllocateResponse, error) {
@@ -31,9 +36,8 @@ func (c *fakeClient) Allocate(context.Context, *fpb.AllocateRequest, ...grpc.Cal
 
 func (c *fakeClient) Refresh(context.Context, *fpb.RefreshRequest, ...grpc.CallOption) (*fpb.RefreshResponse, error) {
 	c.refreshCallCount++
-	if len(c.refreshResponses) == 0 {
-		c.refreshCancel()
-		return nil, fmt.Errorf("no responses")
+	if c.refreshCallCount > len(c.refreshResponses) {
+		return nil, fmt.Errorf("no responses left for Refresh()")
 	}
 	if c.refreshCallCount == len(c.refreshResponses) {
 		c.refreshCancel()
@@ -42,13 +46,30 @@ func (c *fakeClient) Refresh(context.Context, *fpb.RefreshRequest, ...grpc.CallO
 }
 
 func (c *fakeClient) Release(context.Context, *fpb.ReleaseRequest, ...grpc.CallOption) (*fpb.ReleaseResponse, error) {
-	return nil, fmt.Errorf("Release() not implemented")
+	c.releaseCallCount++
+	return &fpb.ReleaseResponse{}, nil
 }
 
 func (c *fakeClient) LicensesStatus(context.Context, *fpb.LicensesStatusRequest, ...grpc.CallOption) (*fpb.LicensesStatusResponse, error) {
 	return nil, fmt.Errorf("LicensesStatus() not implemented")
 }
 
+func (c *fakeClient) UsageReport(context.Context, *fpb.UsageReportRequest, ...grpc.CallOption) (*fpb.UsageReportResponse, error) {
+	return nil, fmt.Errorf("UsageReport() not implemented")
+}
+
+func (c *fakeClient) CreateReservation(context.Context, *fpb.CreateReservationRequest, ...grpc.CallOption) (*fpb.CreateReservationResponse, error) {
+	return nil, fmt.Errorf("CreateReservation() not implemented")
+}
+
+func (c *fakeClient) ListReservations(context.Context, *fpb.ListReservationsRequest, ...grpc.CallOption) (*fpb.ListReservationsResponse, error) {
+	return nil, fmt.Errorf("ListReservations() not implemented")
+}
+
+func (c *fakeClient) CancelReservation(context.Context, *fpb.CancelReservationRequest, ...grpc.CallOption) (*fpb.CancelReservationResponse, error) {
+	return nil, fmt.Errorf("CancelReservation() not implemented")
+}
+
 func TestLicenseClientAcquire(t *testing.T) {
 	now := timestamppb.Now()
 	testCases := []struct {
@@ -150,6 +171,7 @@ func TestLicenseClientRefresh(t *testing.T) {
 		desc             string
 		refreshResponses []*fpb.RefreshResponse
 		wantCallCount    int
+		wantPreempted    *timestamppb.Timestamp
 		wantErr          string
 	}{
 		{
@@ -170,6 +192,27 @@ func TestLicenseClientRefresh(t *testing.T) {
 			},
 			wantCallCount: 3,
 		},
+		{
+			desc: "notifies preemption once",
+			refreshResponses: []*fpb.RefreshResponse{
+				&fpb.RefreshResponse{
+					InvocationId:           "a",
+					LicenseRefreshDeadline: now,
+				},
+				&fpb.RefreshResponse{
+					InvocationId:           "a",
+					LicenseRefreshDeadline: now,
+					PreemptionDeadline:     now,
+				},
+				&fpb.RefreshResponse{
+					InvocationId:           "a",
+					LicenseRefreshDeadline: now,
+					PreemptionDeadline:     now,
+				},
+			},
+			wantCallCount: 3,
+			wantPreempted: now,
+		},
 		{
 			desc:          "propagates error",
 			wantCallCount: 1,
@@ -179,6 +222,7 @@ func TestLicenseClientRefresh(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
 			fake := &fakeClient{
 				refreshResponses: tc.refreshResponses,
 				refreshCancel:    cancel,
@@ -196,6 +240,7 @@ func TestLicenseClientRefresh(t *testing.T) {
 					BuildTag: "test",
 				},
 				licenseErr: make(chan error),
+				preempted:  make(chan time.Time, 1),
 			}
 
 			go client.refresh(ctx)
@@ -203,6 +248,121 @@ func TestLicenseClientRefresh(t *testing.T) {
 
 			errdiff.Check(t, gotErr, tc.wantErr)
 			assert.Equal(t, tc.wantCallCount, fake.refreshCallCount)
+			select {
+			case deadline := <-client.preempted:
+				assert.Equal(t, tc.wantPreempted.AsTime(), deadline)
+			default:
+				assert.Nil(t, tc.wantPreempted)
+			}
+		})
+	}
+}
+
+func TestLicenseClientGuardPreempted(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		stopsAfter os.Signal // Signal the command stops on. nil if it ignores signals.
+		lost       bool      // Whether the refresh after preemption fails.
+		wantErr    string
+	}{
+		{
+			desc:       "command stops on signal",
+			stopsAfter: syscall.SIGTERM,
+			wantErr:    "job stopped: signal: terminated",
+		},
+		{
+			desc:    "command killed at deadline",
+			wantErr: "killed job",
+		},
+		{
+			desc:    "command killed when license lost",
+			lost:    true,
+			wantErr: "lost license and killed job: Refresh() failure",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			stubs := gostub.Stub(&runCommand, func(ctx context.Context, result chan error, signals chan os.Signal, cmd string, args ...string) {
+				for {
+					select {
+					case sig := <-signals:
+						if sig == tc.stopsAfter {
+							result <- fmt.Errorf("signal: terminated")
+							return
+						}
+					case <-ctx.Done():
+						result <- ctx.Err()
+						return
+					}
+				}
+			})
+			defer stubs.Reset()
+
+			fake := &fakeClient{
+				allocateResponses: []*fpb.AllocateResponse{
+					&fpb.AllocateResponse{
+						ResponseType: &fpb.AllocateResponse_LicenseAllocated{
+							LicenseAllocated: &fpb.LicenseAllocated{
+								InvocationId:           "a",
+								LicenseRefreshDeadline: timestamppb.New(time.Now().Add(time.Minute)),
+							},
+						},
+					},
+				},
+				refreshResponses: []*fpb.RefreshResponse{
+					&fpb.RefreshResponse{
+						InvocationId:           "a",
+						LicenseRefreshDeadline: timestamppb.New(time.Now().Add(time.Minute)),
+						PreemptionDeadline:     timestamppb.New(time.Now().Add(100 * time.Millisecond)),
+					},
+				},
+				refreshCancel: func() {},
+			}
+			if tc.lost {
+				// Refreshed again right away, with no responses left.
+				fake.refreshResponses[0].LicenseRefreshDeadline = timestamppb.Now()
+				fake.refreshResponses[0].PreemptionDeadline = timestamppb.New(time.Now().Add(time.Hour))
+			}
+			client := New(fake, "unittest", "xilinx", "foo", "test")
+			client.Preemptible(syscall.SIGTERM)
+			assert.True(t, client.invocation.GetPreemptible())
+
+			gotErr := client.Guard(context.Background(), "sleep", "3600")
+
+			errdiff.Check(t, gotErr, tc.wantErr)
+			assert.Equal(t, 1, fake.releaseCallCount)
+			// Refreshing stopped.
+			_, ok := <-client.licenseErr
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestQueueStatus(t *testing.T) {
+	now := time.Date(2024, time.June, 3, 9, 0, 0, 0, time.Local)
+	testCases := []struct {
+		desc     string
+		estimate int64
+		want     string
+	}{
+		{
+			desc: "no estimate",
+			want: "queued at position: 3",
+		},
+		{
+			desc:     "estimate",
+			estimate: now.Add(90*time.Minute + 20*time.Second).UnixNano(),
+			want:     "queued at position: 3; license expected in 1h30m0s (at 10:30)",
+		},
+		{
+			desc:     "overdue estimate",
+			estimate: now.Add(-time.Minute).UnixNano(),
+			want:     "queued at position: 3; license expected in 0s (at 08:59)",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.want, queueStatus(3, tc.estimate, now))
 		})
 	}
 }
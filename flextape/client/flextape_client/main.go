@@ -19,7 +19,8 @@ import (
 )
 
 var (
-	timeout = flag.Duration("timeout", 7200*time.Second, "Max time waiting in license queue")
+	timeout     = flag.Duration("timeout", 7200*time.Second, "Max time waiting in license queue")
+	preemptible = flag.Bool("preemptible", false, "Allow the license to be revoked in favor of higher priority jobs; the job is sent SIGTERM when preempted, and killed once the license is revoked")
 )
 
 func main() {
@@ -57,6 +58,9 @@ func main() {
 	}(cancel)
 
 	c := client.New(fpb.NewFlextapeClient(conn), user.Username, vendor, feature, id.String())
+	if *preemptible {
+		c.Preemptible(syscall.SIGTERM)
+	}
 	err = c.Guard(ctx, cmd, args...)
 	if err != nil {
 		log.Fatal(err)
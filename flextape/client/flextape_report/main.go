@@ -0,0 +1,126 @@
+// flextape_report prints the license-hours used, and the time spent waiting
+// in queue, aggregated from the usage history recorded by a flextape server.
+//
+// Usage:
+//
+//	flextape_report --server=host:port [--since=720h | --start=2024-06-01 [--end=2024-07-01]] [--window=24h] [--by=owner,build_tag,license]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	server  = flag.String("server", "", "Address of the flextape server, as host:port")
+	since   = flag.Duration("since", 30*24*time.Hour, "Report the usage over this duration before now. Ignored if --start is set")
+	start   = flag.String("start", "", "Start of the report, as YYYY-MM-DD or RFC 3339 time")
+	end     = flag.String("end", "", "End of the report, as YYYY-MM-DD or RFC 3339 time. Default: now")
+	window  = flag.Duration("window", 0, "Split the report in windows of this duration. Default: a single window")
+	by      = flag.String("by", "owner", "Comma separated list of columns to aggregate by: owner, build_tag, license")
+	timeout = flag.Duration("timeout", time.Minute, "Max time waiting for the report")
+)
+
+func exitIf(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseTime parses a date or an RFC 3339 time, in local time if no time zone
+// is specified.
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, want YYYY-MM-DD or RFC 3339", value)
+	}
+	return t, nil
+}
+
+func main() {
+	flag.Parse()
+	if *server == "" {
+		log.Fatal("--server must be set")
+	}
+
+	req := &fpb.UsageReportRequest{
+		StartTime:     timestamppb.New(time.Now().Add(-*since)),
+		WindowSeconds: uint32(window.Seconds()),
+	}
+	if *start != "" {
+		t, err := parseTime(*start)
+		exitIf(err)
+		req.StartTime = timestamppb.New(t)
+	}
+	if *end != "" {
+		t, err := parseTime(*end)
+		exitIf(err)
+		req.EndTime = timestamppb.New(t)
+	}
+	columns := []string{"WINDOW"}
+	for _, column := range strings.Split(*by, ",") {
+		switch column {
+		case "owner":
+			req.ByOwner = true
+		case "build_tag":
+			req.ByBuildTag = true
+		case "license":
+			req.ByLicense = true
+		case "":
+			continue
+		default:
+			log.Fatalf("invalid --by column %q, want owner, build_tag or license", column)
+		}
+		columns = append(columns, strings.ToUpper(column))
+	}
+	columns = append(columns, "LICENSE_HOURS", "QUEUED_HOURS", "ALLOCATIONS")
+
+	conn, err := grpc.NewClient(*server, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	exitIf(err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	resp, err := fpb.NewFlextapeClient(conn).UsageReport(ctx, req)
+	exitIf(err)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(columns, "\t"))
+	for _, row := range resp.GetRows() {
+		fields := []string{row.GetWindowStart().AsTime().Local().Format(time.RFC3339)}
+		if req.GetByOwner() {
+			fields = append(fields, row.GetOwner())
+		}
+		if req.GetByBuildTag() {
+			fields = append(fields, row.GetBuildTag())
+		}
+		if req.GetByLicense() {
+			fields = append(fields, row.GetLicense().GetVendor()+"::"+row.GetLicense().GetFeature())
+		}
+		fields = append(fields,
+			fmt.Sprintf("%.2f", row.GetLicenseHours()),
+			fmt.Sprintf("%.2f", row.GetQueuedHours()),
+			fmt.Sprintf("%d", row.GetAllocations()),
+		)
+		fmt.Fprintln(w, strings.Join(fields, "\t"))
+	}
+	exitIf(w.Flush())
+	if dropped := resp.GetDroppedEvents(); dropped > 0 {
+		log.Printf("WARNING: the server failed to record %d usage events, the report may be incomplete", dropped)
+	}
+}
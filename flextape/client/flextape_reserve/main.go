@@ -0,0 +1,146 @@
+// flextape_reserve creates, lists and cancels reservations of licenses on a
+// flextape server.
+//
+// Usage:
+//
+//	flextape_reserve --server=host:port create --license=vendor::feature --count=N --start=TIME (--end=TIME | --duration=4h) [--owner=OWNER] [--description=TEXT]
+//	flextape_reserve --server=host:port list
+//	flextape_reserve --server=host:port cancel RESERVATION_ID...
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	server  = flag.String("server", "", "Address of the flextape server, as host:port")
+	timeout = flag.Duration("timeout", time.Minute, "Max time waiting for the server")
+)
+
+func exitIf(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// timeLayouts are the formats accepted for times, in local time unless the
+// format includes a time zone.
+var timeLayouts = []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"}
+
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, want one of %s", value, strings.Join(timeLayouts, ", "))
+}
+
+func create(ctx context.Context, client fpb.FlextapeClient, args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	owner := fs.String("owner", "", "Owner of the invocations the licenses are reserved to. Default: the current user")
+	license := fs.String("license", "", "License to reserve, as vendor::feature")
+	count := fs.Uint("count", 1, "Number of licenses to reserve")
+	start := fs.String("start", "", "Start of the reservation, as YYYY-MM-DD HH:MM or RFC 3339 time")
+	end := fs.String("end", "", "End of the reservation, as YYYY-MM-DD HH:MM or RFC 3339 time")
+	duration := fs.Duration("duration", 0, "Duration of the reservation. Ignored if --end is set")
+	description := fs.String("description", "", "Description of the reservation, like the campaign or tape-out it is for")
+	exitIf(fs.Parse(args))
+
+	if *owner == "" {
+		u, err := user.Current()
+		exitIf(err)
+		*owner = u.Username
+	}
+	vendor, feature, ok := strings.Cut(*license, "::")
+	if !ok {
+		log.Fatalf("invalid --license %q, want vendor::feature", *license)
+	}
+	if *start == "" {
+		log.Fatal("--start must be set")
+	}
+	startTime, err := parseTime(*start)
+	exitIf(err)
+	endTime := startTime.Add(*duration)
+	if *end != "" {
+		endTime, err = parseTime(*end)
+		exitIf(err)
+	}
+
+	resp, err := client.CreateReservation(ctx, &fpb.CreateReservationRequest{Reservation: &fpb.Reservation{
+		Owner:       *owner,
+		License:     &fpb.License{Vendor: vendor, Feature: feature},
+		Count:       uint32(*count),
+		StartTime:   timestamppb.New(startTime),
+		EndTime:     timestamppb.New(endTime),
+		Description: *description,
+	}})
+	exitIf(err)
+	fmt.Println(resp.GetReservation().GetId())
+}
+
+func list(ctx context.Context, client fpb.FlextapeClient, args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	exitIf(fs.Parse(args))
+
+	resp, err := client.ListReservations(ctx, &fpb.ListReservationsRequest{})
+	exitIf(err)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tOWNER\tLICENSE\tCOUNT\tSTART\tEND\tDESCRIPTION")
+	for _, r := range resp.GetReservations() {
+		fmt.Fprintf(w, "%s\t%s\t%s::%s\t%d\t%s\t%s\t%s\n",
+			r.GetId(), r.GetOwner(), r.GetLicense().GetVendor(), r.GetLicense().GetFeature(), r.GetCount(),
+			r.GetStartTime().AsTime().Local().Format(time.RFC3339), r.GetEndTime().AsTime().Local().Format(time.RFC3339),
+			r.GetDescription())
+	}
+	exitIf(w.Flush())
+}
+
+func cancel(ctx context.Context, client fpb.FlextapeClient, args []string) {
+	fs := flag.NewFlagSet("cancel", flag.ExitOnError)
+	exitIf(fs.Parse(args))
+	if fs.NArg() == 0 {
+		log.Fatal("cancel needs the IDs of the reservations to cancel")
+	}
+	for _, id := range fs.Args() {
+		_, err := client.CancelReservation(ctx, &fpb.CancelReservationRequest{ReservationId: id})
+		exitIf(err)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *server == "" {
+		log.Fatal("--server must be set")
+	}
+	commands := map[string]func(context.Context, fpb.FlextapeClient, []string){
+		"create": create,
+		"list":   list,
+		"cancel": cancel,
+	}
+	if flag.NArg() == 0 || commands[flag.Arg(0)] == nil {
+		log.Fatal("missing command: create, list or cancel")
+	}
+
+	conn, err := grpc.NewClient(*server, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	exitIf(err)
+	defer conn.Close()
+
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), *timeout)
+	defer cancelTimeout()
+	commands[flag.Arg(0)](ctx, fpb.NewFlextapeClient(conn), flag.Args()[1:])
+}
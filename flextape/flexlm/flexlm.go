@@ -0,0 +1,235 @@
+// Package flexlm parses FlexLM license files and `lmstat -a` reports, to
+// configure flextape with the licenses actually issued by the vendors.
+package flexlm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+)
+
+// Feature is the number of licenses of a feature served by a vendor daemon.
+type Feature struct {
+	Daemon string // Name of the vendor daemon serving the feature, like `xilinxd`.
+	Name   string // Name of the feature, like `Vivado_System_Edition`.
+	Issued int    // Number of licenses issued.
+	InUse  int    // Number of licenses checked out. Always 0 in license files.
+}
+
+// features accumulates features by daemon and name.
+type features map[[2]string]*Feature
+
+func (fs features) get(daemon, name string) *Feature {
+	key := [2]string{daemon, name}
+	if fs[key] == nil {
+		fs[key] = &Feature{Daemon: daemon, Name: name}
+	}
+	return fs[key]
+}
+
+// sorted returns the features sorted by daemon, then by name.
+func (fs features) sorted() []*Feature {
+	sorted := make([]*Feature, 0, len(fs))
+	for _, f := range fs {
+		sorted = append(sorted, f)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Daemon != sorted[j].Daemon {
+			return sorted[i].Daemon < sorted[j].Daemon
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// expired returns whether a license with the FlexLM expiration date expiry,
+// like `31-dec-2024` or `permanent`, is expired at now.
+func expired(expiry string, now time.Time) (bool, error) {
+	if strings.EqualFold(expiry, "permanent") || expiry == "0" {
+		return false, nil
+	}
+	// Dates with a year of 0, like 1-jan-0 or 1-jan-0000, never expire.
+	if fields := strings.Split(expiry, "-"); len(fields) == 3 && strings.Trim(fields[2], "0") == "" {
+		return false, nil
+	}
+	date, err := time.ParseInLocation("2-Jan-2006", expiry, now.Location())
+	if err != nil {
+		return false, fmt.Errorf("invalid expiration date %q", expiry)
+	}
+	// Licenses are valid until the end of the day.
+	return !now.Before(date.AddDate(0, 0, 1)), nil
+}
+
+// ParseLicenseFile returns the features in the FEATURE and INCREMENT lines of
+// a FlexLM license file, counting only the licenses not expired at now.
+//
+// The licenses of INCREMENT lines add up, while only the first FEATURE line
+// of a feature is counted, as done by vendor daemons. Uncounted licenses,
+// usually node-locked, are ignored.
+func ParseLicenseFile(r io.Reader, now time.Time) ([]*Feature, error) {
+	fs := features{}
+	seen := map[*Feature]bool{} // Features with a FEATURE line already counted.
+
+	scanner := bufio.NewScanner(r)
+	lineno, line := 0, ""
+	for scanner.Scan() {
+		lineno++
+		text := strings.TrimSpace(scanner.Text())
+		if line == "" && strings.HasPrefix(text, "#") {
+			continue
+		}
+		// Lines ending with a backslash continue on the next line.
+		if strings.HasSuffix(text, "\\") {
+			line += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		line, text = "", line+text
+
+		// FEATURE|INCREMENT name daemon version expiry count [attributes...]
+		fields := strings.Fields(text)
+		if len(fields) == 0 || (fields[0] != "FEATURE" && fields[0] != "INCREMENT") {
+			continue
+		}
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("line %d: %s line with %d fields, want at least 6", lineno, fields[0], len(fields))
+		}
+		isExpired, err := expired(fields[4], now)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		if strings.EqualFold(fields[5], "uncounted") {
+			continue
+		}
+		count, err := strconv.Atoi(fields[5])
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("line %d: invalid number of licenses %q", lineno, fields[5])
+		}
+		if isExpired || count == 0 {
+			continue
+		}
+
+		f := fs.get(fields[2], fields[1])
+		if fields[0] == "FEATURE" {
+			if seen[f] {
+				continue
+			}
+			seen[f] = true
+		}
+		f.Issued += count
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return fs.sorted(), nil
+}
+
+var (
+	// Vendor daemon status (on licserver):
+	lmstatDaemons = regexp.MustCompile(`^Vendor daemon status`)
+	//    xilinxd: UP v11.16.4
+	lmstatDaemon = regexp.MustCompile(`^\s+(\S+): (UP|The desired vendor daemon is down)`)
+	// Users of HLS:  (Total of 5 licenses issued;  Total of 2 licenses in use)
+	lmstatUsers = regexp.MustCompile(`^Users of (\S+):\s+\(Total of (\d+) licenses? issued;\s+Total of (\d+) licenses? in use\)`)
+	//   "HLS" v2024.06, vendor: xilinxd, expiry: 31-dec-2024
+	lmstatVendor = regexp.MustCompile(`^\s+"(\S+)" \S+, vendor: ([^,\s]+)`)
+)
+
+// ParseLmstat returns the features listed in the output of `lmstat -a`, with
+// the number of licenses issued and in use.
+//
+// lmstat only names the vendor daemon of features with licenses in use. Other
+// features are attributed to the last vendor daemon listed before them.
+// Uncounted features, or features with errors, are ignored.
+func ParseLmstat(r io.Reader) ([]*Feature, error) {
+	listed := []*Feature{}
+	var daemons bool // Whether in the list of vendor daemons.
+	var daemon string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if lmstatDaemons.MatchString(text) {
+			daemons = true
+			continue
+		}
+		if daemons {
+			if m := lmstatDaemon.FindStringSubmatch(text); m != nil {
+				daemon = m[1]
+				continue
+			}
+			if strings.TrimSpace(text) != "" {
+				daemons = false
+			}
+		}
+
+		if m := lmstatUsers.FindStringSubmatch(text); m != nil {
+			issued, _ := strconv.Atoi(m[2])
+			inUse, _ := strconv.Atoi(m[3])
+			listed = append(listed, &Feature{Daemon: daemon, Name: m[1], Issued: issued, InUse: inUse})
+			continue
+		}
+		if m := lmstatVendor.FindStringSubmatch(text); m != nil && len(listed) > 0 && listed[len(listed)-1].Name == m[1] {
+			listed[len(listed)-1].Daemon = m[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// The same feature may be served by multiple license servers.
+	fs := features{}
+	for _, l := range listed {
+		if l.Daemon == "" {
+			return nil, fmt.Errorf("unknown vendor daemon for feature %q", l.Name)
+		}
+		f := fs.get(l.Daemon, l.Name)
+		f.Issued += l.Issued
+		f.InUse += l.InUse
+	}
+	return fs.sorted(), nil
+}
+
+// Vendor returns the flextape vendor of the licenses served by the daemon,
+// looked up in vendors by daemon name. Daemons not in vendors keep their name.
+func Vendor(daemon string, vendors map[string]string) string {
+	if vendor, ok := vendors[daemon]; ok {
+		return vendor
+	}
+	return daemon
+}
+
+// UpdateConfig sets the quantity of the licenses in config to the number of
+// licenses issued for each feature, adding a LicenseConfig for the features
+// not configured yet. Licenses of features listed multiple times, for example
+// in the license files of different servers, add up. Licenses of features not
+// listed are left unchanged.
+//
+// The vendor of each license is looked up in vendors, see Vendor.
+func UpdateConfig(config *fpb.Config, features []*Feature, vendors map[string]string) {
+	configs := map[string]*fpb.LicenseConfig{}
+	for _, lc := range config.GetLicenseConfigs() {
+		configs[lc.GetLicense().GetVendor()+"::"+lc.GetLicense().GetFeature()] = lc
+	}
+	updated := map[*fpb.LicenseConfig]bool{}
+	for _, f := range features {
+		vendor := Vendor(f.Daemon, vendors)
+		lc, ok := configs[vendor+"::"+f.Name]
+		if !ok {
+			lc = &fpb.LicenseConfig{License: &fpb.License{Vendor: vendor, Feature: f.Name}}
+			config.LicenseConfigs = append(config.LicenseConfigs, lc)
+			configs[vendor+"::"+f.Name] = lc
+		}
+		if !updated[lc] {
+			lc.Quantity = 0
+			updated[lc] = true
+		}
+		lc.Quantity += uint32(f.Issued)
+	}
+}
@@ -0,0 +1,193 @@
+package flexlm
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+	"github.com/enfabrica/enkit/lib/errdiff"
+	"github.com/enfabrica/enkit/lib/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLicenseFile(t *testing.T) {
+	now := time.Date(2024, time.June, 30, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		desc    string
+		file    string
+		want    []*Feature
+		wantErr string
+	}{
+		{
+			desc: "counts features and increments",
+			file: `SERVER licserver 0123456789ab 2100
+VENDOR xilinxd
+USE_SERVER
+# INCREMENT Commented xilinxd 1.0 permanent 100 SIGN=0
+FEATURE Vivado_System_Edition xilinxd 2024.06 31-dec-2024 5 \
+	VENDOR_STRING="site license" \
+	SIGN="0123 4567"
+FEATURE Vivado_System_Edition xilinxd 2024.06 31-dec-2024 7 SIGN=0
+INCREMENT HLS xilinxd 2024.06 permanent 2 SIGN=0
+INCREMENT HLS xilinxd 2024.06 1-jan-0 3 SIGN=0
+INCREMENT HLS xilinxd 2024.06 30-jun-2024 1 SIGN=0
+INCREMENT HLS xilinxd 2024.06 29-jun-2024 10 SIGN=0
+INCREMENT Xcelium cdslmd 23.03 31-dec-2024 4 SIGN=0
+FEATURE Nodelocked xilinxd 2024.06 permanent uncounted HOSTID=0123 SIGN=0
+`,
+			want: []*Feature{
+				&Feature{Daemon: "cdslmd", Name: "Xcelium", Issued: 4},
+				&Feature{Daemon: "xilinxd", Name: "HLS", Issued: 6},
+				&Feature{Daemon: "xilinxd", Name: "Vivado_System_Edition", Issued: 5},
+			},
+		},
+		{
+			desc:    "invalid count",
+			file:    "INCREMENT HLS xilinxd 2024.06 permanent many SIGN=0\n",
+			wantErr: `line 1: invalid number of licenses "many"`,
+		},
+		{
+			desc:    "invalid expiration date",
+			file:    "\nINCREMENT HLS xilinxd 2024.06 2024-12-31 1 SIGN=0\n",
+			wantErr: `line 2: invalid expiration date "2024-12-31"`,
+		},
+		{
+			desc:    "truncated line",
+			file:    "INCREMENT HLS xilinxd \\\n  2024.06\n",
+			wantErr: "line 2: INCREMENT line with 4 fields",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, gotErr := ParseLicenseFile(strings.NewReader(tc.file), now)
+			errdiff.Check(t, gotErr, tc.wantErr)
+			if gotErr != nil {
+				return
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestParseLmstat(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		report  string
+		want    []*Feature
+		wantErr string
+	}{
+		{
+			desc: "counts licenses issued and in use",
+			report: `lmutil - Copyright (c) 1989-2019 Flexera. All Rights Reserved.
+Flexible License Manager status on Mon 10/7/2024 12:00
+
+License server status: 2100@licserver
+    License file(s) on licserver: /opt/licenses/xilinx.lic:
+
+  licserver: license server UP (MASTER) v11.16.4
+
+Vendor daemon status (on licserver):
+
+   xilinxd: UP v11.16.4
+   cdslmd: UP v11.16.4
+
+Feature usage info:
+
+Users of Vivado_System_Edition:  (Total of 5 licenses issued;  Total of 2 licenses in use)
+
+  "Vivado_System_Edition" v2024.06, vendor: xilinxd, expiry: 31-dec-2024
+  floating license
+
+    alice host1 host1 (v2024.06) (licserver/2100 101), start Mon 10/7 9:00
+    bob host2 host2 (v2024.06) (licserver/2100 202), start Mon 10/7 10:00
+
+Users of HLS:  (Total of 1 license issued;  Total of 0 licenses in use)
+
+Users of Nodelocked:  (Uncounted, node-locked)
+
+Users of Xcelium:  (Total of 4 licenses issued;  Total of 1 license in use)
+
+  "Xcelium" v23.03, vendor: cdslmd, expiry: 31-dec-2024
+  floating license
+
+    carol host3 host3 (v23.03) (licserver/2100 303), start Mon 10/7 11:00
+
+License server status: 2100@backup
+    License file(s) on backup: /opt/licenses/xilinx.lic:
+
+Vendor daemon status (on backup):
+
+   xilinxd: UP v11.16.4
+
+Feature usage info:
+
+Users of Vivado_System_Edition:  (Total of 3 licenses issued;  Total of 1 license in use)
+
+  "Vivado_System_Edition" v2024.06, vendor: xilinxd, expiry: 31-dec-2024
+`,
+			want: []*Feature{
+				// Attributed to the last daemon listed, as none is in use.
+				&Feature{Daemon: "cdslmd", Name: "HLS", Issued: 1},
+				&Feature{Daemon: "cdslmd", Name: "Xcelium", Issued: 4, InUse: 1},
+				&Feature{Daemon: "xilinxd", Name: "Vivado_System_Edition", Issued: 8, InUse: 3},
+			},
+		},
+		{
+			desc:    "no vendor daemon",
+			report:  "Users of HLS:  (Total of 1 license issued;  Total of 0 licenses in use)\n",
+			wantErr: `unknown vendor daemon for feature "HLS"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, gotErr := ParseLmstat(strings.NewReader(tc.report))
+			errdiff.Check(t, gotErr, tc.wantErr)
+			if gotErr != nil {
+				return
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	config := &fpb.Config{
+		LicenseConfigs: []*fpb.LicenseConfig{
+			&fpb.LicenseConfig{
+				License:     &fpb.License{Vendor: "xilinx", Feature: "HLS"},
+				Quantity:    2,
+				Prioritizer: &fpb.LicenseConfig_EvenOwners{EvenOwners: &fpb.EvenOwnersPrioritizer{}},
+			},
+			&fpb.LicenseConfig{
+				License:  &fpb.License{Vendor: "xilinx", Feature: "Retired"},
+				Quantity: 1,
+			},
+		},
+	}
+	UpdateConfig(config, []*Feature{
+		&Feature{Daemon: "cdslmd", Name: "Xcelium", Issued: 4},
+		&Feature{Daemon: "xilinxd", Name: "HLS", Issued: 6},
+		&Feature{Daemon: "xilinxd", Name: "HLS", Issued: 1},
+	}, map[string]string{"xilinxd": "xilinx"})
+
+	want := &fpb.Config{
+		LicenseConfigs: []*fpb.LicenseConfig{
+			&fpb.LicenseConfig{
+				License:     &fpb.License{Vendor: "xilinx", Feature: "HLS"},
+				Quantity:    7,
+				Prioritizer: &fpb.LicenseConfig_EvenOwners{EvenOwners: &fpb.EvenOwnersPrioritizer{}},
+			},
+			&fpb.LicenseConfig{
+				License:  &fpb.License{Vendor: "xilinx", Feature: "Retired"},
+				Quantity: 1,
+			},
+			&fpb.LicenseConfig{
+				License:  &fpb.License{Vendor: "cdslmd", Feature: "Xcelium"},
+				Quantity: 4,
+			},
+		},
+	}
+	testutil.AssertProtoEqual(t, config, want)
+}
@@ -0,0 +1,110 @@
+// flextape_import prints a flextape config with the quantity of each license
+// set from FlexLM license files, or from the output of `lmstat -a`.
+//
+// Usage:
+//
+//	flextape_import [--config=flextape.textproto] [--lmstat] [--vendor=xilinxd=xilinx ...] FILE...
+//
+// Use `-` as FILE to read from stdin.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/enfabrica/enkit/flextape/flexlm"
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+
+	"google.golang.org/protobuf/encoding/prototext"
+)
+
+// vendorFlag maps vendor daemons to flextape vendors, one daemon=vendor at a time.
+type vendorFlag map[string]string
+
+func (v vendorFlag) String() string {
+	pairs := []string{}
+	for daemon, vendor := range v {
+		pairs = append(pairs, daemon+"="+vendor)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v vendorFlag) Set(value string) error {
+	daemon, vendor, ok := strings.Cut(value, "=")
+	if !ok || daemon == "" || vendor == "" {
+		return fmt.Errorf("invalid vendor %q, want daemon=vendor", value)
+	}
+	v[daemon] = vendor
+	return nil
+}
+
+var (
+	configPath = flag.String("config", "", "Path to a flextape config textproto to update. Licenses not in the input files are left unchanged")
+	lmstat     = flag.Bool("lmstat", false, "Parse the input files as `lmstat -a` output, rather than license files")
+	vendors    = vendorFlag{}
+)
+
+func init() {
+	flag.Var(vendors, "vendor", "Flextape vendor of the licenses served by a vendor daemon, as daemon=vendor. Can be repeated. Default: the name of the daemon")
+}
+
+func exitIf(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func parse(path string) ([]*flexlm.Feature, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var features []*flexlm.Feature
+	var err error
+	if *lmstat {
+		features, err = flexlm.ParseLmstat(r)
+	} else {
+		features, err = flexlm.ParseLicenseFile(r, time.Now())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %q: %w", path, err)
+	}
+	return features, nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		exitIf(fmt.Errorf("no input files - use `-` to read from stdin"))
+	}
+
+	config := &fpb.Config{}
+	if *configPath != "" {
+		contents, err := os.ReadFile(*configPath)
+		exitIf(err)
+		exitIf(prototext.Unmarshal(contents, config))
+	}
+
+	features := []*flexlm.Feature{}
+	for _, path := range flag.Args() {
+		parsed, err := parse(path)
+		exitIf(err)
+		features = append(features, parsed...)
+	}
+	flexlm.UpdateConfig(config, features, vendors)
+
+	out, err := prototext.MarshalOptions{Multiline: true}.Marshal(config)
+	exitIf(err)
+	os.Stdout.Write(out)
+}
@@ -0,0 +1,160 @@
+// Dashboard of the flextape queues, updated live from the /api/events stream.
+"use strict";
+
+// Licenses expanded by the user, by name, kept across updates and reloads.
+const expanded = new Set(JSON.parse(localStorage.getItem("expanded") || "[]"));
+let user = {admin: false};
+let lastStatus = null;
+
+function licenseName(stats) {
+  return stats.license.vendor + "::" + stats.license.feature;
+}
+
+function formatTime(timestamp) {
+  if (!timestamp) {
+    return "unknown";
+  }
+  return new Date(timestamp).toLocaleString([], {month: "short", day: "numeric", hour: "2-digit", minute: "2-digit"});
+}
+
+function element(tag, text, className) {
+  const el = document.createElement(tag);
+  if (text !== undefined) {
+    el.textContent = text;
+  }
+  if (className) {
+    el.className = className;
+  }
+  return el;
+}
+
+function row(cells) {
+  const tr = element("tr");
+  for (const cell of cells) {
+    const td = element("td");
+    if (cell instanceof Node) {
+      td.appendChild(cell);
+    } else {
+      td.textContent = cell;
+    }
+    tr.appendChild(td);
+  }
+  return tr;
+}
+
+function table(headers, rows, empty) {
+  const t = element("table");
+  const head = element("tr");
+  for (const header of headers) {
+    head.appendChild(element("th", header));
+  }
+  t.appendChild(head);
+  for (const r of rows) {
+    t.appendChild(r);
+  }
+  if (rows.length === 0) {
+    const td = element("td", empty, "empty");
+    td.colSpan = headers.length;
+    const tr = element("tr");
+    tr.appendChild(td);
+    t.appendChild(tr);
+  }
+  return t;
+}
+
+async function release(inv) {
+  if (!confirm("Release the licenses of invocation " + inv.id + " of " + inv.owner + "?")) {
+    return;
+  }
+  const res = await fetch("/api/invocations/" + encodeURIComponent(inv.id) + "/release", {method: "POST"});
+  if (!res.ok) {
+    alert("Failed to release " + inv.id + ": " + (await res.text()));
+  }
+}
+
+function releaseButton(inv) {
+  const button = element("button", "Release", "release");
+  button.addEventListener("click", () => release(inv));
+  return button;
+}
+
+function renderLicense(stats) {
+  const name = licenseName(stats);
+  const details = element("details");
+  details.open = expanded.has(name);
+  details.addEventListener("toggle", () => {
+    details.open ? expanded.add(name) : expanded.delete(name);
+    localStorage.setItem("expanded", JSON.stringify([...expanded]));
+  });
+
+  const summary = element("summary");
+  summary.appendChild(element("strong", name));
+  summary.appendChild(element("span", stats.allocatedCount + "/" + stats.totalLicenseCount + " allocated; " + stats.queuedCount + " in queue"));
+  details.appendChild(summary);
+
+  const section = element("section");
+  const allocatedHeaders = ["Invocation", "Owner", "Build tag", "Preemptible"];
+  if (user.admin) {
+    allocatedHeaders.push("");
+  }
+  const allocated = stats.allocatedInvocations.map((inv) => {
+    const cells = [inv.id, inv.owner, inv.buildTag, inv.preemptible ? "yes" : "no"];
+    if (user.admin) {
+      cells.push(releaseButton(inv));
+    }
+    return row(cells);
+  });
+  section.appendChild(element("h3", "Allocations"));
+  section.appendChild(table(allocatedHeaders, allocated, "No allocations"));
+
+  const queued = stats.queuedInvocations.map((inv, i) => row([i + 1, inv.id, inv.owner, inv.buildTag, formatTime(inv.estimatedAllocationTime)]));
+  section.appendChild(element("h3", "Queue"));
+  section.appendChild(table(["Position", "Invocation", "Owner", "Build tag", "Estimated start"], queued, "No queued invocations"));
+  details.appendChild(section);
+  return details;
+}
+
+function render() {
+  if (lastStatus === null) {
+    return;
+  }
+  const licenses = document.getElementById("licenses");
+  licenses.replaceChildren(...lastStatus.licenseStats.map(renderLicense));
+}
+
+function setConnected(connected) {
+  const connection = document.getElementById("connection");
+  connection.textContent = connected ? "live" : "disconnected";
+  connection.className = connected ? "connected" : "disconnected";
+}
+
+function setFailure(message) {
+  const failure = document.getElementById("failure");
+  failure.textContent = message;
+  failure.hidden = message === "";
+}
+
+async function loadUser() {
+  const res = await fetch("/api/user");
+  if (!res.ok) {
+    return;
+  }
+  user = await res.json();
+  document.getElementById("user").textContent = user.name ? user.name + (user.admin ? " (admin)" : "") : "";
+  render();
+}
+
+function connect() {
+  const events = new EventSource("/api/events");
+  events.addEventListener("open", () => setConnected(true));
+  events.addEventListener("error", () => setConnected(false));
+  events.addEventListener("status", (event) => {
+    lastStatus = JSON.parse(event.data);
+    setFailure("");
+    render();
+  });
+  events.addEventListener("failure", (event) => setFailure("Failed to get the status of the queues: " + event.data));
+}
+
+loadUser();
+connect();
@@ -0,0 +1,203 @@
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// estimateResolution is the resolution estimated allocation times are
+	// compared at: estimates of overdue allocations move with the current
+	// time, and would otherwise change the status at every poll.
+	estimateResolution = time.Minute
+	// streamBuffer is the number of events queued for an event stream before
+	// it is considered too slow, and closed.
+	streamBuffer = 16
+)
+
+// forComparison returns a copy of the status without the time the status of
+// each license was taken at, and with the estimated allocation times rounded to
+// estimateResolution, to compare it with the status sent last.
+func forComparison(res *fpb.LicensesStatusResponse) *fpb.LicensesStatusResponse {
+	res = proto.Clone(res).(*fpb.LicensesStatusResponse)
+	for _, stats := range res.GetLicenseStats() {
+		stats.Timestamp = nil
+		for _, inv := range stats.GetQueuedInvocations() {
+			if inv.EstimatedAllocationTime != nil {
+				inv.EstimatedAllocationTime = timestamppb.New(inv.EstimatedAllocationTime.AsTime().Truncate(estimateResolution))
+			}
+		}
+	}
+	return res
+}
+
+// broadcaster polls the status of every license type on behalf of all the
+// event streams, and sends them the events.
+//
+// Polling starts with the first stream, and stops with the last one.
+type broadcaster struct {
+	mu      sync.Mutex
+	streams map[chan string]struct{}
+	last    string        // Last event sent, sent to streams as they start. Empty until the first poll.
+	stop    chan struct{} // Closed to stop polling. nil if not polling.
+}
+
+// subscribe returns a channel receiving the events, starting with the last
+// one sent, if any. The channel is closed if the stream does not keep up.
+func (f *Frontend) subscribe() chan string {
+	b := &f.events
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stream := make(chan string, streamBuffer)
+	if b.last != "" {
+		stream <- b.last
+	}
+	if b.streams == nil {
+		b.streams = map[chan string]struct{}{}
+	}
+	b.streams[stream] = struct{}{}
+	if b.stop == nil {
+		b.stop = make(chan struct{})
+		go f.poll(b.stop)
+	}
+	return stream
+}
+
+func (f *Frontend) unsubscribe(stream chan string) {
+	b := &f.events
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.streams[stream]; ok {
+		delete(b.streams, stream)
+		close(stream)
+	}
+	if len(b.streams) == 0 && b.stop != nil {
+		close(b.stop)
+		b.stop, b.last = nil, ""
+	}
+}
+
+// broadcast sends the event to all the streams, unless polling was stopped.
+func (f *Frontend) broadcast(stop chan struct{}, event string) {
+	b := &f.events
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stop != stop {
+		return
+	}
+	b.last = event
+	for stream := range b.streams {
+		select {
+		case stream <- event:
+		default:
+			delete(b.streams, stream)
+			close(stream)
+		}
+	}
+}
+
+// poll sends a "status" event with the LicensesStatusResponse when polling
+// starts, and every time the queues or allocations change, until stop is
+// closed. Errors getting the status are sent as "failure" events, with the
+// error message.
+func (f *Frontend) poll(stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	t := time.NewTicker(f.pollInterval)
+	defer t.Stop()
+	var last *fpb.LicensesStatusResponse
+	lastFailure := ""
+	for {
+		event := ""
+		res, err := f.svc.LicensesStatus(ctx, &fpb.LicensesStatusRequest{})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Data cannot span multiple lines without being split in fields.
+			failure := strings.ReplaceAll(status.Convert(err).Message(), "\n", " ")
+			if failure != lastFailure {
+				event = fmt.Sprintf("event: failure\ndata: %s\n\n", failure)
+			}
+			// The status is sent again once it can be read.
+			last, lastFailure = nil, failure
+		} else if current := forComparison(res); last == nil || !proto.Equal(last, current) {
+			data, err := marshaler.Marshal(res)
+			if err == nil {
+				event = fmt.Sprintf("event: status\ndata: %s\n\n", data)
+				last, lastFailure = current, ""
+			}
+		}
+		if event != "" {
+			f.broadcast(stop, event)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// serveEvents streams the status of every license type as server-sent events,
+// as sent by poll.
+//
+// The status is polled rather than pushed by the service, so that changes are
+// seen by the replicas forwarding to the leader as well. A single poller is
+// shared by all the streams, so that the service is polled at the same rate
+// regardless of the number of dashboards open.
+func (f *Frontend) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	stream := f.subscribe()
+	defer f.unsubscribe(stream)
+	keepalive := time.NewTimer(f.keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		event := ""
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-stream:
+			if !ok {
+				// Too slow: browsers reconnect, and get the last status.
+				return
+			}
+			event = e
+		case <-keepalive.C:
+			// Comments are ignored by clients, but keep proxies from closing
+			// idle streams.
+			event = ": keepalive\n\n"
+		}
+
+		if _, err := fmt.Fprint(w, event); err != nil {
+			return
+		}
+		flusher.Flush()
+		keepalive.Reset(f.keepaliveInterval)
+	}
+}
@@ -1,60 +1,296 @@
-// Package frontend provides some server-side generated HTML for viewing
-// Flextape state. This package is temporary; functionality should be moved to a
-// client-side React UI that calls the backend service directly.
+// Package frontend serves the Flextape dashboard, and an HTTP/JSON API over the
+// queues and allocations of the service backing it.
+//
+// The API is:
+//
+//	GET  /api/licenses                      status of every license type
+//	GET  /api/licenses/{license}            status of a license type, as vendor::feature
+//	GET  /api/licenses/{license}/queue      invocations queued for a license type
+//	GET  /api/owners/{owner}/allocations    invocations of an owner, allocated or queued
+//	GET  /api/events                        server-sent events with the status of every license type
+//	GET  /api/user                          user of the credentials cookie, if any
+//	POST /api/invocations/{id}/release      force-releases an invocation, for admins only
+//
+// Statuses are LicensesStatusResponse and LicenseStats messages, and
+// invocations Invocation messages, encoded as JSON.
 package frontend
 
 import (
-	"bytes"
+	"embed"
+	"encoding/json"
 	"fmt"
-	"html/template"
-	"io"
+	"io/fs"
+	"log"
 	"net/http"
+	"net/url"
+	"slices"
+	"time"
 
 	fpb "github.com/enfabrica/enkit/flextape/proto"
-	"github.com/enfabrica/enkit/flextape/service"
+	"github.com/enfabrica/enkit/lib/khttp"
+	"github.com/enfabrica/enkit/lib/khttp/kassets"
+	"github.com/enfabrica/enkit/lib/oauth"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
-// Frontend is an HTTP handler for Flextape server-side generated pages.
+//go:embed assets/*
+var assets embed.FS
+
+var marshaler = protojson.MarshalOptions{EmitUnpopulated: true}
+
+// Frontend is an HTTP handler for the Flextape dashboard and API.
 type Frontend struct {
-	tmpl *template.Template
-	svc  *service.Service
+	mux    *http.ServeMux
+	svc    fpb.FlextapeServer
+	auth   *oauth.Extractor
+	admins []string
+
+	pollInterval      time.Duration // Interval the status is checked for changes at, for event streams
+	keepaliveInterval time.Duration // Max interval between writes to event streams
+	events            broadcaster   // Polls the status for the event streams
 }
 
-// New returns a Frontend that serves templates based on state from the supplied
-// service.
-func New(tmpl *template.Template, svc *service.Service) *Frontend {
-	return &Frontend{
-		tmpl: tmpl,
-		svc:  svc,
+// New returns a Frontend serving the state of the supplied service.
+//
+// Users are authenticated by the credentials cookie auth extracts, and only
+// admins, as user@domain or groups they are members of, can release
+// allocations. If auth is nil, no user is authenticated.
+func New(svc fpb.FlextapeServer, auth *oauth.Extractor, admins []string) *Frontend {
+	f := &Frontend{
+		mux:               http.NewServeMux(),
+		svc:               svc,
+		auth:              auth,
+		admins:            admins,
+		pollInterval:      time.Second,
+		keepaliveInterval: 15 * time.Second,
 	}
+	f.mux.HandleFunc("GET /api/licenses", f.serveLicenses)
+	f.mux.HandleFunc("GET /api/licenses/{license}", f.serveLicense)
+	f.mux.HandleFunc("GET /api/licenses/{license}/queue", f.serveQueue)
+	f.mux.HandleFunc("GET /api/owners/{owner}/allocations", f.serveOwner)
+	f.mux.HandleFunc("GET /api/events", f.serveEvents)
+	f.mux.HandleFunc("GET /api/user", f.withCredentials(f.serveUser))
+	f.mux.HandleFunc("POST /api/invocations/{id}/release", f.withCredentials(f.serveRelease))
+	// The dashboard used to be served as /queue.
+	f.mux.Handle("GET /queue", http.RedirectHandler("/", http.StatusMovedPermanently))
+
+	data := map[string][]byte{}
+	err := fs.WalkDir(assets, "assets", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data[path], err = assets.ReadFile(path)
+		return err
+	})
+	if err != nil {
+		// The assets are embedded in the binary, they can always be read.
+		panic(err)
+	}
+	stats := kassets.AssetStats{}
+	kassets.RegisterAssets(&stats, data, "assets/", kassets.DefaultMapper(f.mux))
+	return f
 }
 
-// ServeHTTP serves the template for the queue page.
+// ServeHTTP serves the dashboard and the API.
 func (f *Frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	res, err := f.svc.LicensesStatus(r.Context(), &fpb.LicensesStatusRequest{})
+	f.mux.ServeHTTP(w, r)
+}
+
+// httpStatus returns the HTTP status code matching the gRPC status of err.
+func httpStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.FailedPrecondition:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// checkErr writes an error code and the supplied error to the ResponseWriter if
+// said error is non-nil. Returns true if an error was written.
+func checkErr(w http.ResponseWriter, err error) bool {
+	if err != nil {
+		http.Error(w, status.Convert(err).Message(), httpStatus(err))
+		return true
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func writeProto(w http.ResponseWriter, msg proto.Message) {
+	data, err := marshaler.Marshal(msg)
 	if checkErr(w, err) {
 		return
 	}
+	writeJSON(w, data)
+}
 
-	buf := new(bytes.Buffer)
-	err = f.tmpl.Execute(buf, res)
+func (f *Frontend) serveLicenses(w http.ResponseWriter, r *http.Request) {
+	res, err := f.svc.LicensesStatus(r.Context(), &fpb.LicensesStatusRequest{})
 	if checkErr(w, err) {
 		return
 	}
-	_, err = io.Copy(w, buf)
+	writeProto(w, res)
+}
+
+// licenseStats returns the status of the license type in the request path.
+func (f *Frontend) licenseStats(r *http.Request) (*fpb.LicenseStats, error) {
+	name := r.PathValue("license")
+	res, err := f.svc.LicensesStatus(r.Context(), &fpb.LicensesStatusRequest{})
 	if err != nil {
-		// TODO: do something
+		return nil, err
+	}
+	for _, stats := range res.GetLicenseStats() {
+		if fmt.Sprintf("%s::%s", stats.GetLicense().GetVendor(), stats.GetLicense().GetFeature()) == name {
+			return stats, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "unknown license type: %q", name)
+}
+
+func (f *Frontend) serveLicense(w http.ResponseWriter, r *http.Request) {
+	stats, err := f.licenseStats(r)
+	if checkErr(w, err) {
 		return
 	}
+	writeProto(w, stats)
 }
 
-// checkErr writes an error code and the supplied error to the ResponseWriter if
-// said error is non-nil. Returns true if an error was written.
-func checkErr(w http.ResponseWriter, err error) bool {
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "%v\n", err)
-		return true
+func (f *Frontend) serveQueue(w http.ResponseWriter, r *http.Request) {
+	stats, err := f.licenseStats(r)
+	if checkErr(w, err) {
+		return
+	}
+	queued := []json.RawMessage{}
+	for _, inv := range stats.GetQueuedInvocations() {
+		data, err := marshaler.Marshal(inv)
+		if checkErr(w, err) {
+			return
+		}
+		queued = append(queued, data)
+	}
+	data, err := json.Marshal(queued)
+	if checkErr(w, err) {
+		return
+	}
+	writeJSON(w, data)
+}
+
+// ownerStats returns the status of the license types the owner has
+// invocations allocated or queued for, with the counts and invocations of the
+// owner only.
+func ownerStats(res *fpb.LicensesStatusResponse, owner string) *fpb.LicensesStatusResponse {
+	others := func(inv *fpb.Invocation) bool { return inv.GetOwner() != owner }
+	filtered := &fpb.LicensesStatusResponse{}
+	for _, stats := range res.GetLicenseStats() {
+		stats = proto.Clone(stats).(*fpb.LicenseStats)
+		stats.AllocatedInvocations = slices.DeleteFunc(stats.AllocatedInvocations, others)
+		stats.QueuedInvocations = slices.DeleteFunc(stats.QueuedInvocations, others)
+		if len(stats.AllocatedInvocations) == 0 && len(stats.QueuedInvocations) == 0 {
+			continue
+		}
+		stats.AllocatedCount = uint32(len(stats.AllocatedInvocations))
+		stats.QueuedCount = uint32(len(stats.QueuedInvocations))
+		filtered.LicenseStats = append(filtered.LicenseStats, stats)
+	}
+	return filtered
+}
+
+func (f *Frontend) serveOwner(w http.ResponseWriter, r *http.Request) {
+	res, err := f.svc.LicensesStatus(r.Context(), &fpb.LicensesStatusRequest{})
+	if checkErr(w, err) {
+		return
+	}
+	writeProto(w, ownerStats(res, r.PathValue("owner")))
+}
+
+// withCredentials invokes the handler with the credentials of the user, if
+// any, in the context.
+func (f *Frontend) withCredentials(handler khttp.FuncHandler) khttp.FuncHandler {
+	if f.auth == nil {
+		return handler
+	}
+	return f.auth.WithCredentials(handler)
+}
+
+// isAdmin returns whether the user of the credentials can release
+// allocations.
+func (f *Frontend) isAdmin(creds *oauth.CredentialsCookie) bool {
+	if creds == nil {
+		return false
+	}
+	for _, admin := range f.admins {
+		if admin == creds.Identity.GlobalName() || slices.Contains(creds.Identity.Groups, admin) {
+			return true
+		}
 	}
 	return false
 }
+
+// User is the user of the dashboard, as returned by /api/user.
+type User struct {
+	Name  string `json:"name,omitempty"` // As user@domain. Empty if not authenticated
+	Admin bool   `json:"admin"`          // Whether the user can release allocations
+}
+
+func (f *Frontend) serveUser(w http.ResponseWriter, r *http.Request) {
+	user := User{}
+	if creds := oauth.GetCredentials(r.Context()); creds != nil {
+		user.Name = creds.Identity.GlobalName()
+		user.Admin = f.isAdmin(creds)
+	}
+	data, err := json.Marshal(user)
+	if checkErr(w, err) {
+		return
+	}
+	writeJSON(w, data)
+}
+
+// sameOrigin returns whether the request was sent by a page of this server,
+// or by a client other than a browser. Browsers send the Origin header with
+// every POST request.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (f *Frontend) serveRelease(w http.ResponseWriter, r *http.Request) {
+	creds := oauth.GetCredentials(r.Context())
+	if creds == nil {
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return
+	}
+	if !f.isAdmin(creds) || !sameOrigin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	id := r.PathValue("id")
+	_, err := f.svc.Release(r.Context(), &fpb.ReleaseRequest{InvocationId: id})
+	if checkErr(w, err) {
+		return
+	}
+	log.Printf("invocation %q force-released by %s", id, creds.Identity.GlobalName())
+	writeJSON(w, []byte("{}"))
+}
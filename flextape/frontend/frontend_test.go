@@ -0,0 +1,404 @@
+package frontend
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+	"github.com/enfabrica/enkit/lib/oauth"
+	"github.com/enfabrica/enkit/lib/token"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type fakeService struct {
+	fpb.UnimplementedFlextapeServer
+
+	mu       sync.Mutex
+	status   *fpb.LicensesStatusResponse
+	err      error
+	polled   int
+	released []string
+}
+
+func (s *fakeService) LicensesStatus(ctx context.Context, req *fpb.LicensesStatusRequest) (*fpb.LicensesStatusResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polled++
+	return s.status, s.err
+}
+
+func (s *fakeService) Release(ctx context.Context, req *fpb.ReleaseRequest) (*fpb.ReleaseResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.GetInvocationId() == "unknown" {
+		return nil, status.Errorf(codes.FailedPrecondition, "invocation_id not found: %q", req.GetInvocationId())
+	}
+	s.released = append(s.released, req.GetInvocationId())
+	return &fpb.ReleaseResponse{}, nil
+}
+
+func (s *fakeService) set(res *fpb.LicensesStatusResponse, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.err = res, err
+}
+
+func testStatus() *fpb.LicensesStatusResponse {
+	return &fpb.LicensesStatusResponse{
+		LicenseStats: []*fpb.LicenseStats{
+			&fpb.LicenseStats{
+				License:           &fpb.License{Vendor: "xilinx", Feature: "foo"},
+				TotalLicenseCount: 2,
+				AllocatedCount:    2,
+				AllocatedInvocations: []*fpb.Invocation{
+					&fpb.Invocation{Id: "a1", Owner: "alice", BuildTag: "tag_1"},
+					&fpb.Invocation{Id: "b1", Owner: "bob", BuildTag: "tag_2"},
+				},
+				QueuedCount: 2,
+				QueuedInvocations: []*fpb.Invocation{
+					&fpb.Invocation{Id: "b2", Owner: "bob", BuildTag: "tag_2"},
+					&fpb.Invocation{Id: "c1", Owner: "carol", BuildTag: "tag_3"},
+				},
+			},
+			&fpb.LicenseStats{
+				License:           &fpb.License{Vendor: "xilinx", Feature: "bar"},
+				TotalLicenseCount: 1,
+			},
+		},
+	}
+}
+
+func testFrontend(t *testing.T) (*Frontend, *fakeService, *oauth.Extractor) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(0))
+	key, err := token.GenerateSymmetricKey(rng, 0)
+	require.NoError(t, err)
+	verifying, signing, err := token.GenerateSigningKey(rng)
+	require.NoError(t, err)
+	auth, err := oauth.NewExtractor(
+		oauth.WithRng(rng),
+		oauth.WithSymmetricOptions(token.UseSymmetricKey(key)),
+		oauth.WithSigningOptions(token.UseSigningKey(signing), token.UseVerifyingKey(verifying)),
+	)
+	require.NoError(t, err)
+	svc := &fakeService{status: testStatus()}
+	return New(svc, auth, []string{"alice@example.com", "infra"}), svc, auth
+}
+
+func TestAPI(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		path     string
+		err      error
+		wantCode int
+		want     []string
+		notWant  []string
+	}{
+		{
+			desc:     "licenses",
+			path:     "/api/licenses",
+			wantCode: http.StatusOK,
+			want:     []string{`"feature":"foo"`, `"feature":"bar"`, `"id":"c1"`},
+		},
+		{
+			desc:     "license",
+			path:     "/api/licenses/xilinx::foo",
+			wantCode: http.StatusOK,
+			want:     []string{`"feature":"foo"`, `"id":"a1"`, `"id":"c1"`},
+			notWant:  []string{`"feature":"bar"`},
+		},
+		{
+			desc:     "unknown license",
+			path:     "/api/licenses/xilinx::baz",
+			wantCode: http.StatusNotFound,
+			want:     []string{"unknown license type"},
+		},
+		{
+			desc:     "queue",
+			path:     "/api/licenses/xilinx::foo/queue",
+			wantCode: http.StatusOK,
+			want:     []string{`[{`, `"id":"b2"`, `"id":"c1"`},
+			notWant:  []string{`"id":"a1"`},
+		},
+		{
+			desc:     "empty queue",
+			path:     "/api/licenses/xilinx::bar/queue",
+			wantCode: http.StatusOK,
+			want:     []string{`[]`},
+		},
+		{
+			desc:     "owner",
+			path:     "/api/owners/bob/allocations",
+			wantCode: http.StatusOK,
+			want:     []string{`"id":"b1"`, `"id":"b2"`, `"allocatedCount":1`, `"queuedCount":1`},
+			notWant:  []string{`"id":"a1"`, `"id":"c1"`, `"feature":"bar"`},
+		},
+		{
+			desc:     "service failure",
+			path:     "/api/licenses",
+			err:      status.Errorf(codes.Unavailable, "no leader"),
+			wantCode: http.StatusServiceUnavailable,
+			want:     []string{"no leader"},
+		},
+		{
+			desc:     "dashboard",
+			path:     "/",
+			wantCode: http.StatusOK,
+			want:     []string{"<title>Flextape</title>", "/dashboard.js"},
+		},
+		{
+			desc:     "dashboard script",
+			path:     "/dashboard.js",
+			wantCode: http.StatusOK,
+			want:     []string{"/api/events"},
+		},
+		{
+			desc:     "old queue page",
+			path:     "/queue",
+			wantCode: http.StatusMovedPermanently,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			fe, svc, _ := testFrontend(t)
+			if tc.err != nil {
+				svc.set(nil, tc.err)
+			}
+			w := httptest.NewRecorder()
+			fe.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			assert.Equal(t, tc.wantCode, w.Code)
+			// protojson randomly adds spaces to its output.
+			compact := func(s string) string { return strings.ReplaceAll(s, " ", "") }
+			body := compact(w.Body.String())
+			for _, want := range tc.want {
+				assert.Contains(t, body, compact(want))
+			}
+			for _, notWant := range tc.notWant {
+				assert.NotContains(t, body, compact(notWant))
+			}
+		})
+	}
+}
+
+func TestRelease(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		noAuth       bool
+		user         *oauth.Identity
+		origin       string
+		id           string
+		wantCode     int
+		wantReleased []string
+	}{
+		{
+			desc:         "admin",
+			user:         &oauth.Identity{Username: "alice", Organization: "example.com"},
+			id:           "b1",
+			wantCode:     http.StatusOK,
+			wantReleased: []string{"b1"},
+		},
+		{
+			desc:         "admin by group",
+			user:         &oauth.Identity{Username: "dave", Organization: "example.com", Groups: []string{"infra"}},
+			origin:       "http://flextape.example.com",
+			id:           "b1",
+			wantCode:     http.StatusOK,
+			wantReleased: []string{"b1"},
+		},
+		{
+			desc:     "not authenticated",
+			id:       "b1",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			desc:     "no authenticator",
+			noAuth:   true,
+			user:     &oauth.Identity{Username: "alice", Organization: "example.com"},
+			id:       "b1",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			desc:     "not an admin",
+			user:     &oauth.Identity{Username: "bob", Organization: "example.com"},
+			id:       "b1",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			desc:     "other site",
+			user:     &oauth.Identity{Username: "alice", Organization: "example.com"},
+			origin:   "http://attacker.example.com",
+			id:       "b1",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			desc:     "unknown invocation",
+			user:     &oauth.Identity{Username: "alice", Organization: "example.com"},
+			id:       "unknown",
+			wantCode: http.StatusConflict,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			fe, svc, auth := testFrontend(t)
+			if tc.noAuth {
+				fe = New(svc, nil, fe.admins)
+			}
+			r := httptest.NewRequest(http.MethodPost, "http://flextape.example.com/api/invocations/"+tc.id+"/release", nil)
+			if tc.user != nil {
+				cookie, err := auth.EncodeCredentials(oauth.CredentialsCookie{Identity: *tc.user})
+				require.NoError(t, err)
+				r.AddCookie(&http.Cookie{Name: auth.CredentialsCookieName(), Value: cookie})
+			}
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			w := httptest.NewRecorder()
+			fe.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.wantCode, w.Code, w.Body.String())
+			assert.Equal(t, tc.wantReleased, svc.released)
+		})
+	}
+}
+
+func TestUser(t *testing.T) {
+	fe, _, auth := testFrontend(t)
+	get := func(user *oauth.Identity) string {
+		r := httptest.NewRequest(http.MethodGet, "/api/user", nil)
+		if user != nil {
+			cookie, err := auth.EncodeCredentials(oauth.CredentialsCookie{Identity: *user})
+			require.NoError(t, err)
+			r.AddCookie(&http.Cookie{Name: auth.CredentialsCookieName(), Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		fe.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	assert.JSONEq(t, `{"admin":false}`, get(nil))
+	assert.JSONEq(t, `{"name":"bob@example.com","admin":false}`, get(&oauth.Identity{Username: "bob", Organization: "example.com"}))
+	assert.JSONEq(t, `{"name":"alice@example.com","admin":true}`, get(&oauth.Identity{Username: "alice", Organization: "example.com"}))
+}
+
+// nextEvent returns a function reading the next event of the stream, with its
+// data.
+func nextEvent(t *testing.T, body io.Reader) func() (string, string) {
+	lines := bufio.NewReader(body)
+	return func() (string, string) {
+		var event, data string
+		for {
+			line, err := lines.ReadString('\n')
+			require.NoError(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && event != "":
+				return event, data
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	fe, svc, _ := testFrontend(t)
+	fe.pollInterval = 10 * time.Millisecond
+	server := httptest.NewServer(fe)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/events", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	next := nextEvent(t, resp.Body)
+	event, data := next()
+	assert.Equal(t, "status", event)
+	assert.Contains(t, data, `"c1"`)
+
+	// The time the status was taken at alone is not a change, nor are
+	// estimates moving within estimateResolution.
+	res := testStatus()
+	res.LicenseStats[0].Timestamp = &timestamppb.Timestamp{Seconds: 1}
+	svc.set(res, nil)
+	time.Sleep(5 * fe.pollInterval)
+	res = testStatus()
+	res.LicenseStats[0].QueuedInvocations[0].EstimatedAllocationTime = &timestamppb.Timestamp{Seconds: 60}
+	svc.set(res, nil)
+	event, data = next()
+	assert.Equal(t, "status", event)
+	assert.Contains(t, data, `"1970-01-01T00:01:00Z"`)
+	res = testStatus()
+	res.LicenseStats[0].QueuedInvocations[0].EstimatedAllocationTime = &timestamppb.Timestamp{Seconds: 119}
+	svc.set(res, nil)
+	time.Sleep(5 * fe.pollInterval)
+
+	svc.set(nil, status.Errorf(codes.Unavailable, "no leader"))
+	event, data = next()
+	assert.Equal(t, "failure", event)
+	assert.Equal(t, "no leader", data)
+
+	res = testStatus()
+	res.LicenseStats[0].QueuedInvocations = res.LicenseStats[0].QueuedInvocations[1:]
+	svc.set(res, nil)
+	event, data = next()
+	assert.Equal(t, "status", event)
+	assert.NotContains(t, data, `"b2"`)
+
+	cancel()
+	_, err = io.ReadAll(resp.Body)
+	assert.Error(t, err)
+}
+
+func TestEventsSharePoller(t *testing.T) {
+	fe, svc, _ := testFrontend(t)
+	fe.pollInterval = time.Hour
+	server := httptest.NewServer(fe)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/events", nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		event, data := nextEvent(t, resp.Body)()
+		assert.Equal(t, "status", event)
+		assert.Contains(t, data, `"c1"`)
+	}
+	svc.mu.Lock()
+	assert.Equal(t, 1, svc.polled)
+	svc.mu.Unlock()
+
+	// Polling stops with the last stream.
+	cancel()
+	assert.Eventually(t, func() bool {
+		fe.events.mu.Lock()
+		defer fe.events.mu.Unlock()
+		return fe.events.stop == nil && len(fe.events.streams) == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -2,10 +2,8 @@ package main
 
 import (
 	"context"
-	"embed"
 	"flag"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -13,7 +11,9 @@ import (
 	"github.com/enfabrica/enkit/flextape/frontend"
 	fpb "github.com/enfabrica/enkit/flextape/proto"
 	"github.com/enfabrica/enkit/flextape/service"
+	"github.com/enfabrica/enkit/lib/kflags"
 	"github.com/enfabrica/enkit/lib/metrics"
+	"github.com/enfabrica/enkit/lib/oauth"
 	"github.com/enfabrica/enkit/lib/server"
 
 	"google.golang.org/grpc"
@@ -21,9 +21,10 @@ import (
 )
 
 var (
-	//go:embed templates/*
-	templates     embed.FS
-	serviceConfig = flag.String("service_config", "", "Path to service configuration textproto")
+	serviceConfig  = flag.String("service_config", "", "Path to service configuration textproto")
+	replicaAddress = flag.String("replica_address", "", "Address other replicas use to reach this one, overriding `address` in the `replication` section of the config")
+	// Verify the credentials cookie of the users of the dashboard.
+	authFlags = oauth.DefaultExtractorFlags().Register(&kflags.GoFlagSet{FlagSet: flag.CommandLine}, "")
 )
 
 func exitIf(err error) {
@@ -61,20 +62,28 @@ func main() {
 
 	config, err := loadConfig(*serviceConfig)
 	exitIf(err)
+	if *replicaAddress != "" && config.GetServer().GetReplication() != nil {
+		config.GetServer().GetReplication().Address = *replicaAddress
+	}
 
-	template, err := template.ParseFS(templates, "**/*.tmpl")
-	exitIf(err)
+	// Without the keys of the auth server, users cannot be authenticated: the
+	// dashboard is read-only.
+	var auth *oauth.Extractor
+	if len(authFlags.SymmetricKey) > 0 || len(authFlags.TokenVerifyingKey) > 0 {
+		auth, err = oauth.NewExtractor(oauth.WithExtractorFlags(authFlags))
+		exitIf(err)
+	}
 
 	grpcs := grpc.NewServer()
 	s, err := service.New(config)
 	exitIf(err)
 	fpb.RegisterFlextapeServer(grpcs, s)
 
-	fe := frontend.New(template, s)
+	fe := frontend.New(s, auth, config.GetServer().GetAdmins())
 
 	mux := http.NewServeMux()
 	metrics.AddHandler(mux, "/metrics")
-	mux.Handle("/queue", fe)
+	mux.Handle("/", fe)
 
 	exitIf(server.Run(ctx, mux, grpcs, nil))
 }
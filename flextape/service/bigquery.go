@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// BigQuerySink is a Sink inserting events into a BigQuery table.
+type BigQuerySink struct {
+	client *bigquery.Client
+	table  *bigquery.Table
+}
+
+// NewBigQuerySink returns a BigQuerySink inserting into the specified table,
+// creating it if it does not exist yet.
+func NewBigQuerySink(ctx context.Context, project, dataset, table string) (*BigQuerySink, error) {
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("while creating BigQuery client for project %q: %w", project, err)
+	}
+	bs := &BigQuerySink{
+		client: client,
+		table:  client.Dataset(dataset).Table(table),
+	}
+
+	_, err = bs.table.Metadata(ctx)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		schema, err := bigquery.InferSchema(Event{})
+		if err != nil {
+			return nil, err
+		}
+		err = bs.table.Create(ctx, &bigquery.TableMetadata{
+			Schema:           schema,
+			TimePartitioning: &bigquery.TimePartitioning{Field: "Time"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("while creating BigQuery table %s.%s: %w", dataset, table, err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("while looking up BigQuery table %s.%s: %w", dataset, table, err)
+	}
+	return bs, nil
+}
+
+func (bs *BigQuerySink) Write(ctx context.Context, events []*Event) error {
+	return bs.table.Inserter().Put(ctx, events)
+}
+
+func (bs *BigQuerySink) Read(ctx context.Context, from, to time.Time) ([]*Event, error) {
+	q := bs.client.Query(fmt.Sprintf("SELECT * FROM `%s.%s.%s` WHERE Time >= @from AND Time < @to ORDER BY Time",
+		bs.table.ProjectID, bs.table.DatasetID, bs.table.TableID))
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "from", Value: from},
+		{Name: "to", Value: to},
+	}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("while querying usage history: %w", err)
+	}
+
+	events := []*Event{}
+	for {
+		event := &Event{}
+		err := it.Next(event)
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("while reading usage history: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// KindLease is the datastore kind of the entity holding the lease.
+	KindLease = "FlextapeLease"
+	// KindState is the datastore kind of the entity holding the state saved by the leader.
+	KindState = "FlextapeState"
+)
+
+// DatastoreTimeout bounds the duration of each operation on datastore.
+const DatastoreTimeout = 5 * time.Second
+
+type leaseEntity struct {
+	Holder  string
+	Expires time.Time
+}
+
+type stateEntity struct {
+	Holder   string
+	Time     time.Time
+	Snapshot []byte `datastore:",noindex"`
+}
+
+// DatastoreLeaseStore is a LeaseStore keeping the lease and the state saved by
+// the leader in Google Cloud Datastore.
+//
+// The state is stored in a single entity, so it is limited to the maximum
+// size of an entity - roughly 1MiB, or several thousand invocations.
+type DatastoreLeaseStore struct {
+	client *datastore.Client
+	lease  *datastore.Key
+	state  *datastore.Key
+}
+
+// NewDatastoreLeaseStore returns a DatastoreLeaseStore using the datastore
+// of the specified project, and entities in the specified namespace.
+func NewDatastoreLeaseStore(ctx context.Context, project, namespace string) (*DatastoreLeaseStore, error) {
+	client, err := datastore.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to datastore: %w", err)
+	}
+
+	lease := datastore.NameKey(KindLease, "leader", nil)
+	lease.Namespace = namespace
+	state := datastore.NameKey(KindState, "leader", nil)
+	state.Namespace = namespace
+	return &DatastoreLeaseStore{client: client, lease: lease, state: state}, nil
+}
+
+// currentLease returns the lease stored, or a lease not held by any replica.
+func (ds *DatastoreLeaseStore) currentLease(tx *datastore.Transaction) (*leaseEntity, error) {
+	lease := &leaseEntity{}
+	if err := tx.Get(ds.lease, lease); err != nil && !errors.Is(err, datastore.ErrNoSuchEntity) {
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (ds *DatastoreLeaseStore) AcquireLease(holder string, now, expires time.Time) (*Lease, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DatastoreTimeout)
+	defer cancel()
+
+	var lease *leaseEntity
+	_, err := ds.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var err error
+		lease, err = ds.currentLease(tx)
+		if err != nil {
+			return err
+		}
+		if lease.Holder != "" && lease.Holder != holder && now.Before(lease.Expires) {
+			return nil
+		}
+
+		lease = &leaseEntity{Holder: holder, Expires: expires}
+		_, err = tx.Put(ds.lease, lease)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to acquire lease: %w", err)
+	}
+	return &Lease{Holder: lease.Holder, Expires: lease.Expires}, nil
+}
+
+func (ds *DatastoreLeaseStore) Save(holder string, now time.Time, snap *Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("unable to encode state: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DatastoreTimeout)
+	defer cancel()
+	_, err = ds.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		lease, err := ds.currentLease(tx)
+		if err != nil {
+			return err
+		}
+		if lease.Holder != holder || !now.Before(lease.Expires) {
+			return ErrNotLeader
+		}
+		_, err = tx.Put(ds.state, &stateEntity{Holder: holder, Time: now, Snapshot: data})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to save state: %w", err)
+	}
+	return nil
+}
+
+func (ds *DatastoreLeaseStore) Load() (*Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DatastoreTimeout)
+	defer cancel()
+
+	state := &stateEntity{}
+	if err := ds.client.Get(ctx, ds.state, state); err != nil {
+		if errors.Is(err, datastore.ErrNoSuchEntity) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to load state: %w", err)
+	}
+	snap := &Snapshot{}
+	if err := json.Unmarshal(state.Snapshot, snap); err != nil {
+		return nil, fmt.Errorf("unable to parse state: %w", err)
+	}
+	return snap, nil
+}
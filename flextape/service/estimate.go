@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// holdSamples is the number of recent hold durations kept per license type.
+	holdSamples = 100
+	// buildTagSamples is the number of recent hold durations kept per build
+	// tag, and needed to estimate the hold duration of a build tag.
+	buildTagSamples = 5
+	// maxBuildTags is the number of build tags hold durations are kept for.
+	maxBuildTags = 1000
+	// holdLookback is how far back the usage history is read at startup, to
+	// record the hold durations of recent allocations.
+	holdLookback = 24 * time.Hour
+)
+
+// holdDurations are the durations licenses of a type were recently held for,
+// from allocation to release.
+type holdDurations struct {
+	recent []time.Duration            // Most recent last.
+	byTag  map[string][]time.Duration // Key: build tag. Most recent last.
+}
+
+// Add records a hold duration of an invocation with the build tag.
+func (h *holdDurations) Add(buildTag string, d time.Duration) {
+	h.recent = append(h.recent, d)
+	if len(h.recent) > holdSamples {
+		h.recent = h.recent[1:]
+	}
+
+	if h.byTag == nil {
+		h.byTag = map[string][]time.Duration{}
+	}
+	if _, ok := h.byTag[buildTag]; !ok && len(h.byTag) >= maxBuildTags {
+		// Drop any build tag: most are short lived, like bazel invocation IDs.
+		for tag := range h.byTag {
+			delete(h.byTag, tag)
+			break
+		}
+	}
+	tagged := append(h.byTag[buildTag], d)
+	if len(tagged) > buildTagSamples {
+		tagged = tagged[1:]
+	}
+	h.byTag[buildTag] = tagged
+}
+
+func mean(durations []time.Duration) time.Duration {
+	total := time.Duration(0)
+	for _, d := range durations {
+		total += d
+	}
+	return total / time.Duration(len(durations))
+}
+
+// Expected returns the expected hold duration of an invocation with the build
+// tag: the mean of the recent hold durations of the build tag if enough were
+// recorded, or of the license type otherwise. Returns false if no hold
+// duration was recorded.
+func (h *holdDurations) Expected(buildTag string) (time.Duration, bool) {
+	if tagged := h.byTag[buildTag]; len(tagged) >= buildTagSamples {
+		return mean(tagged), true
+	}
+	if len(h.recent) == 0 {
+		return 0, false
+	}
+	return mean(h.recent), true
+}
+
+// Estimates returns the estimated time each queued invocation is allocated a
+// license, by invocation ID.
+//
+// The estimate simulates the allocation of the licenses in queue order,
+// assuming that each invocation holds its licenses for its expected hold
+// duration. Invocations for which no estimate can be made, like those needing
+// more licenses than available, and the invocations queued after them, are not
+// returned. The queue must be sorted.
+func (l *license) Estimates(now time.Time) map[string]time.Time {
+	estimates := map[string]time.Time{}
+	if l.queue.Len() == 0 {
+		return estimates
+	}
+
+	// Time each license is expected to be released at.
+	available := max(0, l.totalAvailable-l.unavailable)
+	releases := []time.Time{}
+	for _, inv := range l.allocations {
+		hold, ok := l.holds.Expected(inv.BuildTag)
+		if !ok {
+			return estimates
+		}
+		release := latest(inv.AllocatedAt.Add(hold), now)
+		if inv.Preempted() {
+			release = earliest(release, latest(inv.PreemptDeadline, now))
+		}
+		for i := 0; i < inv.Needs(l.name); i++ {
+			releases = append(releases, release)
+		}
+	}
+	for len(releases) < available {
+		releases = append(releases, now)
+	}
+	slices.SortFunc(releases, time.Time.Compare)
+	// With more licenses allocated than available, the first licenses
+	// released are not available to queued invocations.
+	seats := releases[max(0, len(releases)-available):]
+
+	l.queue.Walk(func(pos Position, inv *invocation) bool {
+		// Licenses held back for reservations of other owners must be free as well.
+		need := inv.Needs(l.name) + l.Held(inv)
+		hold, ok := l.holds.Expected(inv.BuildTag)
+		if !ok || need > len(seats) {
+			return false
+		}
+		slices.SortFunc(seats, time.Time.Compare)
+		start := seats[need-1]
+		estimates[inv.ID] = start
+		for i := 0; i < inv.Needs(l.name); i++ {
+			seats[i] = start.Add(hold)
+		}
+		return true
+	})
+	return estimates
+}
+
+// UpdateEstimates computes the estimates returned by Estimate, at now.
+//
+// As the whole queue is simulated, estimates are updated by the janitor and
+// when invocations are queued, rather than every time they are read.
+func (l *license) UpdateEstimates(now time.Time) {
+	l.estimates = l.Estimates(now)
+}
+
+// Estimate returns the estimated time the queued invocation is allocated a
+// license, as of the last UpdateEstimates. Returns false if no estimate was
+// made.
+func (l *license) Estimate(invID string) (time.Time, bool) {
+	t, ok := l.estimates[invID]
+	return t, ok
+}
+
+// estimateAllocation returns the estimated time the invocation queued for the
+// licenses is allocated all of them, or nil if no estimate can be made.
+func estimateAllocation(lics []*license, invID string) *timestamppb.Timestamp {
+	var estimate time.Time
+	for _, lic := range lics {
+		t, ok := lic.Estimate(invID)
+		if !ok {
+			return nil
+		}
+		estimate = latest(estimate, t)
+	}
+	if estimate.IsZero() {
+		return nil
+	}
+	return timestamppb.New(estimate)
+}
+
+// loadHoldDurations records the hold durations of the allocations released in
+// the usage history, so that estimates can be made right after a restart.
+func (s *Service) loadHoldDurations() {
+	ctx, cancel := context.WithTimeout(context.Background(), HistoryTimeout)
+	defer cancel()
+	now := timeNow()
+	events, err := s.history.sink.Read(ctx, now.Add(-holdLookback), now)
+	if err != nil {
+		log.Printf("failed to load hold durations from the usage history: %v", err)
+		return
+	}
+
+	type key struct{ invocationID, licenseType string }
+	allocated := map[key]*Event{}
+	for _, event := range events {
+		k := key{event.InvocationID, event.LicenseType}
+		switch event.Type {
+		case EventAllocated:
+			if allocated[k] == nil {
+				allocated[k] = event
+			}
+		case EventReleased:
+			if start := allocated[k]; start != nil {
+				if lic, ok := s.licenses[event.LicenseType]; ok {
+					lic.holds.Add(start.BuildTag, event.Time.Sub(start.Time))
+				}
+			}
+			delete(allocated, k)
+		case EventExpired, EventPreempted:
+			delete(allocated, k)
+		}
+	}
+}
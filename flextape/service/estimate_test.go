@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestHoldDurations(t *testing.T) {
+	h := holdDurations{}
+	_, ok := h.Expected("tag_1")
+	assert.False(t, ok)
+
+	h.Add("tag_1", time.Hour)
+	h.Add("tag_2", 3*time.Hour)
+	got, ok := h.Expected("tag_1")
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Hour, got)
+
+	// Build tags with enough samples use their own.
+	for i := 0; i < buildTagSamples; i++ {
+		h.Add("tag_3", time.Minute)
+	}
+	got, _ = h.Expected("tag_3")
+	assert.Equal(t, time.Minute, got)
+
+	for i := 0; i < holdSamples; i++ {
+		h.Add("tag_4", 10*time.Minute)
+	}
+	got, _ = h.Expected("tag_1")
+	assert.Equal(t, 10*time.Minute, got)
+	assert.Len(t, h.byTag["tag_4"], buildTagSamples)
+}
+
+func TestEstimates(t *testing.T) {
+	start := time.Date(2024, time.June, 3, 9, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	holds := func(durations ...time.Duration) holdDurations {
+		h := holdDurations{}
+		for _, d := range durations {
+			h.Add("tag", d)
+		}
+		return h
+	}
+
+	testCases := []struct {
+		desc        string
+		total       int
+		unavailable int
+		held        map[string]int
+		holds       holdDurations
+		allocated   []*invocation
+		queued      []*invocation
+		want        map[string]time.Time
+	}{
+		{
+			desc:  "no hold recorded",
+			total: 1,
+			allocated: []*invocation{
+				&invocation{ID: "a1", Owner: "alice", AllocatedAt: at(-time.Hour)},
+			},
+			queued: []*invocation{
+				&invocation{ID: "q1", Owner: "bob"},
+			},
+			want: map[string]time.Time{},
+		},
+		{
+			desc:  "waits for allocations ahead",
+			total: 2,
+			holds: holds(time.Hour, 3*time.Hour),
+			allocated: []*invocation{
+				&invocation{ID: "a1", Owner: "alice", AllocatedAt: at(-time.Hour)},
+				&invocation{ID: "a2", Owner: "alice", AllocatedAt: at(-3 * time.Hour)},
+			},
+			queued: []*invocation{
+				&invocation{ID: "q1", Owner: "bob"},
+				&invocation{ID: "q2", Owner: "bob"},
+				&invocation{ID: "q3", Owner: "bob"},
+			},
+			want: map[string]time.Time{
+				// a2 is overdue: its license is expected to be released now.
+				"q1": at(0),
+				"q2": at(time.Hour),
+				"q3": at(2 * time.Hour),
+			},
+		},
+		{
+			desc:  "invocations needing many licenses",
+			total: 3,
+			holds: holds(time.Hour),
+			allocated: []*invocation{
+				&invocation{ID: "a1", Owner: "alice", AllocatedAt: at(-30 * time.Minute)},
+			},
+			queued: []*invocation{
+				&invocation{ID: "q1", Owner: "bob", Licenses: map[string]int{"xilinx::foo": 3}},
+				&invocation{ID: "q2", Owner: "bob"},
+				&invocation{ID: "q3", Owner: "bob", Licenses: map[string]int{"xilinx::foo": 4}},
+				&invocation{ID: "q4", Owner: "bob"},
+			},
+			want: map[string]time.Time{
+				"q1": at(30 * time.Minute),
+				"q2": at(90 * time.Minute),
+			},
+		},
+		{
+			desc:        "preempted, unavailable and held licenses",
+			total:       4,
+			unavailable: 1,
+			held:        map[string]int{"tapeout": 1},
+			holds:       holds(time.Hour),
+			allocated: []*invocation{
+				&invocation{ID: "a1", Owner: "alice", AllocatedAt: at(-30 * time.Minute), PreemptDeadline: at(time.Minute)},
+				&invocation{ID: "a2", Owner: "alice", AllocatedAt: at(-15 * time.Minute)},
+			},
+			queued: []*invocation{
+				&invocation{ID: "q1", Owner: "bob"},
+				&invocation{ID: "q2", Owner: "tapeout"},
+			},
+			want: map[string]time.Time{
+				"q1": at(time.Minute),
+				"q2": at(time.Minute),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			lic := &license{
+				name:           "xilinx::foo",
+				totalAvailable: tc.total,
+				unavailable:    tc.unavailable,
+				held:           tc.held,
+				holds:          tc.holds,
+				allocations:    map[string]*invocation{},
+				prioritizer:    &FIFOPrioritizer{},
+			}
+			for _, inv := range tc.allocated {
+				inv.BuildTag = "tag"
+				lic.allocations[inv.ID] = inv
+			}
+			for _, inv := range tc.queued {
+				inv.BuildTag = "tag"
+				lic.queue.Enqueue(inv)
+			}
+			assert.Equal(t, tc.want, lic.Estimates(start))
+		})
+	}
+}
+
+func TestEstimateAllocation(t *testing.T) {
+	start := time.Date(2024, time.June, 3, 9, 0, 0, 0, time.UTC)
+	currentTime := start
+	now := &currentTime
+
+	idGen := &fakeID{}
+	stubs := gostub.Stub(&generateRandomID, idGen.Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return *now
+	})
+	defer stubs.Reset()
+
+	// Hold durations are loaded from the usage history.
+	sink := NewJSONLSink(filepath.Join(t.TempDir(), "history.jsonl"))
+	require.NoError(t, sink.Write(context.Background(), []*Event{
+		&Event{Time: start.Add(-3 * time.Hour), Type: EventAllocated, LicenseType: "xilinx::foo", Count: 1, InvocationID: "x", BuildTag: "tag"},
+		&Event{Time: start.Add(-time.Hour), Type: EventReleased, LicenseType: "xilinx::foo", Count: 1, InvocationID: "x", BuildTag: "tag"},
+		&Event{Time: start.Add(-time.Hour), Type: EventAllocated, LicenseType: "xilinx::foo", Count: 1, InvocationID: "y", BuildTag: "tag"},
+		&Event{Time: start.Add(-30 * time.Minute), Type: EventExpired, LicenseType: "xilinx::foo", Count: 1, InvocationID: "y", BuildTag: "tag"},
+	}))
+	server := &Service{
+		currentState:              stateRunning,
+		history:                   NewHistory(sink),
+		queueRefreshDuration:      24 * time.Hour,
+		allocationRefreshDuration: 24 * time.Hour,
+	}
+	defer server.history.Close()
+	server.reset(&fpb.Config{
+		LicenseConfigs: []*fpb.LicenseConfig{
+			&fpb.LicenseConfig{Quantity: 1, License: &fpb.License{Vendor: "xilinx", Feature: "foo"}},
+			&fpb.LicenseConfig{Quantity: 1, License: &fpb.License{Vendor: "xilinx", Feature: "bar"}},
+		},
+	})
+	server.loadHoldDurations()
+	ctx := context.Background()
+
+	allocate := func(features ...string) *fpb.AllocateResponse {
+		licenses := []*fpb.License{}
+		for _, feature := range features {
+			licenses = append(licenses, &fpb.License{Vendor: "xilinx", Feature: feature})
+		}
+		resp, err := server.Allocate(ctx, &fpb.AllocateRequest{Invocation: &fpb.Invocation{Owner: "unit_test", BuildTag: "tag", Licenses: licenses}})
+		require.NoError(t, err)
+		return resp
+	}
+
+	require.NotNil(t, allocate("foo").GetLicenseAllocated())
+	queued := allocate("foo").GetQueued()
+	require.NotNil(t, queued)
+	assert.Equal(t, timestamppb.New(start.Add(2*time.Hour)), queued.GetEstimatedAllocationTime())
+
+	// No license of bar was ever released, so no estimate can be made.
+	require.NotNil(t, allocate("bar").GetLicenseAllocated())
+	queued = allocate("foo", "bar").GetQueued()
+	require.NotNil(t, queued)
+	assert.Nil(t, queued.GetEstimatedAllocationTime())
+
+	status, err := server.LicensesStatus(ctx, &fpb.LicensesStatusRequest{})
+	require.NoError(t, err)
+	for _, stats := range status.GetLicenseStats() {
+		if stats.GetLicense().GetFeature() != "foo" {
+			continue
+		}
+		require.Len(t, stats.GetQueuedInvocations(), 2)
+		assert.Equal(t, timestamppb.New(start.Add(2*time.Hour)), stats.GetQueuedInvocations()[0].GetEstimatedAllocationTime())
+		assert.Equal(t, timestamppb.New(start.Add(4*time.Hour)), stats.GetQueuedInvocations()[1].GetEstimatedAllocationTime())
+	}
+
+	// Estimates are not updated when polled, but by the janitor: once the
+	// allocation is held longer than expected, it is expected to be released
+	// right away.
+	currentTime = start.Add(3 * time.Hour)
+	polled, err := server.Allocate(ctx, &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+		Id:       queued.GetInvocationId(),
+		Owner:    "unit_test",
+		BuildTag: "tag",
+		Licenses: []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "foo"}, &fpb.License{Vendor: "xilinx", Feature: "bar"}},
+	}})
+	require.NoError(t, err)
+	assert.Nil(t, polled.GetQueued().GetEstimatedAllocationTime())
+	first := server.licenses["xilinx::foo"].queue[0].ID
+	estimate, _ := server.licenses["xilinx::foo"].Estimate(first)
+	assert.Equal(t, start.Add(2*time.Hour), estimate)
+	server.janitor()
+	estimate, _ = server.licenses["xilinx::foo"].Estimate(first)
+	assert.Equal(t, start.Add(3*time.Hour), estimate)
+}
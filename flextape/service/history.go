@@ -0,0 +1,222 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricHistoryEventCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "flextape",
+		Name:      "history_event_count",
+		Help:      "Number of usage history events, by result of recording them",
+	},
+		[]string{
+			"result",
+		},
+	)
+)
+
+// Types of the lifecycle events of an invocation, for a license type.
+const (
+	EventQueued    = "queued"    // Queued for a license.
+	EventAllocated = "allocated" // Allocated a license, after being queued or adopted.
+	EventReleased  = "released"  // Released by the client, while queued or allocated.
+	EventExpired   = "expired"   // Not refreshed in time, while queued or allocated.
+	EventPreempted = "preempted" // License revoked after being preempted.
+)
+
+// Event is a change in the lifecycle of an invocation, for a license type.
+type Event struct {
+	Time         time.Time
+	Type         string // One of the Event* constants.
+	LicenseType  string // In vendor::feature format.
+	Count        int    // Number of licenses of the type needed by the invocation.
+	InvocationID string
+	Owner        string
+	BuildTag     string
+}
+
+// Sink stores the usage history.
+type Sink interface {
+	// Write stores the events.
+	Write(ctx context.Context, events []*Event) error
+	// Read returns the events stored with a time in [from, to), in order of time.
+	Read(ctx context.Context, from, to time.Time) ([]*Event, error)
+}
+
+// HistoryTimeout bounds the duration of each write to the sink.
+const HistoryTimeout = 10 * time.Second
+
+// historyBuffer is the number of events waiting to be written to the sink,
+// past which new events are dropped.
+const historyBuffer = 10000
+
+// History records events to a Sink, without blocking the caller: events are
+// buffered, and written to the sink in batches.
+type History struct {
+	sink    Sink
+	events  chan *Event
+	done    chan struct{}
+	dropped atomic.Uint64 // Events dropped or failed to be written. See Dropped.
+}
+
+// NewHistory returns a History writing to the sink until it is closed.
+func NewHistory(sink Sink) *History {
+	h := &History{
+		sink:   sink,
+		events: make(chan *Event, historyBuffer),
+		done:   make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+// record queues an event for the invocation. Events are dropped if the sink
+// is not keeping up. Does nothing on a nil History.
+func (h *History) record(eventType string, licenseType string, inv *invocation) {
+	if h == nil {
+		return
+	}
+	event := &Event{
+		Time:         timeNow(),
+		Type:         eventType,
+		LicenseType:  licenseType,
+		Count:        inv.Needs(licenseType),
+		InvocationID: inv.ID,
+		Owner:        inv.Owner,
+		BuildTag:     inv.BuildTag,
+	}
+	select {
+	case h.events <- event:
+	default:
+		h.dropped.Add(1)
+		metricHistoryEventCount.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Dropped returns the number of events that were not recorded since the
+// History was created, because the sink was not keeping up or failed.
+func (h *History) Dropped() uint64 {
+	return h.dropped.Load()
+}
+
+func (h *History) run() {
+	defer close(h.done)
+	for event := range h.events {
+		batch := []*Event{event}
+	drain:
+		for len(batch) < historyBuffer {
+			select {
+			case event, ok := <-h.events:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, event)
+			default:
+				break drain
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), HistoryTimeout)
+		err := h.sink.Write(ctx, batch)
+		cancel()
+		if err != nil {
+			h.dropped.Add(uint64(len(batch)))
+			metricHistoryEventCount.WithLabelValues("error").Add(float64(len(batch)))
+			log.Printf("failed to record %d usage history events: %v", len(batch), err)
+			continue
+		}
+		metricHistoryEventCount.WithLabelValues("ok").Add(float64(len(batch)))
+	}
+}
+
+// Close writes the events queued so far to the sink, and stops recording.
+func (h *History) Close() {
+	close(h.events)
+	<-h.done
+}
+
+// JSONLSink is a Sink appending events to a local file, as JSON lines.
+type JSONLSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewJSONLSink returns a JSONLSink storing events in the file at path.
+func NewJSONLSink(path string) *JSONLSink {
+	return &JSONLSink{path: path}
+}
+
+func (js *JSONLSink) Write(ctx context.Context, events []*Event) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	f, err := os.OpenFile(js.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to open usage history %q: %w", js.path, err)
+	}
+	w := bufio.NewWriter(f)
+	// Terminate a line interrupted by a crash, so it does not corrupt the next event.
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			w.WriteByte('\n')
+		}
+	}
+	enc := json.NewEncoder(w)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			f.Close()
+			return fmt.Errorf("unable to encode usage history event: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write usage history %q: %w", js.path, err)
+	}
+	return f.Close()
+}
+
+// Read returns the events in [from, to). Lines that cannot be parsed, like
+// a line interrupted by a crash while being written, are skipped.
+func (js *JSONLSink) Read(ctx context.Context, from, to time.Time) ([]*Event, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	f, err := os.Open(js.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open usage history %q: %w", js.path, err)
+	}
+	defer f.Close()
+
+	events := []*Event{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		event := &Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			continue
+		}
+		if event.Time.Before(from) || !event.Time.Before(to) {
+			continue
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read usage history %q: %w", js.path, err)
+	}
+	return events, nil
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+	"github.com/enfabrica/enkit/lib/testutil"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestJSONLSink(t *testing.T) {
+	start := time.Date(2024, time.June, 3, 9, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	sink := NewJSONLSink(path)
+	ctx := context.Background()
+
+	got, err := sink.Read(ctx, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	events := []*Event{
+		&Event{Time: start, Type: EventQueued, LicenseType: "xilinx::foo", Count: 1, InvocationID: "a", Owner: "alice", BuildTag: "tag_1"},
+		&Event{Time: start.Add(time.Minute), Type: EventAllocated, LicenseType: "xilinx::foo", Count: 1, InvocationID: "a", Owner: "alice", BuildTag: "tag_1"},
+	}
+	require.NoError(t, sink.Write(ctx, events[:1]))
+	// A line interrupted while being written is skipped.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"Time":"2024-06-03T09:00:30Z","Type":"rel`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, sink.Write(ctx, events[1:]))
+
+	got, err = sink.Read(ctx, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+	for i := range got {
+		assert.True(t, events[i].Time.Equal(got[i].Time))
+		got[i].Time = events[i].Time
+	}
+	assert.Equal(t, events, got)
+
+	got, err = sink.Read(ctx, start.Add(time.Second), start.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+// failingSink is a Sink failing every write.
+type failingSink struct{ JSONLSink }
+
+func (fs *failingSink) Write(ctx context.Context, events []*Event) error {
+	return fmt.Errorf("unavailable")
+}
+
+func TestHistoryDropped(t *testing.T) {
+	history := NewHistory(&failingSink{})
+	inv := &invocation{ID: "a", Owner: "alice"}
+	history.record(EventQueued, "xilinx::foo", inv)
+	history.record(EventAllocated, "xilinx::foo", inv)
+	history.Close()
+	assert.Equal(t, uint64(2), history.Dropped())
+}
+
+func TestUsageReportRows(t *testing.T) {
+	start := time.Date(2024, time.June, 3, 9, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	event := func(d time.Duration, eventType, id, owner string, count int) *Event {
+		return &Event{Time: at(d), Type: eventType, LicenseType: "xilinx::foo", Count: count, InvocationID: id, Owner: owner, BuildTag: "tag_" + id}
+	}
+	window := func(d time.Duration) *timestamppb.Timestamp { return timestamppb.New(at(d)) }
+	foo := &fpb.License{Vendor: "xilinx", Feature: "foo"}
+
+	testCases := []struct {
+		desc   string
+		events []*Event
+		now    time.Time
+		held   map[usageKey]bool // Invocations still queued or allocated, see openUsage.
+		window time.Duration
+		req    *fpb.UsageReportRequest
+		want   []*fpb.UsageRow
+	}{
+		{
+			desc: "single window",
+			events: []*Event{
+				event(0, EventQueued, "a", "alice", 2),
+				event(time.Hour, EventAllocated, "a", "alice", 2),
+				event(2*time.Hour, EventReleased, "a", "alice", 2),
+				event(0, EventAllocated, "b", "bob", 1),
+				event(30*time.Minute, EventExpired, "b", "bob", 1),
+			},
+			now: at(24 * time.Hour),
+			req: &fpb.UsageReportRequest{},
+			want: []*fpb.UsageRow{
+				&fpb.UsageRow{WindowStart: window(0), LicenseHours: 2.5, QueuedHours: 1, Allocations: 3},
+			},
+		},
+		{
+			desc: "split by window, owner, tag and license",
+			events: []*Event{
+				event(30*time.Minute, EventAllocated, "a", "alice", 2),
+				event(150*time.Minute, EventPreempted, "a", "alice", 2),
+				event(0, EventQueued, "b", "bob", 1),
+				event(90*time.Minute, EventReleased, "b", "bob", 1),
+			},
+			now:    at(24 * time.Hour),
+			window: time.Hour,
+			req:    &fpb.UsageReportRequest{ByOwner: true, ByBuildTag: true, ByLicense: true},
+			want: []*fpb.UsageRow{
+				&fpb.UsageRow{WindowStart: window(0), Owner: "alice", BuildTag: "tag_a", License: foo, LicenseHours: 1, Allocations: 2},
+				&fpb.UsageRow{WindowStart: window(0), Owner: "bob", BuildTag: "tag_b", License: foo, QueuedHours: 1},
+				&fpb.UsageRow{WindowStart: window(time.Hour), Owner: "alice", BuildTag: "tag_a", License: foo, LicenseHours: 2},
+				&fpb.UsageRow{WindowStart: window(time.Hour), Owner: "bob", BuildTag: "tag_b", License: foo, QueuedHours: 0.5},
+				&fpb.UsageRow{WindowStart: window(2 * time.Hour), Owner: "alice", BuildTag: "tag_a", License: foo, LicenseHours: 1},
+			},
+		},
+		{
+			desc: "counts usage before the start only from the start",
+			events: []*Event{
+				event(-time.Hour, EventAllocated, "a", "alice", 1),
+				event(time.Hour, EventReleased, "a", "alice", 1),
+			},
+			now: at(24 * time.Hour),
+			req: &fpb.UsageReportRequest{ByOwner: true},
+			want: []*fpb.UsageRow{
+				&fpb.UsageRow{WindowStart: window(0), Owner: "alice", LicenseHours: 1},
+			},
+		},
+		{
+			desc: "counts open intervals until now",
+			events: []*Event{
+				event(0, EventAllocated, "a", "alice", 1),
+				// Allocations adopted or restored again are ignored.
+				event(time.Hour, EventAllocated, "a", "alice", 1),
+				event(time.Hour, EventQueued, "b", "bob", 1),
+			},
+			now:    at(2 * time.Hour),
+			held:   map[usageKey]bool{{"a", "xilinx::foo"}: true, {"b", "xilinx::foo"}: false},
+			window: 3 * time.Hour,
+			req:    &fpb.UsageReportRequest{ByOwner: true},
+			want: []*fpb.UsageRow{
+				&fpb.UsageRow{WindowStart: window(0), Owner: "alice", LicenseHours: 2, Allocations: 1},
+				&fpb.UsageRow{WindowStart: window(0), Owner: "bob", QueuedHours: 1},
+			},
+		},
+		{
+			desc: "counts intervals whose end was lost until they expire",
+			events: []*Event{
+				event(0, EventAllocated, "a", "alice", 1),
+				event(time.Hour, EventQueued, "b", "bob", 1),
+				// Allocated, but no longer queued.
+				event(time.Hour, EventQueued, "c", "carol", 1),
+			},
+			now:    at(24 * time.Hour),
+			held:   map[usageKey]bool{{"c", "xilinx::foo"}: true},
+			window: 4 * time.Hour,
+			req:    &fpb.UsageReportRequest{ByOwner: true},
+			want: []*fpb.UsageRow{
+				&fpb.UsageRow{WindowStart: window(0), Owner: "alice", LicenseHours: 0.5, Allocations: 1},
+				&fpb.UsageRow{WindowStart: window(0), Owner: "bob", QueuedHours: 0.25},
+				&fpb.UsageRow{WindowStart: window(0), Owner: "carol", QueuedHours: 0.25},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			open := &openUsage{end: tc.now, allocated: tc.held, queueRefresh: 15 * time.Minute, allocationRefresh: 30 * time.Minute}
+			got := usageReport(tc.events, start, at(4*time.Hour), open, tc.window, tc.req)
+			testutil.AssertProtoEqual(t, &fpb.UsageReportResponse{Rows: got}, &fpb.UsageReportResponse{Rows: tc.want})
+		})
+	}
+}
+
+func TestUsageHistory(t *testing.T) {
+	start := time.Date(2024, time.June, 3, 9, 0, 0, 0, time.UTC)
+	currentTime := start
+	now := &currentTime
+
+	idGen := &fakeID{}
+	stubs := gostub.Stub(&generateRandomID, idGen.Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return *now
+	})
+	defer stubs.Reset()
+
+	server := &Service{
+		currentState:              stateRunning,
+		history:                   NewHistory(NewJSONLSink(filepath.Join(t.TempDir(), "history.jsonl"))),
+		queueRefreshDuration:      24 * time.Hour,
+		allocationRefreshDuration: 24 * time.Hour,
+	}
+	server.reset(&fpb.Config{
+		LicenseConfigs: []*fpb.LicenseConfig{
+			&fpb.LicenseConfig{Quantity: 1, License: &fpb.License{Vendor: "xilinx", Feature: "foo"}},
+		},
+	})
+	ctx := context.Background()
+
+	licenses := []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "foo"}}
+	allocate := func(owner, tag string) string {
+		resp, err := server.Allocate(ctx, &fpb.AllocateRequest{Invocation: &fpb.Invocation{Owner: owner, BuildTag: tag, Licenses: licenses}})
+		require.NoError(t, err)
+		if resp.GetLicenseAllocated() != nil {
+			return resp.GetLicenseAllocated().GetInvocationId()
+		}
+		return resp.GetQueued().GetInvocationId()
+	}
+	release := func(id string) {
+		_, err := server.Release(ctx, &fpb.ReleaseRequest{InvocationId: id})
+		require.NoError(t, err)
+	}
+
+	alice := allocate("alice", "tag_1")
+	bob := allocate("bob", "tag_2")
+	*now = start.Add(time.Hour)
+	release(alice)
+	server.janitor()
+	*now = start.Add(3 * time.Hour)
+	release(bob)
+	server.history.Close()
+
+	*now = start.Add(4 * time.Hour)
+	resp, err := server.UsageReport(ctx, &fpb.UsageReportRequest{
+		StartTime:     timestamppb.New(start),
+		WindowSeconds: 7200,
+		ByOwner:       true,
+		ByBuildTag:    true,
+	})
+	require.NoError(t, err)
+	testutil.AssertProtoEqual(t, resp, &fpb.UsageReportResponse{
+		Rows: []*fpb.UsageRow{
+			&fpb.UsageRow{WindowStart: timestamppb.New(start), Owner: "alice", BuildTag: "tag_1", LicenseHours: 1, Allocations: 1},
+			&fpb.UsageRow{WindowStart: timestamppb.New(start), Owner: "bob", BuildTag: "tag_2", LicenseHours: 1, QueuedHours: 1, Allocations: 1},
+			&fpb.UsageRow{WindowStart: timestamppb.New(start.Add(2 * time.Hour)), Owner: "bob", BuildTag: "tag_2", LicenseHours: 1},
+		},
+	})
+	assert.Zero(t, resp.GetDroppedEvents())
+
+	_, err = server.UsageReport(ctx, &fpb.UsageReportRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.UsageReport(ctx, &fpb.UsageReportRequest{StartTime: timestamppb.New(start.Add(5 * time.Hour))})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.UsageReport(ctx, &fpb.UsageReportRequest{StartTime: timestamppb.New(start), WindowSeconds: 1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = testService(stateRunning).UsageReport(ctx, &fpb.UsageReportRequest{StartTime: timestamppb.New(start)})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestNewHistoryWithReplication(t *testing.T) {
+	config := &fpb.Config{
+		Server: &fpb.ServerConfig{
+			Replication: &fpb.ReplicationConfig{Address: "localhost:6433", DatastoreProject: "test"},
+			History:     &fpb.HistoryConfig{Sink: &fpb.HistoryConfig_JsonlPath{JsonlPath: filepath.Join(t.TempDir(), "history.jsonl")}},
+		},
+	}
+	// Each replica would only record the history while leading.
+	_, err := New(config)
+	assert.ErrorContains(t, err, "`replication`")
+}
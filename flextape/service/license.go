@@ -43,6 +43,26 @@ var (
 			"license_type",
 		},
 	)
+	metricUnavailableLicenses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "flextape",
+		Name:      "unavailable_licenses",
+		Help:      "Number of licenses purchased, but checked out outside of flextape or not issued by the license server",
+	},
+		[]string{
+			// The license vendor + feature, in `vendor::feature` format.
+			"license_type",
+		},
+	)
+	metricHeldLicenses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "flextape",
+		Name:      "held_licenses",
+		Help:      "Number of licenses held back for reservations, and not allocated to the owner of the reservation yet",
+	},
+		[]string{
+			// The license vendor + feature, in `vendor::feature` format.
+			"license_type",
+		},
+	)
 	metricLicenseReleaseReason = promauto.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: "flextape",
 		Name:      "license_release_count",
@@ -52,16 +72,36 @@ var (
 			"reason",
 		},
 	)
+	metricPreemptionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "flextape",
+		Name:      "preemption_count",
+		Help:      "Preemption count by license type and event",
+	},
+		[]string{
+			// The license vendor + feature, in `vendor::feature` format.
+			"license_type",
+			// One of `requested` when a preemptible invocation is asked to
+			// release its license, `released` when it does before its
+			// deadline, and `revoked` when the license is revoked after it.
+			"event",
+		},
+	)
 )
 
 // license manages allocations and queued invocations for a single license type.
 type license struct {
 	name           string                 // Name of the license, in vendor::feature format
 	totalAvailable int                    // Constant total number of licenses available for invocations.
+	unavailable    int                    // Licenses not available according to the license servers. See Reconcile.
+	reconciled     bool                   // Whether the license was ever reported by a license server.
+	held           map[string]int         // Licenses held back for reservations, by owner. See Hold.
+	holds          holdDurations          // Durations licenses were recently held for. See Estimates.
+	estimates      map[string]time.Time   // Estimated allocation time of queued invocations, by ID. See UpdateEstimates.
 	allocations    map[string]*invocation // Map of invocation ID to invocation data for an allocated license.
 
 	queue       invocationQueue // List of invocations waiting for a license, in FIFO order.
 	prioritizer Prioritizer
+	history     *History // Records the usage history. nil if disabled.
 }
 
 // formatLicenseType returns a unique string for a particular vendor/feature
@@ -77,38 +117,148 @@ func (l *license) Enqueue(inv *invocation) Position {
 
 	l.queue.Enqueue(inv)
 	l.prioritizer.OnEnqueue(inv)
+	l.history.record(EventQueued, l.name, inv)
 
 	l.queue.Sort(l.prioritizer.Sorter())
+	l.UpdateEstimates(timeNow())
 	return l.queue.Position(inv)
 }
 
+// Fits returns whether the licenses needed by the supplied invocation are
+// available, without allocating them.
+func (l *license) Fits(inv *invocation) bool {
+	return l.Free() >= inv.Needs(l.name)
+}
+
+// Free returns the number of licenses not allocated to any invocation, and
+// available according to the license server.
+func (l *license) Free() int {
+	return l.totalAvailable - l.unavailable - l.Used()
+}
+
+// Used returns the number of licenses allocated to invocations.
+func (l *license) Used() int {
+	used := 0
+	for _, inv := range l.allocations {
+		used += inv.Needs(l.name)
+	}
+	return used
+}
+
+// Reconcile makes unavailable the licenses the license servers report as
+// checked out outside of flextape, and the licenses configured beyond the
+// number issued by the license servers. issued and inUse are the totals across
+// all the license servers serving the license.
+//
+// Licenses checked out by the tools of the invocations allocated a license
+// are not counted as checked out outside of flextape.
+func (l *license) Reconcile(issued, inUse int) {
+	defer l.updateMetrics()
+	l.reconciled = true
+	external := max(0, inUse-l.Used())
+	available := max(0, min(l.totalAvailable, issued-external))
+	l.unavailable = l.totalAvailable - available
+}
+
+// UsedBy returns the number of licenses allocated to invocations of the owner.
+func (l *license) UsedBy(owner string) int {
+	used := 0
+	for _, inv := range l.allocations {
+		if inv.Owner == owner {
+			used += inv.Needs(l.name)
+		}
+	}
+	return used
+}
+
+// Hold holds back licenses for reservations: held is the number of licenses
+// reserved to each owner, including the licenses already allocated to them.
+// Replaces the licenses previously held.
+func (l *license) Hold(held map[string]int) {
+	defer l.updateMetrics()
+	l.held = held
+}
+
+// Held returns the number of licenses held back from the supplied invocation,
+// reserved to other owners and not allocated to them.
+func (l *license) Held(inv *invocation) int {
+	count := 0
+	for owner, reserved := range l.held {
+		if owner != inv.Owner {
+			count += max(0, reserved-l.UsedBy(owner))
+		}
+	}
+	return count
+}
+
+// Limit returns how many of the free licenses can be allocated to the
+// supplied invocation, net of the licenses held back for reservations of
+// other owners, and according to the prioritizer.
+func (l *license) Limit(inv *invocation, free int) int {
+	free = max(0, free-l.Held(inv))
+	if limiter, ok := l.prioritizer.(Limiter); ok {
+		return limiter.Limit(inv, free)
+	}
+	return free
+}
+
+// Preempter returns the prioritizer as a Preempter, or nil if it does not
+// preempt allocations.
+func (l *license) Preempter() Preempter {
+	if preempter, ok := l.prioritizer.(Preempter); ok && preempter.GracePeriod() > 0 {
+		return preempter
+	}
+	return nil
+}
+
+// Preempting returns the number of licenses allocated to invocations being
+// preempted.
+func (l *license) Preempting() int {
+	count := 0
+	for _, inv := range l.allocations {
+		if inv.Preempted() {
+			count += inv.Needs(l.name)
+		}
+	}
+	return count
+}
+
 // Allocate attempts to associate the supplied invocation with a license, if
 // one is available. Returns whether a license was successfully allocated.
 func (l *license) Allocate(inv *invocation) bool {
 	defer l.updateMetrics()
-	if len(l.allocations) >= l.totalAvailable {
+	if !l.Fits(inv) {
 		return false
 	}
 	l.prioritizer.OnAllocate(inv)
+	inv.AllocatedAt = timeNow()
 	l.allocations[inv.ID] = inv
+	l.history.record(EventAllocated, l.name, inv)
 	return true
 }
 
-// Promote attempts to promote queued requests to allocations until either no
-// licenses remain or no queued requests remain.
-func (l *license) Promote() {
-	defer l.updateMetrics()
-	numFree := l.totalAvailable - len(l.allocations)
-	for i := 0; i < numFree && l.queue.Len() > 0; i++ {
-		l.queue.Sort(l.prioritizer.Sorter())
+// Sort reorders the queue according to the prioritizer.
+func (l *license) Sort() {
+	l.queue.Sort(l.prioritizer.Sorter())
+}
 
-		invocation := l.queue.Dequeue()
+// Promote moves the supplied queued invocation to the allocations, without
+// checking if enough licenses are available. Returns false if the invocation
+// was not queued.
+func (l *license) Promote(invID string) bool {
+	defer l.updateMetrics()
+	inv := l.queue.Forget(invID)
+	if inv == nil {
+		return false
+	}
 
-		l.prioritizer.OnDequeue(invocation)
-		l.prioritizer.OnAllocate(invocation)
+	l.prioritizer.OnDequeue(inv)
+	l.prioritizer.OnAllocate(inv)
 
-		l.allocations[invocation.ID] = invocation
-	}
+	inv.AllocatedAt = timeNow()
+	l.allocations[inv.ID] = inv
+	l.history.record(EventAllocated, l.name, inv)
+	return true
 }
 
 // GetAllocated returns an invocation by ID if the invocation is allocated a
@@ -125,6 +275,7 @@ func (l *license) ExpireAllocations(expiry time.Time) {
 	for k, v := range l.allocations {
 		if !v.LastCheckin.After(expiry) {
 			l.prioritizer.OnRelease(v)
+			l.history.record(EventExpired, l.name, v)
 			metricLicenseReleaseReason.WithLabelValues("allocated_expired").Inc()
 			continue
 		}
@@ -133,6 +284,22 @@ func (l *license) ExpireAllocations(expiry time.Time) {
 	l.allocations = newAllocations
 }
 
+// RevokePreempted removes all allocations for preempted invocations that have
+// not released their license by their deadline, at `now`.
+func (l *license) RevokePreempted(now time.Time) {
+	defer l.updateMetrics()
+	for k, v := range l.allocations {
+		if !v.Preempted() || now.Before(v.PreemptDeadline) {
+			continue
+		}
+		l.prioritizer.OnRelease(v)
+		delete(l.allocations, k)
+		l.history.record(EventPreempted, l.name, v)
+		metricLicenseReleaseReason.WithLabelValues("preempted").Inc()
+		metricPreemptionCount.WithLabelValues(l.name, "revoked").Inc()
+	}
+}
+
 // ExpireQueued removes all queued invocations that have not checked in since
 // `expiry`.
 func (l *license) ExpireQueued(expiry time.Time) {
@@ -143,6 +310,7 @@ func (l *license) ExpireQueued(expiry time.Time) {
 		}
 
 		l.prioritizer.OnDequeue(inv)
+		l.history.record(EventExpired, l.name, inv)
 		metricLicenseReleaseReason.WithLabelValues("queued_expired").Inc()
 		return true
 	})
@@ -169,7 +337,11 @@ func (l *license) GetStats() *fpb.LicenseStats {
 	sort.Slice(allocated, func(i, j int) bool { return allocated[i].Id < allocated[j].Id })
 	queued := []*fpb.Invocation{}
 	l.queue.Walk(func(pos Position, inv *invocation) bool {
-		queued = append(queued, inv.ToProto())
+		msg := inv.ToProto()
+		if estimate, ok := l.Estimate(inv.ID); ok {
+			msg.EstimatedAllocationTime = timestamppb.New(estimate)
+		}
+		queued = append(queued, msg)
 		return true
 	})
 	return &fpb.LicenseStats{
@@ -179,7 +351,7 @@ func (l *license) GetStats() *fpb.LicenseStats {
 		},
 		Timestamp:            timestamppb.New(timeNow()),
 		TotalLicenseCount:    uint32(l.totalAvailable),
-		AllocatedCount:       uint32(len(l.allocations)),
+		AllocatedCount:       uint32(l.Used()),
 		AllocatedInvocations: allocated,
 		QueuedCount:          uint32(l.queue.Len()),
 		QueuedInvocations:    queued,
@@ -195,6 +367,13 @@ func (l *license) Forget(invID string) int {
 	for k, v := range l.allocations {
 		if k == invID {
 			l.prioritizer.OnRelease(v)
+			l.history.record(EventReleased, l.name, v)
+			if !v.AllocatedAt.IsZero() {
+				l.holds.Add(v.BuildTag, timeNow().Sub(v.AllocatedAt))
+			}
+			if v.Preempted() {
+				metricPreemptionCount.WithLabelValues(l.name, "released").Inc()
+			}
 			count++
 			continue
 		}
@@ -204,6 +383,7 @@ func (l *license) Forget(invID string) int {
 
 	if inv := l.queue.Forget(invID); inv != nil {
 		l.prioritizer.OnDequeue(inv)
+		l.history.record(EventReleased, l.name, inv)
 		count += 1
 	}
 
@@ -215,4 +395,10 @@ func (l *license) updateMetrics() {
 	metricActiveCount.WithLabelValues(l.name).Set(float64(len(l.allocations)))
 	metricQueueSize.WithLabelValues(l.name).Set(float64(l.queue.Len()))
 	metricTotalLicenses.WithLabelValues(l.name).Set(float64(l.totalAvailable))
+	metricUnavailableLicenses.WithLabelValues(l.name).Set(float64(l.unavailable))
+	held := 0
+	for owner, reserved := range l.held {
+		held += max(0, reserved-l.UsedBy(owner))
+	}
+	metricHeldLicenses.WithLabelValues(l.name).Set(float64(held))
 }
@@ -1,5 +1,13 @@
 package service
 
+import (
+	"sort"
+	"strings"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+)
+
 // Prioritizer is an object capable of sorting a queue in order of priority.
 //
 // In order for the prioritizer to have enough data to make the prioritization
@@ -160,3 +168,226 @@ func (so *EvenOwnersPrioritizer) Sorter() Sorter {
 		return (ap - am + aa) < (bp - bm + ba)
 	}
 }
+
+// Limiter is implemented by Prioritizers that limit the number of licenses
+// an invocation can be allocated, beyond the number of licenses free.
+type Limiter interface {
+	// Limit returns how many of the free licenses can be allocated to the
+	// invocation.
+	Limit(inv *invocation, free int) int
+}
+
+// Preempter is implemented by Prioritizers that can revoke licenses allocated
+// to invocations in favor of queued invocations.
+type Preempter interface {
+	// Victims returns the allocated invocations whose licenses can be revoked
+	// in favor of the queued invocation, in the order they should be revoked.
+	Victims(queued *invocation, allocated []*invocation) []*invocation
+	// GracePeriod returns the time given to preempted invocations to release
+	// their licenses, or 0 if preemption is disabled.
+	GracePeriod() time.Duration
+}
+
+// ownerGroup is a group of owners sharing priority and limits.
+type ownerGroup struct {
+	name     string
+	priority int32
+	max      int // Maximum number of licenses allocated to the group, 0 if unlimited.
+	reserved int // Number of licenses reserved to the group.
+
+	allocated int // Number of licenses currently allocated to the group.
+}
+
+// PriorityClassesPrioritizer is a prioritizer allocating licenses by the
+// priority of the group the owner of the invocation belongs to, and then in
+// the order the invocations were queued.
+//
+// Groups can have a maximum number of licenses allocated at once, and a
+// number of licenses reserved to them, not allocated to other groups even
+// if free. Invocations that cannot be allocated due to these limits are
+// sorted after all other invocations, so that the queue position reflects
+// the order in which licenses will actually be allocated.
+//
+// If preemption is enabled, licenses allocated to preemptible invocations of
+// lower priority are revoked in favor of queued invocations, except for the
+// licenses within the reservation of a group.
+type PriorityClassesPrioritizer struct {
+	license     string        // Name of the license, to count licenses of invocations needing many.
+	total       int           // Total number of licenses.
+	gracePeriod time.Duration // Time given to preempted invocations, 0 if preemption is disabled.
+
+	groups   []*ownerGroup
+	owners   map[string]*ownerGroup // Key: invocation.Owner listed in a group.
+	prefixes map[string]*ownerGroup // Key: owner prefix of a group.
+	fallback *ownerGroup            // Group of owners not matching any group.
+
+	// Key: invocation.ID, value is a monotonically increasing number
+	// representing the order in which invocations were queued.
+	queued map[string]uint64
+	next   uint64
+}
+
+func NewPriorityClassesPrioritizer(license string, total int, config *fpb.PriorityClassesPrioritizer) *PriorityClassesPrioritizer {
+	pc := &PriorityClassesPrioritizer{
+		license:  license,
+		total:    total,
+		owners:   map[string]*ownerGroup{},
+		prefixes: map[string]*ownerGroup{},
+		fallback: &ownerGroup{},
+		queued:   map[string]uint64{},
+	}
+	if config.GetPreemption() != nil {
+		pc.gracePeriod = time.Duration(defaultUint32(config.GetPreemption().GetGracePeriodSeconds(), 60)) * time.Second
+	}
+	pc.groups = append(pc.groups, pc.fallback)
+	for _, gc := range config.GetGroups() {
+		group := &ownerGroup{
+			name:     gc.GetName(),
+			priority: gc.GetPriority(),
+			max:      int(gc.GetMaxAllocated()),
+			reserved: int(gc.GetReserved()),
+		}
+		pc.groups = append(pc.groups, group)
+		for _, owner := range gc.GetOwners() {
+			pc.owners[owner] = group
+		}
+		for _, prefix := range gc.GetOwnerPrefixes() {
+			pc.prefixes[prefix] = group
+		}
+	}
+	return pc
+}
+
+// group returns the group the owner belongs to.
+func (pc *PriorityClassesPrioritizer) group(owner string) *ownerGroup {
+	if group, found := pc.owners[owner]; found {
+		return group
+	}
+	group, longest := pc.fallback, -1
+	for prefix, candidate := range pc.prefixes {
+		if len(prefix) > longest && strings.HasPrefix(owner, prefix) {
+			group, longest = candidate, len(prefix)
+		}
+	}
+	return group
+}
+
+func (pc *PriorityClassesPrioritizer) OnEnqueue(inv *invocation) {
+	pc.next += 1
+	pc.queued[inv.ID] = pc.next
+}
+
+func (pc *PriorityClassesPrioritizer) OnDequeue(inv *invocation) {
+	delete(pc.queued, inv.ID)
+}
+
+func (pc *PriorityClassesPrioritizer) OnAllocate(inv *invocation) {
+	pc.group(inv.Owner).allocated += inv.Needs(pc.license)
+}
+
+func (pc *PriorityClassesPrioritizer) OnRelease(inv *invocation) {
+	pc.group(inv.Owner).allocated -= inv.Needs(pc.license)
+}
+
+// Limit implements the Limiter interface.
+func (pc *PriorityClassesPrioritizer) Limit(inv *invocation, free int) int {
+	group := pc.group(inv.Owner)
+	for _, other := range pc.groups {
+		if other != group && other.reserved > other.allocated {
+			free -= other.reserved - other.allocated
+		}
+	}
+	if group.max > 0 && group.max-group.allocated < free {
+		free = group.max - group.allocated
+	}
+	if free < 0 {
+		return 0
+	}
+	return free
+}
+
+// free returns the number of licenses not allocated.
+func (pc *PriorityClassesPrioritizer) free() int {
+	free := pc.total
+	for _, group := range pc.groups {
+		free -= group.allocated
+	}
+	return free
+}
+
+func (pc *PriorityClassesPrioritizer) Sorter() Sorter {
+	free := pc.free()
+	return func(a, b *invocation) bool {
+		// Invocations that cannot be allocated even once licenses are free,
+		// because their group reached its maximum, go last.
+		ablocked := pc.Limit(a, pc.total) < a.Needs(pc.license)
+		bblocked := pc.Limit(b, pc.total) < b.Needs(pc.license)
+		if ablocked != bblocked {
+			return bblocked
+		}
+
+		// Then invocations of groups with free licenses reserved to them,
+		// which other groups cannot use.
+		ag, bg := pc.group(a.Owner), pc.group(b.Owner)
+		areserved := free > 0 && ag.reserved > ag.allocated
+		breserved := free > 0 && bg.reserved > bg.allocated
+		if areserved != breserved {
+			return areserved
+		}
+
+		if ag.priority != bg.priority {
+			return ag.priority > bg.priority
+		}
+		return pc.queued[a.ID] < pc.queued[b.ID]
+	}
+}
+
+// GracePeriod implements the Preempter interface.
+func (pc *PriorityClassesPrioritizer) GracePeriod() time.Duration {
+	return pc.gracePeriod
+}
+
+// Victims implements the Preempter interface: preemptible invocations of
+// groups with lower priority than the queued invocation are revoked first
+// from the group with the lowest priority, as long as the group keeps its
+// reserved licenses.
+func (pc *PriorityClassesPrioritizer) Victims(queued *invocation, allocated []*invocation) []*invocation {
+	if pc.gracePeriod == 0 {
+		return nil
+	}
+
+	// Licenses reserved to a group are never revoked, including the licenses
+	// of invocations already being preempted.
+	revocable := map[*ownerGroup]int{}
+	for _, group := range pc.groups {
+		revocable[group] = group.allocated - group.reserved
+	}
+	priority := pc.group(queued.Owner).priority
+	victims := []*invocation{}
+	for _, inv := range allocated {
+		if inv.Preempted() {
+			revocable[pc.group(inv.Owner)] -= inv.Needs(pc.license)
+			continue
+		}
+		if inv.Preemptible && pc.group(inv.Owner).priority < priority {
+			victims = append(victims, inv)
+		}
+	}
+	sort.Slice(victims, func(i, j int) bool {
+		gi, gj := pc.group(victims[i].Owner), pc.group(victims[j].Owner)
+		if gi.priority != gj.priority {
+			return gi.priority < gj.priority
+		}
+		return victims[i].ID < victims[j].ID
+	})
+
+	selected := []*invocation{}
+	for _, inv := range victims {
+		group := pc.group(inv.Owner)
+		if need := inv.Needs(pc.license); revocable[group] >= need {
+			revocable[group] -= need
+			selected = append(selected, inv)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+
+	"github.com/enfabrica/enkit/flextape/flexlm"
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricReconcileCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "flextape",
+		Name:      "reconcile_count",
+		Help:      "Number of attempts to reconcile licenses with a license server, by result",
+	},
+		[]string{
+			"result",
+		},
+	)
+)
+
+// runLmstat returns the output of the lmstat command, and can be stubbed out
+// for unit tests.
+var runLmstat = func(ctx context.Context, command []string) ([]byte, error) {
+	return exec.CommandContext(ctx, command[0], command[1:]...).Output()
+}
+
+// checkLicenseServers returns an error if the license server configs are invalid.
+func checkLicenseServers(config *fpb.Config) error {
+	for i, ls := range config.GetServer().GetLicenseServers() {
+		if len(ls.GetLmstatCommand()) == 0 {
+			return fmt.Errorf("missing `lmstat_command` in `license_servers` entry %d of config", i)
+		}
+	}
+	return nil
+}
+
+// startReconciling reconciles the licenses with the license server now, and
+// then periodically.
+func (s *Service) startReconciling(ls *fpb.LicenseServerConfig) {
+	interval := time.Duration(defaultUint32(ls.GetIntervalSeconds(), 60)) * time.Second
+	go func(s *Service) {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			s.reconcile(ls, interval)
+			<-t.C
+		}
+	}(s)
+}
+
+// reconcile updates the licenses available to flextape with the usage
+// reported by the license server.
+//
+// Nothing is reconciled unless the service is running: during startup, the
+// licenses of allocations not adopted yet would be counted as checked out
+// outside of flextape, and followers keep no state.
+func (s *Service) reconcile(ls *fpb.LicenseServerConfig, timeout time.Duration) {
+	s.mu.Lock()
+	running := s.currentState == stateRunning
+	s.mu.Unlock()
+	if !running {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := runLmstat(ctx, ls.GetLmstatCommand())
+	if err != nil {
+		metricReconcileCount.WithLabelValues("error").Inc()
+		log.Printf("failed to run %q: %v", ls.GetLmstatCommand(), err)
+		return
+	}
+	features, err := flexlm.ParseLmstat(bytes.NewReader(out))
+	if err != nil {
+		metricReconcileCount.WithLabelValues("error").Inc()
+		log.Printf("failed to parse the output of %q: %v", ls.GetLmstatCommand(), err)
+		return
+	}
+
+	reported := map[string]licenseUsage{}
+	for _, f := range features {
+		name := fmt.Sprintf("%s::%s", flexlm.Vendor(f.Daemon, ls.GetVendors()), f.Name)
+		reported[name] = reported[name].add(licenseUsage{issued: f.Issued, inUse: f.InUse})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.currentState != stateRunning {
+		return
+	}
+	if s.reported == nil {
+		s.reported = map[*fpb.LicenseServerConfig]map[string]licenseUsage{}
+	}
+	s.reported[ls] = reported
+	s.reconcileLicenses()
+	metricReconcileCount.WithLabelValues("ok").Inc()
+}
+
+// licenseUsage is the usage of a license type reported by license servers.
+type licenseUsage struct {
+	issued int // Licenses issued
+	inUse  int // Licenses checked out
+}
+
+func (u licenseUsage) add(other licenseUsage) licenseUsage {
+	return licenseUsage{issued: u.issued + other.issued, inUse: u.inUse + other.inUse}
+}
+
+// reconcileLicenses reconciles each license with the sum of the usage last
+// reported by each license server, as a feature served by several license
+// servers can be checked out from any of them. Must be called with s.mu held.
+//
+// Licenses no license server ever reported are left available: they are not
+// served by the license servers configured. Licenses reported before, but by
+// no license server anymore, are all made unavailable: the vendor daemon
+// serving them is likely down, and tools could not check them out.
+//
+// The last report of a license server that cannot be reached is kept, so
+// that a flaky connection does not change the licenses available.
+func (s *Service) reconcileLicenses() {
+	totals := map[string]licenseUsage{}
+	for _, reported := range s.reported {
+		for name, usage := range reported {
+			totals[name] = totals[name].add(usage)
+		}
+	}
+	for name, lic := range s.licenses {
+		usage, ok := totals[name]
+		if !ok && !lic.reconciled {
+			continue
+		}
+		lic.Reconcile(usage.issued, usage.inUse)
+	}
+}
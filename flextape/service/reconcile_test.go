@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+)
+
+// lmstatReport returns the output of `lmstat -a` for feature_foo.
+func lmstatReport(issued, inUse int) string {
+	return fmt.Sprintf(`Vendor daemon status (on licserver):
+
+   xilinxd: UP v11.16.4
+
+Feature usage info:
+
+Users of feature_foo:  (Total of %d licenses issued;  Total of %d licenses in use)
+`, issued, inUse)
+}
+
+func TestReconcile(t *testing.T) {
+	start := time.Now()
+	idGen := &fakeID{}
+	report, reportErr := "", error(nil)
+	stubs := gostub.Stub(&generateRandomID, idGen.Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return start
+	})
+	stubs.Stub(&runLmstat, func(ctx context.Context, command []string) ([]byte, error) {
+		assert.Equal(t, []string{"lmutil", "lmstat", "-a"}, command)
+		return []byte(report), reportErr
+	})
+	defer stubs.Reset()
+
+	server := testService(stateRunning).withAllocation("xilinx::feature_foo", &invocation{
+		ID:          "5",
+		Owner:       "unit_test",
+		BuildTag:    "tag_1",
+		LastCheckin: start,
+	})
+	lic := server.licenses["xilinx::feature_foo"]
+	ls := &fpb.LicenseServerConfig{
+		LmstatCommand: []string{"lmutil", "lmstat", "-a"},
+		Vendors:       map[string]string{"xilinxd": "xilinx"},
+	}
+	allocate := func(id string) *fpb.AllocateResponse {
+		resp, err := server.Allocate(context.Background(), &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+			Id:       id,
+			Owner:    "unit_test",
+			BuildTag: "tag_2",
+			Licenses: []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "feature_foo"}},
+		}})
+		assert.NoError(t, err)
+		return resp
+	}
+
+	// The license checked out by the invocation allocated is not external,
+	// while the other license in use is.
+	report = lmstatReport(2, 2)
+	server.reconcile(ls, time.Second)
+	assert.Equal(t, 1, lic.unavailable)
+	queued := allocate("").GetQueued().GetInvocationId()
+	assert.NotEmpty(t, queued)
+
+	// Failures leave the licenses unchanged.
+	report, reportErr = "", fmt.Errorf("license server down")
+	server.reconcile(ls, time.Second)
+	assert.Equal(t, 1, lic.unavailable)
+
+	// Once the external license is returned, it is allocated.
+	report, reportErr = lmstatReport(2, 1), nil
+	server.reconcile(ls, time.Second)
+	assert.Equal(t, 0, lic.unavailable)
+	server.janitor()
+	assert.NotNil(t, allocate(queued).GetLicenseAllocated())
+
+	// No more licenses than issued are allocated.
+	report = lmstatReport(1, 0)
+	server.reconcile(ls, time.Second)
+	assert.Equal(t, 1, lic.unavailable)
+	assert.Equal(t, -1, lic.Free())
+
+	// Nothing is reconciled until allocations are adopted.
+	server.currentState = stateStarting
+	report = lmstatReport(2, 2)
+	server.reconcile(ls, time.Second)
+	assert.Equal(t, 1, lic.unavailable)
+}
+
+func TestReconcileServers(t *testing.T) {
+	reports := map[string]string{}
+	stubs := gostub.Stub(&runLmstat, func(ctx context.Context, command []string) ([]byte, error) {
+		report, ok := reports[command[len(command)-1]]
+		if !ok {
+			return nil, fmt.Errorf("license server down")
+		}
+		return []byte(report), nil
+	})
+	defer stubs.Reset()
+
+	server := testService(stateRunning)
+	lic := server.licenses["xilinx::feature_foo"]
+	lic.totalAvailable = 20
+	server.licenses["xilinx::feature_bar"] = &license{
+		name:           "xilinx::feature_bar",
+		totalAvailable: 3,
+		allocations:    map[string]*invocation{},
+		prioritizer:    &FIFOPrioritizer{},
+	}
+	servers := []*fpb.LicenseServerConfig{
+		&fpb.LicenseServerConfig{LmstatCommand: []string{"lmstat", "-c", "2100@a"}, Vendors: map[string]string{"xilinxd": "xilinx"}},
+		&fpb.LicenseServerConfig{LmstatCommand: []string{"lmstat", "-c", "2100@b"}, Vendors: map[string]string{"xilinxd": "xilinx"}},
+	}
+	reconcile := func() {
+		for _, ls := range servers {
+			server.reconcile(ls, time.Second)
+		}
+	}
+
+	// The licenses issued and in use are summed across the license servers.
+	reports["2100@a"] = lmstatReport(10, 4)
+	reports["2100@b"] = lmstatReport(10, 0)
+	reconcile()
+	assert.Equal(t, 4, lic.unavailable)
+	assert.Equal(t, 16, lic.Free())
+
+	// A license server that cannot be reached keeps its last report.
+	delete(reports, "2100@b")
+	reconcile()
+	assert.Equal(t, 4, lic.unavailable)
+
+	// A license server no longer reporting the feature no longer issues it.
+	reports["2100@b"] = "Vendor daemon status (on licserver):\n\n   xilinxd: UP v11.16.4\n\nFeature usage info:\n"
+	reconcile()
+	assert.Equal(t, 14, lic.unavailable)
+
+	reports["2100@a"] = reports["2100@b"]
+	reconcile()
+	assert.Equal(t, 20, lic.unavailable)
+	assert.Equal(t, 0, lic.Free())
+
+	// Licenses never reported by the license servers are left available.
+	assert.Equal(t, 0, server.licenses["xilinx::feature_bar"].unavailable)
+	assert.Equal(t, 3, server.licenses["xilinx::feature_bar"].Free())
+}
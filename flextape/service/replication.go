@@ -0,0 +1,255 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	metricLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "flextape",
+		Name:      "leader",
+		Help:      "1 if this replica is the leader, 0 otherwise",
+	})
+	metricElectionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "flextape",
+		Name:      "election_count",
+		Help:      "Number of attempts to acquire or renew the lease, by result",
+	},
+		[]string{
+			"result",
+		},
+	)
+)
+
+// forwardedKey is the metadata set on requests forwarded to the leader, with
+// the address of the replica forwarding them.
+const forwardedKey = "flextape-forwarded-by"
+
+// ErrNotLeader is returned by a LeaseStore when saving a snapshot without
+// holding the lease.
+var ErrNotLeader = errors.New("lease not held by this replica")
+
+// Lease grants leadership to a replica until it expires.
+type Lease struct {
+	Holder  string    // Address of the replica holding the lease.
+	Expires time.Time // Time after which another replica can acquire the lease.
+}
+
+// LeaseStore elects a leader among replicas, and shares the state saved by
+// the leader with the replica taking over from it.
+//
+// Expiration is evaluated with the clock of the replica invoking the store, so
+// clocks of the replicas are assumed to be reasonably in sync.
+type LeaseStore interface {
+	// AcquireLease grants the lease to holder until expires, if the lease is
+	// not held, is expired at now, or is already held by holder.
+	//
+	// Returns the lease valid after the call, held by holder only if acquired.
+	AcquireLease(holder string, now, expires time.Time) (*Lease, error)
+
+	// Save persists the snapshot, replacing any previous one, only if holder
+	// still holds the lease at now. Returns ErrNotLeader otherwise.
+	Save(holder string, now time.Time, snap *Snapshot) error
+	// Load returns the last snapshot saved, or nil if there is none.
+	Load() (*Snapshot, error)
+}
+
+// Dialer returns a client for the replica at address.
+type Dialer func(address string) (fpb.FlextapeClient, error)
+
+// NewDialer returns a Dialer connecting to other replicas with the transport
+// credentials in config: TLS, verifying replicas with the CAs in tls_ca_path or
+// those of the system, unless insecure is set.
+func NewDialer(config *fpb.ReplicationConfig) (Dialer, error) {
+	creds := insecure.NewCredentials()
+	if !config.GetInsecure() {
+		tlsConfig := &tls.Config{}
+		if path := config.GetTlsCaPath(); path != "" {
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read `tls_ca_path`: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in `tls_ca_path` %q", path)
+			}
+		}
+		if config.GetTlsCertPath() != "" || config.GetTlsKeyPath() != "" {
+			cert, err := tls.LoadX509KeyPair(config.GetTlsCertPath(), config.GetTlsKeyPath())
+			if err != nil {
+				return nil, fmt.Errorf("unable to load `tls_cert_path` and `tls_key_path`: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	return func(address string) (fpb.FlextapeClient, error) {
+		conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		return fpb.NewFlextapeClient(conn), nil
+	}, nil
+}
+
+// replica is the replication state of a Service.
+type replica struct {
+	address       string        // Address of this replica, used to hold the lease.
+	leases        LeaseStore    // Store used to elect the leader.
+	leaseDuration time.Duration // Duration of the lease held by the leader.
+	config        *fpb.Config   // Used to reset the licenses when leadership changes.
+
+	dial    Dialer
+	clients map[string]fpb.FlextapeClient // Clients of the replicas that were leader, by address.
+
+	lease *Lease // Last lease seen, nil if never seen.
+}
+
+// leasedStore is a Store saving to the LeaseStore as long as the replica holds the lease.
+type leasedStore struct {
+	*replica
+}
+
+func (ls leasedStore) Save(snap *Snapshot) error {
+	return ls.leases.Save(ls.address, timeNow(), snap)
+}
+
+func (ls leasedStore) Load() (*Snapshot, error) {
+	return ls.leases.Load()
+}
+
+// replicate turns the service into a replica following the leader elected
+// via leases, until elect is invoked.
+func (s *Service) replicate(config *fpb.Config, address string, leases LeaseStore, leaseDuration time.Duration, dial Dialer) {
+	s.replica = &replica{
+		address:       address,
+		leases:        leases,
+		leaseDuration: leaseDuration,
+		config:        config,
+		dial:          dial,
+		clients:       map[string]fpb.FlextapeClient{},
+	}
+	s.store = leasedStore{s.replica}
+	s.currentState = stateFollowing
+}
+
+// elect acquires or renews the lease, leading or following accordingly.
+func (s *Service) elect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := timeNow()
+	lease, err := s.replica.leases.AcquireLease(s.replica.address, now, now.Add(s.replica.leaseDuration))
+	if err != nil {
+		metricElectionCount.WithLabelValues("error").Inc()
+		log.Printf("failed to acquire lease: %v", err)
+		// Another replica may take over once the lease expires.
+		if s.currentState != stateFollowing && (s.replica.lease == nil || !now.Before(s.replica.lease.Expires)) {
+			s.follow()
+		}
+		return
+	}
+	metricElectionCount.WithLabelValues("ok").Inc()
+	s.replica.lease = lease
+
+	leading := lease.Holder == s.replica.address
+	switch {
+	case leading && s.currentState == stateFollowing:
+		if err := s.lead(); err != nil {
+			log.Printf("failed to take over as leader: %v", err)
+		}
+	case !leading && s.currentState != stateFollowing:
+		s.follow()
+	}
+}
+
+// lead restores the state saved by the previous leader, and starts serving
+// requests.
+func (s *Service) lead() error {
+	snap, err := s.replica.leases.Load()
+	if err != nil {
+		return err
+	}
+
+	s.reset(s.replica.config)
+	s.saved = snap
+	metricLeader.Set(1)
+	if snap == nil {
+		// No leader saved any state yet: adopt the allocations refreshed by clients.
+		s.currentState = stateStarting
+		s.startAdoption()
+		return nil
+	}
+	s.restore(snap)
+	s.currentState = stateRunning
+	return nil
+}
+
+// follow drops the state of the service, and forwards requests to the leader.
+func (s *Service) follow() {
+	s.cancelSave(ErrNotLeader)
+	s.reset(s.replica.config)
+	s.saved = nil
+	s.currentState = stateFollowing
+	metricLeader.Set(0)
+}
+
+// leader returns a client to forward the request to, or nil if this replica
+// is to serve the request itself.
+func (s *Service) leader(ctx context.Context) (fpb.FlextapeClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.replica == nil {
+		return nil, nil
+	}
+	if s.currentState != stateFollowing {
+		// Another replica may have taken over since the lease expired.
+		if !timeNow().Before(s.replica.lease.Expires) {
+			return nil, status.Errorf(codes.Unavailable, "lease of replica %s expired, retry later", s.replica.address)
+		}
+		return nil, nil
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(forwardedKey)) > 0 {
+		return nil, status.Errorf(codes.Unavailable, "replica %s is not the leader - request forwarded by %s", s.replica.address, md.Get(forwardedKey)[0])
+	}
+	lease := s.replica.lease
+	if lease == nil || !timeNow().Before(lease.Expires) || lease.Holder == s.replica.address {
+		return nil, status.Errorf(codes.Unavailable, "no leader elected, retry later")
+	}
+
+	client, ok := s.replica.clients[lease.Holder]
+	if !ok {
+		var err error
+		client, err = s.replica.dial(lease.Holder)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to connect to leader %s: %v", lease.Holder, err)
+		}
+		s.replica.clients[lease.Holder] = client
+	}
+	return client, nil
+}
+
+// forwarding returns the context to forward a request to the leader with.
+func (s *Service) forwarding(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, forwardedKey, s.replica.address)
+}
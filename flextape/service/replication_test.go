@@ -0,0 +1,282 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// memoryLeaseStore is a LeaseStore shared by replicas in the same process.
+type memoryLeaseStore struct {
+	mu    sync.Mutex
+	lease Lease
+	snap  *Snapshot
+}
+
+func (m *memoryLeaseStore) AcquireLease(holder string, now, expires time.Time) (*Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lease.Holder == "" || m.lease.Holder == holder || !now.Before(m.lease.Expires) {
+		m.lease = Lease{Holder: holder, Expires: expires}
+	}
+	lease := m.lease
+	return &lease, nil
+}
+
+func (m *memoryLeaseStore) Save(holder string, now time.Time, snap *Snapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lease.Holder != holder || !now.Before(m.lease.Expires) {
+		return ErrNotLeader
+	}
+	m.snap = snap
+	return nil
+}
+
+func (m *memoryLeaseStore) Load() (*Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snap, nil
+}
+
+// testCluster is a set of replicas serving over in-memory connections.
+type testCluster struct {
+	replicas  map[string]*Service
+	servers   map[string]*grpc.Server
+	listeners map[string]*bufconn.Listener
+}
+
+func newTestCluster(t *testing.T, leases LeaseStore, addresses ...string) *testCluster {
+	config := &fpb.Config{
+		LicenseConfigs: []*fpb.LicenseConfig{
+			&fpb.LicenseConfig{Quantity: 1, License: &fpb.License{Vendor: "xilinx", Feature: "foo"}},
+		},
+	}
+	cluster := &testCluster{
+		replicas:  map[string]*Service{},
+		servers:   map[string]*grpc.Server{},
+		listeners: map[string]*bufconn.Listener{},
+	}
+	for _, address := range addresses {
+		service := &Service{
+			licenses:                  licensesFromConfig(config),
+			queueRefreshDuration:      5 * time.Second,
+			allocationRefreshDuration: 7 * time.Second,
+		}
+		service.replicate(config, address, leases, 15*time.Second, cluster.dial)
+
+		listener := bufconn.Listen(1024 * 1024)
+		server := grpc.NewServer()
+		fpb.RegisterFlextapeServer(server, service)
+		go server.Serve(listener)
+		t.Cleanup(server.Stop)
+
+		cluster.replicas[address] = service
+		cluster.servers[address] = server
+		cluster.listeners[address] = listener
+	}
+	return cluster
+}
+
+func (c *testCluster) dial(address string) (fpb.FlextapeClient, error) {
+	listener := c.listeners[address]
+	conn, err := grpc.NewClient("passthrough:///"+address,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return fpb.NewFlextapeClient(conn), nil
+}
+
+func TestReplication(t *testing.T) {
+	start := time.Now()
+	currentTime := start
+	now := &currentTime
+	stubs := gostub.Stub(&timeNow, func() time.Time {
+		return *now
+	})
+	defer stubs.Reset()
+
+	// A previous leader saved an empty state, so there is nothing to adopt.
+	leases := &memoryLeaseStore{snap: &Snapshot{}}
+	cluster := newTestCluster(t, leases, "a", "b", "c")
+	a, b, c := cluster.replicas["a"], cluster.replicas["b"], cluster.replicas["c"]
+	ctx := context.Background()
+
+	// Without a leader, requests cannot be served.
+	clientB, err := cluster.dial("b")
+	require.NoError(t, err)
+	clientC, err := cluster.dial("c")
+	require.NoError(t, err)
+	_, err = clientB.LicensesStatus(ctx, &fpb.LicensesStatusRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	for _, replica := range []*Service{a, b, c} {
+		replica.elect()
+	}
+	assert.Equal(t, stateRunning, a.currentState)
+	assert.Equal(t, stateFollowing, b.currentState)
+	assert.Equal(t, stateFollowing, c.currentState)
+
+	// Followers forward requests to the leader.
+	licenses := []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "foo"}}
+	resp, err := clientB.Allocate(ctx, &fpb.AllocateRequest{Invocation: &fpb.Invocation{Owner: "unit_test", BuildTag: "tag_1", Licenses: licenses}})
+	require.NoError(t, err)
+	allocated := resp.GetLicenseAllocated().GetInvocationId()
+	require.NotEmpty(t, allocated)
+	resp, err = clientC.Allocate(ctx, &fpb.AllocateRequest{Invocation: &fpb.Invocation{Owner: "unit_test", BuildTag: "tag_2", Licenses: licenses}})
+	require.NoError(t, err)
+	queued := resp.GetQueued().GetInvocationId()
+	require.NotEmpty(t, queued)
+	assert.Len(t, a.licenses["xilinx::foo"].allocations, 1)
+	assert.Len(t, b.licenses["xilinx::foo"].allocations, 0)
+
+	// Requests are never forwarded twice, even if the replicas disagree on the leader.
+	forwarded := metadata.NewIncomingContext(ctx, metadata.Pairs(forwardedKey, "c"))
+	_, err = b.LicensesStatus(forwarded, &fpb.LicensesStatusRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// The leader fails: once its lease expires, another replica takes over
+	// with the allocations and the queue preserved.
+	cluster.servers["a"].Stop()
+	*now = start.Add(16 * time.Second)
+	b.elect()
+	c.elect()
+	assert.Equal(t, stateRunning, b.currentState)
+	assert.Equal(t, stateFollowing, c.currentState)
+
+	_, err = clientC.Refresh(ctx, &fpb.RefreshRequest{Invocation: &fpb.Invocation{Id: allocated, Owner: "unit_test", BuildTag: "tag_1", Licenses: licenses}})
+	require.NoError(t, err)
+	resp, err = clientC.Allocate(ctx, &fpb.AllocateRequest{Invocation: &fpb.Invocation{Id: queued, Owner: "unit_test", BuildTag: "tag_2", Licenses: licenses}})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), resp.GetQueued().GetQueuePosition())
+
+	// The old leader does not serve requests once its lease expired, and
+	// cannot overwrite the state saved by the new leader.
+	_, err = a.LicensesStatus(ctx, &fpb.LicensesStatusRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.ErrorIs(t, leasedStore{a.replica}.Save(&Snapshot{}), ErrNotLeader)
+	a.elect()
+	assert.Equal(t, stateFollowing, a.currentState)
+	assert.Empty(t, a.licenses["xilinx::foo"].allocations)
+
+	// Changes on the new leader are replicated as well.
+	_, err = clientC.Release(ctx, &fpb.ReleaseRequest{InvocationId: allocated})
+	require.NoError(t, err)
+	b.janitor()
+	require.Len(t, leases.snap.Licenses, 1)
+	require.Len(t, leases.snap.Licenses[0].Allocated, 1)
+	assert.Equal(t, queued, leases.snap.Licenses[0].Allocated[0].ID)
+	assert.Empty(t, leases.snap.Licenses[0].Queued)
+}
+
+func TestReplicationLostLease(t *testing.T) {
+	leases := &memoryLeaseStore{snap: &Snapshot{}}
+	cluster := newTestCluster(t, leases, "a", "b")
+	a := cluster.replicas["a"]
+	a.elect()
+	require.Equal(t, stateRunning, a.currentState)
+
+	// Another replica took over without this one noticing, e.g. while paused:
+	// changes cannot be saved, so clients are not told of them, and the
+	// replica stops leading.
+	leases.mu.Lock()
+	leases.lease = Lease{Holder: "b", Expires: timeNow().Add(time.Minute)}
+	leases.mu.Unlock()
+	_, err := a.Allocate(context.Background(), &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+		Owner:    "unit_test",
+		BuildTag: "tag_1",
+		Licenses: []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "foo"}},
+	}})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	assert.Equal(t, stateFollowing, a.currentState)
+	assert.Empty(t, a.licenses["xilinx::foo"].allocations)
+}
+
+// selfSigned returns a certificate for 127.0.0.1 signed by its own key, and
+// the path of a file with the certificate in PEM format.
+func selfSigned(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
+
+func TestNewDialer(t *testing.T) {
+	cert, caPath := selfSigned(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	fpb.RegisterFlextapeServer(server, testService(stateRunning))
+	go server.Serve(listener)
+	defer server.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Replicas are verified with the CAs configured.
+	dial, err := NewDialer(&fpb.ReplicationConfig{TlsCaPath: caPath})
+	require.NoError(t, err)
+	client, err := dial(listener.Addr().String())
+	require.NoError(t, err)
+	_, err = client.LicensesStatus(ctx, &fpb.LicensesStatusRequest{})
+	assert.NoError(t, err)
+
+	// By default, replicas are verified with the CAs of the system.
+	dial, err = NewDialer(&fpb.ReplicationConfig{})
+	require.NoError(t, err)
+	client, err = dial(listener.Addr().String())
+	require.NoError(t, err)
+	_, err = client.LicensesStatus(ctx, &fpb.LicensesStatusRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = NewDialer(&fpb.ReplicationConfig{TlsCaPath: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.ErrorContains(t, err, "tls_ca_path")
+	_, err = NewDialer(&fpb.ReplicationConfig{TlsCertPath: caPath})
+	assert.ErrorContains(t, err, "tls_key_path")
+	_, err = NewDialer(&fpb.ReplicationConfig{Insecure: true})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,254 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ReportLookback is how long before the start of a report the usage history
+// is read, to count licenses allocated or invocations queued before the start
+// of the report. Older allocations still held are not counted.
+const ReportLookback = 7 * 24 * time.Hour
+
+// maxReportWindows is the maximum number of windows in a report.
+const maxReportWindows = 10000
+
+// usageInterval is a time an invocation was queued or allocated for a license type.
+type usageInterval struct {
+	*Event              // Event starting the interval.
+	End       time.Time // Time of the event ending the interval.
+	Allocated bool      // Whether allocated, rather than queued.
+}
+
+// usageKey identifies an invocation queued or allocated for a license type.
+type usageKey struct{ invocationID, licenseType string }
+
+// openUsage tells how to end the intervals still open in the history.
+//
+// Intervals of invocations still queued or allocated are ended at end. The
+// event ending the other intervals was lost, for example dropped by a History
+// not keeping up or by a restart, so they are ended when the invocation would
+// have expired without being refreshed, and not after end.
+type openUsage struct {
+	end               time.Time
+	allocated         map[usageKey]bool // Whether allocated, for each invocation queued or allocated.
+	queueRefresh      time.Duration     // See Service.queueRefreshDuration.
+	allocationRefresh time.Duration     // See Service.allocationRefreshDuration.
+}
+
+// endOf returns the time the open interval is ended at.
+func (o *openUsage) endOf(interval *usageInterval) time.Time {
+	if allocated, ok := o.allocated[usageKey{interval.InvocationID, interval.LicenseType}]; ok && allocated == interval.Allocated {
+		return o.end
+	}
+	expiry := interval.Time.Add(o.queueRefresh)
+	if interval.Allocated {
+		expiry = interval.Time.Add(o.allocationRefresh)
+	}
+	return latest(interval.Time, earliest(expiry, o.end))
+}
+
+// usageIntervals pairs the queued and allocated events with the events ending
+// them. Intervals still open are ended as described by open.
+//
+// Events starting an interval already open, like invocations queued again or
+// adopted after a restart, are ignored.
+func usageIntervals(events []*Event, open *openUsage) []*usageInterval {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+
+	queued := map[usageKey]*usageInterval{}
+	allocated := map[usageKey]*usageInterval{}
+	intervals := []*usageInterval{}
+	closeInterval := func(open map[usageKey]*usageInterval, k usageKey, t time.Time) {
+		if interval := open[k]; interval != nil {
+			interval.End = t
+			intervals = append(intervals, interval)
+			delete(open, k)
+		}
+	}
+
+	for _, event := range events {
+		k := usageKey{event.InvocationID, event.LicenseType}
+		switch event.Type {
+		case EventQueued:
+			if queued[k] == nil && allocated[k] == nil {
+				queued[k] = &usageInterval{Event: event}
+			}
+		case EventAllocated:
+			closeInterval(queued, k, event.Time)
+			if allocated[k] == nil {
+				allocated[k] = &usageInterval{Event: event, Allocated: true}
+			}
+		case EventReleased, EventExpired, EventPreempted:
+			closeInterval(queued, k, event.Time)
+			closeInterval(allocated, k, event.Time)
+		}
+	}
+	for _, pending := range []map[usageKey]*usageInterval{queued, allocated} {
+		for k, interval := range pending {
+			closeInterval(pending, k, open.endOf(interval))
+		}
+	}
+	return intervals
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// usageReport aggregates the usage in the events over [start, end), split in
+// windows of the specified duration. Intervals still open in the events are
+// ended as described by open.
+func usageReport(events []*Event, start, end time.Time, open *openUsage, window time.Duration, req *fpb.UsageReportRequest) []*fpb.UsageRow {
+	if window <= 0 {
+		window = end.Sub(start)
+	}
+
+	type rowKey struct {
+		window                       int64
+		owner, buildTag, licenseType string
+	}
+	rows := map[rowKey]*fpb.UsageRow{}
+	row := func(w int64, event *Event) *fpb.UsageRow {
+		k := rowKey{window: w}
+		if req.GetByOwner() {
+			k.owner = event.Owner
+		}
+		if req.GetByBuildTag() {
+			k.buildTag = event.BuildTag
+		}
+		if req.GetByLicense() {
+			k.licenseType = event.LicenseType
+		}
+		if rows[k] == nil {
+			rows[k] = &fpb.UsageRow{
+				WindowStart: timestamppb.New(start.Add(time.Duration(w) * window)),
+				Owner:       k.owner,
+				BuildTag:    k.buildTag,
+			}
+			if k.licenseType != "" {
+				fields := strings.SplitN(k.licenseType, "::", 2)
+				if len(fields) != 2 {
+					fields = []string{"<UNKNOWN>", k.licenseType}
+				}
+				rows[k].License = &fpb.License{Vendor: fields[0], Feature: fields[1]}
+			}
+		}
+		return rows[k]
+	}
+
+	for _, interval := range usageIntervals(events, open) {
+		if interval.Allocated && !interval.Time.Before(start) && interval.Time.Before(end) {
+			row(int64(interval.Time.Sub(start)/window), interval.Event).Allocations += uint32(interval.Count)
+		}
+
+		from, to := latest(interval.Time, start), earliest(interval.End, end)
+		for w := int64(from.Sub(start) / window); from.Before(to); w++ {
+			windowEnd := start.Add(time.Duration(w+1) * window)
+			hours := earliest(to, windowEnd).Sub(from).Hours()
+			if interval.Allocated {
+				row(w, interval.Event).LicenseHours += hours * float64(interval.Count)
+			} else {
+				row(w, interval.Event).QueuedHours += hours
+			}
+			from = windowEnd
+		}
+	}
+
+	sorted := make([]*fpb.UsageRow, 0, len(rows))
+	for _, r := range rows {
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if !a.GetWindowStart().AsTime().Equal(b.GetWindowStart().AsTime()) {
+			return a.GetWindowStart().AsTime().Before(b.GetWindowStart().AsTime())
+		}
+		if a.GetOwner() != b.GetOwner() {
+			return a.GetOwner() < b.GetOwner()
+		}
+		if a.GetBuildTag() != b.GetBuildTag() {
+			return a.GetBuildTag() < b.GetBuildTag()
+		}
+		return formatLicenseType(a.GetLicense()) < formatLicenseType(b.GetLicense())
+	})
+	return sorted
+}
+
+// UsageReport returns the usage over a time range, aggregated from the usage
+// history. See the proto docstrings for more details.
+func (s *Service) UsageReport(ctx context.Context, req *fpb.UsageReportRequest) (retRes *fpb.UsageReportResponse, retErr error) {
+	defer updateMetrics("UsageReport", &retErr, time.Now())
+
+	if leader, err := s.leader(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.UsageReport(s.forwarding(ctx), req)
+	}
+
+	// The history is set once in New, so no lock is needed.
+	if s.history == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "usage history not recorded - set `history` in the `server` section of the config")
+	}
+	if req.GetStartTime() == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "start_time must be set")
+	}
+	now := timeNow()
+	start, end := req.GetStartTime().AsTime(), now
+	if req.GetEndTime() != nil {
+		end = req.GetEndTime().AsTime()
+	}
+	if !start.Before(end) {
+		return nil, status.Errorf(codes.InvalidArgument, "start_time %v must be before end_time %v", start, end)
+	}
+	window := time.Duration(req.GetWindowSeconds()) * time.Second
+	if window > 0 && end.Sub(start)/window >= maxReportWindows {
+		return nil, status.Errorf(codes.InvalidArgument, "more than %d windows of %v between %v and %v", maxReportWindows, window, start, end)
+	}
+
+	s.mu.Lock()
+	open := &openUsage{
+		end:               now,
+		allocated:         map[usageKey]bool{},
+		queueRefresh:      s.queueRefreshDuration,
+		allocationRefresh: s.allocationRefreshDuration,
+	}
+	for _, l := range s.licenses {
+		for _, inv := range l.queue {
+			open.allocated[usageKey{inv.ID, l.name}] = false
+		}
+		for id := range l.allocations {
+			open.allocated[usageKey{id, l.name}] = true
+		}
+	}
+	s.mu.Unlock()
+
+	// Events up to now are read to end the intervals ending after the report.
+	events, err := s.history.sink.Read(ctx, start.Add(-ReportLookback), now)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to read usage history: %v", err)
+	}
+	return &fpb.UsageReportResponse{
+		Rows:          usageReport(events, start, end, open, window, req),
+		DroppedEvents: s.history.Dropped(),
+	}, nil
+}
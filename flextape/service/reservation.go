@@ -0,0 +1,265 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	metricReservationCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "flextape",
+		Name:      "reservation_count",
+		Help:      "Reservation count by license type and event",
+	},
+		[]string{
+			// The license vendor + feature, in `vendor::feature` format.
+			"license_type",
+			// One of `created`, `rejected` when conflicting with other
+			// reservations, `cancelled` or `ended`.
+			"event",
+		},
+	)
+)
+
+// reservation books licenses of a type for an owner over a time window.
+type reservation struct {
+	ID          string    // Server-generated unique ID
+	Owner       string    // Owner of the invocations the licenses are reserved to
+	LicenseType string    // License type reserved, in vendor::feature format
+	Count       int       // Number of licenses reserved
+	Start       time.Time // Start of the time window
+	End         time.Time // End of the time window, exclusive
+	Description string    // Client-provided description
+}
+
+func (r *reservation) ToProto() *fpb.Reservation {
+	fields := strings.SplitN(r.LicenseType, "::", 2)
+	if len(fields) != 2 {
+		fields = []string{"<UNKNOWN>", r.LicenseType}
+	}
+	return &fpb.Reservation{
+		Id:          r.ID,
+		Owner:       r.Owner,
+		License:     &fpb.License{Vendor: fields[0], Feature: fields[1]},
+		Count:       uint32(r.Count),
+		StartTime:   timestamppb.New(r.Start),
+		EndTime:     timestamppb.New(r.End),
+		Description: r.Description,
+	}
+}
+
+// overlaps returns whether the reservation overlaps the [start, end) window.
+func (r *reservation) overlaps(start, end time.Time) bool {
+	return r.Start.Before(end) && start.Before(r.End)
+}
+
+// reservedDuring returns the maximum number of licenses of the type reserved
+// at the same time over the [start, end) window, and the reservations
+// overlapping the window, sorted by ID.
+func (s *Service) reservedDuring(licenseType string, start, end time.Time) (int, []*reservation) {
+	overlapping := []*reservation{}
+	for _, r := range s.reservations {
+		if r.LicenseType == licenseType && r.overlaps(start, end) {
+			overlapping = append(overlapping, r)
+		}
+	}
+	sort.Slice(overlapping, func(i, j int) bool { return overlapping[i].ID < overlapping[j].ID })
+
+	// The number of licenses reserved only increases at the start of a
+	// reservation, or at the start of the window.
+	reserved := 0
+	for _, r := range overlapping {
+		at := latest(r.Start, start)
+		count := 0
+		for _, other := range overlapping {
+			if !at.Before(other.Start) && at.Before(other.End) {
+				count += other.Count
+			}
+		}
+		reserved = max(reserved, count)
+	}
+	return reserved, overlapping
+}
+
+// holdReservations drops the reservations ended by now, and holds back the
+// licenses of the others for their owner:
+//   - from reservationLead before the start of the reservation, so that the
+//     licenses allocated to other owners are released by the start,
+//   - until reservationGrace after the start, after which only the licenses
+//     allocated to the owner remain held, and the others are released.
+func (s *Service) holdReservations(now time.Time) {
+	held := map[string]map[string]int{}    // Key: license type, then owner.
+	claimed := map[string]map[string]int{} // As above, for reservations past their grace period.
+	for id, r := range s.reservations {
+		if !now.Before(r.End) {
+			delete(s.reservations, id)
+			metricReservationCount.WithLabelValues(r.LicenseType, "ended").Inc()
+			continue
+		}
+		if now.Before(r.Start.Add(-s.reservationLead)) {
+			continue
+		}
+		counts := held
+		if !now.Before(r.Start.Add(s.reservationGrace)) {
+			counts = claimed
+		}
+		if counts[r.LicenseType] == nil {
+			counts[r.LicenseType] = map[string]int{}
+		}
+		counts[r.LicenseType][r.Owner] += r.Count
+	}
+
+	for name, lic := range s.licenses {
+		owners := held[name]
+		for owner, count := range claimed[name] {
+			if owners == nil {
+				owners = map[string]int{}
+			}
+			owners[owner] += min(count, lic.UsedBy(owner))
+		}
+		lic.Hold(owners)
+	}
+}
+
+// CreateReservation books licenses for an owner over a time window. See the
+// proto docstrings for more details.
+func (s *Service) CreateReservation(ctx context.Context, req *fpb.CreateReservationRequest) (retRes *fpb.CreateReservationResponse, retErr error) {
+	defer updateMetrics("CreateReservation", &retErr, time.Now())
+
+	if leader, err := s.leader(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.CreateReservation(s.forwarding(ctx), req)
+	}
+
+	defer s.lockForUpdate()(&retErr)
+
+	msg := req.GetReservation()
+	licenseType := formatLicenseType(msg.GetLicense())
+	lic, ok := s.licenses[licenseType]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown license type: %q", licenseType)
+	}
+	if msg.GetOwner() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "owner must be set")
+	}
+	if msg.GetCount() == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "count must be at least 1")
+	}
+	if msg.GetStartTime() == nil || msg.GetEndTime() == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "start_time and end_time must be set")
+	}
+	now := timeNow()
+	start, end := msg.GetStartTime().AsTime(), msg.GetEndTime().AsTime()
+	if !start.Before(end) {
+		return nil, status.Errorf(codes.InvalidArgument, "start_time %v must be before end_time %v", start, end)
+	}
+	if !now.Before(end) {
+		return nil, status.Errorf(codes.InvalidArgument, "end_time %v is in the past", end)
+	}
+
+	reserved, overlapping := s.reservedDuring(licenseType, start, end)
+	if reserved+int(msg.GetCount()) > lic.totalAvailable {
+		metricReservationCount.WithLabelValues(licenseType, "rejected").Inc()
+		ids := []string{}
+		for _, r := range overlapping {
+			ids = append(ids, r.ID)
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "%d licenses of %q requested, but only %d exist and up to %d are already reserved between %v and %v by reservations %s",
+			msg.GetCount(), licenseType, lic.totalAvailable, reserved, start, end, strings.Join(ids, ", "))
+	}
+
+	id, err := generateRandomID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate reservation id: %v", err)
+	}
+	r := &reservation{
+		ID:          id,
+		Owner:       msg.GetOwner(),
+		LicenseType: licenseType,
+		Count:       int(msg.GetCount()),
+		Start:       start,
+		End:         end,
+		Description: msg.GetDescription(),
+	}
+	if s.reservations == nil {
+		s.reservations = map[string]*reservation{}
+	}
+	s.reservations[id] = r
+	s.holdReservations(now)
+	metricReservationCount.WithLabelValues(licenseType, "created").Inc()
+	return &fpb.CreateReservationResponse{Reservation: r.ToProto()}, nil
+}
+
+// ListReservations returns the reservations not ended yet. See the proto
+// docstrings for more details.
+func (s *Service) ListReservations(ctx context.Context, req *fpb.ListReservationsRequest) (retRes *fpb.ListReservationsResponse, retErr error) {
+	defer updateMetrics("ListReservations", &retErr, time.Now())
+
+	if leader, err := s.leader(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.ListReservations(s.forwarding(ctx), req)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := timeNow()
+	reservations := []*reservation{}
+	for _, r := range s.reservations {
+		if now.Before(r.End) {
+			reservations = append(reservations, r)
+		}
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		if !reservations[i].Start.Equal(reservations[j].Start) {
+			return reservations[i].Start.Before(reservations[j].Start)
+		}
+		return reservations[i].ID < reservations[j].ID
+	})
+	res := &fpb.ListReservationsResponse{}
+	for _, r := range reservations {
+		res.Reservations = append(res.Reservations, r.ToProto())
+	}
+	return res, nil
+}
+
+// CancelReservation deletes a reservation, releasing the licenses it holds.
+// See the proto docstrings for more details.
+func (s *Service) CancelReservation(ctx context.Context, req *fpb.CancelReservationRequest) (retRes *fpb.CancelReservationResponse, retErr error) {
+	defer updateMetrics("CancelReservation", &retErr, time.Now())
+
+	if leader, err := s.leader(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.CancelReservation(s.forwarding(ctx), req)
+	}
+
+	defer s.lockForUpdate()(&retErr)
+
+	r, ok := s.reservations[req.GetReservationId()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "reservation_id not found: %q", req.GetReservationId())
+	}
+	delete(s.reservations, r.ID)
+	metricReservationCount.WithLabelValues(r.LicenseType, "cancelled").Inc()
+	s.holdReservations(timeNow())
+	if s.currentState == stateRunning {
+		s.promote()
+	}
+	return &fpb.CancelReservationResponse{}, nil
+}
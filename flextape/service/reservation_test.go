@@ -0,0 +1,226 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+	"github.com/enfabrica/enkit/lib/errdiff"
+	"github.com/enfabrica/enkit/lib/testutil"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func reservationTestService() *Service {
+	server := &Service{
+		currentState:              stateRunning,
+		queueRefreshDuration:      24 * time.Hour,
+		allocationRefreshDuration: 24 * time.Hour,
+		reservationLead:           10 * time.Minute,
+		reservationGrace:          10 * time.Minute,
+	}
+	server.reset(&fpb.Config{
+		LicenseConfigs: []*fpb.LicenseConfig{
+			&fpb.LicenseConfig{Quantity: 2, License: &fpb.License{Vendor: "xilinx", Feature: "foo"}},
+		},
+	})
+	return server
+}
+
+func TestCreateReservation(t *testing.T) {
+	start := time.Date(2024, time.June, 3, 9, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *timestamppb.Timestamp { return timestamppb.New(start.Add(d)) }
+	foo := &fpb.License{Vendor: "xilinx", Feature: "foo"}
+
+	testCases := []struct {
+		desc     string
+		existing []*fpb.Reservation
+		req      *fpb.Reservation
+		wantErr  string
+	}{
+		{
+			desc: "reserves licenses",
+			existing: []*fpb.Reservation{
+				&fpb.Reservation{Owner: "regression", License: foo, Count: 1, StartTime: at(time.Hour), EndTime: at(2 * time.Hour)},
+				&fpb.Reservation{Owner: "regression", License: foo, Count: 2, StartTime: at(2 * time.Hour), EndTime: at(3 * time.Hour)},
+			},
+			req: &fpb.Reservation{Owner: "tapeout", License: foo, Count: 1, StartTime: at(0), EndTime: at(2 * time.Hour)},
+		},
+		{
+			desc: "not enough licenses left",
+			existing: []*fpb.Reservation{
+				&fpb.Reservation{Owner: "regression", License: foo, Count: 1, StartTime: at(time.Hour), EndTime: at(2 * time.Hour)},
+				&fpb.Reservation{Owner: "regression", License: foo, Count: 1, StartTime: at(90 * time.Minute), EndTime: at(3 * time.Hour)},
+			},
+			req:     &fpb.Reservation{Owner: "tapeout", License: foo, Count: 1, StartTime: at(0), EndTime: at(2 * time.Hour)},
+			wantErr: "up to 2 are already reserved",
+		},
+		{
+			desc:    "more licenses than exist",
+			req:     &fpb.Reservation{Owner: "tapeout", License: foo, Count: 3, StartTime: at(0), EndTime: at(time.Hour)},
+			wantErr: "only 2 exist",
+		},
+		{
+			desc:    "unknown license",
+			req:     &fpb.Reservation{Owner: "tapeout", License: &fpb.License{Vendor: "xilinx", Feature: "bar"}, Count: 1, StartTime: at(0), EndTime: at(time.Hour)},
+			wantErr: "unknown license type",
+		},
+		{
+			desc:    "missing owner",
+			req:     &fpb.Reservation{License: foo, Count: 1, StartTime: at(0), EndTime: at(time.Hour)},
+			wantErr: "owner must be set",
+		},
+		{
+			desc:    "no licenses",
+			req:     &fpb.Reservation{Owner: "tapeout", License: foo, StartTime: at(0), EndTime: at(time.Hour)},
+			wantErr: "count must be at least 1",
+		},
+		{
+			desc:    "missing window",
+			req:     &fpb.Reservation{Owner: "tapeout", License: foo, Count: 1, StartTime: at(0)},
+			wantErr: "must be set",
+		},
+		{
+			desc:    "empty window",
+			req:     &fpb.Reservation{Owner: "tapeout", License: foo, Count: 1, StartTime: at(time.Hour), EndTime: at(time.Hour)},
+			wantErr: "must be before end_time",
+		},
+		{
+			desc:    "past window",
+			req:     &fpb.Reservation{Owner: "tapeout", License: foo, Count: 1, StartTime: at(-2 * time.Hour), EndTime: at(-time.Hour)},
+			wantErr: "is in the past",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			stubs := gostub.Stub(&generateRandomID, (&fakeID{}).Generate)
+			stubs.Stub(&timeNow, func() time.Time { return start })
+			defer stubs.Reset()
+
+			server := reservationTestService()
+			ctx := context.Background()
+			for _, r := range tc.existing {
+				_, err := server.CreateReservation(ctx, &fpb.CreateReservationRequest{Reservation: r})
+				require.NoError(t, err)
+			}
+
+			got, gotErr := server.CreateReservation(ctx, &fpb.CreateReservationRequest{Reservation: tc.req})
+			errdiff.Check(t, gotErr, tc.wantErr)
+			if gotErr != nil {
+				assert.Len(t, server.reservations, len(tc.existing))
+				return
+			}
+			assert.NotEmpty(t, got.GetReservation().GetId())
+			assert.Len(t, server.reservations, len(tc.existing)+1)
+		})
+	}
+}
+
+func TestReservations(t *testing.T) {
+	start := time.Date(2024, time.June, 3, 9, 0, 0, 0, time.UTC)
+	currentTime := start
+	now := &currentTime
+
+	idGen := &fakeID{}
+	stubs := gostub.Stub(&generateRandomID, idGen.Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return *now
+	})
+	defer stubs.Reset()
+
+	server := reservationTestService()
+	lic := server.licenses["xilinx::foo"]
+	ctx := context.Background()
+
+	foo := &fpb.License{Vendor: "xilinx", Feature: "foo"}
+	reserve := func(owner string, count uint32, from, to time.Duration) (string, error) {
+		resp, err := server.CreateReservation(ctx, &fpb.CreateReservationRequest{Reservation: &fpb.Reservation{
+			Owner:     owner,
+			License:   foo,
+			Count:     count,
+			StartTime: timestamppb.New(start.Add(from)),
+			EndTime:   timestamppb.New(start.Add(to)),
+		}})
+		return resp.GetReservation().GetId(), err
+	}
+	allocate := func(owner string) (string, bool) {
+		resp, err := server.Allocate(ctx, &fpb.AllocateRequest{Invocation: &fpb.Invocation{Owner: owner, BuildTag: "tag", Licenses: []*fpb.License{foo}}})
+		require.NoError(t, err)
+		if resp.GetLicenseAllocated() != nil {
+			return resp.GetLicenseAllocated().GetInvocationId(), true
+		}
+		return resp.GetQueued().GetInvocationId(), false
+	}
+	release := func(id string) {
+		_, err := server.Release(ctx, &fpb.ReleaseRequest{InvocationId: id})
+		require.NoError(t, err)
+	}
+
+	tapeout, err := reserve("tapeout", 2, time.Hour, 3*time.Hour)
+	require.NoError(t, err)
+	_, err = reserve("regression", 1, 2*time.Hour, 4*time.Hour)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	regression, err := reserve("regression", 1, 3*time.Hour, 4*time.Hour)
+	require.NoError(t, err)
+
+	// Licenses are not held before the lead time.
+	bob, allocated := allocate("bob")
+	assert.True(t, allocated)
+
+	// Within the lead time, free licenses are only allocated to the owner.
+	*now = start.Add(55 * time.Minute)
+	server.janitor()
+	alice, allocated := allocate("alice")
+	assert.False(t, allocated)
+	tapeout1, allocated := allocate("tapeout")
+	assert.True(t, allocated)
+
+	// Licenses released by other owners go to the owner as well.
+	*now = start.Add(time.Hour)
+	release(bob)
+	server.janitor()
+	assert.Nil(t, lic.GetAllocated(alice))
+	_, allocated = allocate("tapeout")
+	assert.True(t, allocated)
+
+	resp, err := server.ListReservations(ctx, &fpb.ListReservationsRequest{})
+	require.NoError(t, err)
+	testutil.AssertProtoEqual(t, resp, &fpb.ListReservationsResponse{
+		Reservations: []*fpb.Reservation{
+			&fpb.Reservation{Id: tapeout, Owner: "tapeout", License: foo, Count: 2, StartTime: timestamppb.New(start.Add(time.Hour)), EndTime: timestamppb.New(start.Add(3 * time.Hour))},
+			&fpb.Reservation{Id: regression, Owner: "regression", License: foo, Count: 1, StartTime: timestamppb.New(start.Add(3 * time.Hour)), EndTime: timestamppb.New(start.Add(4 * time.Hour))},
+		},
+	})
+
+	// The reservations are saved and restored with the state.
+	restored := reservationTestService()
+	restored.restore(server.snapshot())
+	assert.Equal(t, server.reservations, restored.reservations)
+
+	// Within the grace period, licenses released by the owner stay held.
+	release(tapeout1)
+	server.janitor()
+	assert.Nil(t, lic.GetAllocated(alice))
+
+	// After it, only the licenses allocated to the owner stay held.
+	*now = start.Add(70 * time.Minute)
+	server.janitor()
+	assert.NotNil(t, lic.GetAllocated(alice))
+
+	_, err = server.CancelReservation(ctx, &fpb.CancelReservationRequest{ReservationId: regression})
+	require.NoError(t, err)
+	_, err = server.CancelReservation(ctx, &fpb.CancelReservationRequest{ReservationId: regression})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Ended reservations are dropped.
+	*now = start.Add(3 * time.Hour)
+	server.janitor()
+	assert.Empty(t, server.reservations)
+	assert.Empty(t, lic.held)
+}
@@ -47,12 +47,25 @@ var (
 
 // Service implements the LicenseManager gRPC service.
 type Service struct {
-	mu           sync.Mutex          // Protects the following members from concurrent access
-	currentState state               // State of the server
-	licenses     map[string]*license // Queues and allocations, managed per-license-type
+	mu           sync.Mutex              // Protects the following members from concurrent access
+	currentState state                   // State of the server
+	licenses     map[string]*license     // Queues and allocations, managed per-license-type
+	reservations map[string]*reservation // Reservations not ended yet, by ID
+
+	reported map[*fpb.LicenseServerConfig]map[string]licenseUsage // Last usage reported by each license server. See reconcile.
+
+	store   Store      // Persists queues and allocations across restarts. nil if disabled.
+	saved   *Snapshot  // Last snapshot persisted in the store.
+	saving  *saveBatch // Snapshot being persisted, nil if none. See save.
+	pending *saveBatch // Snapshot queued to be persisted next, nil if none.
+	replica *replica   // Replication state. nil if not replicated.
+	history *History   // Records the usage history. nil if disabled.
 
 	queueRefreshDuration      time.Duration // Queue entries not refreshed within this duration are expired
 	allocationRefreshDuration time.Duration // Allocations not refreshed within this duration are expired
+	adoptionDuration          time.Duration // Duration of the startup state
+	reservationLead           time.Duration // Licenses are held for reservations starting within this duration
+	reservationGrace          time.Duration // Licenses reserved and not allocated within this duration from the start are released
 }
 
 func licensesFromConfig(config *fpb.Config) map[string]*license {
@@ -66,6 +79,8 @@ func licensesFromConfig(config *fpb.Config) map[string]*license {
 			prioritizer = &FIFOPrioritizer{}
 		case *fpb.LicenseConfig_EvenOwners:
 			prioritizer = NewEvenOwnersPrioritizer()
+		case *fpb.LicenseConfig_PriorityClasses:
+			prioritizer = NewPriorityClassesPrioritizer(name, int(l.GetQuantity()), l.GetPriorityClasses())
 		default:
 			prioritizer = &FIFOPrioritizer{}
 		}
@@ -80,6 +95,37 @@ func licensesFromConfig(config *fpb.Config) map[string]*license {
 	return licenses
 }
 
+// reset drops the queues, allocations, reservations and the usage reported by
+// the license servers, recreating the licenses in config with the usage history
+// of the service, and the hold durations recorded so far.
+func (s *Service) reset(config *fpb.Config) {
+	licenses := licensesFromConfig(config)
+	for name, l := range licenses {
+		l.history = s.history
+		if previous, ok := s.licenses[name]; ok {
+			l.holds = previous.holds
+		}
+	}
+	s.licenses = licenses
+	s.reservations = map[string]*reservation{}
+	s.reported = map[*fpb.LicenseServerConfig]map[string]licenseUsage{}
+}
+
+// checkLicenseConfigs returns an error if the license configs are invalid.
+func checkLicenseConfigs(config *fpb.Config) error {
+	for _, l := range config.GetLicenseConfigs() {
+		name := formatLicenseType(l.GetLicense())
+		reserved := uint32(0)
+		for _, group := range l.GetPriorityClasses().GetGroups() {
+			reserved += group.GetReserved()
+		}
+		if reserved > l.GetQuantity() {
+			return fmt.Errorf("license %q: %d licenses reserved to groups, but only %d exist", name, reserved, l.GetQuantity())
+		}
+	}
+	return nil
+}
+
 func defaultUint32(v, d uint32) uint32 {
 	if v == 0 {
 		return d
@@ -91,18 +137,88 @@ func New(config *fpb.Config) (*Service, error) {
 	if config.GetServer() == nil {
 		return nil, fmt.Errorf("missing `server` section in config")
 	}
+	if err := checkLicenseConfigs(config); err != nil {
+		return nil, err
+	}
+	if err := checkLicenseServers(config); err != nil {
+		return nil, err
+	}
 	queueRefreshSeconds := defaultUint32(config.GetServer().GetQueueRefreshDurationSeconds(), 15)
 	allocationRefreshSeconds := defaultUint32(config.GetServer().GetAllocationRefreshDurationSeconds(), 30)
 	janitorIntervalSeconds := defaultUint32(config.GetServer().GetJanitorIntervalSeconds(), 1)
 	adoptionDurationSeconds := defaultUint32(config.GetServer().GetAdoptionDurationSeconds(), 45)
-
-	licenses := licensesFromConfig(config)
+	reservationLeadSeconds := defaultUint32(config.GetServer().GetReservationLeadSeconds(), 900)
+	reservationGraceSeconds := defaultUint32(config.GetServer().GetReservationGraceSeconds(), 900)
+	replication := config.GetServer().GetReplication()
+
+	var history *History
+	switch sink := config.GetServer().GetHistory().GetSink().(type) {
+	case *fpb.HistoryConfig_JsonlPath:
+		if replication != nil {
+			return nil, fmt.Errorf("`jsonl_path` in `history` and `replication` cannot be both set - each replica would only record the history while leading, use `bigquery` instead")
+		}
+		history = NewHistory(NewJSONLSink(sink.JsonlPath))
+	case *fpb.HistoryConfig_Bigquery:
+		bq, err := NewBigQuerySink(context.Background(), sink.Bigquery.GetProject(), sink.Bigquery.GetDataset(), sink.Bigquery.GetTable())
+		if err != nil {
+			return nil, err
+		}
+		history = NewHistory(bq)
+	}
 
 	service := &Service{
 		currentState:              stateStarting,
-		licenses:                  licenses,
+		history:                   history,
 		queueRefreshDuration:      time.Duration(queueRefreshSeconds) * time.Second,
 		allocationRefreshDuration: time.Duration(allocationRefreshSeconds) * time.Second,
+		adoptionDuration:          time.Duration(adoptionDurationSeconds) * time.Second,
+		reservationLead:           time.Duration(reservationLeadSeconds) * time.Second,
+		reservationGrace:          time.Duration(reservationGraceSeconds) * time.Second,
+	}
+	service.reset(config)
+	if history != nil {
+		service.loadHoldDurations()
+	}
+
+	if replication != nil {
+		if config.GetServer().GetStatePath() != "" {
+			return nil, fmt.Errorf("`state_path` and `replication` cannot be both set - the replicas share the state via datastore")
+		}
+		if replication.GetAddress() == "" {
+			return nil, fmt.Errorf("missing `address` in `replication` section of config")
+		}
+		dial, err := NewDialer(replication)
+		if err != nil {
+			return nil, err
+		}
+		leases, err := NewDatastoreLeaseStore(context.Background(), replication.GetDatastoreProject(), replication.GetDatastoreNamespace())
+		if err != nil {
+			return nil, err
+		}
+		leaseDuration := time.Duration(defaultUint32(replication.GetLeaseDurationSeconds(), 15)) * time.Second
+		service.replicate(config, replication.GetAddress(), leases, leaseDuration, dial)
+		service.elect()
+
+		go func(s *Service) {
+			t := time.NewTicker(leaseDuration / 3)
+			defer t.Stop()
+			for {
+				<-t.C
+				s.elect()
+			}
+		}(service)
+	} else if path := config.GetServer().GetStatePath(); path != "" {
+		service.store = NewLogStore(path)
+		snap, err := service.store.Load()
+		if err != nil {
+			return nil, err
+		}
+		// With the previous state restored, there is nothing left to adopt.
+		if snap != nil {
+			service.restore(snap)
+			service.saved = snap
+			service.currentState = stateRunning
+		}
 	}
 
 	go func(s *Service) {
@@ -115,15 +231,29 @@ func New(config *fpb.Config) (*Service, error) {
 		}
 	}(service)
 
+	if service.replica == nil && service.currentState == stateStarting {
+		service.startAdoption()
+	}
+	for _, ls := range config.GetServer().GetLicenseServers() {
+		service.startReconciling(ls)
+	}
+
+	return service, nil
+}
+
+// startAdoption moves the service out of the startup state once the adoption
+// period is over.
+func (s *Service) startAdoption() {
 	go func(s *Service) {
 		// TODO: Read this from flags
-		<-time.After(time.Duration(adoptionDurationSeconds) * time.Second)
+		<-time.After(s.adoptionDuration)
 		s.mu.Lock()
 		defer s.mu.Unlock()
-		s.currentState = stateRunning
-	}(service)
-
-	return service, nil
+		// A replica may have stopped leading in the meantime.
+		if s.currentState == stateStarting {
+			s.currentState = stateRunning
+		}
+	}(s)
 }
 
 // QueueID is a monotonically increasing number representing the absolute
@@ -148,15 +278,42 @@ type invocation struct {
 	Owner       string    // Client-provided owner
 	BuildTag    string    // Client-provided build tag. May not be unique across invocations
 	LastCheckin time.Time // Time the invocation last had its queue position/allocation refreshed.
+	AllocatedAt time.Time // Time the invocation was allocated its licenses. Zero while queued.
+
+	// Number of licenses needed per license type, for invocations needing more
+	// than a single license. nil means a single license of the type the
+	// invocation is queued or allocated on.
+	//
+	// Such invocations have a distinct entry in the queue or allocations of
+	// each license type they need, all sharing the same map.
+	Licenses map[string]int
+
+	Preemptible     bool      // Client-provided, whether the licenses can be revoked in favor of higher priority invocations
+	PreemptDeadline time.Time // Time the licenses are revoked, if preempted. Zero if not preempted.
 
 	QueueID QueueID // Position in the queue. 0 means the invocation has not been queued yet.
 }
 
+// Needs returns the number of licenses of the specified type the invocation
+// needs.
+func (i *invocation) Needs(licenseType string) int {
+	if i.Licenses == nil {
+		return 1
+	}
+	return i.Licenses[licenseType]
+}
+
+// Preempted returns whether the invocation was asked to release its licenses.
+func (i *invocation) Preempted() bool {
+	return !i.PreemptDeadline.IsZero()
+}
+
 func (i *invocation) ToProto() *fpb.Invocation {
 	return &fpb.Invocation{
-		Owner:    i.Owner,
-		BuildTag: i.BuildTag,
-		Id:       i.ID,
+		Owner:       i.Owner,
+		BuildTag:    i.BuildTag,
+		Id:          i.ID,
+		Preemptible: i.Preemptible,
 	}
 }
 
@@ -170,6 +327,9 @@ const (
 	stateStarting state = iota
 	// Normal operating state.
 	stateRunning
+	// State of replicas that are not the leader: requests are forwarded to the
+	// leader, and no state is kept.
+	stateFollowing
 )
 
 var (
@@ -193,18 +353,241 @@ var (
 func (s *Service) janitor() {
 	defer updateJanitorMetrics(time.Now())
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	// Don't expire or promote anything during startup.
-	if s.currentState == stateStarting {
+	// Failures to save are logged, and retried at the next run.
+	var err error
+	defer s.lockForUpdate()(&err)
+	// Don't expire or promote anything during startup, or unless leading.
+	if s.currentState == stateStarting || s.currentState == stateFollowing {
 		return
 	}
 	allocationExpiry := timeNow().Add(-s.allocationRefreshDuration)
 	queueExpiry := timeNow().Add(-s.queueRefreshDuration)
 	for _, lic := range s.licenses {
 		lic.ExpireAllocations(allocationExpiry)
+		lic.RevokePreempted(timeNow())
 		lic.ExpireQueued(queueExpiry)
-		lic.Promote()
+	}
+	s.holdReservations(timeNow())
+	s.promote()
+	s.preempt()
+	for _, lic := range s.licenses {
+		lic.UpdateEstimates(timeNow())
+	}
+}
+
+// licensesFor returns the licenses needed by the supplied invocation, sorted
+// by name, and the number of licenses needed per type. The map is nil if the
+// invocation needs a single license.
+func (s *Service) licensesFor(invMsg *fpb.Invocation) ([]*license, map[string]int, error) {
+	if len(invMsg.GetLicenses()) == 0 {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "licenses must have at least one license spec")
+	}
+	counts := map[string]int{}
+	for _, l := range invMsg.GetLicenses() {
+		counts[formatLicenseType(l)] += 1
+	}
+
+	lics := []*license{}
+	for licenseType, count := range counts {
+		lic, ok := s.licenses[licenseType]
+		if !ok {
+			return nil, nil, status.Errorf(codes.NotFound, "unknown license type: %q", licenseType)
+		}
+		if count > lic.totalAvailable {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "%d licenses of type %q requested, but only %d exist", count, licenseType, lic.totalAvailable)
+		}
+		lics = append(lics, lic)
+	}
+	sort.Slice(lics, func(i, j int) bool { return lics[i].name < lics[j].name })
+
+	if len(invMsg.GetLicenses()) == 1 {
+		return lics, nil, nil
+	}
+	return lics, counts, nil
+}
+
+// enqueue puts the supplied invocation at the back of the queue of each of
+// the licenses. Returns the worst position the invocation was queued at.
+func enqueue(lics []*license, inv *invocation) Position {
+	worst := Position(0)
+	for _, lic := range lics {
+		entry := *inv
+		if pos := lic.Enqueue(&entry); pos > worst {
+			worst = pos
+		}
+	}
+	return worst
+}
+
+// getAllocated returns the entries of an invocation in the allocations of each
+// of the licenses, or nil if the invocation is not allocated all of them.
+func getAllocated(lics []*license, invID string) []*invocation {
+	invs := []*invocation{}
+	for _, lic := range lics {
+		inv := lic.GetAllocated(invID)
+		if inv == nil {
+			return nil
+		}
+		invs = append(invs, inv)
+	}
+	return invs
+}
+
+// getQueued returns the entries of an invocation in the queue of each of the
+// licenses, or nil if the invocation is not queued for all of them. If the
+// invocation is queued, its worst 1-based position is also returned.
+//
+// Queues are sorted first, as priorities may have changed since the last sort.
+func getQueued(lics []*license, invID string) ([]*invocation, Position) {
+	invs := []*invocation{}
+	worst := Position(0)
+	for _, lic := range lics {
+		lic.Sort()
+		inv, pos := lic.GetQueued(invID)
+		if inv == nil {
+			return nil, 0
+		}
+		invs = append(invs, inv)
+		if pos > worst {
+			worst = pos
+		}
+	}
+	return invs, worst
+}
+
+// promote allocates licenses to queued invocations, until either no licenses
+// remain or no queued invocation can be allocated.
+//
+// Invocations needing several licenses are allocated all of them at once, or
+// none. To queue fairly across license types, invocations are considered in
+// order of their worst position in the queues they are in. The licenses
+// available to an invocation that cannot be allocated yet are reserved for
+// it, so invocations behind it cannot starve it by taking them first.
+func (s *Service) promote() {
+	for s.promoteNext() {
+	}
+}
+
+// promoteNext allocates licenses to the first queued invocation they are
+// available for, following the order described in promote. Returns false if
+// no invocation could be allocated.
+func (s *Service) promoteNext() bool {
+	worst := map[string]Position{}
+	queued := map[string]map[*license]*invocation{}
+	for _, lic := range s.licenses {
+		lic.Sort()
+		lic.queue.Walk(func(pos Position, inv *invocation) bool {
+			if pos > worst[inv.ID] {
+				worst[inv.ID] = pos
+			}
+			if queued[inv.ID] == nil {
+				queued[inv.ID] = map[*license]*invocation{}
+			}
+			queued[inv.ID][lic] = inv
+			return true
+		})
+	}
+
+	ids := make([]string, 0, len(worst))
+	for id := range worst {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if worst[ids[i]] != worst[ids[j]] {
+			return worst[ids[i]] < worst[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+
+	free := map[*license]int{}
+	for _, lic := range s.licenses {
+		free[lic] = lic.Free()
+	}
+	for _, id := range ids {
+		entries := queued[id]
+		fits := true
+		for lic, inv := range entries {
+			if lic.Limit(inv, free[lic]) < inv.Needs(lic.name) {
+				fits = false
+			}
+		}
+		if fits {
+			for lic := range entries {
+				lic.Promote(id)
+			}
+			return true
+		}
+		for lic, inv := range entries {
+			free[lic] -= min(lic.Limit(inv, free[lic]), inv.Needs(lic.name))
+		}
+	}
+	return false
+}
+
+// preempt asks preemptible invocations to release their licenses, when queued
+// invocations the prioritizer prefers to them are waiting for licenses.
+//
+// Queued invocations are considered in queue order, counting the licenses of
+// invocations already being preempted as free, up to the first invocation
+// for which not enough licenses can be revoked. Preemption is not withdrawn
+// if the invocation it was requested for is no longer queued.
+//
+// Licenses are only revoked for the license type the invocation is queued
+// for: an invocation needing several license types may still wait for the
+// others to be released.
+func (s *Service) preempt() {
+	now := timeNow()
+	for _, lic := range s.licenses {
+		preempter := lic.Preempter()
+		if preempter == nil {
+			continue
+		}
+		lic.Sort()
+		free := lic.Free() + lic.Preempting()
+		lic.queue.Walk(func(pos Position, inv *invocation) bool {
+			need := inv.Needs(lic.name)
+			// Revoking licenses does not help invocations over the limits of their group.
+			if lic.Limit(inv, lic.totalAvailable) < need {
+				return true
+			}
+			if free >= need {
+				free -= need
+				return true
+			}
+
+			allocated := make([]*invocation, 0, len(lic.allocations))
+			for _, a := range lic.allocations {
+				allocated = append(allocated, a)
+			}
+			victims := []*invocation{}
+			revoked := free
+			for _, victim := range preempter.Victims(inv, allocated) {
+				if revoked >= need {
+					break
+				}
+				revoked += victim.Needs(lic.name)
+				victims = append(victims, victim)
+			}
+			if revoked < need {
+				return false
+			}
+			for _, victim := range victims {
+				s.preemptInvocation(victim.ID, now.Add(preempter.GracePeriod()))
+			}
+			free = revoked - need
+			return true
+		})
+	}
+}
+
+// preemptInvocation sets the deadline by which the invocation has to release
+// the licenses of all types allocated to it.
+func (s *Service) preemptInvocation(invID string, deadline time.Time) {
+	for _, lic := range s.licenses {
+		if inv := lic.GetAllocated(invID); inv != nil && !inv.Preempted() {
+			inv.PreemptDeadline = deadline
+			metricPreemptionCount.WithLabelValues(lic.name, "requested").Inc()
+		}
 	}
 }
 
@@ -225,17 +608,19 @@ func updateMetrics(method string, err *error, startTime time.Time) {
 func (s *Service) Allocate(ctx context.Context, req *fpb.AllocateRequest) (retRes *fpb.AllocateResponse, retErr error) {
 	defer updateMetrics("Allocate", &retErr, time.Now())
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if leader, err := s.leader(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.Allocate(s.forwarding(ctx), req)
+	}
+
+	defer s.lockForUpdate()(&retErr)
 
 	invMsg := req.GetInvocation()
-	if len(invMsg.GetLicenses()) != 1 {
-		return nil, status.Errorf(codes.InvalidArgument, "licenses must have exactly one license spec")
-	}
-	licenseType := formatLicenseType(invMsg.GetLicenses()[0])
-	lic, ok := s.licenses[licenseType]
-	if !ok {
-		return nil, status.Errorf(codes.NotFound, "unknown license type: %q", licenseType)
+	lics, counts, err := s.licensesFor(invMsg)
+	if err != nil {
+		return nil, err
 	}
 	invocationID := invMsg.GetId()
 
@@ -252,11 +637,13 @@ func (s *Service) Allocate(ctx context.Context, req *fpb.AllocateRequest) (retRe
 			Owner:       invMsg.GetOwner(),
 			BuildTag:    invMsg.GetBuildTag(),
 			LastCheckin: timeNow(),
+			Licenses:    counts,
+			Preemptible: invMsg.GetPreemptible(),
 		}
-		lic.Enqueue(inv)
+		enqueue(lics, inv)
 
 		if s.currentState == stateRunning {
-			lic.Promote()
+			s.promote()
 		}
 	}
 
@@ -264,27 +651,33 @@ func (s *Service) Allocate(ctx context.Context, req *fpb.AllocateRequest) (retRe
 	// insert, or from a previous request) or allocated (promoted from the queue
 	// by above, or asynchronously by the janitor).
 
-	if inv := lic.GetAllocated(invocationID); inv != nil {
+	now := timeNow()
+	if invs := getAllocated(lics, invocationID); invs != nil {
 		// Invocation is allocated
-		inv.LastCheckin = timeNow()
+		for _, inv := range invs {
+			inv.LastCheckin = now
+		}
 		return &fpb.AllocateResponse{
 			ResponseType: &fpb.AllocateResponse_LicenseAllocated{
 				LicenseAllocated: &fpb.LicenseAllocated{
 					InvocationId:           invocationID,
-					LicenseRefreshDeadline: timestamppb.New(timeNow().Add(s.allocationRefreshDuration)),
+					LicenseRefreshDeadline: timestamppb.New(now.Add(s.allocationRefreshDuration)),
 				},
 			},
 		}, nil
 	}
-	if inv, pos := lic.GetQueued(invocationID); inv != nil {
+	if invs, pos := getQueued(lics, invocationID); invs != nil {
 		// Invocation is queued
-		inv.LastCheckin = timeNow()
+		for _, inv := range invs {
+			inv.LastCheckin = now
+		}
 		return &fpb.AllocateResponse{
 			ResponseType: &fpb.AllocateResponse_Queued{
 				Queued: &fpb.Queued{
-					InvocationId:  invocationID,
-					NextPollTime:  timestamppb.New(timeNow().Add(s.queueRefreshDuration)),
-					QueuePosition: uint32(pos),
+					InvocationId:            invocationID,
+					NextPollTime:            timestamppb.New(now.Add(s.queueRefreshDuration)),
+					QueuePosition:           uint32(pos),
+					EstimatedAllocationTime: estimateAllocation(lics, invocationID),
 				},
 			},
 		}, nil
@@ -295,20 +688,27 @@ func (s *Service) Allocate(ctx context.Context, req *fpb.AllocateRequest) (retRe
 		return nil, status.Errorf(codes.FailedPrecondition, "invocation_id not found: %q", invocationID)
 	}
 	// This invocation was previously queued before the server restart; add it
-	// back to the queue.
+	// back to the queue. Drop any partial allocation or queue entry first, so
+	// the invocation never holds only part of its licenses.
+	for _, lic := range lics {
+		lic.Forget(invocationID)
+	}
 	inv := &invocation{
 		ID:          invocationID,
 		Owner:       invMsg.GetOwner(),
 		BuildTag:    invMsg.GetBuildTag(),
-		LastCheckin: timeNow(),
+		LastCheckin: now,
+		Licenses:    counts,
+		Preemptible: invMsg.GetPreemptible(),
 	}
-	pos := lic.Enqueue(inv)
+	pos := enqueue(lics, inv)
 	return &fpb.AllocateResponse{
 		ResponseType: &fpb.AllocateResponse_Queued{
 			Queued: &fpb.Queued{
-				InvocationId:  invocationID,
-				NextPollTime:  timestamppb.New(timeNow().Add(s.queueRefreshDuration)),
-				QueuePosition: uint32(pos),
+				InvocationId:            invocationID,
+				NextPollTime:            timestamppb.New(now.Add(s.queueRefreshDuration)),
+				QueuePosition:           uint32(pos),
+				EstimatedAllocationTime: estimateAllocation(lics, invocationID),
 			},
 		},
 	}, nil
@@ -319,49 +719,70 @@ func (s *Service) Allocate(ctx context.Context, req *fpb.AllocateRequest) (retRe
 func (s *Service) Refresh(ctx context.Context, req *fpb.RefreshRequest) (retRes *fpb.RefreshResponse, retErr error) {
 	defer updateMetrics("Refresh", &retErr, time.Now())
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if leader, err := s.leader(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.Refresh(s.forwarding(ctx), req)
+	}
+
+	defer s.lockForUpdate()(&retErr)
 
 	invMsg := req.GetInvocation()
-	if len(invMsg.GetLicenses()) != 1 {
-		return nil, status.Errorf(codes.InvalidArgument, "licenses must have exactly one license spec")
-	}
-	licenseType := formatLicenseType(invMsg.GetLicenses()[0])
-	lic, ok := s.licenses[licenseType]
-	if !ok {
-		return nil, status.Errorf(codes.NotFound, "unknown license type: %q", licenseType)
+	lics, counts, err := s.licensesFor(invMsg)
+	if err != nil {
+		return nil, err
 	}
 	invID := invMsg.GetId()
 	if invID == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "invocation_id must be set")
 	}
-	inv := lic.GetAllocated(invID)
-	if inv == nil {
+	now := timeNow()
+	invs := getAllocated(lics, invID)
+	if invs == nil {
 		if s.currentState == stateRunning {
 			return nil, status.Errorf(codes.FailedPrecondition, "invocation_id not allocated: %q", invID)
 		}
-		// "Adopt" this invocation and allocate it a license, if possible.
+		// "Adopt" this invocation and allocate it all of its licenses, if
+		// possible.
 		inv := &invocation{
 			ID:          invID,
 			Owner:       invMsg.GetOwner(),
 			BuildTag:    invMsg.GetBuildTag(),
-			LastCheckin: timeNow(),
+			LastCheckin: now,
+			Licenses:    counts,
+			Preemptible: invMsg.GetPreemptible(),
+		}
+		for _, lic := range lics {
+			if lic.GetAllocated(invID) == nil && !lic.Fits(inv) {
+				return nil, status.Errorf(codes.ResourceExhausted, "%q has no available licenses", lic.name)
+			}
 		}
-		if ok := lic.Allocate(inv); ok {
-			return &fpb.RefreshResponse{
-				InvocationId:           invID,
-				LicenseRefreshDeadline: timestamppb.New(timeNow().Add(s.allocationRefreshDuration)),
-			}, nil
-		} else {
-			return nil, status.Errorf(codes.ResourceExhausted, "%q has no available licenses", licenseType)
+		for _, lic := range lics {
+			if allocated := lic.GetAllocated(invID); allocated != nil {
+				allocated.LastCheckin = now
+				continue
+			}
+			entry := *inv
+			lic.Allocate(&entry)
 		}
+		return &fpb.RefreshResponse{
+			InvocationId:           invID,
+			LicenseRefreshDeadline: timestamppb.New(now.Add(s.allocationRefreshDuration)),
+		}, nil
 	}
 	// Update the time and return the next check interval
-	inv.LastCheckin = timeNow()
-	return &fpb.RefreshResponse{
+	for _, inv := range invs {
+		inv.LastCheckin = now
+	}
+	res := &fpb.RefreshResponse{
 		InvocationId:           invID,
-		LicenseRefreshDeadline: timestamppb.New(timeNow().Add(s.allocationRefreshDuration)),
-	}, nil
+		LicenseRefreshDeadline: timestamppb.New(now.Add(s.allocationRefreshDuration)),
+	}
+	if invs[0].Preempted() {
+		res.PreemptionDeadline = timestamppb.New(invs[0].PreemptDeadline)
+	}
+	return res, nil
 }
 
 // Release returns an allocated license and/or unqueues the specified
@@ -370,8 +791,14 @@ func (s *Service) Refresh(ctx context.Context, req *fpb.RefreshRequest) (retRes
 func (s *Service) Release(ctx context.Context, req *fpb.ReleaseRequest) (retRes *fpb.ReleaseResponse, retErr error) {
 	defer updateMetrics("Release", &retErr, time.Now())
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if leader, err := s.leader(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.Release(s.forwarding(ctx), req)
+	}
+
+	defer s.lockForUpdate()(&retErr)
 
 	invID := req.GetInvocationId()
 	if invID == "" {
@@ -392,6 +819,13 @@ func (s *Service) Release(ctx context.Context, req *fpb.ReleaseRequest) (retRes
 func (s *Service) LicensesStatus(ctx context.Context, req *fpb.LicensesStatusRequest) (retRes *fpb.LicensesStatusResponse, retErr error) {
 	defer updateMetrics("LicensesStatus", &retErr, time.Now())
 
+	if leader, err := s.leader(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.LicensesStatus(s.forwarding(ctx), req)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
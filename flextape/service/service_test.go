@@ -11,6 +11,7 @@ import (
 	"github.com/enfabrica/enkit/lib/testutil"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/prashantv/gostub"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
@@ -18,6 +19,10 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// ignoreEstimates ignores the estimates cached by licenses when comparing
+// them, as they are tested separately.
+var ignoreEstimates = cmpopts.IgnoreFields(license{}, "estimates")
+
 // testService returns a preconfigured service, to shorten the testcase
 // descriptions.
 func testService(initialState state) *Service {
@@ -53,6 +58,19 @@ func (s *Service) withAllocation(licenseType string, inv *invocation) *Service {
 	return s
 }
 
+// withLicense is a helper method on a service to set it up with an additional
+// license type.
+func (s *Service) withLicense(licenseType string, total int) *Service {
+	s.licenses[licenseType] = &license{
+		name:           licenseType,
+		totalAvailable: total,
+		queue:          invocationQueue{},
+		allocations:    map[string]*invocation{},
+		prioritizer:    &FIFOPrioritizer{},
+	}
+	return s
+}
+
 // withQueued is a helper method on a service to set it up with a queued
 // invocation for a license.
 func (s *Service) withQueued(licenseType string, inv *invocation) *Service {
@@ -87,7 +105,7 @@ func TestAllocate(t *testing.T) {
 		wantLicenses map[string]*license
 	}{
 		{
-			desc:   "too many licenses",
+			desc:   "unknown license type among several",
 			server: testService(stateStarting),
 			req: &fpb.AllocateRequest{
 				Invocation: &fpb.Invocation{
@@ -100,8 +118,8 @@ func TestAllocate(t *testing.T) {
 					Id:       "",
 				},
 			},
-			wantErrCode: codes.InvalidArgument,
-			wantErr:     "exactly one license spec",
+			wantErrCode: codes.NotFound,
+			wantErr:     "unknown license type",
 			wantLicenses: map[string]*license{
 				"xilinx::feature_foo": &license{
 					name:           "xilinx::feature_foo",
@@ -432,13 +450,172 @@ func TestAllocate(t *testing.T) {
 					totalAvailable: 2,
 					queue:          invocationQueue{},
 					allocations: map[string]*invocation{
-						"1": &invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start},
+						"1": &invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start, AllocatedAt: start},
 						"2": &invocation{ID: "2", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
 					},
 					prioritizer: &FIFOPrioritizer{},
 				},
 			},
 		},
+		{
+			desc:   "error when more licenses requested than exist",
+			server: testService(stateRunning),
+			req: &fpb.AllocateRequest{
+				Invocation: &fpb.Invocation{
+					Licenses: []*fpb.License{
+						&fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+						&fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+						&fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+					},
+					Owner:    "unit_test",
+					BuildTag: "tag_1234",
+				},
+			},
+			wantErrCode: codes.InvalidArgument,
+			wantErr:     "only 2 exist",
+			wantLicenses: map[string]*license{
+				"xilinx::feature_foo": &license{
+					name:           "xilinx::feature_foo",
+					totalAvailable: 2,
+					queue:          invocationQueue{},
+					allocations:    map[string]*invocation{},
+					prioritizer:    &FIFOPrioritizer{},
+				},
+			},
+		},
+		{
+			desc:   "allocates all licenses of multiple types at once while running",
+			server: testService(stateRunning).withLicense("xilinx::feature_bar", 1),
+			req: &fpb.AllocateRequest{
+				Invocation: &fpb.Invocation{
+					Licenses: []*fpb.License{
+						&fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+						&fpb.License{Vendor: "xilinx", Feature: "feature_bar"},
+					},
+					Owner:    "unit_test",
+					BuildTag: "tag_1",
+				},
+			},
+			want: &fpb.AllocateResponse{
+				ResponseType: &fpb.AllocateResponse_LicenseAllocated{
+					LicenseAllocated: &fpb.LicenseAllocated{
+						InvocationId:           "1",
+						LicenseRefreshDeadline: timestamppb.New(start.Add(7 * time.Second)),
+					},
+				},
+			},
+			wantLicenses: map[string]*license{
+				"xilinx::feature_foo": &license{
+					name:           "xilinx::feature_foo",
+					totalAvailable: 2,
+					queue:          invocationQueue{},
+					allocations: map[string]*invocation{
+						"1": &invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start, AllocatedAt: start, Licenses: map[string]int{"xilinx::feature_foo": 1, "xilinx::feature_bar": 1}},
+					},
+					prioritizer: &FIFOPrioritizer{},
+				},
+				"xilinx::feature_bar": &license{
+					name:           "xilinx::feature_bar",
+					totalAvailable: 1,
+					queue:          invocationQueue{},
+					allocations: map[string]*invocation{
+						"1": &invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start, AllocatedAt: start, Licenses: map[string]int{"xilinx::feature_foo": 1, "xilinx::feature_bar": 1}},
+					},
+					prioritizer: &FIFOPrioritizer{},
+				},
+			},
+		},
+		{
+			desc: "queues for all licenses when one type is not available while running",
+			server: testService(stateRunning).withLicense("xilinx::feature_bar", 1).withAllocation("xilinx::feature_bar", &invocation{
+				ID:          "5",
+				Owner:       "unit_test",
+				BuildTag:    "tag_1",
+				LastCheckin: start,
+			}),
+			req: &fpb.AllocateRequest{
+				Invocation: &fpb.Invocation{
+					Licenses: []*fpb.License{
+						&fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+						&fpb.License{Vendor: "xilinx", Feature: "feature_bar"},
+					},
+					Owner:    "unit_test",
+					BuildTag: "tag_2",
+				},
+			},
+			want: &fpb.AllocateResponse{
+				ResponseType: &fpb.AllocateResponse_Queued{
+					Queued: &fpb.Queued{
+						InvocationId:  "1",
+						NextPollTime:  timestamppb.New(start.Add(5 * time.Second)),
+						QueuePosition: 1,
+					},
+				},
+			},
+			wantLicenses: map[string]*license{
+				"xilinx::feature_foo": &license{
+					name:           "xilinx::feature_foo",
+					totalAvailable: 2,
+					queue: invocationQueue{
+						&invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start, QueueID: 1, Licenses: map[string]int{"xilinx::feature_foo": 1, "xilinx::feature_bar": 1}},
+					},
+					allocations: map[string]*invocation{},
+					prioritizer: &FIFOPrioritizer{},
+				},
+				"xilinx::feature_bar": &license{
+					name:           "xilinx::feature_bar",
+					totalAvailable: 1,
+					queue: invocationQueue{
+						&invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start, QueueID: 1, Licenses: map[string]int{"xilinx::feature_foo": 1, "xilinx::feature_bar": 1}},
+					},
+					allocations: map[string]*invocation{
+						"5": &invocation{ID: "5", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
+					},
+					prioritizer: &FIFOPrioritizer{},
+				},
+			},
+		},
+		{
+			desc: "queues when not enough licenses of the same type are available while running",
+			server: testService(stateRunning).withAllocation("xilinx::feature_foo", &invocation{
+				ID:          "5",
+				Owner:       "unit_test",
+				BuildTag:    "tag_1",
+				LastCheckin: start,
+			}),
+			req: &fpb.AllocateRequest{
+				Invocation: &fpb.Invocation{
+					Licenses: []*fpb.License{
+						&fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+						&fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+					},
+					Owner:    "unit_test",
+					BuildTag: "tag_2",
+				},
+			},
+			want: &fpb.AllocateResponse{
+				ResponseType: &fpb.AllocateResponse_Queued{
+					Queued: &fpb.Queued{
+						InvocationId:  "1",
+						NextPollTime:  timestamppb.New(start.Add(5 * time.Second)),
+						QueuePosition: 1,
+					},
+				},
+			},
+			wantLicenses: map[string]*license{
+				"xilinx::feature_foo": &license{
+					name:           "xilinx::feature_foo",
+					totalAvailable: 2,
+					queue: invocationQueue{
+						&invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start, QueueID: 1, Licenses: map[string]int{"xilinx::feature_foo": 2}},
+					},
+					allocations: map[string]*invocation{
+						"5": &invocation{ID: "5", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
+					},
+					prioritizer: &FIFOPrioritizer{},
+				},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -452,7 +629,7 @@ func TestAllocate(t *testing.T) {
 
 			got, gotErr := tc.server.Allocate(ctx, tc.req)
 
-			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}))
+			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}, holdDurations{}), ignoreEstimates)
 			assert.Equal(t, tc.wantErrCode.String(), status.Code(gotErr).String())
 			errdiff.Check(t, gotErr, tc.wantErr)
 			if gotErr != nil {
@@ -502,7 +679,7 @@ func TestRefresh(t *testing.T) {
 			},
 		},
 		{
-			desc:   "error when multiple licenses specified",
+			desc:   "error when one of multiple licenses is unknown",
 			server: testService(stateStarting),
 			req: &fpb.RefreshRequest{
 				Invocation: &fpb.Invocation{
@@ -515,8 +692,8 @@ func TestRefresh(t *testing.T) {
 					BuildTag: "tag_2",
 				},
 			},
-			wantErrCode: codes.InvalidArgument,
-			wantErr:     "exactly one license spec",
+			wantErrCode: codes.NotFound,
+			wantErr:     "unknown license type",
 			wantLicenses: map[string]*license{
 				"xilinx::feature_foo": &license{
 					name:           "xilinx::feature_foo",
@@ -550,7 +727,7 @@ func TestRefresh(t *testing.T) {
 					totalAvailable: 2,
 					queue:          invocationQueue{},
 					allocations: map[string]*invocation{
-						"1": &invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start},
+						"1": &invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start, AllocatedAt: start},
 					},
 					prioritizer: &FIFOPrioritizer{},
 				},
@@ -687,6 +864,85 @@ func TestRefresh(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc:   "allocates all licenses when invocation_id not found during starting state",
+			server: testService(stateStarting).withLicense("xilinx::feature_bar", 1),
+			req: &fpb.RefreshRequest{
+				Invocation: &fpb.Invocation{
+					Id: "1",
+					Licenses: []*fpb.License{
+						&fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+						&fpb.License{Vendor: "xilinx", Feature: "feature_bar"},
+					},
+					Owner:    "unit_test",
+					BuildTag: "tag_2",
+				},
+			},
+			want: &fpb.RefreshResponse{
+				InvocationId:           "1",
+				LicenseRefreshDeadline: timestamppb.New(start.Add(7 * time.Second)),
+			},
+			wantLicenses: map[string]*license{
+				"xilinx::feature_foo": &license{
+					name:           "xilinx::feature_foo",
+					totalAvailable: 2,
+					queue:          invocationQueue{},
+					allocations: map[string]*invocation{
+						"1": &invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start, AllocatedAt: start, Licenses: map[string]int{"xilinx::feature_foo": 1, "xilinx::feature_bar": 1}},
+					},
+					prioritizer: &FIFOPrioritizer{},
+				},
+				"xilinx::feature_bar": &license{
+					name:           "xilinx::feature_bar",
+					totalAvailable: 1,
+					queue:          invocationQueue{},
+					allocations: map[string]*invocation{
+						"1": &invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start, AllocatedAt: start, Licenses: map[string]int{"xilinx::feature_foo": 1, "xilinx::feature_bar": 1}},
+					},
+					prioritizer: &FIFOPrioritizer{},
+				},
+			},
+		},
+		{
+			desc: "allocates no license when one type is not available during starting state",
+			server: testService(stateStarting).withLicense("xilinx::feature_bar", 1).withAllocation("xilinx::feature_bar", &invocation{
+				ID:          "5",
+				Owner:       "unit_test",
+				BuildTag:    "tag_1",
+				LastCheckin: start,
+			}),
+			req: &fpb.RefreshRequest{
+				Invocation: &fpb.Invocation{
+					Id: "1",
+					Licenses: []*fpb.License{
+						&fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+						&fpb.License{Vendor: "xilinx", Feature: "feature_bar"},
+					},
+					Owner:    "unit_test",
+					BuildTag: "tag_2",
+				},
+			},
+			wantErrCode: codes.ResourceExhausted,
+			wantErr:     "no available licenses",
+			wantLicenses: map[string]*license{
+				"xilinx::feature_foo": &license{
+					name:           "xilinx::feature_foo",
+					totalAvailable: 2,
+					queue:          invocationQueue{},
+					allocations:    map[string]*invocation{},
+					prioritizer:    &FIFOPrioritizer{},
+				},
+				"xilinx::feature_bar": &license{
+					name:           "xilinx::feature_bar",
+					totalAvailable: 1,
+					queue:          invocationQueue{},
+					allocations: map[string]*invocation{
+						"5": &invocation{ID: "5", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
+					},
+					prioritizer: &FIFOPrioritizer{},
+				},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -700,7 +956,7 @@ func TestRefresh(t *testing.T) {
 
 			got, gotErr := tc.server.Refresh(ctx, tc.req)
 
-			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}))
+			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}, holdDurations{}), ignoreEstimates)
 			assert.Equal(t, tc.wantErrCode.String(), status.Code(gotErr).String())
 			errdiff.Check(t, gotErr, tc.wantErr)
 			if gotErr != nil {
@@ -844,7 +1100,7 @@ func TestRelease(t *testing.T) {
 
 			got, gotErr := tc.server.Release(ctx, tc.req)
 
-			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}))
+			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}, holdDurations{}), ignoreEstimates)
 			assert.Equal(t, tc.wantErrCode.String(), status.Code(gotErr).String())
 			errdiff.Check(t, gotErr, tc.wantErr)
 			if gotErr != nil {
@@ -946,7 +1202,7 @@ func TestLicensesStatus(t *testing.T) {
 
 			got, gotErr := tc.server.LicensesStatus(ctx, tc.req)
 
-			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}))
+			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}, holdDurations{}), ignoreEstimates)
 			assert.Equal(t, tc.wantErrCode.String(), status.Code(gotErr).String())
 			errdiff.Check(t, gotErr, tc.wantErr)
 			if gotErr != nil {
@@ -1099,7 +1355,7 @@ func TestJanitor(t *testing.T) {
 					queue:          invocationQueue{},
 					allocations: map[string]*invocation{
 						"5": &invocation{ID: "5", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
-						"3": &invocation{ID: "3", Owner: "unit_test", BuildTag: "tag_3", LastCheckin: start},
+						"3": &invocation{ID: "3", Owner: "unit_test", BuildTag: "tag_3", LastCheckin: start, AllocatedAt: start},
 					},
 					prioritizer: &FIFOPrioritizer{},
 				},
@@ -1118,7 +1374,7 @@ func TestJanitor(t *testing.T) {
 			*now = tc.endTime
 			tc.server.janitor()
 
-			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}))
+			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}, holdDurations{}), ignoreEstimates)
 		})
 	}
 }
@@ -1432,7 +1688,7 @@ func TestPrioritizerBasic(t *testing.T) {
 					totalAvailable: 2,
 					queue:          invocationQueue{},
 					allocations: map[string]*invocation{
-						"1": &invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start},
+						"1": &invocation{ID: "1", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start, AllocatedAt: start},
 						"2": &invocation{ID: "2", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
 					},
 					prioritizer: &EvenOwnersPrioritizer{position: map[string]uint64{}, enqueued: map[string]uint64{}, dequeued: map[string]uint64{}, allocated: map[string]uint64{"unit_test": 1}},
@@ -1452,7 +1708,7 @@ func TestPrioritizerBasic(t *testing.T) {
 
 			got, gotErr := tc.server.Allocate(ctx, tc.req)
 
-			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}, EvenOwnersPrioritizer{}))
+			testutil.AssertCmp(t, tc.server.licenses, tc.wantLicenses, cmp.AllowUnexported(invocation{}, license{}, holdDurations{}, EvenOwnersPrioritizer{}), ignoreEstimates)
 			assert.Equal(t, tc.wantErrCode.String(), status.Code(gotErr).String())
 			errdiff.Check(t, gotErr, tc.wantErr)
 			if gotErr != nil {
@@ -1607,6 +1863,298 @@ func TestPrioritization(t *testing.T) {
 	assert.True(t, converted, "%+v", resp.ResponseType)
 }
 
+func TestMultipleLicenses(t *testing.T) {
+	start := time.Now()
+	currentTime := start
+	now := &currentTime
+
+	idGen := &fakeID{}
+	stubs := gostub.Stub(&generateRandomID, idGen.Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return *now
+	})
+	defer stubs.Reset()
+
+	server := &Service{
+		currentState: stateRunning,
+		licenses: licensesFromConfig(&fpb.Config{
+			LicenseConfigs: []*fpb.LicenseConfig{
+				&fpb.LicenseConfig{Quantity: 1, License: &fpb.License{Vendor: "xilinx", Feature: "compiler"}},
+				&fpb.LicenseConfig{Quantity: 1, License: &fpb.License{Vendor: "xilinx", Feature: "simulator"}},
+			},
+		}),
+		queueRefreshDuration:      5 * time.Second,
+		allocationRefreshDuration: 7 * time.Second,
+	}
+	ctx := context.Background()
+
+	compiler := &fpb.License{Vendor: "xilinx", Feature: "compiler"}
+	simulator := &fpb.License{Vendor: "xilinx", Feature: "simulator"}
+	allocate := func(id string, licenses ...*fpb.License) *fpb.AllocateResponse {
+		resp, err := server.Allocate(ctx, &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+			Id:       id,
+			Owner:    "unit_test",
+			BuildTag: "tag",
+			Licenses: licenses,
+		}})
+		assert.NoError(t, err)
+		return resp
+	}
+
+	// The first invocation takes the compiler.
+	resp := allocate("", compiler)
+	assert.Equal(t, "1", resp.GetLicenseAllocated().GetInvocationId())
+
+	// The second needs both, and must wait without holding the simulator.
+	resp = allocate("", simulator, compiler)
+	assert.Equal(t, uint32(1), resp.GetQueued().GetQueuePosition())
+
+	// The simulator is free, but reserved to the invocation ahead in the queue.
+	resp = allocate("", simulator)
+	assert.Equal(t, uint32(2), resp.GetQueued().GetQueuePosition())
+
+	res, err := server.LicensesStatus(ctx, &fpb.LicensesStatusRequest{})
+	assert.NoError(t, err)
+	for _, stats := range res.GetLicenseStats() {
+		if stats.GetLicense().GetFeature() == "simulator" {
+			assert.Equal(t, uint32(0), stats.GetAllocatedCount())
+		}
+	}
+
+	// Once the compiler is released, both licenses are allocated at once.
+	_, err = server.Release(ctx, &fpb.ReleaseRequest{InvocationId: "1"})
+	assert.NoError(t, err)
+	server.janitor()
+	resp = allocate("2", compiler, simulator)
+	assert.NotNil(t, resp.GetLicenseAllocated(), "%+v", resp.ResponseType)
+	resp = allocate("3", simulator)
+	assert.Equal(t, uint32(1), resp.GetQueued().GetQueuePosition())
+
+	// Releasing the invocation returns all of its licenses.
+	_, err = server.Release(ctx, &fpb.ReleaseRequest{InvocationId: "2"})
+	assert.NoError(t, err)
+	server.janitor()
+	resp = allocate("3", simulator)
+	assert.NotNil(t, resp.GetLicenseAllocated(), "%+v", resp.ResponseType)
+	resp = allocate("", compiler)
+	assert.NotNil(t, resp.GetLicenseAllocated(), "%+v", resp.ResponseType)
+}
+
+func TestPriorityClasses(t *testing.T) {
+	start := time.Now()
+	currentTime := start
+	now := &currentTime
+
+	idGen := &fakeID{}
+	stubs := gostub.Stub(&generateRandomID, idGen.Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return *now
+	})
+	defer stubs.Reset()
+
+	server := &Service{
+		currentState: stateRunning,
+		licenses: licensesFromConfig(&fpb.Config{
+			LicenseConfigs: []*fpb.LicenseConfig{&fpb.LicenseConfig{
+				Quantity: 4,
+				License:  &fpb.License{Vendor: "xilinx", Feature: "foo"},
+				Prioritizer: &fpb.LicenseConfig_PriorityClasses{PriorityClasses: &fpb.PriorityClassesPrioritizer{
+					Groups: []*fpb.OwnerGroup{
+						&fpb.OwnerGroup{Name: "release", OwnerPrefixes: []string{"ci-release"}, Priority: 10, Reserved: 1},
+						&fpb.OwnerGroup{Name: "interactive", Owners: []string{"alice", "bob"}, MaxAllocated: 2},
+					},
+				}},
+			}},
+		}),
+		queueRefreshDuration:      5 * time.Second,
+		allocationRefreshDuration: 7 * time.Second,
+	}
+	ctx := context.Background()
+
+	allocate := func(owner, id string) *fpb.AllocateResponse {
+		resp, err := server.Allocate(ctx, &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+			Id:       id,
+			Owner:    owner,
+			BuildTag: "tag",
+			Licenses: []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "foo"}},
+		}})
+		assert.NoError(t, err)
+		return resp
+	}
+	release := func(id string) {
+		_, err := server.Release(ctx, &fpb.ReleaseRequest{InvocationId: id})
+		assert.NoError(t, err)
+		server.janitor()
+	}
+
+	// Interactive users get at most 2 licenses.
+	assert.NotNil(t, allocate("alice", "").GetLicenseAllocated())
+	assert.NotNil(t, allocate("bob", "").GetLicenseAllocated())
+	resp := allocate("alice", "")
+	assert.Equal(t, uint32(1), resp.GetQueued().GetQueuePosition())
+	alice := resp.GetQueued().GetInvocationId()
+
+	// The last free license is reserved to release builds.
+	assert.NotNil(t, allocate("carol", "").GetLicenseAllocated())
+	resp = allocate("dave", "")
+	dave := resp.GetQueued().GetInvocationId()
+	assert.Equal(t, uint32(1), resp.GetQueued().GetQueuePosition())
+	// Alice cannot get a license before her group releases one, so she is behind Dave.
+	assert.Equal(t, uint32(2), allocate("alice", alice).GetQueued().GetQueuePosition())
+
+	assert.NotNil(t, allocate("ci-release-1", "").GetLicenseAllocated())
+	resp = allocate("ci-release-2", "")
+	release2 := resp.GetQueued().GetInvocationId()
+	// Release builds have higher priority.
+	assert.Equal(t, uint32(1), resp.GetQueued().GetQueuePosition())
+	assert.Equal(t, uint32(2), allocate("dave", dave).GetQueued().GetQueuePosition())
+	assert.Equal(t, uint32(3), allocate("alice", alice).GetQueued().GetQueuePosition())
+
+	// Carol is done, the release build goes first.
+	release("4")
+	assert.NotNil(t, allocate("ci-release-2", release2).GetLicenseAllocated())
+	assert.Equal(t, uint32(1), allocate("dave", dave).GetQueued().GetQueuePosition())
+	assert.Equal(t, uint32(2), allocate("alice", alice).GetQueued().GetQueuePosition())
+
+	// Bob is done: now that interactive users are below their maximum,
+	// Alice is served in the order she queued, before Dave.
+	release("2")
+	assert.NotNil(t, allocate("alice", alice).GetLicenseAllocated())
+	assert.Equal(t, uint32(1), allocate("dave", dave).GetQueued().GetQueuePosition())
+}
+
+func TestPriorityClassesGroups(t *testing.T) {
+	pc := NewPriorityClassesPrioritizer("xilinx::foo", 4, &fpb.PriorityClassesPrioritizer{
+		Groups: []*fpb.OwnerGroup{
+			&fpb.OwnerGroup{Name: "ci", OwnerPrefixes: []string{"ci-"}},
+			&fpb.OwnerGroup{Name: "release", OwnerPrefixes: []string{"ci-release-"}, Owners: []string{"bob"}},
+			&fpb.OwnerGroup{Name: "frontend", Owners: []string{"ci-frontend"}},
+		},
+	})
+	for owner, want := range map[string]string{
+		"ci-nightly":    "ci",
+		"ci-release-12": "release",
+		"bob":           "release",
+		"ci-frontend":   "frontend",
+		"alice":         "",
+	} {
+		assert.Equal(t, want, pc.group(owner).name, "owner %s", owner)
+	}
+
+	err := checkLicenseConfigs(&fpb.Config{LicenseConfigs: []*fpb.LicenseConfig{&fpb.LicenseConfig{
+		Quantity: 2,
+		License:  &fpb.License{Vendor: "xilinx", Feature: "foo"},
+		Prioritizer: &fpb.LicenseConfig_PriorityClasses{PriorityClasses: &fpb.PriorityClassesPrioritizer{
+			Groups: []*fpb.OwnerGroup{
+				&fpb.OwnerGroup{Name: "release", Reserved: 2},
+				&fpb.OwnerGroup{Name: "nightly", Reserved: 1},
+			},
+		}},
+	}}})
+	errdiff.Check(t, err, "3 licenses reserved")
+}
+
+func TestPreemption(t *testing.T) {
+	start := time.Now()
+	currentTime := start
+	now := &currentTime
+
+	idGen := &fakeID{}
+	stubs := gostub.Stub(&generateRandomID, idGen.Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return *now
+	})
+	defer stubs.Reset()
+
+	server := &Service{
+		currentState: stateRunning,
+		licenses: licensesFromConfig(&fpb.Config{
+			LicenseConfigs: []*fpb.LicenseConfig{&fpb.LicenseConfig{
+				Quantity: 4,
+				License:  &fpb.License{Vendor: "xilinx", Feature: "foo"},
+				Prioritizer: &fpb.LicenseConfig_PriorityClasses{PriorityClasses: &fpb.PriorityClassesPrioritizer{
+					Groups: []*fpb.OwnerGroup{
+						&fpb.OwnerGroup{Name: "release", OwnerPrefixes: []string{"ci-release"}, Priority: 10},
+						&fpb.OwnerGroup{Name: "nightly", OwnerPrefixes: []string{"ci-nightly"}, Priority: -1, Reserved: 1},
+					},
+					Preemption: &fpb.Preemption{GracePeriodSeconds: 30},
+				}},
+			}},
+		}),
+		queueRefreshDuration:      60 * time.Second,
+		allocationRefreshDuration: 60 * time.Second,
+	}
+	ctx := context.Background()
+
+	licenses := []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "foo"}}
+	allocate := func(owner, id string, preemptible bool) *fpb.AllocateResponse {
+		resp, err := server.Allocate(ctx, &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+			Id:          id,
+			Owner:       owner,
+			BuildTag:    "tag",
+			Licenses:    licenses,
+			Preemptible: preemptible,
+		}})
+		assert.NoError(t, err)
+		return resp
+	}
+	refresh := func(owner, id string) (*fpb.RefreshResponse, error) {
+		return server.Refresh(ctx, &fpb.RefreshRequest{Invocation: &fpb.Invocation{
+			Id:          id,
+			Owner:       owner,
+			BuildTag:    "tag",
+			Licenses:    licenses,
+			Preemptible: true,
+		}})
+	}
+	deadline := func(owner, id string) *timestamppb.Timestamp {
+		resp, err := refresh(owner, id)
+		assert.NoError(t, err)
+		return resp.GetPreemptionDeadline()
+	}
+
+	assert.NotNil(t, allocate("alice", "", false).GetLicenseAllocated())
+	assert.NotNil(t, allocate("carol", "", true).GetLicenseAllocated())
+	assert.NotNil(t, allocate("ci-nightly-a", "", true).GetLicenseAllocated())
+	assert.NotNil(t, allocate("ci-nightly-b", "", true).GetLicenseAllocated())
+
+	// The nightly build with the lowest priority is preempted first.
+	release1 := allocate("ci-release-1", "", false).GetQueued().GetInvocationId()
+	server.janitor()
+	assert.Equal(t, timestamppb.New(start.Add(30*time.Second)), deadline("ci-nightly-a", "3"))
+	assert.Nil(t, deadline("ci-nightly-b", "4"))
+
+	// The other nightly build keeps the license reserved to its group, and
+	// Alice's invocation is not preemptible.
+	*now = start.Add(10 * time.Second)
+	release2 := allocate("ci-release-2", "", false).GetQueued().GetInvocationId()
+	server.janitor()
+	assert.Equal(t, timestamppb.New(start.Add(40*time.Second)), deadline("carol", "2"))
+	assert.Nil(t, deadline("ci-nightly-b", "4"))
+	assert.Nil(t, deadline("alice", "1"))
+
+	// Invocations with the same priority are never preempted.
+	bob := allocate("bob", "", false).GetQueued().GetInvocationId()
+	server.janitor()
+	assert.Nil(t, deadline("ci-nightly-b", "4"))
+	assert.Nil(t, deadline("alice", "1"))
+
+	// Carol releases her license before the deadline.
+	_, err := server.Release(ctx, &fpb.ReleaseRequest{InvocationId: "2"})
+	assert.NoError(t, err)
+	server.janitor()
+	assert.NotNil(t, allocate("ci-release-1", release1, false).GetLicenseAllocated())
+	assert.Equal(t, uint32(1), allocate("ci-release-2", release2, false).GetQueued().GetQueuePosition())
+
+	// The license of the nightly build is revoked after its deadline.
+	*now = start.Add(30 * time.Second)
+	server.janitor()
+	assert.NotNil(t, allocate("ci-release-2", release2, false).GetLicenseAllocated())
+	assert.Equal(t, uint32(1), allocate("bob", bob, false).GetQueued().GetQueuePosition())
+	_, err = refresh("ci-nightly-a", "3")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
 func TestLicensesFromConfig(t *testing.T) {
 	testCases := []struct {
 		desc         string
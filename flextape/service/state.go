@@ -0,0 +1,293 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	metricStateSaveCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "flextape",
+		Name:      "state_save_count",
+		Help:      "Number of attempts to persist the state, by result",
+	},
+		[]string{
+			"result",
+		},
+	)
+)
+
+// Store persists snapshots of the queues and allocations, so that they can be
+// restored when the service restarts.
+//
+// Stores are invoked by a single goroutine at a time, without the Service lock
+// held.
+type Store interface {
+	// Save persists the supplied snapshot, replacing any previous one.
+	Save(snap *Snapshot) error
+	// Load returns the last snapshot saved, or nil if there is none.
+	Load() (*Snapshot, error)
+}
+
+// Snapshot is the state of all license types at a point in time.
+type Snapshot struct {
+	Licenses     []*LicenseSnapshot
+	Reservations []*ReservationSnapshot `json:",omitempty"` // Sorted by ID
+}
+
+// LicenseSnapshot is the state of a single license type.
+type LicenseSnapshot struct {
+	Name      string                // Name of the license, in vendor::feature format
+	Allocated []*InvocationSnapshot // Invocations allocated a license, sorted by ID
+	Queued    []*InvocationSnapshot // Invocations waiting for a license, in queue order
+}
+
+// InvocationSnapshot is an invocation queued or allocated for a license type.
+//
+// The time of the last checkin is not part of the snapshot: it changes at
+// every poll, and clients are given a full refresh period to check in after
+// the state is restored.
+type InvocationSnapshot struct {
+	ID       string
+	Owner    string
+	BuildTag string
+	Licenses map[string]int `json:",omitempty"` // See invocation.Licenses
+
+	Preemptible     bool      `json:",omitempty"`
+	PreemptDeadline time.Time `json:",omitzero"` // Zero if not preempted
+	AllocatedAt     time.Time `json:",omitzero"` // Zero if queued
+}
+
+// ReservationSnapshot is a reservation not ended yet.
+type ReservationSnapshot struct {
+	ID          string
+	Owner       string
+	LicenseType string
+	Count       int
+	Start       time.Time
+	End         time.Time
+	Description string `json:",omitempty"`
+}
+
+func snapshotInvocation(inv *invocation) *InvocationSnapshot {
+	return &InvocationSnapshot{
+		ID:       inv.ID,
+		Owner:    inv.Owner,
+		BuildTag: inv.BuildTag,
+		Licenses: inv.Licenses,
+
+		Preemptible:     inv.Preemptible,
+		PreemptDeadline: inv.PreemptDeadline,
+		AllocatedAt:     inv.AllocatedAt,
+	}
+}
+
+// snapshot returns the current state of all license types, sorted by name.
+func (s *Service) snapshot() *Snapshot {
+	snap := &Snapshot{}
+	for _, lic := range s.licenses {
+		ls := &LicenseSnapshot{Name: lic.name}
+		for _, inv := range lic.allocations {
+			ls.Allocated = append(ls.Allocated, snapshotInvocation(inv))
+		}
+		sort.Slice(ls.Allocated, func(i, j int) bool { return ls.Allocated[i].ID < ls.Allocated[j].ID })
+		lic.queue.Walk(func(pos Position, inv *invocation) bool {
+			ls.Queued = append(ls.Queued, snapshotInvocation(inv))
+			return true
+		})
+		snap.Licenses = append(snap.Licenses, ls)
+	}
+	sort.Slice(snap.Licenses, func(i, j int) bool { return snap.Licenses[i].Name < snap.Licenses[j].Name })
+	for _, r := range s.reservations {
+		snap.Reservations = append(snap.Reservations, &ReservationSnapshot{
+			ID:          r.ID,
+			Owner:       r.Owner,
+			LicenseType: r.LicenseType,
+			Count:       r.Count,
+			Start:       r.Start,
+			End:         r.End,
+			Description: r.Description,
+		})
+	}
+	sort.Slice(snap.Reservations, func(i, j int) bool { return snap.Reservations[i].ID < snap.Reservations[j].ID })
+	return snap
+}
+
+// restore adds the queues and allocations in the snapshot to the licenses,
+// and the reservations to the service.
+//
+// License types no longer configured are ignored, as are invocations needing
+// any of them, so no invocation is restored with only part of its licenses.
+// Allocations are restored even if the number of licenses configured was
+// reduced in the meantime.
+func (s *Service) restore(snap *Snapshot) {
+	known := func(is *InvocationSnapshot) bool {
+		for licenseType := range is.Licenses {
+			if _, ok := s.licenses[licenseType]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	newInvocation := func(is *InvocationSnapshot) *invocation {
+		return &invocation{
+			ID:          is.ID,
+			Owner:       is.Owner,
+			BuildTag:    is.BuildTag,
+			LastCheckin: timeNow(),
+			Licenses:    is.Licenses,
+
+			Preemptible:     is.Preemptible,
+			PreemptDeadline: is.PreemptDeadline,
+			AllocatedAt:     is.AllocatedAt,
+		}
+	}
+
+	for _, ls := range snap.Licenses {
+		lic, ok := s.licenses[ls.Name]
+		if !ok {
+			continue
+		}
+		for _, is := range ls.Allocated {
+			if !known(is) {
+				continue
+			}
+			inv := newInvocation(is)
+			lic.prioritizer.OnAllocate(inv)
+			lic.allocations[inv.ID] = inv
+		}
+		for _, is := range ls.Queued {
+			if !known(is) {
+				continue
+			}
+			lic.Enqueue(newInvocation(is))
+		}
+		lic.updateMetrics()
+	}
+
+	if s.reservations == nil {
+		s.reservations = map[string]*reservation{}
+	}
+	for _, rs := range snap.Reservations {
+		s.reservations[rs.ID] = &reservation{
+			ID:          rs.ID,
+			Owner:       rs.Owner,
+			LicenseType: rs.LicenseType,
+			Count:       rs.Count,
+			Start:       rs.Start,
+			End:         rs.End,
+			Description: rs.Description,
+		}
+	}
+}
+
+// saveBatch is a snapshot queued to be persisted, and the result of
+// persisting it.
+type saveBatch struct {
+	snap *Snapshot
+	done chan struct{} // Closed once the snapshot was persisted, or failed to be.
+	err  error
+}
+
+func (b *saveBatch) wait() error {
+	<-b.done
+	return b.err
+}
+
+func noWait() error {
+	return nil
+}
+
+// save queues the current state to be persisted, if it changed since it was
+// last persisted, and returns the function waiting for it to be.
+//
+// Snapshots are persisted by a single writer, started as needed, without the
+// lock held. Snapshots queued while the writer is busy are coalesced: only the
+// last one is persisted, and all the callers that queued them get its result.
+func (s *Service) save() func() error {
+	if s.store == nil || s.currentState == stateFollowing {
+		return noWait
+	}
+	snap := s.snapshot()
+	if reflect.DeepEqual(snap, s.saved) {
+		return noWait
+	}
+	if s.pending == nil && s.saving != nil && reflect.DeepEqual(snap, s.saving.snap) {
+		return s.saving.wait
+	}
+	if s.pending == nil {
+		s.pending = &saveBatch{done: make(chan struct{})}
+	}
+	s.pending.snap = snap
+	wait := s.pending.wait
+	if s.saving == nil {
+		s.saving, s.pending = s.pending, nil
+		go s.write(s.store, s.saving)
+	}
+	return wait
+}
+
+// write persists the batch, then the batches queued in the meantime, until
+// none is left.
+//
+// Failures are logged: the state is kept in memory, and persisted again at the
+// next change. A replica that lost its lease stops leading right away.
+func (s *Service) write(store Store, b *saveBatch) {
+	for b != nil {
+		err := store.Save(b.snap)
+
+		s.mu.Lock()
+		if err != nil {
+			metricStateSaveCount.WithLabelValues("error").Inc()
+			log.Printf("failed to save state: %v", err)
+			if errors.Is(err, ErrNotLeader) && s.currentState != stateFollowing {
+				s.follow()
+			}
+		} else {
+			metricStateSaveCount.WithLabelValues("ok").Inc()
+			s.saved = b.snap
+		}
+		b.err = err
+		close(b.done)
+		b = s.pending
+		s.saving, s.pending = b, nil
+		s.mu.Unlock()
+	}
+}
+
+// cancelSave fails the snapshot waiting to be persisted, if any, with err.
+// The snapshot being persisted, if any, is not affected.
+func (s *Service) cancelSave(err error) {
+	if s.pending == nil {
+		return
+	}
+	s.pending.err = err
+	close(s.pending.done)
+	s.pending = nil
+}
+
+// lockForUpdate locks the service to change its state, and returns the
+// function to unlock it with once done.
+//
+// Unlocking queues the state to be saved, and waits for it to be saved with
+// the lock released. If it cannot be saved, the error pointed to by err is
+// replaced with an Unavailable error, so clients are never told of a change
+// that would be lost if the service restarted, or another replica took over.
+func (s *Service) lockForUpdate() func(err *error) {
+	s.mu.Lock()
+	return func(err *error) {
+		wait := s.save()
+		s.mu.Unlock()
+		if saveErr := wait(); saveErr != nil && *err == nil {
+			*err = status.Errorf(codes.Unavailable, "failed to save state, retry later: %v", saveErr)
+		}
+	}
+}
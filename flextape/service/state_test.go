@@ -0,0 +1,342 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fpb "github.com/enfabrica/enkit/flextape/proto"
+	"github.com/enfabrica/enkit/lib/testutil"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLogStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.log")
+	snap := func(id string) *Snapshot {
+		return &Snapshot{Licenses: []*LicenseSnapshot{{
+			Name:      "xilinx::feature_foo",
+			Allocated: []*InvocationSnapshot{{ID: id, Owner: "unit_test", BuildTag: "tag_1"}},
+		}}}
+	}
+
+	store := NewLogStore(path)
+	got, err := store.Load()
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	for _, id := range []string{"1", "2", "3"} {
+		require.NoError(t, store.Save(snap(id)))
+	}
+	require.NoError(t, store.Close())
+	got, err = NewLogStore(path).Load()
+	require.NoError(t, err)
+	assert.Equal(t, snap("3"), got)
+
+	// A record interrupted while being written is discarded.
+	store = NewLogStore(path)
+	_, err = store.Load()
+	require.NoError(t, err)
+	require.NoError(t, store.Save(snap("4")))
+	require.NoError(t, store.Close())
+	record := encodeRecord([]byte(`{"Licenses":[]}`))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write(record[:len(record)-3])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	store = NewLogStore(path)
+	got, err = store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, snap("4"), got)
+	// And the next records are appended after the last complete one.
+	require.NoError(t, store.Save(snap("5")))
+	require.NoError(t, store.Close())
+	got, err = NewLogStore(path).Load()
+	require.NoError(t, err)
+	assert.Equal(t, snap("5"), got)
+
+	// A corrupted record is discarded as well.
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	got, err = NewLogStore(path).Load()
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	// Once too large, the log is compacted to the last snapshot.
+	store = NewLogStore(path)
+	store.maxSize = 200
+	for _, id := range []string{"6", "7", "8", "9"} {
+		require.NoError(t, store.Save(snap(id)))
+	}
+	require.NoError(t, store.Close())
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(200))
+	got, err = NewLogStore(path).Load()
+	require.NoError(t, err)
+	assert.Equal(t, snap("9"), got)
+}
+
+// memoryStore is a Store keeping the snapshots in memory.
+type memoryStore struct {
+	saved []*Snapshot
+	err   error // Returned by Save, if set.
+}
+
+func (m *memoryStore) Save(snap *Snapshot) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.saved = append(m.saved, snap)
+	return nil
+}
+
+func (m *memoryStore) Load() (*Snapshot, error) {
+	if len(m.saved) == 0 {
+		return nil, nil
+	}
+	return m.saved[len(m.saved)-1], nil
+}
+
+// blockingStore is a memoryStore whose Save blocks until unblock is closed.
+type blockingStore struct {
+	memoryStore
+	started chan struct{} // Receives a value every time Save is invoked.
+	unblock chan struct{}
+}
+
+func (b *blockingStore) Save(snap *Snapshot) error {
+	b.started <- struct{}{}
+	<-b.unblock
+	return b.memoryStore.Save(snap)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	start := time.Now()
+	stubs := gostub.Stub(&timeNow, func() time.Time {
+		return start
+	})
+	defer stubs.Reset()
+
+	both := map[string]int{"xilinx::feature_foo": 1, "xilinx::feature_bar": 1}
+	server := testService(stateRunning).withLicense("xilinx::feature_bar", 1).withAllocation("xilinx::feature_foo", &invocation{
+		ID:          "5",
+		Owner:       "unit_test",
+		BuildTag:    "tag_1",
+		LastCheckin: start.Add(-3 * time.Second),
+	}).withAllocation("xilinx::feature_bar", &invocation{
+		ID:          "6",
+		Owner:       "unit_test",
+		BuildTag:    "tag_2",
+		LastCheckin: start,
+	}).withQueued("xilinx::feature_foo", &invocation{
+		ID:          "7",
+		Owner:       "unit_test",
+		BuildTag:    "tag_3",
+		LastCheckin: start,
+		Licenses:    both,
+	}).withQueued("xilinx::feature_bar", &invocation{
+		ID:          "7",
+		Owner:       "unit_test",
+		BuildTag:    "tag_3",
+		LastCheckin: start,
+		Licenses:    both,
+	}).withQueued("xilinx::feature_foo", &invocation{
+		ID:          "8",
+		Owner:       "unit_test",
+		BuildTag:    "tag_4",
+		LastCheckin: start,
+	})
+
+	store := &memoryStore{}
+	server.store = store
+	require.NoError(t, server.save()())
+	require.NoError(t, server.save()())
+	require.Len(t, store.saved, 1, "unchanged state saved again")
+
+	restored := testService(stateRunning).withLicense("xilinx::feature_bar", 1)
+	restored.restore(store.saved[0])
+	wantLicenses := map[string]*license{
+		"xilinx::feature_foo": &license{
+			name:           "xilinx::feature_foo",
+			totalAvailable: 2,
+			queue: invocationQueue{
+				&invocation{ID: "7", Owner: "unit_test", BuildTag: "tag_3", LastCheckin: start, QueueID: 1, Licenses: both},
+				&invocation{ID: "8", Owner: "unit_test", BuildTag: "tag_4", LastCheckin: start, QueueID: 2},
+			},
+			allocations: map[string]*invocation{
+				"5": &invocation{ID: "5", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
+			},
+			prioritizer: &FIFOPrioritizer{},
+		},
+		"xilinx::feature_bar": &license{
+			name:           "xilinx::feature_bar",
+			totalAvailable: 1,
+			queue: invocationQueue{
+				&invocation{ID: "7", Owner: "unit_test", BuildTag: "tag_3", LastCheckin: start, QueueID: 1, Licenses: both},
+			},
+			allocations: map[string]*invocation{
+				"6": &invocation{ID: "6", Owner: "unit_test", BuildTag: "tag_2", LastCheckin: start},
+			},
+			prioritizer: &FIFOPrioritizer{},
+		},
+	}
+	testutil.AssertCmp(t, restored.licenses, wantLicenses, cmp.AllowUnexported(invocation{}, license{}, holdDurations{}), ignoreEstimates)
+
+	// Invocations needing a license type no longer configured are dropped.
+	restored = testService(stateRunning)
+	restored.restore(store.saved[0])
+	wantLicenses = map[string]*license{
+		"xilinx::feature_foo": &license{
+			name:           "xilinx::feature_foo",
+			totalAvailable: 2,
+			queue: invocationQueue{
+				&invocation{ID: "8", Owner: "unit_test", BuildTag: "tag_4", LastCheckin: start, QueueID: 1},
+			},
+			allocations: map[string]*invocation{
+				"5": &invocation{ID: "5", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
+			},
+			prioritizer: &FIFOPrioritizer{},
+		},
+	}
+	testutil.AssertCmp(t, restored.licenses, wantLicenses, cmp.AllowUnexported(invocation{}, license{}, holdDurations{}), ignoreEstimates)
+
+	// Releasing an invocation saves the new state.
+	_, err := server.Release(context.Background(), &fpb.ReleaseRequest{InvocationId: "7"})
+	require.NoError(t, err)
+	require.Len(t, store.saved, 2)
+	assert.Len(t, store.saved[1].Licenses[0].Queued, 0)
+}
+
+func TestSaveFailure(t *testing.T) {
+	store := &memoryStore{err: errors.New("disk full")}
+	server := testService(stateRunning)
+	server.store = store
+	ctx := context.Background()
+	req := &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+		Owner:    "unit_test",
+		BuildTag: "tag_1",
+		Licenses: []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "feature_foo"}},
+	}}
+
+	// Clients are not told of changes that could not be saved.
+	_, err := server.Allocate(ctx, req)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = server.Release(ctx, &fpb.ReleaseRequest{InvocationId: "unknown"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "unrelated errors are preserved")
+
+	// Once the store recovers, the state is saved with the next change.
+	store.err = nil
+	resp, err := server.Allocate(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, store.saved, 1)
+	assert.Len(t, store.saved[0].Licenses[0].Allocated, 2)
+
+	store.err = errors.New("disk full")
+	_, err = server.Release(ctx, &fpb.ReleaseRequest{InvocationId: resp.GetLicenseAllocated().GetInvocationId()})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestSaveOutsideLock(t *testing.T) {
+	store := &blockingStore{started: make(chan struct{}, 10), unblock: make(chan struct{})}
+	server := testService(stateRunning)
+	server.store = store
+	ctx := context.Background()
+	req := &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+		Owner:    "unit_test",
+		BuildTag: "tag_1",
+		Licenses: []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "feature_foo"}},
+	}}
+
+	errs := make(chan error)
+	allocate := func() {
+		_, err := server.Allocate(ctx, req)
+		errs <- err
+	}
+	go allocate()
+	<-store.started
+
+	// Requests are served while the state is being saved.
+	_, err := server.LicensesStatus(ctx, &fpb.LicensesStatusRequest{})
+	require.NoError(t, err)
+
+	// Changes made in the meantime are saved together, once the first save completes.
+	go allocate()
+	go allocate()
+	require.Eventually(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		lic := server.licenses["xilinx::feature_foo"]
+		return len(lic.allocations)+lic.queue.Len() == 3
+	}, time.Second, time.Millisecond)
+	close(store.unblock)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, <-errs)
+	}
+	require.Len(t, store.saved, 2)
+	assert.Len(t, store.saved[1].Licenses[0].Allocated, 2)
+	assert.Len(t, store.saved[1].Licenses[0].Queued, 1)
+}
+
+func TestNewRestoresState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.log")
+	config := &fpb.Config{
+		LicenseConfigs: []*fpb.LicenseConfig{
+			&fpb.LicenseConfig{Quantity: 1, License: &fpb.License{Vendor: "xilinx", Feature: "foo"}},
+		},
+		Server: &fpb.ServerConfig{StatePath: path},
+	}
+
+	// Without a previous state, the service adopts allocations first.
+	server, err := New(config)
+	require.NoError(t, err)
+	server.mu.Lock()
+	assert.Equal(t, stateStarting, server.currentState)
+	server.currentState = stateRunning
+	server.mu.Unlock()
+
+	req := &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+		Owner:    "unit_test",
+		BuildTag: "tag_1",
+		Licenses: []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "foo"}},
+	}}
+	resp, err := server.Allocate(context.Background(), req)
+	require.NoError(t, err)
+	allocated := resp.GetLicenseAllocated().GetInvocationId()
+	require.NotEmpty(t, allocated)
+	resp, err = server.Allocate(context.Background(), req)
+	require.NoError(t, err)
+	queued := resp.GetQueued().GetInvocationId()
+	require.NotEmpty(t, queued)
+
+	// After a restart, allocations and queue positions are preserved.
+	restarted, err := New(config)
+	require.NoError(t, err)
+	restarted.mu.Lock()
+	assert.Equal(t, stateRunning, restarted.currentState)
+	restarted.mu.Unlock()
+
+	req.Invocation.Id = queued
+	resp, err = restarted.Allocate(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), resp.GetQueued().GetQueuePosition())
+	_, err = restarted.Refresh(context.Background(), &fpb.RefreshRequest{Invocation: &fpb.Invocation{
+		Id:       allocated,
+		Owner:    "unit_test",
+		BuildTag: "tag_1",
+		Licenses: req.Invocation.Licenses,
+	}})
+	require.NoError(t, err)
+}
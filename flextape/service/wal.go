@@ -0,0 +1,147 @@
+package service
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+)
+
+// DefaultMaxLogSize is the size past which a LogStore is compacted.
+const DefaultMaxLogSize = 4 * 1024 * 1024
+
+// Each record is the length of the payload and its CRC32, followed by the payload.
+const recordHeaderSize = 8
+
+// LogStore is a Store that appends snapshots to a write-ahead log file.
+//
+// Each snapshot is written as a checksummed record, and synced to disk before
+// Save returns. If the service crashes while writing, the incomplete record is
+// discarded when loading, and the previous snapshot is restored instead.
+//
+// Once the log grows past its maximum size, it is compacted: a new log
+// containing only the last snapshot atomically replaces the old one.
+type LogStore struct {
+	path    string
+	maxSize int64
+
+	file *os.File // Log being appended to, nil if it has to be compacted first.
+	size int64    // Size of the log being appended to.
+}
+
+// NewLogStore returns a LogStore persisting snapshots in the file at path.
+func NewLogStore(path string) *LogStore {
+	return &LogStore{
+		path:    path,
+		maxSize: DefaultMaxLogSize,
+	}
+}
+
+func encodeRecord(payload []byte) []byte {
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+// Load returns the last complete snapshot in the log, or nil if the log does
+// not exist or has no complete snapshot.
+func (ls *LogStore) Load() (*Snapshot, error) {
+	data, err := os.ReadFile(ls.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state log %q: %w", ls.path, err)
+	}
+
+	var last []byte
+	for len(data) >= recordHeaderSize {
+		size := int64(binary.BigEndian.Uint32(data[0:4]))
+		if int64(len(data)-recordHeaderSize) < size {
+			break
+		}
+		payload := data[recordHeaderSize : recordHeaderSize+size]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:8]) {
+			break
+		}
+		last = payload
+		data = data[recordHeaderSize+size:]
+	}
+	if last == nil {
+		return nil, nil
+	}
+
+	snap := &Snapshot{}
+	if err := json.Unmarshal(last, snap); err != nil {
+		return nil, fmt.Errorf("unable to parse state log %q: %w", ls.path, err)
+	}
+	// Start the next Save from a clean log, without any incomplete record.
+	if err := ls.compact(last); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Save appends the snapshot to the log, compacting it if needed.
+func (ls *LogStore) Save(snap *Snapshot) error {
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("unable to encode state: %w", err)
+	}
+	record := encodeRecord(payload)
+	if ls.file == nil || ls.size+int64(len(record)) > ls.maxSize {
+		return ls.compact(payload)
+	}
+
+	if _, err := ls.file.Write(record); err != nil {
+		ls.Close()
+		return fmt.Errorf("unable to write state log %q: %w", ls.path, err)
+	}
+	if err := ls.file.Sync(); err != nil {
+		ls.Close()
+		return fmt.Errorf("unable to sync state log %q: %w", ls.path, err)
+	}
+	ls.size += int64(len(record))
+	return nil
+}
+
+// compact replaces the log with a new one containing only the payload.
+func (ls *LogStore) compact(payload []byte) error {
+	record := encodeRecord(payload)
+	tmp := ls.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to create state log %q: %w", tmp, err)
+	}
+	if _, err := file.Write(record); err != nil {
+		file.Close()
+		return fmt.Errorf("unable to write state log %q: %w", tmp, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("unable to sync state log %q: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, ls.path); err != nil {
+		file.Close()
+		return fmt.Errorf("unable to replace state log %q: %w", ls.path, err)
+	}
+
+	ls.Close()
+	ls.file = file
+	ls.size = int64(len(record))
+	return nil
+}
+
+// Close closes the log. The next Save will compact it.
+func (ls *LogStore) Close() error {
+	if ls.file == nil {
+		return nil
+	}
+	err := ls.file.Close()
+	ls.file = nil
+	return err
+}
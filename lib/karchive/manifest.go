@@ -0,0 +1,249 @@
+package karchive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Format is the format of an archive, as determined by FormatOf.
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	FormatTar
+	FormatTarGz
+	FormatTarXz
+	FormatTarBz2
+	FormatZip
+)
+
+// FormatOf returns the format of an archive based on the extension of its name.
+//
+// Returns FormatUnknown if the name does not look like an archive.
+func FormatOf(name string) Format {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return FormatTar
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return FormatTarGz
+	case strings.HasSuffix(name, ".tar.xz"), strings.HasSuffix(name, ".txz"):
+		return FormatTarXz
+	case strings.HasSuffix(name, ".tar.bz2"), strings.HasSuffix(name, ".tbz2"):
+		return FormatTarBz2
+	case strings.HasSuffix(name, ".zip"):
+		return FormatZip
+	}
+	return FormatUnknown
+}
+
+func (f Format) String() string {
+	switch f {
+	case FormatTar:
+		return "tar"
+	case FormatTarGz:
+		return "tar.gz"
+	case FormatTarXz:
+		return "tar.xz"
+	case FormatTarBz2:
+		return "tar.bz2"
+	case FormatZip:
+		return "zip"
+	}
+	return "unknown"
+}
+
+// IsTar returns true for tar archives, compressed or not.
+func (f Format) IsTar() bool {
+	return f >= FormatTar && f <= FormatTarBz2
+}
+
+// Seekable returns true if the files in the archive can be read at their
+// Offset, without reading the rest of the archive.
+func (f Format) Seekable() bool {
+	return f == FormatTar || f == FormatZip
+}
+
+// Decoder returns a reader decompressing the tar stream in r.
+func (f Format) Decoder(r io.Reader) (io.Reader, error) {
+	switch f {
+	case FormatTar:
+		return r, nil
+	case FormatTarGz:
+		_, d, err := Decoder(".gz", r)
+		return d, err
+	case FormatTarXz:
+		_, d, err := Decoder(".xz", r)
+		return d, err
+	case FormatTarBz2:
+		_, d, err := Decoder(".bz2", r)
+		return d, err
+	}
+	return nil, fmt.Errorf("%s archives are not a tar stream", f)
+}
+
+// Entry describes a regular file stored in an archive.
+type Entry struct {
+	// Name of the file in the archive, as returned by CleanName.
+	Name string
+	Mode os.FileMode
+	// Size of the file, once extracted.
+	Size int64
+
+	// Offset of the file data from the start of the archive, or -1 if the
+	// archive is compressed as a whole and the file can only be reached by
+	// decompressing what precedes it.
+	Offset int64
+	// Size of the file data as stored in the archive, starting at Offset.
+	StoredSize int64
+	// Compression method of the stored data, zip.Store or zip.Deflate.
+	Method uint16
+	// CRC32 of the extracted file, for zip archives only. 0 otherwise.
+	CRC32 uint32
+}
+
+// CleanName normalizes the name of a file in an archive, so "./bin/tool"
+// and "bin/tool" both become "bin/tool".
+func CleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r     io.Reader
+	count int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.count += int64(n)
+	return n, err
+}
+
+// tarEntry returns the Entry describing a regular file in a tar archive, with an unknown Offset.
+func tarEntry(hdr *tar.Header) Entry {
+	return Entry{
+		Name:       CleanName(hdr.Name),
+		Mode:       hdr.FileInfo().Mode(),
+		Size:       hdr.Size,
+		Offset:     -1,
+		StoredSize: hdr.Size,
+		Method:     zip.Store,
+	}
+}
+
+// ListTar returns the regular files stored in the tar archive r, of the specified format.
+func ListTar(format Format, r io.Reader) ([]Entry, error) {
+	d, err := format.Decoder(r)
+	if err != nil {
+		return nil, err
+	}
+	// The tar reader consumes exactly the headers preceding the data of a
+	// file, so the number of bytes read so far is the offset of the data.
+	counter := &countingReader{r: d}
+	tr := tar.NewReader(counter)
+
+	entries := []Entry{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		entry := tarEntry(hdr)
+		if format.Seekable() {
+			entry.Offset = counter.count
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// ListZip returns the regular files stored in the zip archive r, of the specified size.
+func ListZip(r io.ReaderAt, size int64) ([]Entry, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if f.Method != zip.Store && f.Method != zip.Deflate {
+			return nil, fmt.Errorf("file %s uses unsupported compression method %d", f.Name, f.Method)
+		}
+		offset, err := f.DataOffset()
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %w", f.Name, err)
+		}
+		entries = append(entries, Entry{
+			Name:       CleanName(f.Name),
+			Mode:       f.Mode(),
+			Size:       int64(f.UncompressedSize64),
+			Offset:     offset,
+			StoredSize: int64(f.CompressedSize64),
+			Method:     f.Method,
+			CRC32:      f.CRC32,
+		})
+	}
+	return entries, nil
+}
+
+// OpenEntry returns a reader for the content of the file described by entry,
+// given a reader r positioned at the entry Offset.
+func OpenEntry(entry Entry, r io.Reader) (io.ReadCloser, error) {
+	stored := io.LimitReader(r, entry.StoredSize)
+	switch entry.Method {
+	case zip.Store:
+		return io.NopCloser(stored), nil
+	case zip.Deflate:
+		return flate.NewReader(stored), nil
+	}
+	return nil, fmt.Errorf("file %s uses unsupported compression method %d", entry.Name, entry.Method)
+}
+
+// WalkTar decompresses the tar archive r, of the specified format, and
+// invokes fn with the header and content of each regular file.
+//
+// WalkTar stops as soon as fn returns an error. If the error is io.EOF,
+// WalkTar returns nil, allowing fn to stop the walk early.
+func WalkTar(format Format, r io.Reader, fn func(entry Entry, content io.Reader) error) error {
+	d, err := format.Decoder(r)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(d)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err := fn(tarEntry(hdr), tr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package karchive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var manifestFiles = []struct {
+	Name, Body string
+}{
+	{"./bin/tool", "#!/bin/sh\necho tool\n"},
+	{"README", "Nothing to see here, move along."},
+	{"share/doc/long.txt", string(bytes.Repeat([]byte("a long and repetitive file "), 100))},
+}
+
+func tarForTest(t *testing.T) []byte {
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for _, file := range manifestFiles {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: file.Name, Mode: 0755, Size: int64(len(file.Body))}))
+		_, err := tw.Write([]byte(file.Body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func zipForTest(t *testing.T) []byte {
+	buf := bytes.Buffer{}
+	zw := zip.NewWriter(&buf)
+	for i, file := range manifestFiles {
+		method := zip.Deflate
+		if i%2 == 0 {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: file.Name, Method: method})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(file.Body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestFormatOf(t *testing.T) {
+	assert.Equal(t, FormatTar, FormatOf("dir/release.tar"))
+	assert.Equal(t, FormatTarGz, FormatOf("release.tar.gz"))
+	assert.Equal(t, FormatTarGz, FormatOf("RELEASE.TGZ"))
+	assert.Equal(t, FormatTarXz, FormatOf("release.txz"))
+	assert.Equal(t, FormatTarBz2, FormatOf("release.tar.bz2"))
+	assert.Equal(t, FormatZip, FormatOf("release.zip"))
+	assert.Equal(t, FormatUnknown, FormatOf("release.gz"))
+	assert.Equal(t, FormatUnknown, FormatOf("tar"))
+	assert.True(t, FormatTarBz2.IsTar())
+	assert.False(t, FormatZip.IsTar())
+	assert.False(t, FormatTarGz.Seekable())
+}
+
+func TestList(t *testing.T) {
+	for _, format := range []Format{FormatTar, FormatZip} {
+		data := tarForTest(t)
+		if format == FormatZip {
+			data = zipForTest(t)
+		}
+
+		entries := mustList(t, format, data)
+		require.Len(t, entries, len(manifestFiles), "%s", format)
+		for i, entry := range entries {
+			body := manifestFiles[i].Body
+			assert.Equal(t, CleanName(manifestFiles[i].Name), entry.Name)
+			assert.Equal(t, int64(len(body)), entry.Size)
+
+			r, err := OpenEntry(entry, io.NewSectionReader(bytes.NewReader(data), entry.Offset, entry.StoredSize))
+			require.NoError(t, err)
+			content, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(content), "%s %s", format, entry.Name)
+			if format == FormatZip {
+				assert.Equal(t, crc32.ChecksumIEEE([]byte(body)), entry.CRC32)
+			}
+		}
+	}
+	assert.Equal(t, uint16(zip.Deflate), mustList(t, FormatZip, zipForTest(t))[1].Method)
+}
+
+func mustList(t *testing.T, format Format, data []byte) []Entry {
+	if format == FormatZip {
+		entries, err := ListZip(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		return entries
+	}
+	entries, err := ListTar(format, bytes.NewReader(data))
+	require.NoError(t, err)
+	return entries
+}
+
+func TestListCompressed(t *testing.T) {
+	buf := bytes.Buffer{}
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(tarForTest(t))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	entries := mustList(t, FormatTarGz, buf.Bytes())
+	require.Len(t, entries, len(manifestFiles))
+	assert.Equal(t, "bin/tool", entries[0].Name)
+	assert.Equal(t, int64(-1), entries[0].Offset)
+
+	var walked []string
+	err = WalkTar(FormatTarGz, bytes.NewReader(buf.Bytes()), func(entry Entry, content io.Reader) error {
+		walked = append(walked, entry.Name)
+		if entry.Name == "README" {
+			data, err := io.ReadAll(content)
+			require.NoError(t, err)
+			assert.Equal(t, manifestFiles[1].Body, string(data))
+			return io.EOF
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bin/tool", "README"}, walked)
+}
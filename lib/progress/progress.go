@@ -15,9 +15,19 @@ type Handler interface {
 	Step(fmt string, args ...interface{})
 	Reader(reader io.ReadCloser, total int64) io.ReadCloser
 	Writer(writer io.WriteCloser, total int64) io.WriteCloser
+	// Counter returns a Counter to report the progress over total, for work
+	// not done by a single reader or writer.
+	Counter(total int64) Counter
 	Done()
 }
 
+// Counter tracks the progress of work done in pieces, possibly in parallel.
+type Counter interface {
+	// Add adds n to the progress. n is negative to take back the progress of
+	// work that has to be done again.
+	Add(n int64)
+}
+
 type Factory func() Handler
 
 type Discard struct{}
@@ -30,6 +40,10 @@ func (dp *Discard) Reader(reader io.ReadCloser, total int64) io.ReadCloser {
 func (dp *Discard) Writer(writer io.WriteCloser, total int64) io.WriteCloser {
 	return writer
 }
+func (dp *Discard) Counter(total int64) Counter {
+	return dp
+}
+func (dp *Discard) Add(n int64) {}
 func NewDiscard() Handler {
 	return &Discard{}
 }
@@ -50,6 +64,14 @@ func (bp *Bar) Writer(writer io.WriteCloser, total int64) io.WriteCloser {
 	bar.SetTotal(total)
 	return bar.NewProxyWriter(writer)
 }
+func (bp *Bar) Counter(total int64) Counter {
+	bar := (*pb.ProgressBar)(bp)
+	bar.SetTotal(total)
+	return bp
+}
+func (bp *Bar) Add(n int64) {
+	(*pb.ProgressBar)(bp).Add64(n)
+}
 func (bp *Bar) Done() {
 	(*pb.ProgressBar)(bp).Finish()
 }
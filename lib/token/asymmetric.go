@@ -2,6 +2,7 @@ package token
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/hex"
 	"fmt"
 	"math/rand"
@@ -16,6 +17,11 @@ func (pk *VerifyingKey) ToBytes() *[32]byte {
 	return (*[32]byte)(pk)
 }
 
+// Verify returns true if signature is a valid detached signature of data, as returned by SigningKey.Sign.
+func (pk *VerifyingKey) Verify(data, signature []byte) bool {
+	return len(signature) == ed25519.SignatureSize && ed25519.Verify(ed25519.PublicKey(pk[:]), data, signature)
+}
+
 func VerifyingKeyFromSlice(slice []byte) (*VerifyingKey, error) {
 	parsed := VerifyingKey{}
 	if copy(parsed[:], slice) != len(parsed) || len(slice) > len(parsed) {
@@ -38,6 +44,21 @@ func (pk *SigningKey) ToBytes() *[64]byte {
 	return (*[64]byte)(pk)
 }
 
+// VerifyingKey returns the key to verify the signatures generated with this key.
+func (pk *SigningKey) VerifyingKey() *VerifyingKey {
+	verifying := VerifyingKey{}
+	copy(verifying[:], pk[32:])
+	return &verifying
+}
+
+// Sign returns a detached signature of data.
+//
+// Differently from SigningEncoder.Encode, the data is not part of the result,
+// and must be supplied separately to VerifyingKey.Verify.
+func (pk *SigningKey) Sign(data []byte) []byte {
+	return ed25519.Sign(ed25519.PrivateKey(pk[:]), data)
+}
+
 // SigningEncoder is an encoder that adds a cryptographically strong signature to the data.
 //
 // Data will fail to decode if the signature is invalid.
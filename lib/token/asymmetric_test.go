@@ -45,3 +45,29 @@ func TestAsymmetricSimple(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, text2, original)
 }
+
+func TestSigningDetached(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	verifying, signing, err := GenerateSigningKey(rng)
+	assert.NoError(t, err)
+	assert.Equal(t, verifying, signing.VerifyingKey())
+
+	text := []byte("Sharing is caring")
+	signature := signing.Sign(text)
+	assert.Len(t, signature, 64)
+	assert.True(t, verifying.Verify(text, signature))
+	assert.False(t, verifying.Verify([]byte("Sharing is scaring"), signature))
+	assert.False(t, verifying.Verify(text, signature[1:]))
+
+	// Detached signatures are compatible with the ones of the SigningEncoder.
+	se, err := NewSigningEncoder(rng, UseSigningKey(signing))
+	assert.NoError(t, err)
+	encoded, err := se.Encode(text)
+	assert.NoError(t, err)
+	assert.Equal(t, signature, encoded[:64])
+
+	other, _, err := GenerateSigningKey(rng)
+	assert.NoError(t, err)
+	assert.False(t, other.Verify(text, signature))
+}